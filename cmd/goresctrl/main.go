@@ -0,0 +1,306 @@
+/*
+Copyright 2021 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// goresctrl is a command line tool for inspecting the resctrl filesystem and
+// applying RDT configurations on it.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	stdlog "log"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"sigs.k8s.io/yaml"
+
+	"github.com/intel/goresctrl/pkg/rdt"
+)
+
+const defaultPrefix = "goresctrl."
+
+type command struct {
+	description string
+	run         func(args []string) error
+}
+
+var commands = map[string]command{
+	"info":    {"print the RDT capabilities of the system", cmdInfo},
+	"classes": {"list classes with their schemata and task counts", cmdClasses},
+	"apply":   {"apply an RDT configuration from a file", cmdApply},
+	"mon":     {"print monitoring data of all groups", cmdMon},
+	"mount":   {"mount or remount the resctrl filesystem", cmdMount},
+	"unmount": {"unmount the resctrl filesystem", cmdUnmount},
+}
+
+// globalOpts are the options common to all commands
+type globalOpts struct {
+	prefix      string
+	verbose     bool
+	lockTimeout time.Duration
+}
+
+var opts = globalOpts{prefix: defaultPrefix}
+
+func main() {
+	flags := flag.NewFlagSet("goresctrl", flag.ExitOnError)
+	flags.Usage = usage(flags)
+	addGlobalFlags(flags)
+	_ = flags.Parse(os.Args[1:])
+
+	if flags.NArg() < 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	cmd, ok := commands[flags.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", flags.Arg(0))
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	if err := cmd.run(flags.Args()[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func usage(flags *flag.FlagSet) func() {
+	return func() {
+		names := make([]string, 0, len(commands))
+		for name := range commands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		fmt.Fprintf(os.Stderr, "Usage: %s [options] COMMAND [command options]\n\nCommands:\n", flags.Name())
+		for _, name := range names {
+			fmt.Fprintf(os.Stderr, "  %-10s %s\n", name, commands[name].description)
+		}
+		fmt.Fprintf(os.Stderr, "\nOptions:\n")
+		flags.PrintDefaults()
+	}
+}
+
+// addGlobalFlags adds the common options to a flag set. Common options are
+// accepted both before and after the command name.
+func addGlobalFlags(flags *flag.FlagSet) {
+	flags.StringVar(&opts.prefix, "prefix", opts.prefix, "prefix of the resctrl groups managed")
+	flags.BoolVar(&opts.verbose, "v", opts.verbose, "verbose logging")
+	flags.DurationVar(&opts.lockTimeout, "lock-timeout", opts.lockTimeout, "maximum time to wait for the resctrl lock, 0 waits indefinitely")
+}
+
+// parseCmdFlags parses the options of a command
+func parseCmdFlags(name string, flags *flag.FlagSet, args []string) error {
+	addGlobalFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments to %s: %s", name, strings.Join(flags.Args(), " "))
+	}
+	return nil
+}
+
+// initialize initializes the rdt package. Commands only inspecting the
+// resctrl filesystem use read-only mode.
+func initialize(readOnly bool) error {
+	if !opts.verbose {
+		rdt.SetLogger(rdt.NewLoggerWrapper(stdlog.New(ioutil.Discard, "", 0)))
+	}
+	return rdt.InitializeWithOptions(rdt.ControlOptions{
+		ResctrlGroupPrefix: opts.prefix,
+		LockTimeout:        opts.lockTimeout,
+		ReadOnly:           readOnly,
+	})
+}
+
+func printYaml(v interface{}) error {
+	out, err := yaml.Marshal(v)
+	if err != nil {
+		return err
+	}
+	fmt.Print(string(out))
+	return nil
+}
+
+func cmdInfo(args []string) error {
+	var profile bool
+
+	flags := flag.NewFlagSet("info", flag.ExitOnError)
+	flags.BoolVar(&profile, "profile", false, "print the hardware profile usable for offline config validation")
+	if err := parseCmdFlags("info", flags, args); err != nil {
+		return err
+	}
+
+	if profile {
+		hw, err := rdt.DiscoverHardwareProfile()
+		if err != nil {
+			return err
+		}
+		return printYaml(hw)
+	}
+
+	if err := initialize(true); err != nil {
+		return err
+	}
+	info, err := rdt.GetInfo()
+	if err != nil {
+		return err
+	}
+	return printYaml(info)
+}
+
+func cmdClasses(args []string) error {
+	if err := parseCmdFlags("classes", flag.NewFlagSet("classes", flag.ExitOnError), args); err != nil {
+		return err
+	}
+	if err := initialize(true); err != nil {
+		return err
+	}
+
+	classes := rdt.GetClasses()
+	sort.Slice(classes, func(i, j int) bool { return classes[i].Name() < classes[j].Name() })
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tTASKS\tMON GROUPS\tSCHEMATA")
+	for _, cls := range classes {
+		pids, err := cls.GetPids()
+		if err != nil {
+			return fmt.Errorf("failed to get tasks of %q: %v", cls.Name(), err)
+		}
+		schemata, err := cls.GetSchemata()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\n", cls.Name(), len(pids), len(cls.GetMonGroups()),
+			strings.Join(strings.Fields(schemata), " "))
+	}
+	return w.Flush()
+}
+
+func cmdApply(args []string) error {
+	var (
+		file   string
+		force  bool
+		dryRun bool
+	)
+
+	flags := flag.NewFlagSet("apply", flag.ExitOnError)
+	flags.StringVar(&file, "f", "", "configuration file (required)")
+	flags.BoolVar(&force, "force", false, "remove resctrl groups even if they have tasks assigned")
+	flags.BoolVar(&dryRun, "dry-run", false, "only print what would be done")
+	if err := parseCmdFlags("apply", flags, args); err != nil {
+		return err
+	}
+	if file == "" {
+		return fmt.Errorf("configuration file must be specified with -f")
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("failed to read configuration: %v", err)
+	}
+	conf := &rdt.Config{}
+	if err := yaml.Unmarshal(data, conf); err != nil {
+		return fmt.Errorf("failed to parse configuration %q: %v", file, err)
+	}
+
+	if err := initialize(dryRun); err != nil {
+		return err
+	}
+
+	if dryRun {
+		plan, err := rdt.PlanConfig(conf)
+		if err != nil {
+			return err
+		}
+		return printYaml(plan)
+	}
+	return rdt.SetConfig(conf, force)
+}
+
+func cmdMon(args []string) error {
+	if err := parseCmdFlags("mon", flag.NewFlagSet("mon", flag.ExitOnError), args); err != nil {
+		return err
+	}
+	if err := initialize(true); err != nil {
+		return err
+	}
+	if !rdt.MonSupported() {
+		return fmt.Errorf("RDT monitoring not supported by the system")
+	}
+
+	type classMonData struct {
+		MonData   rdt.MonData            `json:"monData"`
+		MonGroups map[string]rdt.MonData `json:"monGroups,omitempty"`
+	}
+
+	data := map[string]classMonData{}
+	for _, cls := range rdt.GetClasses() {
+		d := classMonData{MonData: cls.GetMonData(), MonGroups: map[string]rdt.MonData{}}
+		for _, mg := range cls.GetMonGroups() {
+			d.MonGroups[mg.Name()] = mg.GetMonData()
+		}
+		data[cls.Name()] = d
+	}
+	return printYaml(data)
+}
+
+func cmdMount(args []string) error {
+	var (
+		path    string
+		remount bool
+		mopts   rdt.MountOptions
+	)
+
+	flags := flag.NewFlagSet("mount", flag.ExitOnError)
+	flags.StringVar(&path, "path", rdt.DefaultMountPoint, "mount point")
+	flags.BoolVar(&remount, "remount", false, "remount with new options if there are no resctrl groups")
+	flags.BoolVar(&mopts.CDP, "cdp", false, "enable L3 code and data prioritization")
+	flags.BoolVar(&mopts.CDPL2, "cdpl2", false, "enable L2 code and data prioritization")
+	flags.BoolVar(&mopts.MBps, "mba-mbps", false, "specify memory bandwidth allocations in MBps")
+	flags.BoolVar(&mopts.Debug, "debug", false, "enable the debug files of the kernel")
+	if err := parseCmdFlags("mount", flags, args); err != nil {
+		return err
+	}
+
+	if support, err := rdt.GetKernelSupport(); err != nil {
+		return err
+	} else if !support.Supported() {
+		return fmt.Errorf("resctrl not supported by the system")
+	}
+	if remount {
+		return rdt.Remount(mopts, opts.lockTimeout)
+	}
+	return rdt.Mount(path, mopts)
+}
+
+func cmdUnmount(args []string) error {
+	var force bool
+
+	flags := flag.NewFlagSet("unmount", flag.ExitOnError)
+	flags.BoolVar(&force, "force", false, "unmount even if resctrl groups exist or resctrl is busy")
+	if err := parseCmdFlags("unmount", flags, args); err != nil {
+		return err
+	}
+	return rdt.Unmount(force, opts.lockTimeout)
+}
@@ -31,6 +31,19 @@ func (b Bitmask) MarshalJSON() ([]byte, error) {
 	return []byte(fmt.Sprintf("\"%#x\"", b)), nil
 }
 
+// UnmarshalJSON implements the Unmarshaler interface of "encoding/json".
+// Accepts both JSON numbers and strings in any base supported by
+// strconv.ParseUint, e.g. "0xff".
+func (b *Bitmask) UnmarshalJSON(data []byte) error {
+	str := strings.Trim(string(data), "\"")
+	value, err := strconv.ParseUint(str, 0, 64)
+	if err != nil {
+		return fmt.Errorf("invalid bitmask %s: %w", data, err)
+	}
+	*b = Bitmask(value)
+	return nil
+}
+
 // ListStr prints the bitmask in human-readable format, similar to e.g. the
 // cpuset format of the Linux kernel
 func (b Bitmask) ListStr() string {
@@ -82,7 +95,7 @@ func ListStrToBitmask(str string) (Bitmask, error) {
 
 		bitNum, err := strconv.ParseUint(split[0], 10, 6)
 		if err != nil {
-			return b, rdtError("invalid bitmask %q: %v", str, err)
+			return b, rdtError("invalid bitmask %q: %w", str, err)
 		}
 
 		if len(split) == 1 {
@@ -90,7 +103,7 @@ func ListStrToBitmask(str string) (Bitmask, error) {
 		} else {
 			endNum, err := strconv.ParseUint(split[1], 10, 6)
 			if err != nil {
-				return b, rdtError("invalid bitmask %q: %v", str, err)
+				return b, rdtError("invalid bitmask %q: %w", str, err)
 			}
 			if endNum <= bitNum {
 				return b, rdtError("invalid range %q in bitmask %q", ran, str)
@@ -101,6 +114,22 @@ func ListStrToBitmask(str string) (Bitmask, error) {
 	return b, nil
 }
 
+// largestRange returns the largest range of consecutive ones in the bitmask.
+// The lowest one is returned if there are several ranges of equal length.
+func (b Bitmask) largestRange() Bitmask {
+	largest := Bitmask(0)
+	for b != 0 {
+		lsb := uint(b.lsbOne())
+		numOnes := uint((b >> lsb).lsbZero())
+		r := Bitmask((uint64(1)<<numOnes)-1) << lsb
+		if bits.OnesCount64(uint64(r)) > bits.OnesCount64(uint64(largest)) {
+			largest = r
+		}
+		b &^= r
+	}
+	return largest
+}
+
 func (b Bitmask) lsbOne() int {
 	if b == 0 {
 		return -1
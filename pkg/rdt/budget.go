@@ -0,0 +1,162 @@
+/*
+Copyright 2021 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rdt
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// IDUsage contains the number of hardware ids of one kind in use and the
+// number of ids supported by the system
+type IDUsage struct {
+	Used  uint64 `json:"used"`
+	Total uint64 `json:"total"`
+}
+
+// Free returns the number of ids not in use
+func (u IDUsage) Free() uint64 {
+	if u.Used >= u.Total {
+		return 0
+	}
+	return u.Total - u.Used
+}
+
+// IDBudget describes the usage of CLOSIDs and RMIDs by all resctrl groups,
+// including the ones not managed by goresctrl. Every control group uses one
+// CLOSID, and every control and monitoring group uses one RMID if monitoring
+// is supported. Pseudo-locked groups release their ids. Note that the kernel
+// keeps recently freed RMIDs busy until their cache occupancy drops, so
+// fewer RMIDs than reported may actually be available.
+type IDBudget struct {
+	Closids IDUsage `json:"closids"`
+	// Rmids is zero if monitoring is not supported
+	Rmids IDUsage `json:"rmids"`
+}
+
+// GetIDBudget returns the current usage of CLOSIDs and RMIDs
+func GetIDBudget() (IDBudget, error) {
+	if r := getRdt(); r != nil {
+		return r.GetIDBudget()
+	}
+	return IDBudget{}, rdtError("%w", ErrNotInitialized)
+}
+
+// GetIDBudget returns the current usage of CLOSIDs and RMIDs
+func (c *Control) GetIDBudget() (IDBudget, error) {
+	unlock, err := c.lockResctrl(false)
+	if err != nil {
+		return IDBudget{}, err
+	}
+	defer unlock()
+
+	budget := IDBudget{Closids: IDUsage{Total: c.info.numClosids}}
+	if c.info.l3mon.Supported() {
+		budget.Rmids.Total = c.info.l3mon.numRmids
+	}
+
+	groups, err := resctrlGroupsFromFs("", c.info.resctrlPath)
+	if err != nil {
+		return budget, rdtError("failed to list resctrl groups: %w", err)
+	}
+	for _, g := range append([]string{""}, groups...) {
+		closids, rmids, err := c.groupIDUsage(g)
+		if err != nil {
+			return budget, err
+		}
+		budget.Closids.Used += closids
+		budget.Rmids.Used += rmids
+	}
+	return budget, nil
+}
+
+// groupIDUsage returns the number of CLOSIDs and RMIDs used by a control
+// group and its monitoring groups. The group is given as a path relative to
+// the resctrl root.
+func (c *Control) groupIDUsage(group string) (uint64, uint64, error) {
+	mode := GroupModeShareable
+	if data, err := c.readRdtFile(filepath.Join(group, "mode")); err == nil {
+		mode = GroupMode(strings.TrimSpace(string(data)))
+	} else if !os.IsNotExist(err) {
+		return 0, 0, rdtError("failed to read mode of %q: %w", group, err)
+	}
+
+	closids, rmids := uint64(1), uint64(0)
+	switch mode {
+	case GroupModePseudoLocked:
+		return 0, 0, nil
+	case GroupModePseudoLockSetup:
+		// The RMID is released already when entering pseudo-lock setup
+		return closids, rmids, nil
+	}
+
+	if c.info.l3mon.Supported() {
+		monGroups, err := resctrlGroupsFromFs("", filepath.Join(c.info.resctrlPath, group, "mon_groups"))
+		if err != nil && !os.IsNotExist(err) {
+			return 0, 0, rdtError("failed to list monitoring groups of %q: %w", group, err)
+		}
+		rmids = 1 + uint64(len(monGroups))
+	}
+	return closids, rmids, nil
+}
+
+// checkIDBudget verifies that enough CLOSIDs and RMIDs are available for
+// creating the resctrl groups of a configuration. Groups that are removed
+// because they are not part of the configuration are taken into account.
+func (c *Control) checkIDBudget(conf config) error {
+	budget, err := c.GetIDBudget()
+	if err != nil {
+		return err
+	}
+	closids, rmids := budget.Closids.Used, budget.Rmids.Used
+
+	groups, err := resctrlGroupsFromFs(c.resctrlGroupPrefix, c.info.resctrlPath)
+	if err != nil {
+		return rdtError("failed to list resctrl groups: %w", err)
+	}
+	existing := map[string]struct{}{RootClassName: {}}
+	for _, g := range groups {
+		name := g[len(c.resctrlGroupPrefix):]
+		existing[name] = struct{}{}
+		if _, ok := conf.Classes[name]; ok {
+			continue
+		}
+		gClosids, gRmids, err := c.groupIDUsage(g)
+		if err != nil {
+			return err
+		}
+		closids -= gClosids
+		rmids -= gRmids
+	}
+	for name := range conf.Classes {
+		if _, ok := existing[name]; !ok {
+			closids++
+			if budget.Rmids.Total > 0 {
+				rmids++
+			}
+		}
+	}
+
+	if budget.Closids.Total > 0 && closids > budget.Closids.Total {
+		return rdtError("configuration requires %d CLOSIDs but only %d are available: %w", closids, budget.Closids.Total, ErrClosidsExhausted)
+	}
+	if rmids > budget.Rmids.Total {
+		return rdtError("configuration requires %d RMIDs but only %d are available: %w", rmids, budget.Rmids.Total, ErrRmidsExhausted)
+	}
+	return nil
+}
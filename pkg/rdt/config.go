@@ -31,11 +31,20 @@ import (
 type Config struct {
 	Options    Options `json:"options"`
 	Partitions map[string]struct {
+		L2Allocation interface{} `json:"l2Allocation"`
 		L3Allocation interface{} `json:"l3Allocation"`
 		MBAllocation interface{} `json:"mbAllocation"`
 		Classes      map[string]struct {
+			L2Schema interface{} `json:"l2Schema"`
 			L3Schema interface{} `json:"l3Schema"`
 			MBSchema interface{} `json:"mbSchema"`
+			// Cpus, if specified, are the CPUs owned by the class, in
+			// list format (e.g. "0-3,8"). CPUs of classes without
+			// cpus are left untouched.
+			Cpus *CPUSet `json:"cpus"`
+			// Mode is the mode of the resctrl group, "shareable" (the
+			// default) or "exclusive"
+			Mode GroupMode `json:"mode"`
 		} `json:"classes"`
 	} `json:"partitions"`
 }
@@ -46,6 +55,12 @@ type config struct {
 	Options    Options
 	Partitions partitionSet
 	Classes    classSet
+
+	// warnings contains non-fatal adjustments made during resolution
+	warnings []string
+	// pseudoLocked contains the pseudo-locked regions of the classes, whose
+	// cache ways are reserved
+	pseudoLocked pseudoLocks
 }
 
 // partitionSet represents the pool of rdt partitions
@@ -56,27 +71,63 @@ type classSet map[string]classConfig
 
 // partitionConfig is the final configuration of one partition
 type partitionConfig struct {
-	L3 l3Schema
-	MB mbSchema
+	CAT map[cacheLevel]catSchema
+	MB  mbSchema
 }
 
 // classConfig represents configuration of one class, i.e. one CTRL group in
 // the Linux resctrl interface
 type classConfig struct {
 	Partition string
-	L3Schema  l3Schema
+	CATSchema map[cacheLevel]catSchema
 	MBSchema  mbSchema
+	// Cpus are the CPUs owned by the class, nil if not managed
+	Cpus CPUSet
+	Mode GroupMode
 }
 
 // Options contains the common settings for all classes
 type Options struct {
-	L3 l3Options `json:"l3"`
-	MB mbOptions `json:"mb"`
+	L2 catOptions `json:"l2"`
+	L3 catOptions `json:"l3"`
+	MB mbOptions  `json:"mb"`
 }
 
-// l3Options contains the common settings for L3 cache allocation
-type l3Options struct {
+// catOptions contains the common settings for cache allocation
+type catOptions struct {
 	Optional bool
+	// ShareableBits is the policy for allocating ways shared with hardware,
+	// e.g. with I/O devices (DDIO), to partitions
+	ShareableBits ShareableBitsPolicy
+}
+
+// ShareableBitsPolicy describes how cache ways shared with hardware are
+// allocated to partitions
+type ShareableBitsPolicy string
+
+const (
+	// ShareableBitsAllow treats shared ways like any other ways. Partitions
+	// are laid out starting from the lowest way. Unlike with an empty
+	// policy, which behaves similarly, no warnings about partitions
+	// overlapping shared ways are given.
+	ShareableBitsAllow ShareableBitsPolicy = "allow"
+	// ShareableBitsAvoid excludes shared ways from partitions. Relative
+	// allocations are calculated from the remaining ways and absolute
+	// allocations overlapping shared ways are rejected.
+	ShareableBitsAvoid ShareableBitsPolicy = "avoid"
+	// ShareableBitsPrefer lays out partitions starting from the shared
+	// ways so that they are allocated even if the relative allocations of
+	// partitions add up to less than 100%.
+	ShareableBitsPrefer ShareableBitsPolicy = "prefer"
+)
+
+// cat returns the cache allocation options of one cache level
+func (o Options) cat(lvl cacheLevel) catOptions {
+	switch lvl {
+	case cacheLevelL2:
+		return o.L2
+	}
+	return o.L3
 }
 
 // mbOptions contains the common settings for memory bandwidth allocation
@@ -84,14 +135,15 @@ type mbOptions struct {
 	Optional bool
 }
 
-// l3Schema represents the L3 part of the schemata of a class (i.e. resctrl group)
-type l3Schema map[uint64]l3Allocation
+// catSchema represents a cache part of the schemata of a class (i.e. resctrl
+// group)
+type catSchema map[uint64]catAllocation
 
 // mbSchema represents the MB part of the schemata of a class (i.e. resctrl group)
 type mbSchema map[uint64]uint64
 
-// l3Allocation describes the L3 allocation configuration for one cache id
-type l3Allocation struct {
+// catAllocation describes the allocation configuration for one cache id
+type catAllocation struct {
 	Unified cacheAllocation
 	Code    cacheAllocation `json:",omitempty"`
 	Data    cacheAllocation `json:",omitempty"`
@@ -100,37 +152,41 @@ type l3Allocation struct {
 // cacheAllocation is the basic interface for handling cache allocations of one
 // type (unified, code, data)
 type cacheAllocation interface {
-	Overlay(Bitmask) (Bitmask, error)
+	Overlay(baseMask Bitmask, minBits uint64) (Bitmask, error)
 }
 
-// l3AbsoluteAllocation represents an explicitly specified cache allocation
+// catAbsoluteAllocation represents an explicitly specified cache allocation
 // bitmask
-type l3AbsoluteAllocation Bitmask
+type catAbsoluteAllocation Bitmask
 
-// l3PctAllocation represents a relative (percentage) share of the available
+// catPctAllocation represents a relative (percentage) share of the available
 // bitmask
-type l3PctAllocation uint64
+type catPctAllocation uint64
 
-// l3PctRangeAllocation represents a percentage range of the available bitmask
-type l3PctRangeAllocation struct {
+// catPctRangeAllocation represents a percentage range of the available bitmask
+type catPctRangeAllocation struct {
 	lowPct  uint64
 	highPct uint64
 }
 
-// L3SchemaType represents different L3 cache allocation schemes
-type l3SchemaType string
+// catBytesAllocation represents a cache allocation of a given size in bytes.
+// It is rounded to the nearest number of cache ways.
+type catBytesAllocation uint64
+
+// catSchemaType represents different cache allocation schemes
+type catSchemaType string
 
 const (
-	// l3SchemaTypeUnified is the schema type when CDP is not enabled
-	l3SchemaTypeUnified l3SchemaType = "unified"
-	// l3SchemaTypeCode is the 'code' part of CDP schema
-	l3SchemaTypeCode l3SchemaType = "code"
-	// l3SchemaTypeData is the 'data' part of CDP schema
-	l3SchemaTypeData l3SchemaType = "data"
+	// catSchemaTypeUnified is the schema type when CDP is not enabled
+	catSchemaTypeUnified catSchemaType = "unified"
+	// catSchemaTypeCode is the 'code' part of CDP schema
+	catSchemaTypeCode catSchemaType = "code"
+	// catSchemaTypeData is the 'data' part of CDP schema
+	catSchemaTypeData catSchemaType = "data"
 )
 
-func (t l3SchemaType) ToResctrlStr() string {
-	if t == l3SchemaTypeUnified {
+func (t catSchemaType) ToResctrlStr() string {
+	if t == catSchemaTypeUnified {
 		return ""
 	}
 	return strings.ToUpper(string(t))
@@ -141,23 +197,48 @@ const (
 	mbSuffixMbps = "MBps"
 )
 
-// ToStr returns the L3 schema in a format accepted by the Linux kernel
+// ToStr returns the cache schema in a format accepted by the Linux kernel
 // resctrl (schemata) interface
-func (s l3Schema) ToStr(typ l3SchemaType, baseSchema l3Schema) (string, error) {
-	schema := "L3" + typ.ToResctrlStr() + ":"
+func (s catSchema) ToStr(info *resctrlInfo, lvl cacheLevel, typ catSchemaType, baseSchema catSchema) (string, error) {
+	// Leave the schemata of this cache level untouched if the partition does
+	// not have any allocation for it
+	if len(baseSchema) == 0 {
+		return "", nil
+	}
+
+	bitmasks, err := s.bitmasks(info, lvl, typ, baseSchema)
+	if err != nil {
+		return "", err
+	}
+
+	schema := string(lvl) + typ.ToResctrlStr() + ":"
 	sep := ""
 
 	// Get a sorted slice of cache ids for deterministic output
-	ids := make([]uint64, 0, len(baseSchema))
-	for id := range baseSchema {
+	ids := make([]uint64, 0, len(bitmasks))
+	for id := range bitmasks {
 		ids = append(ids, id)
 	}
 	utils.SortUint64s(ids)
 
 	for _, id := range ids {
-		baseMask, ok := baseSchema[id].getEffective(typ).(l3AbsoluteAllocation)
+		schema += fmt.Sprintf("%s%d=%x", sep, id, bitmasks[id])
+		sep = ";"
+	}
+
+	return schema + "\n", nil
+}
+
+// bitmasks returns the effective bitmasks of the cache schema, per cache id.
+// Returns an empty set if the partition does not have any allocation for the
+// cache level.
+func (s catSchema) bitmasks(info *resctrlInfo, lvl cacheLevel, typ catSchemaType, baseSchema catSchema) (map[uint64]Bitmask, error) {
+	ret := make(map[uint64]Bitmask, len(baseSchema))
+
+	for id := range baseSchema {
+		baseMask, ok := baseSchema[id].getEffective(typ).(catAbsoluteAllocation)
 		if !ok {
-			return "", fmt.Errorf("BUG: basemask not of type l3AbsoluteAllocation")
+			return nil, fmt.Errorf("BUG: basemask not of type catAbsoluteAllocation")
 		}
 		bitmask := Bitmask(baseMask)
 
@@ -167,33 +248,32 @@ func (s l3Schema) ToStr(typ l3SchemaType, baseSchema l3Schema) (string, error) {
 			masks := s[id]
 			overlayMask := masks.getEffective(typ)
 
-			bitmask, err = overlayMask.Overlay(bitmask)
+			bitmask, err = overlayMask.Overlay(bitmask, info.catMinCbmBits(lvl))
 			if err != nil {
-				return "", err
+				return nil, err
 			}
 		}
-		schema += fmt.Sprintf("%s%d=%x", sep, id, bitmask)
-		sep = ";"
+		ret[id] = bitmask
 	}
 
-	return schema + "\n", nil
+	return ret, nil
 }
 
-func (a l3Allocation) get(typ l3SchemaType) cacheAllocation {
+func (a catAllocation) get(typ catSchemaType) cacheAllocation {
 	switch typ {
-	case l3SchemaTypeCode:
+	case catSchemaTypeCode:
 		return a.Code
-	case l3SchemaTypeData:
+	case catSchemaTypeData:
 		return a.Data
 	}
 	return a.Unified
 }
 
-func (a l3Allocation) set(typ l3SchemaType, v cacheAllocation) l3Allocation {
+func (a catAllocation) set(typ catSchemaType, v cacheAllocation) catAllocation {
 	switch typ {
-	case l3SchemaTypeCode:
+	case catSchemaTypeCode:
 		a.Code = v
-	case l3SchemaTypeData:
+	case catSchemaTypeData:
 		a.Data = v
 	default:
 		a.Unified = v
@@ -202,13 +282,13 @@ func (a l3Allocation) set(typ l3SchemaType, v cacheAllocation) l3Allocation {
 	return a
 }
 
-func (a l3Allocation) getEffective(typ l3SchemaType) cacheAllocation {
+func (a catAllocation) getEffective(typ catSchemaType) cacheAllocation {
 	switch typ {
-	case l3SchemaTypeCode:
+	case catSchemaTypeCode:
 		if a.Code != nil {
 			return a.Code
 		}
-	case l3SchemaTypeData:
+	case catSchemaTypeData:
 		if a.Data != nil {
 			return a.Data
 		}
@@ -218,8 +298,8 @@ func (a l3Allocation) getEffective(typ l3SchemaType) cacheAllocation {
 }
 
 // Overlay function of the cacheAllocation interface
-func (a l3AbsoluteAllocation) Overlay(baseMask Bitmask) (Bitmask, error) {
-	if err := verifyL3BaseMask(baseMask); err != nil {
+func (a catAbsoluteAllocation) Overlay(baseMask Bitmask, minBits uint64) (Bitmask, error) {
+	if err := verifyCatBaseMask(baseMask, minBits); err != nil {
 		return 0, err
 	}
 
@@ -237,18 +317,18 @@ func (a l3AbsoluteAllocation) Overlay(baseMask Bitmask) (Bitmask, error) {
 }
 
 // MarshalJSON implements the Marshaler interface of "encoding/json"
-func (a l3AbsoluteAllocation) MarshalJSON() ([]byte, error) {
+func (a catAbsoluteAllocation) MarshalJSON() ([]byte, error) {
 	return []byte(fmt.Sprintf("\"%#x\"", a)), nil
 }
 
 // Overlay function of the cacheAllocation interface
-func (a l3PctAllocation) Overlay(baseMask Bitmask) (Bitmask, error) {
-	return l3PctRangeAllocation{highPct: uint64(a)}.Overlay(baseMask)
+func (a catPctAllocation) Overlay(baseMask Bitmask, minBits uint64) (Bitmask, error) {
+	return catPctRangeAllocation{highPct: uint64(a)}.Overlay(baseMask, minBits)
 }
 
 // Overlay function of the cacheAllocation interface
-func (a l3PctRangeAllocation) Overlay(baseMask Bitmask) (Bitmask, error) {
-	if err := verifyL3BaseMask(baseMask); err != nil {
+func (a catPctRangeAllocation) Overlay(baseMask Bitmask, minBits uint64) (Bitmask, error) {
+	if err := verifyCatBaseMask(baseMask, minBits); err != nil {
 		return 0, err
 	}
 
@@ -272,8 +352,8 @@ func (a l3PctRangeAllocation) Overlay(baseMask Bitmask) (Bitmask, error) {
 
 	// Make sure the number of bits set satisfies the minimum requirement
 	numBits := msb - lsb + 1
-	if numBits < info.l3MinCbmBits() {
-		gap := info.l3MinCbmBits() - numBits
+	if numBits < minBits {
+		gap := minBits - numBits
 
 		// First, widen the mask from the "lsb end"
 		if gap <= lsb {
@@ -297,7 +377,7 @@ func (a l3PctRangeAllocation) Overlay(baseMask Bitmask) (Bitmask, error) {
 	return Bitmask(value), nil
 }
 
-func verifyL3BaseMask(baseMask Bitmask) error {
+func verifyCatBaseMask(baseMask Bitmask, minBits uint64) error {
 	if baseMask == 0 {
 		return fmt.Errorf("empty basemask not allowed")
 	}
@@ -308,26 +388,85 @@ func verifyL3BaseMask(baseMask Bitmask) error {
 	if bits.OnesCount64(uint64(baseMask)) != baseMaskWidth {
 		return fmt.Errorf("invalid basemask %#x: more than one block of bits set", baseMask)
 	}
-	if uint64(bits.OnesCount64(uint64(baseMask))) < info.l3MinCbmBits() {
-		return fmt.Errorf("invalid basemask %#x: fewer than %d bits set", baseMask, info.l3MinCbmBits())
+	if uint64(bits.OnesCount64(uint64(baseMask))) < minBits {
+		return fmt.Errorf("invalid basemask %#x: fewer than %d bits set", baseMask, minBits)
 	}
 
 	return nil
 }
 
 // MarshalJSON implements the Marshaler interface of "encoding/json"
-func (a l3PctAllocation) MarshalJSON() ([]byte, error) {
+func (a catPctAllocation) MarshalJSON() ([]byte, error) {
 	return []byte(fmt.Sprintf("\"%d%%\"", a)), nil
 }
 
 // MarshalJSON implements the Marshaler interface of "encoding/json"
-func (a l3PctRangeAllocation) MarshalJSON() ([]byte, error) {
+func (a catPctRangeAllocation) MarshalJSON() ([]byte, error) {
 	return []byte(fmt.Sprintf("\"%d-%d%%\"", a.lowPct, a.highPct)), nil
 }
 
+// Overlay function of the cacheAllocation interface. Size-based allocations
+// are only supported in partitions where they are resolved into absolute
+// allocations.
+func (a catBytesAllocation) Overlay(baseMask Bitmask, minBits uint64) (Bitmask, error) {
+	return 0, rdtError("size-based cache allocation %s not supported in class schemas", formatBytes(uint64(a)))
+}
+
+// MarshalJSON implements the Marshaler interface of "encoding/json"
+func (a catBytesAllocation) MarshalJSON() ([]byte, error) {
+	return []byte(fmt.Sprintf("\"%s\"", formatBytes(uint64(a)))), nil
+}
+
+// ways returns the number of cache ways closest to the allocation, but at
+// least minBits
+func (a catBytesAllocation) ways(waySize, minBits uint64) uint64 {
+	n := (uint64(a) + waySize/2) / waySize
+	if n < minBits {
+		n = minBits
+	}
+	return n
+}
+
+// byteUnits are the units accepted in size-based cache allocations
+var byteUnits = []struct {
+	suffix string
+	size   uint64
+}{
+	{"GiB", 1 << 30},
+	{"MiB", 1 << 20},
+	{"KiB", 1 << 10},
+	{"B", 1},
+}
+
+// parseBytes parses a size with a binary unit suffix, e.g. "12MiB" or
+// "1.5GiB"
+func parseBytes(str string) (uint64, error) {
+	for _, u := range byteUnits {
+		if strings.HasSuffix(str, u.suffix) {
+			value, err := strconv.ParseFloat(strings.TrimSuffix(str, u.suffix), 64)
+			if err != nil || value < 0 {
+				return 0, fmt.Errorf("invalid size %q", str)
+			}
+			return uint64(value*float64(u.size) + 0.5), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid size %q, unit missing", str)
+}
+
+// formatBytes formats a size using the largest binary unit that represents
+// it exactly
+func formatBytes(size uint64) string {
+	for _, u := range byteUnits {
+		if size >= u.size && size%u.size == 0 {
+			return strconv.FormatUint(size/u.size, 10) + u.suffix
+		}
+	}
+	return strconv.FormatUint(size, 10) + "B"
+}
+
 // ToStr returns the MB schema in a format accepted by the Linux kernel
 // resctrl (schemata) interface
-func (s mbSchema) ToStr(base map[uint64]uint64) string {
+func (s mbSchema) ToStr(info *resctrlInfo, base map[uint64]uint64) string {
 	schema := "MB:"
 	sep := ""
 
@@ -386,7 +525,7 @@ func listStrToArray(str string) ([]int, error) {
 		// We limit to 8 bits in order to avoid accidental super long slices
 		num, err := strconv.ParseInt(split[0], 10, 8)
 		if err != nil {
-			return a, rdtError("invalid integer %q: %v", str, err)
+			return a, rdtError("invalid integer %q: %w", str, err)
 		}
 
 		if len(split) == 1 {
@@ -394,7 +533,7 @@ func listStrToArray(str string) ([]int, error) {
 		} else {
 			endNum, err := strconv.ParseInt(split[1], 10, 8)
 			if err != nil {
-				return a, rdtError("invalid integer in range %q: %v", str, err)
+				return a, rdtError("invalid integer in range %q: %w", str, err)
 			}
 			if endNum <= num {
 				return a, rdtError("invalid integer range %q in %q", ran, str)
@@ -409,60 +548,191 @@ func listStrToArray(str string) ([]int, error) {
 }
 
 // resolve tries to resolve the requested configuration into a working
-// configuration
-func (raw Config) resolve() (config, error) {
+// configuration on a system with the given RDT capabilities. Cache ways of
+// existing pseudo-locked regions of the configured classes are reserved, i.e.
+// not allocated to any partition.
+func (raw Config) resolve(info *resctrlInfo, locks pseudoLocks) (config, error) {
 	var err error
 	conf := config{Options: raw.Options}
 
 	log.DebugBlock("", "resolving configuration: |\n%s", utils.DumpJSON(raw))
 
-	conf.Partitions, err = raw.resolvePartitions()
+	// Pseudo-locked regions of removed classes are torn down
+	conf.pseudoLocked = pseudoLocks{}
+	for _, partition := range raw.Partitions {
+		for name := range partition.Classes {
+			if l, ok := locks[name]; ok {
+				conf.pseudoLocked[name] = l
+			}
+		}
+	}
+
+	conf.Partitions, conf.warnings, err = raw.resolvePartitions(info, conf.pseudoLocked)
 	if err != nil {
 		return conf, err
 	}
 
-	conf.Classes, err = raw.resolveClasses()
+	conf.Classes, err = raw.resolveClasses(info)
 	if err != nil {
 		return conf, err
 	}
 
+	if err := conf.verifyModes(info, conf.pseudoLocked); err != nil {
+		return conf, err
+	}
+
 	return conf, nil
 }
 
+// verifyModes checks that the cache allocations of exclusive classes do not
+// overlap the allocations of any other class or the bits shared with
+// hardware. Code and data allocations of CDP are treated as one. Classes with
+// a pseudo-locked region are ignored as their allocations cannot be changed.
+func (conf config) verifyModes(info *resctrlInfo, locks pseudoLocks) error {
+	names := make([]string, 0, len(conf.Classes))
+	for name := range conf.Classes {
+		if _, ok := locks[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, lvl := range []cacheLevel{cacheLevelL3, cacheLevelL2} {
+		typs := info.catSchemaTypes(lvl)
+		if len(typs) == 0 {
+			continue
+		}
+
+		masks := make(map[string]map[uint64]Bitmask, len(names))
+		for _, name := range names {
+			class := conf.Classes[name]
+			masks[name] = make(map[uint64]Bitmask)
+			for _, typ := range typs {
+				m, err := class.CATSchema[lvl].bitmasks(info, lvl, typ, conf.Partitions[class.Partition].CAT[lvl])
+				if err != nil {
+					return err
+				}
+				for id, b := range m {
+					masks[name][id] |= b
+				}
+			}
+		}
+
+		for _, name := range names {
+			if conf.Classes[name].Mode != GroupModeExclusive {
+				continue
+			}
+			for _, id := range info.catCacheIds(lvl) {
+				mask := masks[name][id]
+				if shared := mask & info.cat[lvl].hardwareBits(id); shared != 0 {
+					return fmt.Errorf("%s allocation %#x of exclusive class %q for cache id %d overlaps with bits %#x shared with hardware",
+						lvl, mask, name, id, shared)
+				}
+				for _, other := range names {
+					if other != name && mask&masks[other][id] != 0 {
+						return fmt.Errorf("%s allocation %#x of exclusive class %q for cache id %d overlaps with allocation %#x of class %q",
+							lvl, mask, name, id, masks[other][id], other)
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
 // resolvePartitions tries to resolve the requested resource allocations of
-// partitions
-func (raw Config) resolvePartitions() (partitionSet, error) {
+// partitions. Returns warnings about adjustments made to the allocations.
+func (raw Config) resolvePartitions(info *resctrlInfo, locks pseudoLocks) (partitionSet, []string, error) {
 	// Initialize empty partition configuration
 	conf := make(partitionSet, len(raw.Partitions))
-	numCacheIds := len(info.cacheIds)
 	for name := range raw.Partitions {
-		conf[name] = partitionConfig{L3: make(l3Schema, numCacheIds),
-			MB: make(mbSchema, numCacheIds)}
+		conf[name] = partitionConfig{
+			CAT: map[cacheLevel]catSchema{
+				cacheLevelL2: make(catSchema, len(info.catCacheIds(cacheLevelL2))),
+				cacheLevelL3: make(catSchema, len(info.catCacheIds(cacheLevelL3))),
+			},
+			MB: make(mbSchema, len(info.mb.cacheIds))}
 	}
 
-	// Try to resolve L3 partition allocations
-	err := raw.resolveL3Partitions(conf)
-	if err != nil {
-		return nil, err
+	// Try to resolve L2 and L3 partition allocations
+	warnings := []string{}
+	for _, lvl := range []cacheLevel{cacheLevelL2, cacheLevelL3} {
+		if err := raw.resolveCatPartitions(info, lvl, conf, locks); err != nil {
+			return nil, nil, err
+		}
+		if raw.Options.cat(lvl).ShareableBits != ShareableBitsAllow {
+			warnings = append(warnings, conf.verifyHardwareOverlap(info, lvl)...)
+		}
 	}
 
 	// Try to resolve MB partition allocations
-	err = raw.resolveMBPartitions(conf)
+	w, err := raw.resolveMBPartitions(info, conf)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
+	warnings = append(warnings, w...)
 
-	return conf, nil
+	return conf, warnings, nil
 }
 
-// resolveL3Partitions tries to resolve requested L3 allocations between partitions
-func (raw Config) resolveL3Partitions(conf partitionSet) error {
-	allocationsPerCacheID := make(map[uint64][]l3PartitionAllocation, len(info.cacheIds))
-	for _, id := range info.cacheIds {
-		allocationsPerCacheID[id] = make([]l3PartitionAllocation, 0, len(raw.Partitions))
+// verifyHardwareOverlap checks the cache allocations of partitions against
+// the ways used by hardware, e.g. by I/O devices (DDIO). Returns warnings
+// about overlapping allocations. Overlaps of exclusive classes are rejected
+// separately by verifyModes.
+func (s partitionSet) verifyHardwareOverlap(info *resctrlInfo, lvl cacheLevel) []string {
+	warnings := []string{}
+
+	names := make([]string, 0, len(s))
+	for name := range s {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		for _, id := range info.catCacheIds(lvl) {
+			mask := Bitmask(0)
+			for _, typ := range info.catSchemaTypes(lvl) {
+				if a, ok := s[name].CAT[lvl][id].getEffective(typ).(catAbsoluteAllocation); ok {
+					mask |= Bitmask(a)
+				}
+			}
+
+			overlap := mask & info.cat[lvl].hardwareBits(id)
+			var w string
+			switch {
+			case overlap == 0:
+				continue
+			case overlap == mask:
+				w = fmt.Sprintf("%s allocation %#x of partition %q for cache id %d only contains ways used by hardware",
+					lvl, mask, name, id)
+			default:
+				w = fmt.Sprintf("%s allocation %#x of partition %q for cache id %d overlaps with ways %#x used by hardware",
+					lvl, mask, name, id, overlap)
+			}
+			log.Warn("%s", w)
+			warnings = append(warnings, w)
+		}
+	}
+	return warnings
+}
+
+// resolveCatPartitions tries to resolve requested cache allocations between
+// partitions
+func (raw Config) resolveCatPartitions(info *resctrlInfo, lvl cacheLevel, conf partitionSet, locks pseudoLocks) error {
+	policy := raw.Options.cat(lvl).ShareableBits
+	switch policy {
+	case "", ShareableBitsAllow, ShareableBitsAvoid, ShareableBitsPrefer:
+	default:
+		return fmt.Errorf("invalid %s shareable bits policy %q", lvl, policy)
+	}
+
+	cacheIds := info.catCacheIds(lvl)
+	allocationsPerCacheID := make(map[uint64][]catPartitionAllocation, len(cacheIds))
+	for _, id := range cacheIds {
+		allocationsPerCacheID[id] = make([]catPartitionAllocation, 0, len(raw.Partitions))
 	}
 	// Helper structure for printing out human-readable info in the end
-	requests := map[string]map[uint64]l3Allocation{}
+	requests := map[string]catSchema{}
 
 	// Resolve partitions in sorted order for reproducibility
 	names := make([]string, 0, len(raw.Partitions))
@@ -475,9 +745,9 @@ func (raw Config) resolveL3Partitions(conf partitionSet) error {
 	// per-cache-id structure
 	numNils := 0
 	for _, name := range names {
-		allocations, err := parseRawL3Allocations(raw.Partitions[name].L3Allocation)
+		allocations, err := parseRawCatAllocations(info, lvl, raw.rawPartitionCatAllocation(lvl, name))
 		if err != nil {
-			return fmt.Errorf("failed to parse L3 allocation request for partition %q: %v", name, err)
+			return fmt.Errorf("failed to parse %s allocation request for partition %q: %w", lvl, name, err)
 		}
 
 		requests[name] = allocations
@@ -487,44 +757,51 @@ func (raw Config) resolveL3Partitions(conf partitionSet) error {
 		}
 
 		for id, val := range allocations {
-			allocationsPerCacheID[id] = append(allocationsPerCacheID[id], l3PartitionAllocation{name: name, allocation: val})
+			allocationsPerCacheID[id] = append(allocationsPerCacheID[id], catPartitionAllocation{name: name, allocation: val})
 		}
 	}
 
 	if numNils == len(raw.Partitions) {
-		log.Debug("L3 allocation disabled for all partitions")
+		log.Debug("%s allocation disabled for all partitions", lvl)
 		return nil
 	} else if numNils != 0 {
-		return fmt.Errorf("L3 allocation only specified for a subset of partitions")
+		return fmt.Errorf("%s allocation only specified for a subset of partitions", lvl)
 	}
 
 	// Next, try to resolve partition allocations, separately for each cache-id
-	fullBitmaskNumBits := uint64(info.l3CbmMask().lsbZero())
-	for id := range info.cacheIds {
-		err := conf.resolveCacheID(uint64(id), allocationsPerCacheID[uint64(id)])
+	fullBitmaskNumBits := uint64(info.catCbmMask(lvl).lsbZero())
+	for _, id := range cacheIds {
+		err := conf.resolveCacheID(info, lvl, id, allocationsPerCacheID[id], locks.reserved(lvl, id), policy)
 		if err != nil {
 			return err
 		}
 	}
 
-	log.Info("actual (and requested) L3 allocations per partition and cache id:")
+	log.Info("actual (and requested) %s allocations per partition and cache id:", lvl)
 	infoStr := ""
 	for name, partition := range requests {
 		infoStr += "\n    " + name
-		for _, id := range info.cacheIds {
+		for _, id := range cacheIds {
 			infoStr += fmt.Sprintf("\n      %2d: ", id)
 			allocationReq := partition[id]
-			for _, typ := range []l3SchemaType{l3SchemaTypeUnified, l3SchemaTypeCode, l3SchemaTypeData} {
+			for _, typ := range []catSchemaType{catSchemaTypeUnified, catSchemaTypeCode, catSchemaTypeData} {
 				infoStr += string(typ) + " "
 				requested := allocationReq.get(typ)
 				switch v := requested.(type) {
-				case l3AbsoluteAllocation:
+				case catAbsoluteAllocation:
 					infoStr += fmt.Sprintf("<absolute %#x>  ", v)
-				case l3PctAllocation:
-					granted := conf[name].L3[id].get(typ).(l3AbsoluteAllocation)
-					requestedPct := fmt.Sprintf("(%d%%)", v)
-					truePct := float64(bits.OnesCount64(uint64(granted))) * 100 / float64(fullBitmaskNumBits)
-					infoStr += fmt.Sprintf("%5.1f%% %-6s ", truePct, requestedPct)
+				case catPctAllocation, catBytesAllocation:
+					granted := conf[name].CAT[lvl][id].get(typ).(catAbsoluteAllocation)
+					requested := fmt.Sprintf("(%d%%)", v)
+					if b, ok := v.(catBytesAllocation); ok {
+						requested = "(" + formatBytes(uint64(b)) + ")"
+					}
+					numBits := uint64(bits.OnesCount64(uint64(granted)))
+					truePct := float64(numBits) * 100 / float64(fullBitmaskNumBits)
+					infoStr += fmt.Sprintf("%5.1f%% %-6s ", truePct, requested)
+					if waySize := info.cat[lvl].waySize(id); waySize > 0 {
+						infoStr += fmt.Sprintf("%s ", formatBytes(numBits*waySize))
+					}
 				case nil:
 					infoStr += "<not specified>  "
 				}
@@ -537,16 +814,28 @@ func (raw Config) resolveL3Partitions(conf partitionSet) error {
 	return nil
 }
 
-type l3PartitionAllocation struct {
+// rawPartitionCatAllocation returns the raw cache allocation request of one
+// partition
+func (raw Config) rawPartitionCatAllocation(lvl cacheLevel, name string) interface{} {
+	switch lvl {
+	case cacheLevelL2:
+		return raw.Partitions[name].L2Allocation
+	}
+	return raw.Partitions[name].L3Allocation
+}
+
+type catPartitionAllocation struct {
 	name       string
-	allocation l3Allocation
+	allocation catAllocation
 }
 
-// resolveCacheID resolves the partition allocations for one cache id
-func (s partitionSet) resolveCacheID(id uint64, partitions []l3PartitionAllocation) error {
-	for _, typ := range []l3SchemaType{l3SchemaTypeUnified, l3SchemaTypeCode, l3SchemaTypeData} {
-		log.Debug("resolving partitions for %q schema for cache id %d", typ, id)
-		err := s.resolveCacheIDPerType(id, partitions, typ)
+// resolveCacheID resolves the partition allocations for one cache id. The
+// reserved ways are not allocated to any partition. Ways shared with hardware
+// are allocated according to the policy.
+func (s partitionSet) resolveCacheID(info *resctrlInfo, lvl cacheLevel, id uint64, partitions []catPartitionAllocation, reserved Bitmask, policy ShareableBitsPolicy) error {
+	for _, typ := range []catSchemaType{catSchemaTypeUnified, catSchemaTypeCode, catSchemaTypeData} {
+		log.Debug("resolving partitions for %s %q schema for cache id %d", lvl, typ, id)
+		err := s.resolveCacheIDPerType(info, lvl, id, partitions, typ, reserved, policy)
 		if err != nil {
 			return err
 		}
@@ -554,29 +843,29 @@ func (s partitionSet) resolveCacheID(id uint64, partitions []l3PartitionAllocati
 	return nil
 }
 
-func (s partitionSet) resolveCacheIDPerType(id uint64, partitions []l3PartitionAllocation, typ l3SchemaType) error {
-	// Sanity check: if any partition has l3 allocation of this schema type
+func (s partitionSet) resolveCacheIDPerType(info *resctrlInfo, lvl cacheLevel, id uint64, partitions []catPartitionAllocation, typ catSchemaType, reserved Bitmask, policy ShareableBitsPolicy) error {
+	// Sanity check: if any partition has cache allocation of this schema type
 	// configured check that all other partitions have it, too
 	a := partitions[0].allocation.get(typ)
 	isNil := a == nil
 	for _, partition := range partitions {
 		if (partition.allocation.get(typ) == nil) != isNil {
-			return fmt.Errorf("some partition(s) missing l3 %q allocation request for cache id %d", typ, id)
+			return fmt.Errorf("some partition(s) missing %s %q allocation request for cache id %d", strings.ToLower(string(lvl)), typ, id)
 		}
 	}
 
 	// Act depending on the type of the first request in the list
 	switch a.(type) {
-	case l3AbsoluteAllocation:
-		return s.resolveCacheIDAbsolute(id, partitions, typ)
+	case catAbsoluteAllocation:
+		return s.resolveCacheIDAbsolute(info, lvl, id, partitions, typ, reserved, policy)
 	case nil:
 	default:
-		return s.resolveCacheIDRelative(id, partitions, typ)
+		return s.resolveCacheIDRelative(info, lvl, id, partitions, typ, reserved, policy)
 	}
 	return nil
 }
 
-func (s partitionSet) resolveCacheIDRelative(id uint64, partitions []l3PartitionAllocation, typ l3SchemaType) error {
+func (s partitionSet) resolveCacheIDRelative(info *resctrlInfo, lvl cacheLevel, id uint64, partitions []catPartitionAllocation, typ catSchemaType, reserved Bitmask, policy ShareableBitsPolicy) error {
 	type reqHelper struct {
 		name string
 		req  uint64
@@ -588,23 +877,26 @@ func (s partitionSet) resolveCacheIDRelative(id uint64, partitions []l3Partition
 	// Additionally fill a helper structure for sorting partitions
 	total := uint64(0)
 	reqs := make([]reqHelper, 0, len(partitions))
+	sizeReqs := make(map[string]catBytesAllocation)
 	for _, partition := range partitions {
 		switch a := partition.allocation.get(typ).(type) {
-		case l3PctAllocation:
+		case catPctAllocation:
 			total += uint64(a)
 			reqs = append(reqs, reqHelper{name: partition.name, req: uint64(a)})
-		case l3AbsoluteAllocation:
-			return fmt.Errorf("error resolving L3 allocation for cache id %d: mixing relative and absolute allocations between partitions not supported", id)
-		case l3PctRangeAllocation:
+		case catBytesAllocation:
+			sizeReqs[partition.name] = a
+		case catAbsoluteAllocation:
+			return fmt.Errorf("error resolving %s allocation for cache id %d: mixing relative and absolute allocations between partitions not supported", lvl, id)
+		case catPctRangeAllocation:
 			return fmt.Errorf("percentage ranges in partition allocation not supported")
 		default:
 			return fmt.Errorf("BUG: unknown cacheAllocation type %T", a)
 		}
 	}
 	if total < 100 {
-		log.Info("requested total L3 %q partition allocation for cache id %d <100%% (%d%%)", typ, id, total)
+		log.Info("requested total %s %q partition allocation for cache id %d <100%% (%d%%)", lvl, typ, id, total)
 	} else if total > 100 {
-		return fmt.Errorf("accumulated L3 %q partition allocation requests for cache id %d exceeds 100%% (%d%%)", typ, id, total)
+		return fmt.Errorf("accumulated %s %q partition allocation requests for cache id %d exceeds 100%% (%d%%)", lvl, typ, id, total)
 	}
 
 	// Sort partition allocations. We want to resolve smallest allocations
@@ -614,18 +906,55 @@ func (s partitionSet) resolveCacheIDRelative(id uint64, partitions []l3Partition
 		return reqs[i].req < reqs[j].req
 	})
 
-	// Calculate number of bits granted each partition.
+	// Percentages are relative to the largest contiguous range of ways not
+	// reserved for pseudo-locked regions or, if to be avoided, shared with
+	// hardware
+	shared := info.cat[lvl].hardwareBits(id)
+	available := info.catCbmMask(lvl) &^ reserved
+	if policy == ShareableBitsAvoid {
+		available &^= shared
+	}
+	baseMask := available.largestRange()
+	if baseMask == 0 {
+		return fmt.Errorf("unable to resolve %s allocation for cache id %d, no ways available", lvl, id)
+	}
+
+	// Calculate number of bits granted each partition. Size-based
+	// allocations are granted first, percentages are relative to all ways.
 	grants := make(map[string]uint64, len(partitions))
-	minCbmBits := info.l3MinCbmBits()
-	bitsTotal := uint64(info.l3CbmMask().lsbZero())
+	minCbmBits := info.catMinCbmBits(lvl)
+	bitsTotal := uint64(bits.OnesCount64(uint64(baseMask)))
 	bitsAvailable := bitsTotal
+	if len(sizeReqs) > 0 {
+		waySize := info.cat[lvl].waySize(id)
+		if waySize == 0 {
+			return fmt.Errorf("unable to resolve size-based %s allocations for cache id %d, cache size not known", lvl, id)
+		}
+		names := make([]string, 0, len(sizeReqs))
+		for name := range sizeReqs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			numBits := sizeReqs[name].ways(waySize, minCbmBits)
+			if numBits > bitsAvailable {
+				return fmt.Errorf("unable to resolve %s allocation of partition %q for cache id %d, %s exceeds the available cache size of %s",
+					lvl, name, id, formatBytes(uint64(sizeReqs[name])), formatBytes(bitsAvailable*waySize))
+			}
+			grants[name] = numBits
+			bitsAvailable -= numBits
+		}
+		if sizeBits := bitsTotal - bitsAvailable; total+sizeBits*100/bitsTotal > 100 {
+			return fmt.Errorf("accumulated %s %q partition allocation requests for cache id %d exceed the available cache size", lvl, typ, id)
+		}
+	}
 	for _, req := range reqs {
 		percentageAvailable := bitsAvailable * 100 / bitsTotal
 
 		// This might happen e.g. if number of partitions would be greater
 		// than the total number of bits
 		if bitsAvailable < minCbmBits {
-			return fmt.Errorf("unable to resolve L3 allocation for cache id %d, not enough exlusive bits available", id)
+			return fmt.Errorf("unable to resolve %s allocation for cache id %d, not enough exlusive bits available", lvl, id)
 		}
 
 		// Use integer arithmetics, effectively always rounding down
@@ -645,62 +974,94 @@ func (s partitionSet) resolveCacheIDRelative(id uint64, partitions []l3Partition
 		bitsAvailable -= numBits
 	}
 
-	// Construct the actual bitmasks for each partition
-	lsbID := uint64(0)
+	// Construct the actual bitmasks for each partition. Shared ways are
+	// preferred by starting from the most significant way if the shared
+	// ways do not include the least significant one.
+	fromMsb := policy == ShareableBitsPrefer && shared&baseMask != 0 && (shared&baseMask).lsbOne() > baseMask.lsbOne()
+	lsbID := uint64(baseMask.lsbOne())
+	if fromMsb {
+		lsbID += bitsTotal
+	}
 	for _, partition := range partitions {
+		if fromMsb {
+			lsbID -= grants[partition.name]
+		}
+
 		// Compose the actual bitmask
-		v := s[partition.name].L3[id].set(typ, l3AbsoluteAllocation(Bitmask(((1<<grants[partition.name])-1)<<lsbID)))
-		s[partition.name].L3[id] = v
+		v := s[partition.name].CAT[lvl][id].set(typ, catAbsoluteAllocation(Bitmask(((1<<grants[partition.name])-1)<<lsbID)))
+		s[partition.name].CAT[lvl][id] = v
 
-		lsbID += grants[partition.name]
+		if !fromMsb {
+			lsbID += grants[partition.name]
+		}
 	}
 
 	return nil
 }
 
-func (s partitionSet) resolveCacheIDAbsolute(id uint64, partitions []l3PartitionAllocation, typ l3SchemaType) error {
+func (s partitionSet) resolveCacheIDAbsolute(info *resctrlInfo, lvl cacheLevel, id uint64, partitions []catPartitionAllocation, typ catSchemaType, reserved Bitmask, policy ShareableBitsPolicy) error {
 	// Just sanity check:
 	// 1. allocation requests of the correct type (absolute)
-	// 2. allocations do not overlap
-	mask := Bitmask(0)
+	// 2. allocations do not overlap with each other or with reserved ways
+	// 3. allocations do not overlap with shared ways, if to be avoided
+	shared := Bitmask(0)
+	if policy == ShareableBitsAvoid {
+		shared = info.cat[lvl].hardwareBits(id)
+	}
+	mask := reserved
 	for _, partition := range partitions {
-		a, ok := partition.allocation.get(typ).(l3AbsoluteAllocation)
+		a, ok := partition.allocation.get(typ).(catAbsoluteAllocation)
 		if !ok {
-			return fmt.Errorf("error resolving L3 allocation for cache id %d: mixing absolute and relative allocations between partitions not supported", id)
+			return fmt.Errorf("error resolving %s allocation for cache id %d: mixing absolute and relative allocations between partitions not supported", lvl, id)
+		}
+		if Bitmask(a)&reserved > 0 {
+			return fmt.Errorf("%s allocation of partition %q for cache id %d overlaps with ways %#x reserved for pseudo-locked regions", lvl, partition.name, id, reserved)
+		}
+		if Bitmask(a)&shared > 0 {
+			return fmt.Errorf("%s allocation of partition %q for cache id %d overlaps with ways %#x shared with hardware", lvl, partition.name, id, shared)
 		}
 		if Bitmask(a)&mask > 0 {
-			return fmt.Errorf("overlapping L3 partition allocation requests for cache id %d", id)
+			return fmt.Errorf("overlapping %s partition allocation requests for cache id %d", lvl, id)
 		}
 		mask |= Bitmask(a)
 
-		s[partition.name].L3[id] = s[partition.name].L3[id].set(typ, a)
+		s[partition.name].CAT[lvl][id] = s[partition.name].CAT[lvl][id].set(typ, a)
 	}
 
 	return nil
 }
 
-// resolveMBPartitions tries to resolve requested MB allocations between partitions
-func (raw Config) resolveMBPartitions(conf partitionSet) error {
+// resolveMBPartitions tries to resolve requested MB allocations between
+// partitions. Returns warnings about allocations raised to the minimum
+// bandwidth supported by the system.
+func (raw Config) resolveMBPartitions(info *resctrlInfo, conf partitionSet) ([]string, error) {
+	warnings := []string{}
+
 	// We use percentage values directly from the raw conf
 	for name, partition := range raw.Partitions {
-		allocations, err := parseRawMBAllocations(partition.MBAllocation)
+		allocations, err := parseRawMBAllocations(info, partition.MBAllocation)
 		if err != nil {
-			return fmt.Errorf("failed to resolve MB allocation for partition %q: %v", name, err)
+			return nil, fmt.Errorf("failed to resolve MB allocation for partition %q: %w", name, err)
 		}
 		for id, allocation := range allocations {
 			conf[name].MB[id] = allocation
 			// Check that we don't go under the minimum allowed bandwidth setting
 			if !info.mb.mbpsEnabled && allocation < info.mb.minBandwidth {
 				conf[name].MB[id] = info.mb.minBandwidth
+				w := fmt.Sprintf("MB allocation of partition %q for cache id %d raised from %d%% to the minimum of %d%%",
+					name, id, allocation, info.mb.minBandwidth)
+				log.Warn("%s", w)
+				warnings = append(warnings, w)
 			}
 		}
 	}
+	sort.Strings(warnings)
 
-	return nil
+	return warnings, nil
 }
 
 // resolveClasses tries to resolve class allocations of all partitions
-func (raw Config) resolveClasses() (classSet, error) {
+func (raw Config) resolveClasses(info *resctrlInfo) (classSet, error) {
 	classes := make(classSet)
 
 	for bname, partition := range raw.Partitions {
@@ -710,41 +1071,93 @@ func (raw Config) resolveClasses() (classSet, error) {
 			}
 
 			var err error
-			gc := classConfig{Partition: bname}
-
-			gc.L3Schema, err = parseRawL3Allocations(class.L3Schema)
-			if err != nil {
-				return classes, fmt.Errorf("failed to resolve L3 allocation for class %q: %v", gname, err)
-			}
-			if gc.L3Schema != nil && partition.L3Allocation == nil {
-				return classes, fmt.Errorf("L3 allocation missing from partition %q but class %q specifies L3 schema", bname, gname)
+			gc := classConfig{Partition: bname, CATSchema: make(map[cacheLevel]catSchema, 2)}
+
+			for _, c := range []struct {
+				lvl        cacheLevel
+				allocation interface{}
+				schema     interface{}
+			}{
+				{cacheLevelL2, partition.L2Allocation, class.L2Schema},
+				{cacheLevelL3, partition.L3Allocation, class.L3Schema},
+			} {
+				gc.CATSchema[c.lvl], err = parseRawCatAllocations(info, c.lvl, c.schema)
+				if err != nil {
+					return classes, fmt.Errorf("failed to resolve %s allocation for class %q: %w", c.lvl, gname, err)
+				}
+				for _, a := range gc.CATSchema[c.lvl] {
+					for _, v := range []cacheAllocation{a.Unified, a.Code, a.Data} {
+						if b, ok := v.(catBytesAllocation); ok {
+							return classes, fmt.Errorf("invalid %s schema of class %q: size-based allocation %s only supported in partitions",
+								c.lvl, gname, formatBytes(uint64(b)))
+						}
+					}
+				}
+				if gc.CATSchema[c.lvl] != nil && c.allocation == nil {
+					return classes, fmt.Errorf("%s allocation missing from partition %q but class %q specifies %s schema", c.lvl, bname, gname, c.lvl)
+				}
 			}
 
-			gc.MBSchema, err = parseRawMBAllocations(class.MBSchema)
+			gc.MBSchema, err = parseRawMBAllocations(info, class.MBSchema)
 			if err != nil {
-				return classes, fmt.Errorf("failed to resolve MB allocation for class %q: %v", gname, err)
+				return classes, fmt.Errorf("failed to resolve MB allocation for class %q: %w", gname, err)
 			}
 			if gc.MBSchema != nil && partition.MBAllocation == nil {
 				return classes, fmt.Errorf("MB allocation missing from partition %q but class %q specifies MB schema", bname, gname)
 			}
 
+			if class.Cpus != nil {
+				gc.Cpus = NewCPUSet(class.Cpus.List()...)
+			}
+
+			switch class.Mode {
+			case "", GroupModeShareable:
+				gc.Mode = GroupModeShareable
+			case GroupModeExclusive:
+				gc.Mode = class.Mode
+			default:
+				return classes, fmt.Errorf("invalid mode %q of class %q", class.Mode, gname)
+			}
+
 			classes[gname] = gc
 		}
 	}
 
+	if err := classes.verifyCpus(); err != nil {
+		return classes, err
+	}
+
 	return classes, nil
 }
 
-// parseRawL3Allocations parses a raw L3 cache allocation
-func parseRawL3Allocations(raw interface{}) (l3Schema, error) {
-	rawValues, err := preparseRawAllocations(raw, "100%", false)
+// verifyCpus checks that no CPU is assigned to more than one class
+func (s classSet) verifyCpus() error {
+	names := make([]string, 0, len(s))
+	for name := range s {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for i, a := range names {
+		for _, b := range names[i+1:] {
+			if common := s[a].Cpus.Intersection(s[b].Cpus); common.Size() > 0 {
+				return fmt.Errorf("cpus %s assigned to both class %q and class %q", common, a, b)
+			}
+		}
+	}
+	return nil
+}
+
+// parseRawCatAllocations parses a raw cache allocation
+func parseRawCatAllocations(info *resctrlInfo, lvl cacheLevel, raw interface{}) (catSchema, error) {
+	rawValues, err := preparseRawAllocations(raw, info.catCacheIds(lvl), "100%", false)
 	if err != nil || rawValues == nil {
 		return nil, err
 	}
 
-	allocations := make(l3Schema, len(rawValues))
+	allocations := make(catSchema, len(rawValues))
 	for id, rawVal := range rawValues {
-		allocations[id], err = parseL3Allocation(rawVal)
+		allocations[id], err = parseCatAllocation(info, lvl, rawVal)
 		if err != nil {
 			return nil, err
 		}
@@ -754,8 +1167,8 @@ func parseRawL3Allocations(raw interface{}) (l3Schema, error) {
 }
 
 // parseRawMBAllocations parses a raw MB allocation
-func parseRawMBAllocations(raw interface{}) (mbSchema, error) {
-	rawValues, err := preparseRawAllocations(raw, []interface{}{}, false)
+func parseRawMBAllocations(info *resctrlInfo, raw interface{}) (mbSchema, error) {
+	rawValues, err := preparseRawAllocations(raw, info.mb.cacheIds, []interface{}{}, false)
 	if err != nil || rawValues == nil {
 		return nil, err
 	}
@@ -766,7 +1179,7 @@ func parseRawMBAllocations(raw interface{}) (mbSchema, error) {
 		if !ok {
 			return nil, fmt.Errorf("not a list value %q", rawVal)
 		}
-		allocations[id], err = parseMBAllocation(strList)
+		allocations[id], err = parseMBAllocation(info, strList)
 		if err != nil {
 			return nil, err
 		}
@@ -777,13 +1190,13 @@ func parseRawMBAllocations(raw interface{}) (mbSchema, error) {
 
 // preparseRawAllocations "pre-parses" the rawAllocations per each cache id. I.e. it assigns
 // a raw (string) allocation for each cache id
-func preparseRawAllocations(raw interface{}, defaultVal interface{}, initEmpty bool) (map[uint64]interface{}, error) {
+func preparseRawAllocations(raw interface{}, cacheIds []uint64, defaultVal interface{}, initEmpty bool) (map[uint64]interface{}, error) {
 	if raw == nil && !initEmpty {
 		return nil, nil
 	}
 
 	var rawPerCacheId map[string]interface{}
-	allocations := make(map[uint64]interface{}, len(info.cacheIds))
+	allocations := make(map[uint64]interface{}, len(cacheIds))
 
 	switch value := raw.(type) {
 	case string:
@@ -801,7 +1214,7 @@ func preparseRawAllocations(raw interface{}, defaultVal interface{}, initEmpty b
 		return allocations, fmt.Errorf("invalid structure of allocation schema '%v' (%T)", raw, raw)
 	}
 
-	for _, i := range info.cacheIds {
+	for _, i := range cacheIds {
 		allocations[i] = defaultVal
 	}
 
@@ -823,14 +1236,16 @@ func preparseRawAllocations(raw interface{}, defaultVal interface{}, initEmpty b
 	return allocations, nil
 }
 
-// parseL3Allocation parses a generic string map into l3Allocation struct
-func parseL3Allocation(raw interface{}) (l3Allocation, error) {
+// parseCatAllocation parses a generic string map into catAllocation struct
+func parseCatAllocation(info *resctrlInfo, lvl cacheLevel, raw interface{}) (catAllocation, error) {
 	var err error
-	allocation := l3Allocation{}
+	allocation := catAllocation{}
+	minBits := info.catMinCbmBits(lvl)
+	schemaName := strings.ToLower(string(lvl)) + "Schema"
 
 	switch value := raw.(type) {
 	case string:
-		allocation.Unified, err = parseCacheAllocation(value)
+		allocation.Unified, err = parseCacheAllocation(value, minBits)
 		if err != nil {
 			return allocation, err
 		}
@@ -841,37 +1256,49 @@ func parseL3Allocation(raw interface{}) (l3Allocation, error) {
 				return allocation, fmt.Errorf("not a string value %q", v)
 			}
 			switch strings.ToLower(k) {
-			case string(l3SchemaTypeUnified):
-				allocation.Unified, err = parseCacheAllocation(s)
-			case string(l3SchemaTypeCode):
-				allocation.Code, err = parseCacheAllocation(s)
-			case string(l3SchemaTypeData):
-				allocation.Data, err = parseCacheAllocation(s)
+			case string(catSchemaTypeUnified):
+				allocation.Unified, err = parseCacheAllocation(s, minBits)
+			case string(catSchemaTypeCode):
+				allocation.Code, err = parseCacheAllocation(s, minBits)
+			case string(catSchemaTypeData):
+				allocation.Data, err = parseCacheAllocation(s, minBits)
 			}
 			if err != nil {
 				return allocation, err
 			}
 		}
 	default:
-		return allocation, fmt.Errorf("invalid structure of l3Schema %q", raw)
+		return allocation, fmt.Errorf("invalid structure of %s %q", schemaName, raw)
 	}
 
 	// Sanity check for the configuration
 	if allocation.Unified == nil {
-		return allocation, fmt.Errorf("'unified' not specified in l3Schema %s", raw)
+		return allocation, fmt.Errorf("'unified' not specified in %s %s", schemaName, raw)
 	}
 	if allocation.Code != nil && allocation.Data == nil {
-		return allocation, fmt.Errorf("'code' specified but missing 'data' from l3Schema %s", raw)
+		return allocation, fmt.Errorf("'code' specified but missing 'data' from %s %s", schemaName, raw)
 	}
 	if allocation.Code == nil && allocation.Data != nil {
-		return allocation, fmt.Errorf("'data' specified but missing 'code' from l3Schema %s", raw)
+		return allocation, fmt.Errorf("'data' specified but missing 'code' from %s %s", schemaName, raw)
 	}
 
 	return allocation, nil
 }
 
 // parseCacheAllocation parses a string value into cacheAllocation type
-func parseCacheAllocation(data string) (cacheAllocation, error) {
+func parseCacheAllocation(data string, minBits uint64) (cacheAllocation, error) {
+	if !strings.HasPrefix(data, "0x") && data[len(data)-1] == 'B' {
+		// Size in bytes
+		size, err := parseBytes(data)
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return nil, fmt.Errorf("invalid cache allocation size %q", data)
+		}
+		return catBytesAllocation(size), nil
+	}
+
 	if data[len(data)-1] == '%' {
 		// Percentages of the max number of bits
 		split := strings.SplitN(data[0:len(data)-1], "-", 2)
@@ -885,7 +1312,7 @@ func parseCacheAllocation(data string) (cacheAllocation, error) {
 			if pct > 100 {
 				return allocation, fmt.Errorf("invalid percentage value %q", data)
 			}
-			allocation = l3PctAllocation(pct)
+			allocation = catPctAllocation(pct)
 		} else {
 			low, err := strconv.ParseUint(split[0], 10, 7)
 			if err != nil {
@@ -898,7 +1325,7 @@ func parseCacheAllocation(data string) (cacheAllocation, error) {
 			if low > high || low > 100 || high > 100 {
 				return allocation, fmt.Errorf("invalid percentage range %q", data)
 			}
-			allocation = l3PctRangeAllocation{lowPct: low, highPct: high}
+			allocation = catPctRangeAllocation{lowPct: low, highPct: high}
 		}
 
 		return allocation, nil
@@ -928,15 +1355,15 @@ func parseCacheAllocation(data string) (cacheAllocation, error) {
 	if numOnes != 64-bits.LeadingZeros64(value)-bits.TrailingZeros64(value) {
 		return nil, fmt.Errorf("invalid cache bitmask %q: more than one continuous block of ones", data)
 	}
-	if uint64(numOnes) < info.l3MinCbmBits() {
-		return nil, fmt.Errorf("invalid cache bitmask %q: number of bits less than %d", data, info.l3MinCbmBits())
+	if uint64(numOnes) < minBits {
+		return nil, fmt.Errorf("invalid cache bitmask %q: number of bits less than %d", data, minBits)
 	}
 
-	return l3AbsoluteAllocation(value), nil
+	return catAbsoluteAllocation(value), nil
 }
 
 // parseMBAllocation parses a generic string map into MB allocation value
-func parseMBAllocation(raw []interface{}) (uint64, error) {
+func parseMBAllocation(info *resctrlInfo, raw []interface{}) (uint64, error) {
 	for _, v := range raw {
 		strVal, ok := v.(string)
 		if !ok {
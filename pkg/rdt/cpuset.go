@@ -0,0 +1,168 @@
+/*
+Copyright 2021 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rdt
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// maxCPUs is the upper bound of CPU numbers accepted by ParseCPUSet, the
+// maximum number of CPUs supported by the Linux kernel (CONFIG_MAXSMP)
+const maxCPUs = 8192
+
+// CPUSet is a set of logical CPU numbers. Unlike Bitmask it is not limited to
+// 64 entries.
+type CPUSet map[int]struct{}
+
+// NewCPUSet creates a new CPUSet containing the given CPUs
+func NewCPUSet(cpus ...int) CPUSet {
+	s := make(CPUSet, len(cpus))
+	for _, cpu := range cpus {
+		s[cpu] = struct{}{}
+	}
+	return s
+}
+
+// ParseCPUSet parses a string in the list format of the Linux kernel, e.g.
+// "0-3,8", into a CPUSet. This is the format used in the cpus_list files of
+// the resctrl filesystem. CPU numbers must be below 8192.
+func ParseCPUSet(str string) (CPUSet, error) {
+	s := CPUSet{}
+
+	str = strings.TrimSpace(str)
+	if len(str) == 0 {
+		return s, nil
+	}
+
+	for _, ran := range strings.Split(str, ",") {
+		split := strings.SplitN(ran, "-", 2)
+
+		first, err := strconv.ParseUint(split[0], 10, 31)
+		if err != nil {
+			return nil, rdtError("invalid cpu list %q: %w", str, err)
+		}
+
+		last := first
+		if len(split) == 2 {
+			last, err = strconv.ParseUint(split[1], 10, 31)
+			if err != nil {
+				return nil, rdtError("invalid cpu list %q: %w", str, err)
+			}
+			if last <= first {
+				return nil, rdtError("invalid range %q in cpu list %q", ran, str)
+			}
+		}
+		if last >= maxCPUs {
+			return nil, rdtError("invalid cpu list %q: cpu %d out of range [0,%d]", str, last, maxCPUs-1)
+		}
+
+		for cpu := first; cpu <= last; cpu++ {
+			s[int(cpu)] = struct{}{}
+		}
+	}
+	return s, nil
+}
+
+// Has returns true if the set contains the given CPU
+func (s CPUSet) Has(cpu int) bool {
+	_, ok := s[cpu]
+	return ok
+}
+
+// Size returns the number of CPUs in the set
+func (s CPUSet) Size() int {
+	return len(s)
+}
+
+// List returns the CPUs of the set in increasing order
+func (s CPUSet) List() []int {
+	ret := make([]int, 0, len(s))
+	for cpu := range s {
+		ret = append(ret, cpu)
+	}
+	sort.Ints(ret)
+	return ret
+}
+
+// Equals returns true if both sets contain the same CPUs
+func (s CPUSet) Equals(o CPUSet) bool {
+	if len(s) != len(o) {
+		return false
+	}
+	for cpu := range s {
+		if !o.Has(cpu) {
+			return false
+		}
+	}
+	return true
+}
+
+// Intersection returns the CPUs that are present in both sets
+func (s CPUSet) Intersection(o CPUSet) CPUSet {
+	ret := CPUSet{}
+	for cpu := range s {
+		if o.Has(cpu) {
+			ret[cpu] = struct{}{}
+		}
+	}
+	return ret
+}
+
+// String prints the set in the list format of the Linux kernel, i.e. the
+// format accepted by ParseCPUSet
+func (s CPUSet) String() string {
+	cpus := s.List()
+	ranges := []string{}
+
+	for i := 0; i < len(cpus); {
+		j := i
+		for j+1 < len(cpus) && cpus[j+1] == cpus[j]+1 {
+			j++
+		}
+		if i == j {
+			ranges = append(ranges, strconv.Itoa(cpus[i]))
+		} else {
+			ranges = append(ranges, strconv.Itoa(cpus[i])+"-"+strconv.Itoa(cpus[j]))
+		}
+		i = j + 1
+	}
+
+	return strings.Join(ranges, ",")
+}
+
+// MarshalJSON implements the Marshaler interface of "encoding/json"
+func (s CPUSet) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+// UnmarshalJSON implements the Unmarshaler interface of "encoding/json".
+// Accepts a string in list format or a single CPU number.
+func (s *CPUSet) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		str = string(data)
+	}
+	cpus, err := ParseCPUSet(str)
+	if err != nil {
+		return err
+	}
+	*s = cpus
+	return nil
+}
@@ -0,0 +1,200 @@
+/*
+Copyright 2021 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rdt
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Sentinel errors for classifying failures with errors.Is()
+var (
+	// ErrNotInitialized is returned by the package-level functions before
+	// Initialize() has succeeded
+	ErrNotInitialized = errors.New("rdt not initialized")
+
+	// ErrNotSupported is returned when a feature is not supported by the
+	// system or the resctrl filesystem is not available
+	ErrNotSupported = errors.New("not supported")
+
+	// ErrInvalidConfig is returned when a configuration is invalid or cannot
+	// be resolved on the system
+	ErrInvalidConfig = errors.New("invalid configuration")
+
+	// ErrKernelRejected is returned when the kernel refuses a change to the
+	// resctrl filesystem
+	ErrKernelRejected = errors.New("rejected by the kernel")
+
+	// ErrGroupNotEmpty is returned when a resctrl group is not removed
+	// because it has tasks assigned
+	ErrGroupNotEmpty = errors.New("group not empty")
+
+	// ErrResourcesExhausted is returned when the hardware runs out of
+	// CLOSIDs, RMIDs or cache ways
+	ErrResourcesExhausted = errors.New("resources exhausted")
+
+	// ErrGroupsExist is returned when resctrl is not re-mounted or unmounted
+	// because resctrl groups other than the root group exist
+	ErrGroupsExist = errors.New("resctrl groups exist")
+
+	// ErrReadOnly is returned when a modification is attempted through a
+	// read-only Control
+	ErrReadOnly = errors.New("read-only mode")
+
+	// ErrLockTimeout is returned when the lock of the resctrl filesystem
+	// could not be taken within the configured timeout
+	ErrLockTimeout = errors.New("timeout waiting for resctrl lock")
+
+	// ErrClosidsExhausted is returned when a resctrl control group cannot be
+	// created because all CLOSIDs are in use. It matches
+	// ErrResourcesExhausted.
+	ErrClosidsExhausted error = exhaustedError("CLOSIDs")
+
+	// ErrRmidsExhausted is returned when a resctrl group cannot be created
+	// because all RMIDs are in use. It matches ErrResourcesExhausted.
+	ErrRmidsExhausted error = exhaustedError("RMIDs")
+)
+
+// exhaustedError is a sentinel error for one exhausted hardware resource
+type exhaustedError string
+
+func (e exhaustedError) Error() string {
+	return string(e) + " exhausted"
+}
+
+func (e exhaustedError) Is(target error) bool {
+	return target == ErrResourcesExhausted
+}
+
+// ConfigError is returned when a configuration is invalid or cannot be
+// resolved on the system. It matches ErrInvalidConfig.
+type ConfigError struct {
+	// Err is the reason of the failure
+	Err error
+}
+
+func (e *ConfigError) Error() string {
+	return "rdt: invalid configuration: " + e.Err.Error()
+}
+
+// Unwrap returns the reason of the failure
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+// Is implements matching with errors.Is()
+func (e *ConfigError) Is(target error) bool {
+	return target == ErrInvalidConfig
+}
+
+// GroupError describes a failed operation on a resctrl group. Its message
+// is the status reported by the kernel or the underlying error, callers add
+// the context. A GroupError with a kernel status or EINVAL matches
+// ErrKernelRejected, ENOSPC matches ErrResourcesExhausted and EBUSY or
+// ENOTEMPTY match ErrGroupNotEmpty. Other failures, e.g. EACCES or ENOENT,
+// are not rejections by the kernel. A failed mkdir with ENOSPC also matches
+// ErrRmidsExhausted for monitoring groups or if the kernel status tells so,
+// and ErrClosidsExhausted for control groups otherwise.
+type GroupError struct {
+	// Group is the path of the resctrl group relative to the resctrl root,
+	// e.g. "goresctrl.Guaranteed/mon_groups/goresctrl.mg". Empty for the
+	// root group.
+	Group string
+	// Op is the failed operation: "mkdir", "rmdir", "write" or
+	// "pseudo-lock"
+	Op string
+	// File is the name of the file written, e.g. "schemata"
+	File string
+	// Resource is the allocation resource the failure concerns, e.g. "L3"
+	// or "MB", if reported by the kernel
+	Resource string
+	// CacheID is the cache id the failure concerns, valid if HasCacheID is
+	// true
+	CacheID    uint64
+	HasCacheID bool
+	// CmdStatus is the status reported by the kernel in
+	// info/last_cmd_status, if any
+	CmdStatus string
+	// Err is the underlying error
+	Err error
+}
+
+func (e *GroupError) Error() string {
+	if e.CmdStatus != "" {
+		return e.CmdStatus
+	}
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error
+func (e *GroupError) Unwrap() error {
+	return e.Err
+}
+
+// Is implements matching with errors.Is()
+func (e *GroupError) Is(target error) bool {
+	switch target {
+	case ErrKernelRejected:
+		return e.CmdStatus != "" || errors.Is(e.Err, syscall.EINVAL)
+	case ErrResourcesExhausted:
+		return errors.Is(e.Err, syscall.ENOSPC)
+	case ErrRmidsExhausted:
+		return e.outOfIDs() && (e.isMonGroup() || strings.Contains(e.CmdStatus, "RMID"))
+	case ErrClosidsExhausted:
+		return e.outOfIDs() && !e.isMonGroup() && !strings.Contains(e.CmdStatus, "RMID")
+	case ErrGroupNotEmpty:
+		return errors.Is(e.Err, syscall.EBUSY) || errors.Is(e.Err, syscall.ENOTEMPTY)
+	}
+	return false
+}
+
+// outOfIDs returns true if the kernel ran out of CLOSIDs or RMIDs when
+// creating the group
+func (e *GroupError) outOfIDs() bool {
+	return e.Op == "mkdir" && errors.Is(e.Err, syscall.ENOSPC)
+}
+
+// isMonGroup returns true if the group is a monitoring group
+func (e *GroupError) isMonGroup() bool {
+	return strings.HasPrefix(e.Group, "mon_groups/") || strings.Contains(e.Group, "/mon_groups/")
+}
+
+var (
+	// cmdStatusDomainRe matches kernel status messages referring to one
+	// domain, e.g. "No space on L3:0"
+	cmdStatusDomainRe = regexp.MustCompile(`\b([A-Z][A-Z0-9]*):([0-9]+)\b`)
+	// cmdStatusResourceRe matches kernel status messages referring to one
+	// resource, e.g. "Unknown or unsupported resource name 'L2'"
+	cmdStatusResourceRe = regexp.MustCompile(`resource name '([^']*)'`)
+)
+
+// newGroupError creates a GroupError, extracting the resource and cache id
+// from the kernel status message
+func newGroupError(op, group, file, cmdStatus string, err error) *GroupError {
+	e := &GroupError{Group: group, Op: op, File: file, CmdStatus: cmdStatus, Err: err}
+	if m := cmdStatusDomainRe.FindStringSubmatch(cmdStatus); m != nil {
+		if id, err := strconv.ParseUint(m[2], 10, 64); err == nil {
+			e.Resource, e.CacheID, e.HasCacheID = m[1], id, true
+		}
+	} else if m := cmdStatusResourceRe.FindStringSubmatch(cmdStatus); m != nil {
+		e.Resource = m[1]
+	}
+	return e
+}
@@ -0,0 +1,52 @@
+/*
+Copyright 2021 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rdt
+
+import (
+	"io"
+	"os"
+)
+
+// FileSystem abstracts the operations that modify the resctrl filesystem.
+// Reads are done directly from the filesystem. The main purpose is plugging
+// in an emulation of the kernel behavior in tests, see package resctrltest.
+type FileSystem interface {
+	// OpenFile opens a resctrl file for writing. Every Write on
+	// the returned writer corresponds to one write(2) on the file.
+	OpenFile(path string) (io.WriteCloser, error)
+
+	// Mkdir creates a resctrl group
+	Mkdir(path string) error
+
+	// Rmdir removes a resctrl group
+	Rmdir(path string) error
+}
+
+// osFileSystem accesses the resctrl filesystem directly
+type osFileSystem struct{}
+
+func (osFileSystem) OpenFile(path string) (io.WriteCloser, error) {
+	return os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+}
+
+func (osFileSystem) Mkdir(path string) error {
+	return os.Mkdir(path, 0755)
+}
+
+func (osFileSystem) Rmdir(path string) error {
+	return groupRemoveFunc(path)
+}
@@ -17,9 +17,9 @@ limitations under the License.
 package rdt
 
 import (
-	"bufio"
 	"fmt"
 	"io/ioutil"
+	"math/bits"
 	"os"
 	"path/filepath"
 	"sort"
@@ -29,21 +29,58 @@ import (
 
 // resctrlInfo contains information about the RDT support in the system
 type resctrlInfo struct {
-	resctrlPath      string
-	resctrlMountOpts map[string]struct{}
-	numClosids       uint64
-	cacheIds         []uint64
-	l3               l3Info
-	l3code           l3Info
-	l3data           l3Info
-	l3mon            l3MonInfo
-	mb               mbInfo
-}
-
-type l3Info struct {
+	resctrlPath string
+	mountOpts   MountOptions
+	numClosids  uint64
+	cat         map[cacheLevel]catInfoAll
+	l3mon       l3MonInfo
+	mb          mbInfo
+}
+
+// cacheLevel represents a cache level supporting RDT cache allocation
+type cacheLevel string
+
+const (
+	// cacheLevelL2 is the L2 cache
+	cacheLevelL2 cacheLevel = "L2"
+	// cacheLevelL3 is the L3 cache
+	cacheLevelL3 cacheLevel = "L3"
+)
+
+// catInfoAll contains the cache allocation information of one cache level,
+// covering all schema types (unified, code and data)
+type catInfoAll struct {
+	cacheIds []uint64
+	// cacheSizes contains the sizes of the cache instances in bytes, i.e.
+	// the sizes corresponding to the full cbm mask, per cache id
+	cacheSizes map[uint64]uint64
+	unified    catInfo
+	code       catInfo
+	data       catInfo
+}
+
+type catInfo struct {
+	numClosids    uint64
 	cbmMask       Bitmask
 	minCbmBits    uint64
 	shareableBits Bitmask
+	// hardwareBits contains the ways used by hardware per cache id, as
+	// reported by bit usage
+	hardwareBits map[uint64]Bitmask
+}
+
+// BitUsage describes the usage of the ways (bits) of one cache instance, as
+// reported by the bit_usage files of the resctrl info directory
+type BitUsage struct {
+	// Hardware contains the ways used by hardware, e.g. by I/O devices
+	// (DDIO), possibly shared with software
+	Hardware Bitmask `json:"hardware"`
+	// Software contains the ways used by shareable resctrl groups
+	Software Bitmask `json:"software"`
+	// Exclusive contains the ways used by exclusive resctrl groups
+	Exclusive Bitmask `json:"exclusive"`
+	// PseudoLocked contains the ways of pseudo-locked regions
+	PseudoLocked Bitmask `json:"pseudoLocked"`
 }
 
 type l3MonInfo struct {
@@ -52,131 +89,303 @@ type l3MonInfo struct {
 }
 
 type mbInfo struct {
+	numClosids    uint64
+	cacheIds      []uint64
 	bandwidthGran uint64
 	delayLinear   uint64
 	minBandwidth  uint64
 	mbpsEnabled   bool // true if MBA_MBps is enabled
 }
 
-var mountInfoPath string = "/proc/mounts"
+// defaultMountInfoPath is the mount table used for detecting the resctrl
+// filesystem if not specified otherwise
+var defaultMountInfoPath string = "/proc/self/mountinfo"
 
-// l3Info is a helper method for a "unified API" for getting L3 information
-func (i *resctrlInfo) l3Info() l3Info {
+// getInfo is a helper method for a "unified API" for getting cache
+// allocation information of one cache level
+func (i catInfoAll) getInfo() catInfo {
 	switch {
-	case i.l3code.Supported():
-		return i.l3code
-	case i.l3data.Supported():
-		return i.l3data
+	case i.code.Supported():
+		return i.code
+	case i.data.Supported():
+		return i.data
 	}
-	return i.l3
+	return i.unified
 }
 
-func (i *resctrlInfo) l3CbmMask() Bitmask {
-	mask := i.l3Info().cbmMask
+func (i catInfoAll) cbmMask() Bitmask {
+	mask := i.getInfo().cbmMask
 	if mask != 0 {
 		return mask
 	}
 	return Bitmask(^uint64(0))
 }
 
-func (i *resctrlInfo) l3MinCbmBits() uint64 {
-	return i.l3Info().minCbmBits
+func (i catInfoAll) minCbmBits() uint64 {
+	return i.getInfo().minCbmBits
+}
+
+// waySize returns the size of one cache way in bytes, or zero if the size of
+// the cache is not known
+func (i catInfoAll) waySize(id uint64) uint64 {
+	numBits := uint64(bits.OnesCount64(uint64(i.cbmMask())))
+	if numBits == 0 {
+		return 0
+	}
+	return i.cacheSizes[id] / numBits
+}
+
+func (i *resctrlInfo) catCacheIds(lvl cacheLevel) []uint64 {
+	return i.cat[lvl].cacheIds
+}
+
+func (i *resctrlInfo) catCbmMask(lvl cacheLevel) Bitmask {
+	return i.cat[lvl].cbmMask()
+}
+
+func (i *resctrlInfo) catMinCbmBits(lvl cacheLevel) uint64 {
+	return i.cat[lvl].minCbmBits()
+}
+
+// catSchemaTypes returns the schema types of one cache level enabled in the
+// system
+func (i *resctrlInfo) catSchemaTypes(lvl cacheLevel) []catSchemaType {
+	switch {
+	case i.cat[lvl].unified.Supported():
+		return []catSchemaType{catSchemaTypeUnified}
+	case i.cat[lvl].data.Supported() || i.cat[lvl].code.Supported():
+		return []catSchemaType{catSchemaTypeCode, catSchemaTypeData}
+	}
+	return nil
 }
 
-func getRdtInfo() (*resctrlInfo, error) {
+// hardwareBits returns the ways of one cache instance used by hardware. Code
+// and data ways of CDP are combined. The shareable bits are included as bit
+// usage does not report hardware use of ways used by exclusive groups.
+func (i catInfoAll) hardwareBits(id uint64) Bitmask {
+	mask := Bitmask(0)
+	for _, ci := range []catInfo{i.unified, i.code, i.data} {
+		mask |= ci.shareableBits | ci.hardwareBits[id]
+	}
+	return mask
+}
+
+// getRdtInfo discovers the RDT capabilities of the system from the resctrl
+// filesystem found in the given mount table
+func getRdtInfo(mountInfoPath string) (*resctrlInfo, error) {
 	var err error
 	info := &resctrlInfo{}
 
-	info.resctrlPath, info.resctrlMountOpts, err = getResctrlMountInfo()
+	mount, err := findResctrlMount(mountInfoPath)
 	if err != nil {
-		return info, rdtError("failed to detect resctrl mount point: %v", err)
+		return info, rdtError("failed to detect resctrl mount point: %w", err)
 	}
-	log.Info("detected resctrl filesystem at %q", info.resctrlPath)
+	info.resctrlPath = mount.mountPoint
+	info.mountOpts = mountOptionsFromSet(mount.options)
 
 	// Check that RDT is available
 	infopath := filepath.Join(info.resctrlPath, "info")
 	if _, err := os.Stat(infopath); err != nil {
-		return info, rdtError("failed to read RDT info from %q: %v", infopath, err)
+		return info, rdtError("failed to read RDT info from %q: %w", infopath, err)
 	}
 
-	subpath := filepath.Join(infopath, "L3")
-	if _, err = os.Stat(subpath); err == nil {
-		info.l3, info.numClosids, err = getL3Info(subpath)
-		if err != nil {
-			return info, rdtError("failed to get L3 info from %q: %v", subpath, err)
+	// Check cache allocation (CAT) support of all cache levels
+	info.cat = make(map[cacheLevel]catInfoAll, 2)
+	for _, c := range []struct {
+		lvl cacheLevel
+		typ catSchemaType
+	}{
+		{cacheLevelL2, catSchemaTypeUnified},
+		{cacheLevelL2, catSchemaTypeCode},
+		{cacheLevelL2, catSchemaTypeData},
+		{cacheLevelL3, catSchemaTypeUnified},
+		{cacheLevelL3, catSchemaTypeCode},
+		{cacheLevelL3, catSchemaTypeData},
+	} {
+		name := string(c.lvl) + c.typ.ToResctrlStr()
+		subpath := filepath.Join(infopath, name)
+		if _, err = os.Stat(subpath); err == nil {
+			i, err := getCatInfo(subpath)
+			if err != nil {
+				return info, rdtError("failed to get %s info from %q: %w", name, subpath, err)
+			}
+			info.cat[c.lvl] = info.cat[c.lvl].set(c.typ, i)
+			info.numClosids = minClosids(info.numClosids, i.numClosids)
 		}
 	}
 
-	subpath = filepath.Join(infopath, "L3CODE")
-	if _, err = os.Stat(subpath); err == nil {
-		info.l3code, info.numClosids, err = getL3Info(subpath)
+	for lvl, cat := range info.cat {
+		cat.cacheIds, err = getCacheIds(info.resctrlPath, string(lvl))
 		if err != nil {
-			return info, rdtError("failed to get L3CODE info from %q: %v", subpath, err)
+			return info, rdtError("failed to get %s cache IDs: %w", lvl, err)
 		}
-	}
-
-	subpath = filepath.Join(infopath, "L3DATA")
-	if _, err = os.Stat(subpath); err == nil {
-		info.l3data, info.numClosids, err = getL3Info(subpath)
+		cat.cacheSizes, err = getCacheSizes(info.resctrlPath, lvl, cat.cbmMask())
 		if err != nil {
-			return info, rdtError("failed to get L3DATA info from %q: %v", subpath, err)
+			return info, rdtError("failed to get %s cache sizes: %w", lvl, err)
 		}
+		info.cat[lvl] = cat
 	}
 
-	subpath = filepath.Join(infopath, "L3_MON")
+	subpath := filepath.Join(infopath, "L3_MON")
 	if _, err = os.Stat(subpath); err == nil {
 		info.l3mon, err = getL3MonInfo(subpath)
 		if err != nil {
-			return info, rdtError("failed to get L3_MON info from %q: %v", subpath, err)
+			return info, rdtError("failed to get L3_MON info from %q: %w", subpath, err)
 		}
 	}
 
 	subpath = filepath.Join(infopath, "MB")
 	if _, err = os.Stat(subpath); err == nil {
-		info.mb, info.numClosids, err = getMBInfo(subpath)
+		info.mb, err = getMBInfo(subpath, info.mountOpts.MBps)
 		if err != nil {
-			return info, rdtError("failed to get MBA info from %q: %v", subpath, err)
+			return info, rdtError("failed to get MBA info from %q: %w", subpath, err)
 		}
-	}
+		info.numClosids = minClosids(info.numClosids, info.mb.numClosids)
 
-	info.cacheIds, err = getCacheIds(info.resctrlPath)
-	if err != nil {
-		return info, rdtError("failed to get cache IDs: %v", err)
+		info.mb.cacheIds, err = getCacheIds(info.resctrlPath, "MB")
+		if err != nil {
+			return info, rdtError("failed to get MB cache IDs: %w", err)
+		}
 	}
 
 	return info, nil
 }
 
-func getL3Info(basepath string) (l3Info, uint64, error) {
+// minClosids returns the smaller of two CLOSID counts, zero meaning unknown.
+// The kernel limits the number of resctrl groups to the smallest number of
+// CLOSIDs supported by any resource.
+func minClosids(a, b uint64) uint64 {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+func getCatInfo(basepath string) (catInfo, error) {
 	var err error
-	var numClosids uint64
-	info := l3Info{}
+	info := catInfo{}
 
 	info.cbmMask, err = readFileBitmask(filepath.Join(basepath, "cbm_mask"))
 	if err != nil {
-		return info, numClosids, err
+		return info, err
 	}
 	info.minCbmBits, err = readFileUint64(filepath.Join(basepath, "min_cbm_bits"))
 	if err != nil {
-		return info, numClosids, err
+		return info, err
 	}
 	info.shareableBits, err = readFileBitmask(filepath.Join(basepath, "shareable_bits"))
 	if err != nil {
-		return info, numClosids, err
+		return info, err
 	}
-	numClosids, err = readFileUint64(filepath.Join(basepath, "num_closids"))
+	info.numClosids, err = readFileUint64(filepath.Join(basepath, "num_closids"))
 	if err != nil {
-		return info, numClosids, err
+		return info, err
 	}
 
-	return info, numClosids, nil
+	// Bit usage is not available on older kernels
+	data, err := readFileString(filepath.Join(basepath, "bit_usage"))
+	if err != nil && !os.IsNotExist(err) {
+		return info, err
+	} else if err == nil {
+		usage, err := parseBitUsage(data)
+		if err != nil {
+			return info, err
+		}
+		for id, u := range usage {
+			if u.Hardware != 0 {
+				if info.hardwareBits == nil {
+					info.hardwareBits = make(map[uint64]Bitmask)
+				}
+				info.hardwareBits[id] = u.Hardware
+			}
+		}
+	}
+
+	return info, nil
 }
 
-// Supported returns true if L3 cache allocation has is supported and enabled in the system
-func (i l3Info) Supported() bool {
+// parseBitUsage parses the content of a bit_usage file, e.g.
+// "0=HHSSSS0000;1=XXSSEE0000". Each character describes one bit, the most
+// significant bit first.
+func parseBitUsage(data string) (map[uint64]BitUsage, error) {
+	ret := map[uint64]BitUsage{}
+
+	data = strings.TrimSpace(data)
+	if data == "" {
+		return ret, nil
+	}
+
+	for _, domain := range strings.Split(data, ";") {
+		split := strings.SplitN(domain, "=", 2)
+		if len(split) != 2 {
+			return nil, fmt.Errorf("invalid bit usage %q", domain)
+		}
+		id, err := strconv.ParseUint(strings.TrimSpace(split[0]), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cache id in bit usage %q: %w", domain, err)
+		}
+
+		usage := BitUsage{}
+		chars := strings.TrimSpace(split[1])
+		if len(chars) > 64 {
+			return nil, fmt.Errorf("too many bits in bit usage %q", domain)
+		}
+		for i, c := range chars {
+			bit := Bitmask(1) << uint(len(chars)-1-i)
+			switch c {
+			case '0':
+			case 'H':
+				usage.Hardware |= bit
+			case 'S':
+				usage.Software |= bit
+			case 'X':
+				usage.Hardware |= bit
+				usage.Software |= bit
+			case 'E':
+				usage.Exclusive |= bit
+			case 'P':
+				usage.PseudoLocked |= bit
+			default:
+				return nil, fmt.Errorf("invalid character %q in bit usage %q", c, domain)
+			}
+		}
+		ret[id] = usage
+	}
+	return ret, nil
+}
+
+// Used returns all ways in use
+func (u BitUsage) Used() Bitmask {
+	return u.Hardware | u.Software | u.Exclusive | u.PseudoLocked
+}
+
+// Supported returns true if cache allocation has is supported and enabled in the system
+func (i catInfo) Supported() bool {
 	return i.cbmMask != 0
 }
 
+func (i catInfoAll) get(typ catSchemaType) catInfo {
+	switch typ {
+	case catSchemaTypeCode:
+		return i.code
+	case catSchemaTypeData:
+		return i.data
+	}
+	return i.unified
+}
+
+func (i catInfoAll) set(typ catSchemaType, v catInfo) catInfoAll {
+	switch typ {
+	case catSchemaTypeCode:
+		i.code = v
+	case catSchemaTypeData:
+		i.data = v
+	default:
+		i.unified = v
+	}
+	return i
+}
+
 func getL3MonInfo(basepath string) (l3MonInfo, error) {
 	var err error
 	info := l3MonInfo{}
@@ -201,39 +410,32 @@ func (i l3MonInfo) Supported() bool {
 	return i.numRmids != 0 && len(i.monFeatures) > 0
 }
 
-func getMBInfo(basepath string) (mbInfo, uint64, error) {
+func getMBInfo(basepath string, mbps bool) (mbInfo, error) {
 	var err error
-	var numClosids uint64
 	info := mbInfo{}
 
 	info.bandwidthGran, err = readFileUint64(filepath.Join(basepath, "bandwidth_gran"))
 	if err != nil {
-		return info, numClosids, err
+		return info, err
 	}
 	info.delayLinear, err = readFileUint64(filepath.Join(basepath, "delay_linear"))
 	if err != nil {
-		return info, numClosids, err
+		return info, err
 	}
 	info.minBandwidth, err = readFileUint64(filepath.Join(basepath, "min_bandwidth"))
 	if err != nil {
-		return info, numClosids, err
+		return info, err
 	}
-	numClosids, err = readFileUint64(filepath.Join(basepath, "num_closids"))
+	info.numClosids, err = readFileUint64(filepath.Join(basepath, "num_closids"))
 	if err != nil {
-		return info, numClosids, err
+		return info, err
 	}
 
-	// Detect MBps mode directly from mount options as it's not visible in MB
-	// info directory
-	_, mountOpts, err := getResctrlMountInfo()
-	if err != nil {
-		return info, numClosids, fmt.Errorf("failed to get resctrl mount options: %v", err)
-	}
-	if _, ok := mountOpts["mba_MBps"]; ok {
-		info.mbpsEnabled = true
-	}
+	// MBps mode is only visible in the mount options, not in the MB info
+	// directory
+	info.mbpsEnabled = mbps
 
-	return info, numClosids, nil
+	return info, nil
 }
 
 // Supported returns true if memory bandwidth allocation has is supported and enabled in the system
@@ -241,63 +443,90 @@ func (i mbInfo) Supported() bool {
 	return i.minBandwidth != 0
 }
 
-func getCacheIds(basepath string) ([]uint64, error) {
+// roundBandwidth rounds a bandwidth percentage up to the bandwidth
+// granularity, like the kernel does when the schemata is written. Values in
+// MBps are not rounded.
+func (i mbInfo) roundBandwidth(value uint64) uint64 {
+	if i.mbpsEnabled || i.bandwidthGran == 0 || value%i.bandwidthGran == 0 {
+		return value
+	}
+	return value + i.bandwidthGran - value%i.bandwidthGran
+}
+
+// getCacheIds parses the cache (or memory domain) ids of one resource from
+// the root schemata. The resource name is matched with and without the CDP
+// suffixes, e.g. "L3" matches "L3", "L3CODE" and "L3DATA".
+func getCacheIds(basepath string, resource string) ([]uint64, error) {
 	var ids []uint64
 
 	// Parse cache IDs from the root schemata
 	data, err := readFileString(filepath.Join(basepath, "schemata"))
 	if err != nil {
-		return ids, rdtError("failed to read root schemata: %v", err)
+		return ids, rdtError("failed to read root schemata: %w", err)
 	}
 
 	for _, line := range strings.Split(data, "\n") {
 		trimmed := strings.TrimSpace(line)
 
-		// Find line with L3 or MB schema
-		if strings.HasPrefix(trimmed, "L3") || strings.HasPrefix(trimmed, "MB:") {
-			schema := strings.Split(trimmed[3:], ";")
-			ids = make([]uint64, len(schema))
+		split := strings.SplitN(trimmed, ":", 2)
+		if len(split) != 2 {
+			continue
+		}
+		name := strings.TrimSpace(split[0])
+		if name != resource && name != resource+"CODE" && name != resource+"DATA" {
+			continue
+		}
 
-			// Get individual cache configurations from the schema
-			for idx, definition := range schema {
-				split := strings.Split(definition, "=")
-				if len(split) != 2 {
-					return ids, rdtError("looks like an invalid L3 %q", trimmed)
-				}
-				ids[idx], err = strconv.ParseUint(split[0], 10, 64)
-				if err != nil {
-					if len(split) != 2 {
-						return ids, rdtError("failed to parse cache id in %q: %v", trimmed, err)
-					}
-				}
+		// Get individual cache configurations from the schema
+		schema := strings.Split(strings.TrimSpace(split[1]), ";")
+		ids = make([]uint64, len(schema))
+		for idx, definition := range schema {
+			split := strings.Split(definition, "=")
+			if len(split) != 2 {
+				return ids, rdtError("looks like an invalid %s schema %q", resource, trimmed)
+			}
+			ids[idx], err = strconv.ParseUint(strings.TrimSpace(split[0]), 10, 64)
+			if err != nil {
+				return ids, rdtError("failed to parse cache id in %q: %w", trimmed, err)
 			}
-			return ids, nil
 		}
+		return ids, nil
 	}
-	return ids, rdtError("no resources in root schemata")
+	return ids, rdtError("no %s resources in root schemata", resource)
 }
 
-func getResctrlMountInfo() (string, map[string]struct{}, error) {
-	mountOptions := map[string]struct{}{}
+// getCacheSizes calculates the sizes of the cache instances of one cache
+// level from the size and schemata files of the root group. Returns nil if
+// the kernel does not report sizes.
+func getCacheSizes(basepath string, lvl cacheLevel, cbmMask Bitmask) (map[uint64]uint64, error) {
+	data, err := readFileString(filepath.Join(basepath, "size"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, rdtError("failed to read root size: %w", err)
+	}
+	sizes := parseSchemata(data, 10)
 
-	f, err := os.Open(mountInfoPath)
+	data, err = readFileString(filepath.Join(basepath, "schemata"))
 	if err != nil {
-		return "", mountOptions, err
+		return nil, rdtError("failed to read root schemata: %w", err)
 	}
-	defer f.Close()
-
-	s := bufio.NewScanner(f)
-	for s.Scan() {
-		split := strings.Split(s.Text(), " ")
-		if len(split) > 3 && split[2] == "resctrl" {
-			opts := strings.Split(split[3], ",")
-			for _, opt := range opts {
-				mountOptions[opt] = struct{}{}
+	masks := parseSchemata(data, 16)
+
+	var ret map[uint64]uint64
+	for _, name := range []string{string(lvl), string(lvl) + "CODE", string(lvl) + "DATA"} {
+		for id, size := range sizes[name] {
+			numBits := bits.OnesCount64(masks[name][id])
+			if numBits == 0 || size == 0 {
+				continue
+			}
+			if ret == nil {
+				ret = make(map[uint64]uint64)
 			}
-			return split[1], mountOptions, nil
+			ret[id] = size / uint64(numBits) * uint64(bits.OnesCount64(uint64(cbmMask)))
 		}
 	}
-	return "", mountOptions, rdtError("resctrl not found in " + mountInfoPath)
+	return ret, nil
 }
 
 func readFileUint64(path string) (uint64, error) {
@@ -323,3 +552,137 @@ func readFileString(path string) (string, error) {
 	data, err := ioutil.ReadFile(path)
 	return strings.TrimSpace(string(data)), err
 }
+
+// Info describes the RDT resources discovered from the resctrl filesystem.
+// It is a snapshot taken at discovery time and a new copy is returned by
+// every call of GetInfo(), i.e. modifying it has no effect on the Control.
+type Info struct {
+	// ResctrlPath is the mount point of the resctrl filesystem
+	ResctrlPath string `json:"resctrlPath"`
+	// MountOptions contains the options of the resctrl filesystem
+	MountOptions MountOptions `json:"mountOptions"`
+	// NumClosids is the number of CLOSIDs, i.e. resctrl groups, available
+	NumClosids uint64 `json:"numClosids"`
+	// L2 describes L2 cache allocation, nil if not supported
+	L2 *CacheInfo `json:"l2,omitempty"`
+	// L3 describes L3 cache allocation, nil if not supported
+	L3 *CacheInfo `json:"l3,omitempty"`
+	// MB describes memory bandwidth allocation, nil if not supported
+	MB *MBAInfo `json:"mb,omitempty"`
+	// L3Mon describes L3 monitoring, nil if not supported
+	L3Mon *L3MonitoringInfo `json:"l3Mon,omitempty"`
+}
+
+// CacheInfo describes the allocation capabilities of one cache level
+type CacheInfo struct {
+	// CacheIds contains the ids of the cache instances
+	CacheIds []uint64 `json:"cacheIds"`
+	// CacheSizes contains the sizes of the cache instances in bytes per
+	// cache id, if known
+	CacheSizes map[uint64]uint64 `json:"cacheSizes,omitempty"`
+	// CDP is true if code and data prioritization is enabled
+	CDP bool `json:"cdp"`
+	// Resources contains the allocation resources of the cache level: the
+	// unified resource, e.g. "L3", or the code and data resources, e.g.
+	// "L3CODE" and "L3DATA", if CDP is enabled
+	Resources []CacheResourceInfo `json:"resources"`
+}
+
+// CacheResourceInfo describes one cache allocation resource, i.e. one line in
+// the schemata
+type CacheResourceInfo struct {
+	// Name is the name of the resource, e.g. "L3" or "L3CODE"
+	Name string `json:"name"`
+	// NumClosids is the number of CLOSIDs supported by the resource
+	NumClosids uint64 `json:"numClosids"`
+	// CbmMask is the bitmask covering all ways of the cache
+	CbmMask Bitmask `json:"cbmMask"`
+	// NumCbmBits is the number of bits (cache ways) in CbmMask
+	NumCbmBits uint64 `json:"numCbmBits"`
+	// MinCbmBits is the minimum number of bits in an allocation
+	MinCbmBits uint64 `json:"minCbmBits"`
+	// ShareableBits contains the ways that may be shared with hardware
+	ShareableBits Bitmask `json:"shareableBits"`
+	// HardwareBits contains the ways used by hardware per cache id, as
+	// reported by bit usage
+	HardwareBits map[uint64]Bitmask `json:"hardwareBits,omitempty"`
+}
+
+// MBAInfo describes the memory bandwidth allocation capabilities
+type MBAInfo struct {
+	// NumClosids is the number of CLOSIDs supported by the resource
+	NumClosids uint64 `json:"numClosids"`
+	// CacheIds contains the ids of the memory bandwidth domains
+	CacheIds []uint64 `json:"cacheIds"`
+	// BandwidthGran is the granularity of bandwidth allocations in percent
+	BandwidthGran uint64 `json:"bandwidthGran"`
+	// DelayLinear is true if the throttling delay scale is linear
+	DelayLinear bool `json:"delayLinear"`
+	// MinBandwidth is the minimum bandwidth allocation in percent
+	MinBandwidth uint64 `json:"minBandwidth"`
+	// MBpsEnabled is true if the resctrl filesystem is mounted with the
+	// mba_MBps option, i.e. allocations are in MBps instead of percent
+	MBpsEnabled bool `json:"mbaMBps"`
+}
+
+// L3MonitoringInfo describes the L3 monitoring capabilities
+type L3MonitoringInfo struct {
+	// NumRmids is the number of RMIDs, i.e. monitored groups, available
+	NumRmids uint64 `json:"numRmids"`
+	// MonFeatures contains the available monitoring events
+	MonFeatures []string `json:"monFeatures"`
+}
+
+// export converts resctrlInfo into the exported Info
+func (i *resctrlInfo) export() Info {
+	ret := Info{ResctrlPath: i.resctrlPath, MountOptions: i.mountOpts, NumClosids: i.numClosids}
+
+	for _, lvl := range []cacheLevel{cacheLevelL2, cacheLevelL3} {
+		cat, ok := i.cat[lvl]
+		if !ok {
+			continue
+		}
+		c := &CacheInfo{
+			CacheIds:   append([]uint64{}, cat.cacheIds...),
+			CacheSizes: copySizes(cat.cacheSizes),
+			CDP:        !cat.unified.Supported(),
+		}
+		for _, typ := range i.catSchemaTypes(lvl) {
+			ci := cat.get(typ)
+			c.Resources = append(c.Resources, CacheResourceInfo{
+				Name:          string(lvl) + typ.ToResctrlStr(),
+				NumClosids:    ci.numClosids,
+				CbmMask:       ci.cbmMask,
+				NumCbmBits:    uint64(bits.OnesCount64(uint64(ci.cbmMask))),
+				MinCbmBits:    ci.minCbmBits,
+				ShareableBits: ci.shareableBits,
+				HardwareBits:  copyBitmasks(ci.hardwareBits),
+			})
+		}
+		if lvl == cacheLevelL2 {
+			ret.L2 = c
+		} else {
+			ret.L3 = c
+		}
+	}
+
+	if i.mb.Supported() {
+		ret.MB = &MBAInfo{
+			NumClosids:    i.mb.numClosids,
+			CacheIds:      append([]uint64{}, i.mb.cacheIds...),
+			BandwidthGran: i.mb.bandwidthGran,
+			DelayLinear:   i.mb.delayLinear != 0,
+			MinBandwidth:  i.mb.minBandwidth,
+			MBpsEnabled:   i.mb.mbpsEnabled,
+		}
+	}
+
+	if i.l3mon.Supported() {
+		ret.L3Mon = &L3MonitoringInfo{
+			NumRmids:    i.l3mon.numRmids,
+			MonFeatures: append([]string{}, i.l3mon.monFeatures...),
+		}
+	}
+
+	return ret
+}
@@ -0,0 +1,275 @@
+/*
+Copyright 2021 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rdt
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"runtime"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// lockPollInterval is the interval of lock attempts when waiting for the lock
+// with a timeout
+const lockPollInterval = 10 * time.Millisecond
+
+// fsLock is the advisory lock of the resctrl filesystem, an flock on the
+// resctrl root directory as documented by the kernel. Writers take an
+// exclusive and readers a shared lock. The flock is taken by the first and
+// released by the last holder of the process. Within the process the lock
+// works like a reentrant read-write mutex: goroutines holding the lock may
+// take it again, exclusive holders in any mode. A shared lock is never
+// converted into an exclusive one, sequences that may write take the
+// exclusive lock up front. Writers are preferred, new readers wait while a
+// writer is waiting.
+type fsLock struct {
+	mutex sync.Mutex
+
+	path    string
+	timeout time.Duration
+	file    *os.File
+	// readers contains the depth of the shared lock per goroutine
+	readers map[int64]int
+	// writer is the goroutine holding the exclusive lock, depth its depth
+	writer int64
+	depth  int
+	// waitingWriters is the number of writers waiting for the lock
+	waitingWriters int
+}
+
+func (l *fsLock) lock(exclusive bool) error {
+	g := goroutineID()
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	switch {
+	case l.writer != 0 && l.writer == g:
+		l.depth++
+		return nil
+	case l.readers[g] > 0 && exclusive:
+		return rdtError("cannot lock %q exclusively while holding a shared lock", l.path)
+	case l.readers[g] > 0:
+		l.readers[g]++
+		return nil
+	}
+
+	if exclusive {
+		l.waitingWriters++
+		defer func() { l.waitingWriters-- }()
+	}
+	deadline := time.Now().Add(l.timeout)
+	for !l.available(exclusive) {
+		if l.timeout > 0 && time.Now().After(deadline) {
+			return rdtError("failed to lock %q in %v: %w", l.path, l.timeout, ErrLockTimeout)
+		}
+		l.mutex.Unlock()
+		time.Sleep(lockPollInterval)
+		l.mutex.Lock()
+	}
+
+	if l.file == nil {
+		f, err := os.Open(l.path)
+		if err != nil {
+			return rdtError("failed to open %q for locking: %w", l.path, err)
+		}
+		l.file = f
+
+		how := syscall.LOCK_SH
+		if exclusive {
+			how = syscall.LOCK_EX
+		}
+		if err := l.flock(how); err != nil {
+			f.Close()
+			l.file = nil
+			return err
+		}
+	}
+
+	if exclusive {
+		l.writer, l.depth = g, 1
+	} else {
+		if l.readers == nil {
+			l.readers = make(map[int64]int)
+		}
+		l.readers[g] = 1
+	}
+	return nil
+}
+
+// available returns true if the lock can be taken by a goroutine not holding
+// it, caller must hold l.mutex
+func (l *fsLock) available(exclusive bool) bool {
+	if exclusive {
+		return l.writer == 0 && len(l.readers) == 0
+	}
+	return l.writer == 0 && l.waitingWriters == 0
+}
+
+func (l *fsLock) unlock() {
+	g := goroutineID()
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	switch {
+	case l.writer != 0 && l.writer == g:
+		l.depth--
+		if l.depth == 0 {
+			l.writer = 0
+		}
+	case l.readers[g] > 0:
+		l.readers[g]--
+		if l.readers[g] == 0 {
+			delete(l.readers, g)
+		}
+	default:
+		log.Error("unlock of %q by a goroutine not holding the lock", l.path)
+		return
+	}
+
+	if l.writer == 0 && len(l.readers) == 0 {
+		// Closing the file releases the lock
+		l.file.Close()
+		l.file = nil
+	}
+}
+
+// goroutineID returns the id of the calling goroutine for tracking the
+// holders of the lock. The runtime does not expose the id, it is parsed
+// from the header of the stack trace, "goroutine <id> [...". Returns 0 if
+// the header cannot be parsed.
+func goroutineID() int64 {
+	buf := make([]byte, 64)
+	buf = buf[:runtime.Stack(buf, false)]
+	fields := bytes.Fields(buf)
+	if len(fields) < 2 {
+		return 0
+	}
+	id, _ := strconv.ParseInt(string(fields[1]), 10, 64)
+	return id
+}
+
+// flock takes the lock, waiting at most the timeout if one is set, caller
+// must hold l.mutex
+func (l *fsLock) flock(how int) error {
+	fd := int(l.file.Fd())
+
+	if l.timeout <= 0 {
+		for {
+			err := syscall.Flock(fd, how)
+			if err == nil {
+				return nil
+			} else if err != syscall.EINTR {
+				return rdtError("failed to lock %q: %w", l.path, err)
+			}
+		}
+	}
+
+	deadline := time.Now().Add(l.timeout)
+	for {
+		err := syscall.Flock(fd, how|syscall.LOCK_NB)
+		if err == nil {
+			return nil
+		} else if err != syscall.EWOULDBLOCK && err != syscall.EINTR {
+			return rdtError("failed to lock %q: %w", l.path, err)
+		}
+		if time.Now().After(deadline) {
+			return rdtError("failed to lock %q in %v: %w", l.path, l.timeout, ErrLockTimeout)
+		}
+		time.Sleep(lockPollInterval)
+	}
+}
+
+// lockResctrl takes the lock of the resctrl filesystem for a sequence of
+// operations. Returns the function for releasing the lock. The lock is
+// always shared in read-only mode.
+func (c *Control) lockResctrl(exclusive bool) (func(), error) {
+	if err := c.lock.lock(exclusive && !c.readOnly); err != nil {
+		return nil, err
+	}
+	return c.lock.unlock, nil
+}
+
+// lockingFileSystem holds the exclusive lock of the resctrl filesystem
+// during every modification. In read-only mode all modifications are
+// refused.
+type lockingFileSystem struct {
+	fs       FileSystem
+	lock     *fsLock
+	readOnly bool
+}
+
+// lockedFile releases the lock when closed
+type lockedFile struct {
+	io.WriteCloser
+	once   sync.Once
+	unlock func()
+}
+
+func (f *lockedFile) Close() error {
+	err := f.WriteCloser.Close()
+	f.once.Do(f.unlock)
+	return err
+}
+
+func (l *lockingFileSystem) OpenFile(path string) (io.WriteCloser, error) {
+	if l.readOnly {
+		return nil, &os.PathError{Op: "open", Path: path, Err: ErrReadOnly}
+	}
+	if err := l.lock.lock(true); err != nil {
+		return nil, err
+	}
+	f, err := l.fs.OpenFile(path)
+	if err != nil {
+		l.lock.unlock()
+		return nil, err
+	}
+	return &lockedFile{WriteCloser: f, unlock: l.lock.unlock}, nil
+}
+
+func (l *lockingFileSystem) Mkdir(path string) error {
+	if l.readOnly {
+		// Existing groups are taken into use by creating them
+		if _, err := os.Stat(path); err == nil {
+			return &os.PathError{Op: "mkdir", Path: path, Err: os.ErrExist}
+		}
+		return &os.PathError{Op: "mkdir", Path: path, Err: ErrReadOnly}
+	}
+	if err := l.lock.lock(true); err != nil {
+		return err
+	}
+	defer l.lock.unlock()
+
+	return l.fs.Mkdir(path)
+}
+
+func (l *lockingFileSystem) Rmdir(path string) error {
+	if l.readOnly {
+		return &os.PathError{Op: "rmdir", Path: path, Err: ErrReadOnly}
+	}
+	if err := l.lock.lock(true); err != nil {
+		return err
+	}
+	defer l.lock.unlock()
+
+	return l.fs.Rmdir(path)
+}
@@ -20,6 +20,7 @@ import (
 	"fmt"
 	stdlog "log"
 	"strings"
+	"sync"
 )
 
 // Logger is the logging interface for goresctl
@@ -84,3 +85,57 @@ func (l *logger) blockPrint(levelPrefix, linePrefix, format string, v ...interfa
 	p := strings.Repeat(" ", len(l.Logger.Prefix())+len(levelPrefix)) + linePrefix
 	l.Logger.Print(strings.Join(lines, "\n"+p))
 }
+
+// syncLogger is the logger of the package. It forwards to a logger that may
+// be replaced with SetLogger() while other goroutines are logging.
+type syncLogger struct {
+	mutex  sync.RWMutex
+	logger Logger
+}
+
+func (s *syncLogger) get() Logger {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.logger
+}
+
+func (s *syncLogger) set(l Logger) {
+	if l == Logger(s) {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.logger = l
+}
+
+func (s *syncLogger) Debug(format string, v ...interface{}) {
+	s.get().Debug(format, v...)
+}
+
+func (s *syncLogger) Info(format string, v ...interface{}) {
+	s.get().Info(format, v...)
+}
+
+func (s *syncLogger) Warn(format string, v ...interface{}) {
+	s.get().Warn(format, v...)
+}
+
+func (s *syncLogger) Error(format string, v ...interface{}) {
+	s.get().Error(format, v...)
+}
+
+func (s *syncLogger) Panic(format string, v ...interface{}) {
+	s.get().Panic(format, v...)
+}
+
+func (s *syncLogger) Fatal(format string, v ...interface{}) {
+	s.get().Fatal(format, v...)
+}
+
+func (s *syncLogger) DebugBlock(prefix, format string, v ...interface{}) {
+	s.get().DebugBlock(prefix, format, v...)
+}
+
+func (s *syncLogger) InfoBlock(prefix, format string, v ...interface{}) {
+	s.get().InfoBlock(prefix, format, v...)
+}
@@ -0,0 +1,314 @@
+/*
+Copyright 2021 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rdt
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultMBSamplingInterval is the default sampling interval of MBSampler
+	DefaultMBSamplingInterval = 5 * time.Second
+
+	mbmTotalBytes = "mbm_total_bytes"
+	mbmLocalBytes = "mbm_local_bytes"
+)
+
+// MBSamplerOptions contains the settings of an MBSampler
+type MBSamplerOptions struct {
+	// Interval is the sampling interval. Defaults to
+	// DefaultMBSamplingInterval.
+	Interval time.Duration
+
+	// CounterWidth is the width of the MBM counters in bits. A decreasing
+	// counter value is interpreted as a wraparound if the width is less
+	// than 64. With 64-bit counters, which the kernel provides by
+	// accumulating the hardware counters, a decrease is interpreted as a
+	// counter reset and the sample is ignored. Defaults to 64.
+	CounterWidth uint
+}
+
+// MBRate contains the memory bandwidth rates of one cache domain, in bytes
+// per second
+type MBRate struct {
+	Total float64 `json:"total"`
+	Local float64 `json:"local"`
+}
+
+// MBGroupRates contains the memory bandwidth rates of one group
+type MBGroupRates struct {
+	// Class is the name of the class (control group)
+	Class string `json:"class"`
+	// MonGroup is the name of the monitoring group, empty for the class
+	// itself
+	MonGroup string `json:"monGroup,omitempty"`
+	// Rates contains the rates per cache id
+	Rates map[uint64]MBRate `json:"rates"`
+
+	annotations map[string]string
+}
+
+// MBSampler periodically samples the memory bandwidth monitoring (MBM)
+// counters of all classes and monitoring groups and computes bandwidth
+// rates from them
+type MBSampler struct {
+	mutex sync.Mutex
+
+	interval     time.Duration
+	counterWidth uint
+	classes      func() []CtrlGroup
+	monFeatures  func() map[MonResource][]string
+	samples      map[mbGroupKey]mbSample
+	rates        map[mbGroupKey]MBGroupRates
+	stop         chan struct{}
+	done         chan struct{}
+}
+
+type mbGroupKey struct {
+	class    string
+	monGroup string
+}
+
+// mbSample is one sample of the MBM counters of one group
+type mbSample struct {
+	timestamp time.Time
+	data      MonL3Data
+}
+
+// NewMBSampler creates a new memory bandwidth sampler for the classes of the
+// default Control instance
+func NewMBSampler(opts MBSamplerOptions) *MBSampler {
+	return newMBSampler(opts, GetClasses, GetMonFeatures)
+}
+
+// NewMBSampler creates a new memory bandwidth sampler for the classes of the
+// Control
+func (c *Control) NewMBSampler(opts MBSamplerOptions) *MBSampler {
+	return newMBSampler(opts, c.GetClasses, c.GetMonFeatures)
+}
+
+func newMBSampler(opts MBSamplerOptions, classes func() []CtrlGroup, monFeatures func() map[MonResource][]string) *MBSampler {
+	s := &MBSampler{
+		interval:     opts.Interval,
+		counterWidth: opts.CounterWidth,
+		classes:      classes,
+		monFeatures:  monFeatures,
+		samples:      make(map[mbGroupKey]mbSample),
+		rates:        make(map[mbGroupKey]MBGroupRates),
+	}
+	if s.interval <= 0 {
+		s.interval = DefaultMBSamplingInterval
+	}
+	if s.counterWidth == 0 || s.counterWidth > 64 {
+		s.counterWidth = 64
+	}
+	return s
+}
+
+// Start starts periodic sampling in the background
+func (s *MBSampler) Start() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.stop != nil {
+		return
+	}
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+
+	go func(stop, done chan struct{}) {
+		defer close(done)
+
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+
+		s.sample(time.Now())
+		for {
+			select {
+			case <-stop:
+				return
+			case now := <-ticker.C:
+				s.sample(now)
+			}
+		}
+	}(s.stop, s.done)
+}
+
+// Stop stops periodic sampling
+func (s *MBSampler) Stop() {
+	s.mutex.Lock()
+	stop, done := s.stop, s.done
+	s.stop, s.done = nil, nil
+	s.mutex.Unlock()
+
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+}
+
+// GetRates returns the latest rates of all groups, sorted by class and
+// monitoring group name
+func (s *MBSampler) GetRates() []MBGroupRates {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	ret := make([]MBGroupRates, 0, len(s.rates))
+	for _, r := range s.rates {
+		ret = append(ret, r.copy())
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Class != ret[j].Class {
+			return ret[i].Class < ret[j].Class
+		}
+		return ret[i].MonGroup < ret[j].MonGroup
+	})
+	return ret
+}
+
+// GetGroupRates returns the latest rates of one group. Use an empty
+// monGroup for getting the rates of the class itself.
+func (s *MBSampler) GetGroupRates(class, monGroup string) (map[uint64]MBRate, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	r, ok := s.rates[mbGroupKey{class: class, monGroup: monGroup}]
+	if !ok {
+		return nil, false
+	}
+	return r.copy().Rates, true
+}
+
+// features returns the MBM features supported by the system
+func (s *MBSampler) features() []string {
+	ret := []string{}
+	for _, f := range s.monFeatures()[MonResourceL3] {
+		if f == mbmTotalBytes || f == mbmLocalBytes {
+			ret = append(ret, f)
+		}
+	}
+	return ret
+}
+
+// sample reads the MBM counters of all groups and updates the rates
+func (s *MBSampler) sample(now time.Time) {
+	type groupData struct {
+		data        MonData
+		annotations map[string]string
+	}
+
+	// Read the counters before taking the lock, not blocking readers of
+	// the rates during file I/O
+	groups := make(map[mbGroupKey]groupData)
+	for _, cls := range s.classes() {
+		groups[mbGroupKey{class: cls.Name()}] = groupData{data: cls.GetMonData()}
+
+		for _, mg := range cls.GetMonGroups() {
+			key := mbGroupKey{class: cls.Name(), monGroup: mg.Name()}
+			groups[key] = groupData{data: mg.GetMonData(), annotations: mg.GetAnnotations()}
+		}
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for key, g := range groups {
+		s.sampleGroup(now, key, g.data, g.annotations)
+	}
+
+	// Forget groups that have disappeared
+	for key := range s.samples {
+		if _, ok := groups[key]; !ok {
+			delete(s.samples, key)
+			delete(s.rates, key)
+		}
+	}
+}
+
+// sampleGroup updates the rates of one group, caller must hold the mutex
+func (s *MBSampler) sampleGroup(now time.Time, key mbGroupKey, data MonData, annotations map[string]string) {
+	prev, ok := s.samples[key]
+	s.samples[key] = mbSample{timestamp: now, data: data.L3}
+	if !ok {
+		return
+	}
+
+	seconds := now.Sub(prev.timestamp).Seconds()
+	if seconds <= 0 {
+		return
+	}
+
+	rates := MBGroupRates{
+		Class:       key.class,
+		MonGroup:    key.monGroup,
+		Rates:       make(map[uint64]MBRate, len(data.L3)),
+		annotations: annotations,
+	}
+	for id, cur := range data.L3 {
+		old, ok := prev.data[id]
+		if !ok {
+			continue
+		}
+		rate := MBRate{}
+		valid := false
+		if d, ok := s.counterDelta(old, cur, mbmTotalBytes); ok {
+			rate.Total = float64(d) / seconds
+			valid = true
+		}
+		if d, ok := s.counterDelta(old, cur, mbmLocalBytes); ok {
+			rate.Local = float64(d) / seconds
+			valid = true
+		}
+		if valid {
+			rates.Rates[id] = rate
+		}
+	}
+	s.rates[key] = rates
+}
+
+// counterDelta calculates the increase of one MBM counter between two
+// samples, taking counter wraparound into account
+func (s *MBSampler) counterDelta(prev, cur MonLeafData, feature string) (uint64, bool) {
+	p, ok := prev[feature]
+	if !ok {
+		return 0, false
+	}
+	c, ok := cur[feature]
+	if !ok {
+		return 0, false
+	}
+
+	if s.counterWidth >= 64 {
+		if c < p {
+			// Counter reset, e.g. the group was re-created
+			return 0, false
+		}
+		return c - p, true
+	}
+	return (c - p) & (uint64(1)<<s.counterWidth - 1), true
+}
+
+func (r MBGroupRates) copy() MBGroupRates {
+	ret := r
+	ret.Rates = make(map[uint64]MBRate, len(r.Rates))
+	for id, rate := range r.Rates {
+		ret.Rates[id] = rate
+	}
+	return ret
+}
@@ -0,0 +1,382 @@
+/*
+Copyright 2021 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rdt
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// DefaultMountPoint is the conventional mount point of the resctrl
+// filesystem
+const DefaultMountPoint = "/sys/fs/resctrl"
+
+var (
+	// procFilesystemsPath lists the filesystems supported by the kernel
+	procFilesystemsPath = "/proc/filesystems"
+	// cpuInfoPath contains the feature flags of the CPUs
+	cpuInfoPath = "/proc/cpuinfo"
+
+	// mountFunc and unmountFunc are replaced in tests
+	mountFunc   = syscall.Mount
+	unmountFunc = syscall.Unmount
+)
+
+// MountOptions contains the options of the resctrl filesystem
+type MountOptions struct {
+	// CDP enables L3 code and data prioritization (cdp)
+	CDP bool `json:"cdp,omitempty"`
+	// CDPL2 enables L2 code and data prioritization (cdpl2)
+	CDPL2 bool `json:"cdpl2,omitempty"`
+	// MBps enables specifying memory bandwidth allocations in MBps
+	// (mba_MBps)
+	MBps bool `json:"mbps,omitempty"`
+	// Debug enables the debug files of the kernel (debug)
+	Debug bool `json:"debug,omitempty"`
+}
+
+// String returns the options in the format of the mount command
+func (o MountOptions) String() string {
+	opts := []string{}
+	for _, opt := range []struct {
+		enabled bool
+		name    string
+	}{{o.CDP, "cdp"}, {o.CDPL2, "cdpl2"}, {o.MBps, "mba_MBps"}, {o.Debug, "debug"}} {
+		if opt.enabled {
+			opts = append(opts, opt.name)
+		}
+	}
+	return strings.Join(opts, ",")
+}
+
+// mountOptionsFromSet converts the options of a mount table entry
+func mountOptionsFromSet(opts map[string]struct{}) MountOptions {
+	has := func(opt string) bool {
+		_, ok := opts[opt]
+		return ok
+	}
+	return MountOptions{CDP: has("cdp"), CDPL2: has("cdpl2"), MBps: has("mba_MBps"), Debug: has("debug")}
+}
+
+// KernelSupport describes the support for resctrl by the kernel and the
+// CPUs
+type KernelSupport struct {
+	// Filesystem is true if the kernel supports the resctrl filesystem
+	Filesystem bool `json:"filesystem"`
+	// CATL3 is true if the CPUs support L3 cache allocation (cat_l3)
+	CATL3 bool `json:"catL3"`
+	// CATL2 is true if the CPUs support L2 cache allocation (cat_l2)
+	CATL2 bool `json:"catL2"`
+	// CDPL3 is true if the CPUs support L3 code and data prioritization
+	// (cdp_l3)
+	CDPL3 bool `json:"cdpL3"`
+	// CDPL2 is true if the CPUs support L2 code and data prioritization
+	// (cdp_l2)
+	CDPL2 bool `json:"cdpL2"`
+	// MBA is true if the CPUs support memory bandwidth allocation (mba)
+	MBA bool `json:"mba"`
+	// CMT is true if the CPUs support L3 cache occupancy monitoring
+	// (cqm_occup_llc)
+	CMT bool `json:"cmt"`
+	// MBMTotal and MBMLocal are true if the CPUs support total and local
+	// memory bandwidth monitoring (cqm_mbm_total, cqm_mbm_local)
+	MBMTotal bool `json:"mbmTotal"`
+	MBMLocal bool `json:"mbmLocal"`
+}
+
+// Supported returns true if resctrl can be mounted and provides at least
+// one allocation or monitoring feature
+func (k KernelSupport) Supported() bool {
+	return k.Filesystem && (k.CATL3 || k.CATL2 || k.MBA || k.CMT || k.MBMTotal || k.MBMLocal)
+}
+
+// check verifies that the kernel and the CPUs support the mount options
+func (k KernelSupport) check(opts MountOptions) error {
+	switch {
+	case !k.Filesystem:
+		return rdtError("resctrl filesystem %w by the kernel", ErrNotSupported)
+	case opts.CDP && !k.CDPL3:
+		return rdtError("L3 code and data prioritization %w by the CPU", ErrNotSupported)
+	case opts.CDPL2 && !k.CDPL2:
+		return rdtError("L2 code and data prioritization %w by the CPU", ErrNotSupported)
+	case opts.MBps && !(k.MBA && k.MBMLocal):
+		// The kernel controls bandwidth with local bandwidth monitoring
+		return rdtError("memory bandwidth allocation in MBps %w by the CPU", ErrNotSupported)
+	}
+	return nil
+}
+
+// GetKernelSupport detects the support for resctrl from /proc/filesystems
+// and the CPU flags in /proc/cpuinfo
+func GetKernelSupport() (KernelSupport, error) {
+	k := KernelSupport{}
+
+	f, err := os.Open(procFilesystemsPath)
+	if err != nil {
+		return k, rdtError("failed to read supported filesystems: %w", err)
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) > 0 && fields[len(fields)-1] == "resctrl" {
+			k.Filesystem = true
+		}
+	}
+	if err := s.Err(); err != nil {
+		return k, rdtError("failed to read supported filesystems: %w", err)
+	}
+
+	flags, err := getCPUFlags()
+	if err != nil {
+		return k, err
+	}
+	for flag, v := range map[string]*bool{
+		"cat_l3":        &k.CATL3,
+		"cat_l2":        &k.CATL2,
+		"cdp_l3":        &k.CDPL3,
+		"cdp_l2":        &k.CDPL2,
+		"mba":           &k.MBA,
+		"cqm_occup_llc": &k.CMT,
+		"cqm_mbm_total": &k.MBMTotal,
+		"cqm_mbm_local": &k.MBMLocal,
+	} {
+		_, *v = flags[flag]
+	}
+
+	return k, nil
+}
+
+// getCPUFlags returns the feature flags of the first CPU in cpuinfo
+func getCPUFlags() (map[string]struct{}, error) {
+	f, err := os.Open(cpuInfoPath)
+	if err != nil {
+		return nil, rdtError("failed to read cpuinfo: %w", err)
+	}
+	defer f.Close()
+
+	flags := map[string]struct{}{}
+	s := bufio.NewScanner(f)
+	s.Buffer(make([]byte, 64*1024), 1024*1024)
+	for s.Scan() {
+		split := strings.SplitN(s.Text(), ":", 2)
+		if len(split) == 2 && strings.TrimSpace(split[0]) == "flags" {
+			for _, flag := range strings.Fields(split[1]) {
+				flags[flag] = struct{}{}
+			}
+			break
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, rdtError("failed to read cpuinfo: %w", err)
+	}
+	return flags, nil
+}
+
+// MountInfo describes a mounted resctrl filesystem
+type MountInfo struct {
+	// Path is the mount point
+	Path string `json:"path"`
+	// Options contains the mount options
+	Options MountOptions `json:"options"`
+}
+
+// GetMount returns the mounted resctrl filesystem, nil if resctrl is not
+// mounted
+func GetMount() (*MountInfo, error) {
+	return getMount(defaultMountInfoPath)
+}
+
+func getMount(mountInfoPath string) (*MountInfo, error) {
+	m, err := findResctrlMount(mountInfoPath)
+	if errors.Is(err, ErrNotSupported) {
+		return nil, nil
+	} else if err != nil {
+		return nil, rdtError("failed to read mount table: %w", err)
+	}
+	return &MountInfo{Path: m.mountPoint, Options: mountOptionsFromSet(m.options)}, nil
+}
+
+// Mount mounts the resctrl filesystem at the given path, DefaultMountPoint if
+// empty, with the given options. Does nothing if resctrl is already mounted
+// with the same options.
+func Mount(path string, opts MountOptions) error {
+	if path == "" {
+		path = DefaultMountPoint
+	}
+
+	m, err := GetMount()
+	if err != nil {
+		return err
+	}
+	if m != nil {
+		if m.Options != opts {
+			return rdtError("resctrl already mounted at %q with options %q, remount for changing options", m.Path, m.Options)
+		}
+		return nil
+	}
+	return checkAndMount(path, opts)
+}
+
+// mountIfNeeded mounts resctrl at the default mount point if it is not
+// mounted
+func mountIfNeeded(mountInfoPath string, opts MountOptions) error {
+	m, err := getMount(mountInfoPath)
+	if err != nil {
+		return err
+	}
+	if m != nil {
+		if m.Options != opts {
+			log.Warn("resctrl mounted at %q with options %q instead of %q", m.Path, m.Options, opts)
+		}
+		return nil
+	}
+	return checkAndMount(DefaultMountPoint, opts)
+}
+
+// checkAndMount mounts resctrl if supported by the system
+func checkAndMount(path string, opts MountOptions) error {
+	k, err := GetKernelSupport()
+	if err != nil {
+		return err
+	}
+	if err := k.check(opts); err != nil {
+		return err
+	}
+	return mount(path, opts)
+}
+
+func mount(path string, opts MountOptions) error {
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return rdtError("failed to create mount point: %w", err)
+	}
+	log.Info("mounting resctrl at %q with options %q", path, opts)
+	if err := mountFunc("resctrl", path, "resctrl", 0, opts.String()); err != nil {
+		return rdtError("failed to mount resctrl at %q: %w", path, err)
+	}
+	return nil
+}
+
+// Remount re-mounts the resctrl filesystem with new options, e.g. for
+// toggling code and data prioritization or the MBps mode. The kernel only
+// applies the options when mounting, so resctrl is unmounted and mounted
+// again. This is only done if there are no resctrl groups other than the
+// root group as all groups are lost, and fails with EBUSY if resctrl is in
+// use. Control instances must be re-created after a remount. The resctrl
+// filesystem is locked exclusively while checking for groups, lockTimeout
+// limits the time to wait for the lock, 0 waits indefinitely.
+func Remount(opts MountOptions, lockTimeout time.Duration) error {
+	m, err := GetMount()
+	if err != nil {
+		return err
+	} else if m == nil {
+		return rdtError("resctrl %w: not mounted", ErrNotSupported)
+	}
+	if m.Options == opts {
+		return nil
+	}
+
+	k, err := GetKernelSupport()
+	if err != nil {
+		return err
+	}
+	if err := k.check(opts); err != nil {
+		return err
+	}
+	if err := checkedUnmount(m.Path, lockTimeout, true, false, "remount"); err != nil {
+		return err
+	}
+	if err := mount(m.Path, opts); err != nil {
+		// Try to restore the original mount
+		if restoreErr := mount(m.Path, m.Options); restoreErr != nil {
+			log.Error("failed to restore resctrl mount: %v", restoreErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// Unmount unmounts the resctrl filesystem, removing all resctrl groups. If
+// force is false, resctrl is only unmounted if there are no resctrl groups
+// other than the root group, and the unmount fails with EBUSY if resctrl is
+// in use. If force is true, a busy resctrl is detached lazily and destroyed
+// once no longer in use. Control instances become unusable. The resctrl
+// filesystem is locked exclusively while checking for groups, lockTimeout
+// limits the time to wait for the lock, 0 waits indefinitely.
+func Unmount(force bool, lockTimeout time.Duration) error {
+	m, err := GetMount()
+	if err != nil || m == nil {
+		return err
+	}
+	return checkedUnmount(m.Path, lockTimeout, !force, force, "unmount")
+}
+
+// checkedUnmount unmounts resctrl after checking for groups under the
+// exclusive lock. The lock keeps the root directory open, so it is released
+// before unmounting. Other processes taking the lock in between keep resctrl
+// busy and make the unmount fail with EBUSY unless detaching is allowed.
+func checkedUnmount(path string, lockTimeout time.Duration, checkGroups, detach bool, op string) error {
+	l := &fsLock{path: path, timeout: lockTimeout}
+	if err := l.lock(true); err != nil {
+		return err
+	}
+	if checkGroups {
+		if err := checkNoGroups(path); err != nil {
+			l.unlock()
+			return rdtError("refusing to %s resctrl: %w", op, err)
+		}
+	}
+	l.unlock()
+
+	return unmount(path, detach)
+}
+
+func unmount(path string, detach bool) error {
+	log.Info("unmounting resctrl at %q", path)
+	err := unmountFunc(path, 0)
+	if errors.Is(err, syscall.EBUSY) && detach {
+		log.Warn("resctrl at %q is busy, detaching it", path)
+		err = unmountFunc(path, syscall.MNT_DETACH)
+	}
+	if err != nil {
+		return rdtError("failed to unmount resctrl at %q: %w", path, err)
+	}
+	return nil
+}
+
+// checkNoGroups verifies that there are no control or monitoring groups other
+// than the root group
+func checkNoGroups(path string) error {
+	groups, err := resctrlGroupsFromFs("", path)
+	if err != nil {
+		return err
+	}
+	monGroups, err := resctrlGroupsFromFs("", filepath.Join(path, "mon_groups"))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if n := len(groups) + len(monGroups); n > 0 {
+		return rdtError("%d resctrl groups exist: %w", n, ErrGroupsExist)
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+/*
+Copyright 2021 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rdt
+
+import (
+	"bufio"
+	"os"
+	"strings"
+)
+
+// mountEntry is one entry of the mount table
+type mountEntry struct {
+	// root is the directory of the filesystem mounted, "/" unless the entry
+	// is a bind mount of a subdirectory
+	root       string
+	mountPoint string
+	fsType     string
+	source     string
+	// options contains both the per-mount and the superblock options
+	options map[string]struct{}
+}
+
+// parseMountTable parses a mount table in the format of
+// /proc/self/mountinfo. The format of /proc/mounts is also accepted.
+func parseMountTable(path string) ([]mountEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries := []mountEntry{}
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if e, ok := parseMountInfoLine(s.Text()); ok {
+			entries = append(entries, e)
+		}
+	}
+	return entries, s.Err()
+}
+
+// parseMountInfoLine parses one line of a mount table. A mountinfo line
+// looks like
+//
+//	36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+//
+// with a variable number of optional fields before the separator, and a
+// /proc/mounts line like
+//
+//	/dev/root /mnt2 ext3 rw,noatime 0 0
+func parseMountInfoLine(line string) (mountEntry, bool) {
+	fields := strings.Split(line, " ")
+
+	sep := -1
+	for i := 6; i < len(fields); i++ {
+		if fields[i] == "-" {
+			sep = i
+			break
+		}
+	}
+
+	var e mountEntry
+	var opts []string
+	switch {
+	case sep >= 0 && len(fields) >= sep+4:
+		e = mountEntry{
+			root:       unescapeMountField(fields[3]),
+			mountPoint: unescapeMountField(fields[4]),
+			fsType:     fields[sep+1],
+			source:     unescapeMountField(fields[sep+2]),
+		}
+		opts = append(strings.Split(fields[5], ","), strings.Split(fields[sep+3], ",")...)
+	case sep < 0 && len(fields) >= 4:
+		e = mountEntry{
+			root:       "/",
+			mountPoint: unescapeMountField(fields[1]),
+			fsType:     fields[2],
+			source:     unescapeMountField(fields[0]),
+		}
+		opts = strings.Split(fields[3], ",")
+	default:
+		return e, false
+	}
+
+	e.options = make(map[string]struct{}, len(opts))
+	for _, opt := range opts {
+		e.options[opt] = struct{}{}
+	}
+	return e, true
+}
+
+// unescapeMountField decodes the octal escapes, e.g. "\040" for a space,
+// that the kernel uses for whitespace and backslashes in the mount table
+func unescapeMountField(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) && isOctal(s[i+1]) && isOctal(s[i+2]) && isOctal(s[i+3]) {
+			b.WriteByte((s[i+1]-'0')<<6 | (s[i+2]-'0')<<3 | (s[i+3] - '0'))
+			i += 3
+			continue
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+func isOctal(c byte) bool {
+	return c >= '0' && c <= '7'
+}
+
+// findResctrlMount returns the mount of the resctrl filesystem. Resctrl has
+// only one instance so all full mounts are equivalent and the first one is
+// used. Bind mounts of subdirectories, e.g. of a single group inside a
+// container, cannot be used as the resctrl root and are skipped.
+func findResctrlMount(mountInfoPath string) (mountEntry, error) {
+	entries, err := parseMountTable(mountInfoPath)
+	if err != nil {
+		return mountEntry{}, err
+	}
+
+	partial := ""
+	for _, e := range entries {
+		if e.fsType != "resctrl" {
+			continue
+		}
+		if e.root == "/" {
+			return e, nil
+		}
+		if partial == "" {
+			partial = e.mountPoint
+		}
+	}
+	if partial != "" {
+		return mountEntry{}, rdtError("resctrl not found in %s, %q is a bind mount of a resctrl subdirectory: %w", mountInfoPath, partial, ErrNotSupported)
+	}
+	return mountEntry{}, rdtError("resctrl not found in %s: %w", mountInfoPath, ErrNotSupported)
+}
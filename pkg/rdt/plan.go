@@ -0,0 +1,141 @@
+/*
+Copyright 2021 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rdt
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Plan describes the changes that SetConfig would make on the resctrl
+// filesystem. Groups are identified by their class names.
+type Plan struct {
+	// Create lists the resctrl groups that would be created
+	Create []string `json:"create"`
+	// Delete lists the existing resctrl groups that would be removed
+	Delete []string `json:"delete"`
+	// Blocking lists the groups to be removed that still have tasks
+	// assigned. These prevent the change unless it is forced.
+	Blocking []string `json:"blocking"`
+	// Schemata contains the exact schemata that would be written, per class
+	Schemata map[string]string `json:"schemata"`
+	// Cpus contains the cpus that would be assigned, per class. Classes whose
+	// cpus are not managed by the configuration are not listed.
+	Cpus map[string]string `json:"cpus,omitempty"`
+	// PseudoLocked lists the classes with a pseudo-locked region. These are
+	// left untouched and are not listed in Schemata or Cpus.
+	PseudoLocked []string `json:"pseudoLocked,omitempty"`
+	// Warnings lists adjustments made to the requested configuration
+	Warnings []string `json:"warnings"`
+}
+
+// PlanConfig resolves a configuration and reports what applying it would do,
+// using the default Control instance
+func PlanConfig(c *Config) (*Plan, error) {
+	if r := getRdt(); r != nil {
+		return r.PlanConfig(c)
+	}
+	return nil, rdtError("%w", ErrNotInitialized)
+}
+
+// PlanConfig resolves a configuration and reports what applying it would do,
+// without touching the resctrl filesystem
+func (c *Control) PlanConfig(newConfig *Config) (*Plan, error) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	unlock, err := c.lockResctrl(false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	locks, err := c.pseudoLocks()
+	if err != nil {
+		return nil, err
+	}
+
+	conf, err := (*newConfig).resolve(c.info, locks)
+	if err != nil {
+		return nil, &ConfigError{Err: err}
+	}
+	if err := c.checkIDBudget(conf); err != nil {
+		return nil, err
+	}
+
+	plan := &Plan{
+		Create:   []string{},
+		Delete:   []string{},
+		Blocking: []string{},
+		Schemata: make(map[string]string, len(conf.Classes)),
+		Cpus:     make(map[string]string),
+		Warnings: append([]string{}, conf.warnings...),
+	}
+
+	groups, err := resctrlGroupsFromFs(c.resctrlGroupPrefix, c.info.resctrlPath)
+	if err != nil {
+		return nil, rdtError("failed to read resctrl groups: %w", err)
+	}
+	existing := make(map[string]struct{}, len(groups)+1)
+	existing[RootClassName] = struct{}{}
+	for _, g := range groups {
+		name := g[len(c.resctrlGroupPrefix):]
+		existing[name] = struct{}{}
+
+		if _, ok := conf.Classes[name]; ok {
+			continue
+		}
+		plan.Delete = append(plan.Delete, name)
+
+		data, err := c.readRdtFile(filepath.Join(g, "tasks"))
+		if err != nil {
+			return nil, rdtError("failed to get resctrl group tasks: %w", err)
+		}
+		if len(strings.TrimSpace(string(data))) > 0 {
+			plan.Blocking = append(plan.Blocking, name)
+		}
+	}
+
+	for name, class := range conf.Classes {
+		if _, ok := existing[name]; !ok {
+			plan.Create = append(plan.Create, name)
+		}
+		if _, ok := conf.pseudoLocked[name]; ok {
+			plan.PseudoLocked = append(plan.PseudoLocked, name)
+			continue
+		}
+
+		schemata, warnings, err := classSchemata(c.info, name, class, conf.Partitions[class.Partition], conf.Options)
+		if err != nil {
+			return nil, err
+		}
+		plan.Schemata[name] = schemata
+		if class.Cpus != nil {
+			plan.Cpus[name] = class.Cpus.String()
+		}
+		plan.Warnings = append(plan.Warnings, warnings...)
+	}
+
+	sort.Strings(plan.Create)
+	sort.Strings(plan.Delete)
+	sort.Strings(plan.Blocking)
+	sort.Strings(plan.PseudoLocked)
+	sort.Strings(plan.Warnings)
+
+	return plan, nil
+}
@@ -0,0 +1,248 @@
+/*
+Copyright 2021 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rdt
+
+// HardwareProfile describes the RDT capabilities of a system. It can be
+// captured from a live system with DiscoverHardwareProfile() and used for
+// validating configurations offline with ValidateConfig().
+type HardwareProfile struct {
+	// NumClosids is the number of CLOSIDs, i.e. resctrl groups, available
+	NumClosids uint64 `json:"numClosids"`
+	// L2 describes L2 cache allocation, nil if not supported
+	L2 *CacheProfile `json:"l2,omitempty"`
+	// L3 describes L3 cache allocation, nil if not supported
+	L3 *CacheProfile `json:"l3,omitempty"`
+	// MB describes memory bandwidth allocation, nil if not supported
+	MB *MBProfile `json:"mb,omitempty"`
+	// L3Mon describes L3 monitoring, nil if not supported
+	L3Mon *L3MonProfile `json:"l3Mon,omitempty"`
+}
+
+// CacheProfile describes the cache allocation capabilities of one cache level
+type CacheProfile struct {
+	// NumClosids is the number of CLOSIDs supported by the cache level,
+	// defaults to the NumClosids of the hardware profile
+	NumClosids uint64   `json:"numClosids,omitempty"`
+	CacheIds   []uint64 `json:"cacheIds"`
+	// CacheSizes contains the sizes of the cache instances in bytes per
+	// cache id, if known
+	CacheSizes    map[uint64]uint64 `json:"cacheSizes,omitempty"`
+	CbmMask       Bitmask           `json:"cbmMask"`
+	MinCbmBits    uint64            `json:"minCbmBits"`
+	ShareableBits Bitmask           `json:"shareableBits,omitempty"`
+	// HardwareBits contains the ways used by hardware per cache id, as
+	// reported by bit usage. With CDP the ways of code and data are combined.
+	HardwareBits map[uint64]Bitmask `json:"hardwareBits,omitempty"`
+	// CDP is true if code and data prioritization is enabled
+	CDP bool `json:"cdp,omitempty"`
+}
+
+// MBProfile describes the memory bandwidth allocation capabilities
+type MBProfile struct {
+	// NumClosids is the number of CLOSIDs supported by memory bandwidth
+	// allocation, defaults to the NumClosids of the hardware profile
+	NumClosids    uint64   `json:"numClosids,omitempty"`
+	CacheIds      []uint64 `json:"cacheIds"`
+	BandwidthGran uint64   `json:"bandwidthGran"`
+	DelayLinear   uint64   `json:"delayLinear"`
+	MinBandwidth  uint64   `json:"minBandwidth"`
+	// MBpsEnabled is true if the resctrl filesystem is mounted with the
+	// mba_MBps option
+	MBpsEnabled bool `json:"mbaMBps,omitempty"`
+}
+
+// L3MonProfile describes the L3 monitoring capabilities
+type L3MonProfile struct {
+	NumRmids    uint64   `json:"numRmids"`
+	MonFeatures []string `json:"monFeatures"`
+}
+
+// DiscoverHardwareProfile captures the hardware profile of the running system
+// from the resctrl filesystem
+func DiscoverHardwareProfile() (HardwareProfile, error) {
+	info, err := getRdtInfo(defaultMountInfoPath)
+	if err != nil {
+		return HardwareProfile{}, err
+	}
+	return info.hardwareProfile(), nil
+}
+
+// ValidateConfig checks that a configuration can be applied on a system
+// described by the given hardware profile. The configuration is fully
+// resolved, including the schemata of every class.
+func ValidateConfig(c *Config, hw HardwareProfile) error {
+	info := hw.resctrlInfo()
+
+	conf, err := (*c).resolve(info, nil)
+	if err != nil {
+		return &ConfigError{Err: err}
+	}
+
+	for name, class := range conf.Classes {
+		if _, _, err := classSchemata(info, name, class, conf.Partitions[class.Partition], conf.Options); err != nil {
+			return err
+		}
+	}
+
+	numGroups := uint64(len(conf.Classes))
+	if _, ok := conf.Classes[RootClassName]; !ok {
+		numGroups++
+	}
+	if hw.NumClosids != 0 && numGroups > hw.NumClosids {
+		return rdtError("configuration requires %d resctrl groups but only %d CLOSIDs are available: %w", numGroups, hw.NumClosids, ErrClosidsExhausted)
+	}
+
+	return nil
+}
+
+// hardwareProfile converts resctrlInfo into a hardware profile
+func (i *resctrlInfo) hardwareProfile() HardwareProfile {
+	hw := HardwareProfile{NumClosids: i.numClosids}
+
+	for _, lvl := range []cacheLevel{cacheLevelL2, cacheLevelL3} {
+		cat, ok := i.cat[lvl]
+		if !ok {
+			continue
+		}
+		ci := cat.getInfo()
+		p := &CacheProfile{
+			NumClosids:    ci.numClosids,
+			CacheIds:      append([]uint64{}, cat.cacheIds...),
+			CacheSizes:    copySizes(cat.cacheSizes),
+			CbmMask:       ci.cbmMask,
+			MinCbmBits:    ci.minCbmBits,
+			ShareableBits: ci.shareableBits,
+			HardwareBits:  cat.mergedHardwareBits(),
+			CDP:           !cat.unified.Supported(),
+		}
+		if lvl == cacheLevelL2 {
+			hw.L2 = p
+		} else {
+			hw.L3 = p
+		}
+	}
+
+	if i.mb.Supported() {
+		hw.MB = &MBProfile{
+			NumClosids:    i.mb.numClosids,
+			CacheIds:      append([]uint64{}, i.mb.cacheIds...),
+			BandwidthGran: i.mb.bandwidthGran,
+			DelayLinear:   i.mb.delayLinear,
+			MinBandwidth:  i.mb.minBandwidth,
+			MBpsEnabled:   i.mb.mbpsEnabled,
+		}
+	}
+
+	if i.l3mon.Supported() {
+		hw.L3Mon = &L3MonProfile{
+			NumRmids:    i.l3mon.numRmids,
+			MonFeatures: append([]string{}, i.l3mon.monFeatures...),
+		}
+	}
+
+	return hw
+}
+
+// mergedHardwareBits returns the ways used by hardware per cache id with the
+// code and data ways of CDP combined, as the profile has only one set of them
+func (cat catInfoAll) mergedHardwareBits() map[uint64]Bitmask {
+	var bits map[uint64]Bitmask
+	for _, ci := range []catInfo{cat.unified, cat.code, cat.data} {
+		for id, b := range ci.hardwareBits {
+			if bits == nil {
+				bits = make(map[uint64]Bitmask, len(ci.hardwareBits))
+			}
+			bits[id] |= b
+		}
+	}
+	return bits
+}
+
+// resctrlInfo converts a hardware profile into resctrlInfo usable in
+// configuration resolution
+func (hw HardwareProfile) resctrlInfo() *resctrlInfo {
+	info := &resctrlInfo{
+		numClosids: hw.NumClosids,
+		cat:        make(map[cacheLevel]catInfoAll, 2),
+	}
+
+	for lvl, p := range map[cacheLevel]*CacheProfile{cacheLevelL2: hw.L2, cacheLevelL3: hw.L3} {
+		if p == nil {
+			continue
+		}
+		ci := catInfo{numClosids: hw.numClosids(p.NumClosids), cbmMask: p.CbmMask, minCbmBits: p.MinCbmBits, shareableBits: p.ShareableBits, hardwareBits: copyBitmasks(p.HardwareBits)}
+		cat := catInfoAll{cacheIds: append([]uint64{}, p.CacheIds...), cacheSizes: copySizes(p.CacheSizes)}
+		if p.CDP {
+			cat.code = ci
+			cat.data = ci
+		} else {
+			cat.unified = ci
+		}
+		info.cat[lvl] = cat
+	}
+
+	if hw.MB != nil {
+		info.mb = mbInfo{
+			numClosids:    hw.numClosids(hw.MB.NumClosids),
+			cacheIds:      append([]uint64{}, hw.MB.CacheIds...),
+			bandwidthGran: hw.MB.BandwidthGran,
+			delayLinear:   hw.MB.DelayLinear,
+			minBandwidth:  hw.MB.MinBandwidth,
+			mbpsEnabled:   hw.MB.MBpsEnabled,
+		}
+	}
+
+	if hw.L3Mon != nil {
+		info.l3mon = l3MonInfo{
+			numRmids:    hw.L3Mon.NumRmids,
+			monFeatures: append([]string{}, hw.L3Mon.MonFeatures...),
+		}
+	}
+
+	return info
+}
+
+// numClosids returns the number of CLOSIDs of one resource, defaulting to the
+// system-wide value
+func (hw HardwareProfile) numClosids(n uint64) uint64 {
+	if n == 0 {
+		return hw.NumClosids
+	}
+	return n
+}
+
+func copyBitmasks(m map[uint64]Bitmask) map[uint64]Bitmask {
+	if m == nil {
+		return nil
+	}
+	ret := make(map[uint64]Bitmask, len(m))
+	for id, b := range m {
+		ret[id] = b
+	}
+	return ret
+}
+
+func copySizes(m map[uint64]uint64) map[uint64]uint64 {
+	if m == nil {
+		return nil
+	}
+	ret := make(map[uint64]uint64, len(m))
+	for id, size := range m {
+		ret[id] = size
+	}
+	return ret
+}
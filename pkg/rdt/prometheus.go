@@ -25,8 +25,14 @@ import (
 
 var customLabels []string = []string{}
 
+// customLabelsMutex protects customLabels
+var customLabelsMutex sync.RWMutex
+
 // collector implements prometheus.Collector interface
 type collector struct {
+	// mutex protects descriptors which are lazily populated from concurrent
+	// per-group collection goroutines
+	mutex       sync.Mutex
 	descriptors map[string]*prometheus.Desc
 }
 
@@ -39,6 +45,9 @@ func NewCollector() (prometheus.Collector, error) {
 // RegisterCustomPrometheusLabels registers monitor group annotations to be
 // exported as Prometheus metrics labels
 func RegisterCustomPrometheusLabels(names ...string) {
+	customLabelsMutex.Lock()
+	defer customLabelsMutex.Unlock()
+
 Names:
 	for _, n := range names {
 		for _, c := range customLabels {
@@ -63,7 +72,7 @@ func (c *collector) Describe(ch chan<- *prometheus.Desc) {
 }
 
 // Collect method of the prometheus.Collector interface
-func (c collector) Collect(ch chan<- prometheus.Metric) {
+func (c *collector) Collect(ch chan<- prometheus.Metric) {
 	var wg sync.WaitGroup
 
 	for _, cls := range GetClasses() {
@@ -80,6 +89,9 @@ func (c collector) Collect(ch chan<- prometheus.Metric) {
 }
 
 func (c *collector) describeL3(feature string) *prometheus.Desc {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
 	d, ok := c.descriptors[feature]
 	if !ok {
 		name := "l3_" + feature
@@ -93,7 +105,7 @@ func (c *collector) describeL3(feature string) *prometheus.Desc {
 		case "mbm_total_bytes":
 			help = "total bytes transferred to/from memory through LLC"
 		}
-		labels := append([]string{"rdt_class", "rdt_mon_group", "cache_id"}, customLabels...)
+		labels := append([]string{"rdt_class", "rdt_mon_group", "cache_id"}, getCustomLabels()...)
 		d = prometheus.NewDesc(name, help, labels, nil)
 		c.descriptors[feature] = d
 	}
@@ -104,8 +116,9 @@ func (c *collector) collectGroupMetrics(ch chan<- prometheus.Metric, mg MonGroup
 	allData := mg.GetMonData()
 
 	annotations := mg.GetAnnotations()
-	customLabelValues := make([]string, len(customLabels))
-	for i, name := range customLabels {
+	labelNames := getCustomLabels()
+	customLabelValues := make([]string, len(labelNames))
+	for i, name := range labelNames {
 		customLabelValues[i] = annotations[name]
 	}
 
@@ -122,3 +135,77 @@ func (c *collector) collectGroupMetrics(ch chan<- prometheus.Metric, mg MonGroup
 		}
 	}
 }
+
+func getCustomLabels() []string {
+	customLabelsMutex.RLock()
+	defer customLabelsMutex.RUnlock()
+
+	return customLabels
+}
+
+// mbRateCollector implements prometheus.Collector interface for memory
+// bandwidth rates
+type mbRateCollector struct {
+	sampler *MBSampler
+}
+
+// NewMBRateCollector creates new Prometheus collector exporting the memory
+// bandwidth rates measured by an MBSampler as gauges. Only the MBM features
+// supported by the system are exported.
+func NewMBRateCollector(s *MBSampler) prometheus.Collector {
+	return &mbRateCollector{sampler: s}
+}
+
+// Describe method of the prometheus.Collector interface
+func (c *mbRateCollector) Describe(ch chan<- *prometheus.Desc) {
+	labelNames := getCustomLabels()
+	for _, feature := range c.sampler.features() {
+		ch <- describeMBRate(feature, labelNames)
+	}
+}
+
+// Collect method of the prometheus.Collector interface
+func (c *mbRateCollector) Collect(ch chan<- prometheus.Metric) {
+	features := c.sampler.features()
+	if len(features) == 0 {
+		return
+	}
+
+	// Descriptors are created on every collection as the custom labels
+	// may have changed since the previous one
+	labelNames := getCustomLabels()
+	descriptors := make(map[string]*prometheus.Desc, len(features))
+	for _, feature := range features {
+		descriptors[feature] = describeMBRate(feature, labelNames)
+	}
+
+	for _, r := range c.sampler.GetRates() {
+		customLabelValues := make([]string, len(labelNames))
+		for i, name := range labelNames {
+			customLabelValues[i] = r.annotations[name]
+		}
+
+		for cacheID, rate := range r.Rates {
+			labels := append([]string{r.Class, r.MonGroup, fmt.Sprint(cacheID)}, customLabelValues...)
+			values := map[string]float64{mbmTotalBytes: rate.Total, mbmLocalBytes: rate.Local}
+			for feature, d := range descriptors {
+				ch <- prometheus.MustNewConstMetric(
+					d,
+					prometheus.GaugeValue,
+					values[feature],
+					labels...,
+				)
+			}
+		}
+	}
+}
+
+func describeMBRate(feature string, labelNames []string) *prometheus.Desc {
+	name := "l3_" + feature + "_per_second"
+	help := "total memory bandwidth through LLC, in bytes per second"
+	if feature == mbmLocalBytes {
+		help = "local memory bandwidth through LLC, in bytes per second"
+	}
+	labels := append([]string{"rdt_class", "rdt_mon_group", "cache_id"}, labelNames...)
+	return prometheus.NewDesc(name, help, labels, nil)
+}
@@ -0,0 +1,275 @@
+/*
+Copyright 2021 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rdt
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// pseudoLockDevDir is the directory where the kernel creates the character
+// devices of pseudo-locked regions
+const pseudoLockDevDir = "/dev/pseudo_lock"
+
+// PseudoLockedRegion describes a cache region pseudo-locked by a class
+type PseudoLockedRegion struct {
+	// Cache is the cache level of the region, "L2" or "L3"
+	Cache string `json:"cache"`
+	// CacheID is the id of the cache instance holding the region
+	CacheID uint64 `json:"cacheId"`
+	// Bitmask contains the cache ways of the region
+	Bitmask Bitmask `json:"bitmask"`
+	// Size is the size of the region in bytes
+	Size uint64 `json:"size"`
+	// DevicePath is the path of the character device that applications use
+	// to map the region into their address space
+	DevicePath string `json:"devicePath"`
+}
+
+// pseudoLocks contains the pseudo-locked regions of classes
+type pseudoLocks map[string]*PseudoLockedRegion
+
+// reserved returns the cache ways of one cache id used by pseudo-locked
+// regions
+func (l pseudoLocks) reserved(lvl cacheLevel, id uint64) Bitmask {
+	mask := Bitmask(0)
+	for _, r := range l {
+		if r.Cache == string(lvl) && r.CacheID == id {
+			mask |= r.Bitmask
+		}
+	}
+	return mask
+}
+
+// pseudoLocks returns the pseudo-locked regions of all classes
+func (c *Control) pseudoLocks() (pseudoLocks, error) {
+	locks := pseudoLocks{}
+	for name, cls := range c.classes {
+		r, err := cls.GetPseudoLockedRegion()
+		if err != nil {
+			return nil, err
+		}
+		if r != nil {
+			locks[name] = r
+		}
+	}
+	return locks, nil
+}
+
+// PseudoLock creates a pseudo-locked region from the current allocation of a
+// class on one L2 or L3 cache instance. The class must not have any tasks,
+// cpus or monitoring groups and its allocation must not overlap with any
+// other class. Once locked, the class is dedicated to the region and its
+// allocations are not changed by SetConfig. Not supported with code and data
+// prioritization (CDP).
+func PseudoLock(class, cache string, cacheID uint64) (*PseudoLockedRegion, error) {
+	if r := getRdt(); r != nil {
+		return r.PseudoLock(class, cache, cacheID)
+	}
+	return nil, rdtError("%w", ErrNotInitialized)
+}
+
+// RemovePseudoLock tears down the pseudo-locked region of a class
+func RemovePseudoLock(class string) error {
+	if r := getRdt(); r != nil {
+		return r.RemovePseudoLock(class)
+	}
+	return rdtError("%w", ErrNotInitialized)
+}
+
+// PseudoLock creates a pseudo-locked region from the current allocation of a
+// class on one L2 or L3 cache instance, see PseudoLock()
+func (c *Control) PseudoLock(class, cache string, cacheID uint64) (*PseudoLockedRegion, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	cls, ok := c.classes[class]
+	if !ok {
+		return nil, rdtError("class %q not found", class)
+	}
+
+	unlock, err := c.lockResctrl(true)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	return cls.pseudoLock(cache, cacheID)
+}
+
+// pseudoLock pseudo-locks the allocation of the group, caller must hold
+// c.ctrl.mutex and the lock of the resctrl filesystem
+func (c *ctrlGroup) pseudoLock(cache string, cacheID uint64) (*PseudoLockedRegion, error) {
+	lvl := cacheLevel(cache)
+	cat, ok := c.ctrl.info.cat[lvl]
+	switch {
+	case c.name == RootClassName:
+		return nil, rdtError("cannot pseudo-lock the root class")
+	case !ok:
+		return nil, rdtError("%s cache allocation %w by system", cache, ErrNotSupported)
+	case !cat.unified.Supported():
+		return nil, rdtError("pseudo-locking %w with %s code and data prioritization enabled", ErrNotSupported, cache)
+	}
+
+	if err := c.checkPseudoLockable(); err != nil {
+		return nil, rdtError("cannot pseudo-lock %q: %w", c.name, err)
+	}
+
+	// Lock the current allocation of the class
+	data, err := c.ctrl.readRdtFile(c.relPath("schemata"))
+	if err != nil {
+		return nil, rdtError("failed to read schemata of %q: %w", c.name, err)
+	}
+	mask, ok := parseSchemata(string(data), 16)[cache][cacheID]
+	if !ok {
+		return nil, rdtError("no %s allocation for cache id %d in the schemata of %q", cache, cacheID, c.name)
+	}
+
+	c.ctrl.logger().Debug("pseudo-locking %s cache id %d ways %#x of %q", cache, cacheID, mask, c.relPath(""))
+	if err := c.setMode(GroupModePseudoLockSetup); err != nil {
+		return nil, err
+	}
+	schemata := cache + ":" + strconv.FormatUint(cacheID, 10) + "=" + strconv.FormatUint(mask, 16) + "\n"
+	if err := c.ctrl.writeRdtFile(c.relPath("schemata"), []byte(schemata)); err != nil {
+		if exitErr := c.setMode(GroupModeShareable); exitErr != nil {
+			c.ctrl.logger().Warn("failed to exit pseudo-lock setup of %q: %v", c.name, exitErr)
+		}
+		return nil, rdtError("failed to pseudo-lock %s cache of %q: %w", cache, c.name, err)
+	}
+
+	r, err := c.GetPseudoLockedRegion()
+	if err == nil && r == nil {
+		err = rdtError("pseudo-locked region of %q not found", c.name)
+	}
+	return r, err
+}
+
+// checkPseudoLockable verifies that the group has no tasks, cpus or
+// monitoring groups. The kernel refuses the pseudo-lock setup otherwise,
+// without telling which one is the problem.
+func (c *ctrlGroup) checkPseudoLockable() error {
+	notEmpty := func(format string, args ...interface{}) error {
+		err := fmt.Errorf(format+": %w", append(args, ErrGroupNotEmpty)...)
+		return &GroupError{Group: c.relPath(""), Op: "pseudo-lock", Err: err}
+	}
+
+	pids, err := c.GetPids()
+	if err != nil {
+		return rdtError("failed to read tasks of %q: %w", c.name, err)
+	}
+	if len(pids) > 0 {
+		return notEmpty("%d tasks assigned", len(pids))
+	}
+
+	cpus, err := c.GetCpus()
+	if err != nil {
+		return err
+	}
+	if cpus.Size() > 0 {
+		return notEmpty("cpus %s assigned", cpus)
+	}
+
+	monGroups, err := resctrlGroupsFromFs("", c.path("mon_groups"))
+	if err != nil && !os.IsNotExist(err) {
+		return rdtError("failed to read monitoring groups of %q: %w", c.name, err)
+	}
+	if len(monGroups) > 0 {
+		return notEmpty("%d monitoring groups exist", len(monGroups))
+	}
+	return nil
+}
+
+func (c *ctrlGroup) GetPseudoLockedRegion() (*PseudoLockedRegion, error) {
+	mode, err := c.GetMode()
+	if err != nil || mode != GroupModePseudoLocked {
+		return nil, err
+	}
+
+	r := &PseudoLockedRegion{DevicePath: filepath.Join(pseudoLockDevDir, c.prefix+c.name)}
+
+	// Both schemata and size only contain the locked region
+	data, err := c.ctrl.readRdtFile(c.relPath("schemata"))
+	if err != nil {
+		return nil, rdtError("failed to read schemata of %q: %w", c.name, err)
+	}
+	for cache, domains := range parseSchemata(string(data), 16) {
+		for id, mask := range domains {
+			r.Cache, r.CacheID, r.Bitmask = cache, id, Bitmask(mask)
+		}
+	}
+
+	data, err = c.ctrl.readRdtFile(c.relPath("size"))
+	if err != nil {
+		return nil, rdtError("failed to read size of %q: %w", c.name, err)
+	}
+	r.Size = parseSchemata(string(data), 10)[r.Cache][r.CacheID]
+
+	return r, nil
+}
+
+// RemovePseudoLock tears down the pseudo-locked region of a class. The kernel
+// only supports this by removing the resctrl group so the group is re-created
+// and configured according to the active configuration.
+func (c *Control) RemovePseudoLock(class string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	cls, ok := c.classes[class]
+	if !ok {
+		return rdtError("class %q not found", class)
+	}
+
+	unlock, err := c.lockResctrl(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return cls.removePseudoLock()
+}
+
+// removePseudoLock re-creates the pseudo-locked group, caller must hold
+// c.ctrl.mutex and the lock of the resctrl filesystem
+func (c *ctrlGroup) removePseudoLock() error {
+	if r, err := c.GetPseudoLockedRegion(); err != nil {
+		return err
+	} else if r == nil {
+		return rdtError("class %q does not have a pseudo-locked region", c.name)
+	}
+
+	c.ctrl.logger().Debug("removing pseudo-locked region of %q", c.relPath(""))
+	if err := c.ctrl.fs.Rmdir(c.path("")); err != nil && !os.IsNotExist(err) {
+		return rdtError("failed to remove resctrl group %q: %w", c.relPath(""), newGroupError("rmdir", c.relPath(""), "", "", err))
+	}
+	if err := c.ctrl.fs.Mkdir(c.path("")); err != nil {
+		return rdtError("failed to re-create resctrl group %q: %w", c.relPath(""), c.ctrl.cmdError("mkdir", c.relPath(""), "", err))
+	}
+
+	class, ok := c.ctrl.conf.Classes[c.name]
+	if !ok {
+		return nil
+	}
+	if err := c.configure(c.name, class, c.ctrl.conf.Partitions[class.Partition], c.ctrl.conf.Options); err != nil {
+		return err
+	}
+	if class.Mode == GroupModeExclusive {
+		return c.setMode(class.Mode)
+	}
+	return nil
+}
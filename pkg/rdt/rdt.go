@@ -17,6 +17,7 @@ limitations under the License.
 package rdt
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -26,7 +27,9 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/intel/goresctrl/pkg/utils"
 )
@@ -37,20 +40,92 @@ const (
 	RootClassName = "SYSTEM_DEFAULT"
 )
 
-type control struct {
-	Logger
+// Control is the interface for managing RDT classes, i.e. resctrl groups, of
+// one resctrl filesystem.
+//
+// Control, and the CtrlGroup and MonGroup instances it hands out, are safe for
+// concurrent use. The locking model is as follows:
+//   - Control.mutex protects the set of classes and the active configuration.
+//     Reconfiguration (SetConfig, DiscoverClasses) holds it exclusively for
+//     its whole duration, queries take it shared.
+//   - ctrlGroup.mutex protects the set of monitoring groups of one class.
+//   - Control.logMutex protects the logger only and is never held while
+//     acquiring other locks.
+//   - The lock of the resctrl filesystem is reentrant per goroutine only.
+//     Sequences of modifications take it exclusively up front.
+//   - Locks are always acquired in the order Control.mutex -> resctrl lock ->
+//     ctrlGroup.mutex. Methods of ctrlGroup never take Control.mutex,
+//     operations that need both, like pseudo-locking, are methods of Control.
+//   - The discovered resctrlInfo, the names and paths of groups and the
+//     annotations of monitoring groups are immutable after creation and need
+//     no locking. Concurrent reads and writes of individual resctrl files are
+//     serialized by the kernel.
+type Control struct {
+	mutex    sync.RWMutex
+	logMutex sync.RWMutex
+	log      Logger
+	info     *resctrlInfo
+	fs       FileSystem
 
 	resctrlGroupPrefix string
 	conf               config
 	rawConf            Config
 	classes            map[string]*ctrlGroup
+	state              *stateFile
+	lock               *fsLock
+	readOnly           bool
 }
 
-var log Logger = NewLoggerWrapper(stdlog.New(os.Stderr, "[ rdt ] ", 0))
+// ControlOptions contains the settings for creating a new Control instance
+type ControlOptions struct {
+	// ResctrlGroupPrefix is the prefix used in the names of the resctrl
+	// groups managed by the Control
+	ResctrlGroupPrefix string
+
+	// Logger is the logger used by the Control. The package-wide logger is
+	// used if not specified.
+	Logger Logger
+
+	// MountInfoPath is the mount table used for detecting the resctrl
+	// filesystem. Defaults to /proc/self/mountinfo, the format of
+	// /proc/mounts is also accepted.
+	MountInfoPath string
+
+	// Mount, if set, makes the Control mount the resctrl filesystem at
+	// DefaultMountPoint with the given options if it is not mounted
+	Mount *MountOptions
+
+	// FileSystem is used for modifying the resctrl filesystem. Defaults to
+	// direct access.
+	FileSystem FileSystem
+
+	// StateFile is the file where the annotations of monitoring groups are
+	// stored so that they are restored when the Control is re-created, e.g.
+	// after a restart of the process. The file should be on a tmpfs, like
+	// /run, as resctrl groups do not survive a reboot. The annotations are
+	// not persisted if not specified.
+	StateFile string
+
+	// LockTimeout is the maximum time to wait for the lock of the resctrl
+	// filesystem. Modifications of the resctrl filesystem, and sequences of
+	// reads that need a consistent view, are serialized with other processes
+	// by an flock on the resctrl root directory, as documented by the
+	// kernel. Waits indefinitely if zero.
+	LockTimeout time.Duration
+
+	// ReadOnly makes the Control only take a shared lock of the resctrl
+	// filesystem and refuse all modifications with ErrReadOnly. Empty
+	// monitoring groups are not pruned in read-only mode.
+	ReadOnly bool
+}
+
+var log = &syncLogger{logger: NewLoggerWrapper(stdlog.New(os.Stderr, "[ rdt ] ", 0))}
 
-var info *resctrlInfo
+// rdt is the default Control instance used by the package-level functions
+var rdt *Control
 
-var rdt *control
+// rdtMutex protects the default Control instance pointer
+var rdtMutex sync.RWMutex
 
 // Function for removing resctrl groups from the filesystem. This is
 // configurable because of unit tests.
@@ -74,6 +149,21 @@ type CtrlGroup interface {
 
 	// GetMonGroups returns all monitoring groups under the class
 	GetMonGroups() []MonGroup
+
+	// GetSchemata returns the current schemata of the class
+	GetSchemata() (string, error)
+
+	// GetMode returns the current mode of the class
+	GetMode() (GroupMode, error)
+
+	// Size returns the sizes of the cache allocations of the class in bytes,
+	// per cache resource (e.g. "L3" or "L3CODE") and cache id
+	Size() (map[string]map[uint64]uint64, error)
+
+	// GetPseudoLockedRegion returns the pseudo-locked region of the class, or
+	// nil if the class is not pseudo-locked. Regions are created and removed
+	// with Control.PseudoLock() and Control.RemovePseudoLock().
+	GetPseudoLockedRegion() (*PseudoLockedRegion, error)
 }
 
 // ResctrlGroup is the generic interface for resctrl CTRL and MON groups
@@ -87,6 +177,16 @@ type ResctrlGroup interface {
 	// AddPids assigns the given process ids to the group
 	AddPids(pids ...string) error
 
+	// GetCpus returns the CPUs assigned to the group
+	GetCpus() (CPUSet, error)
+
+	// SetCpus assigns the given CPUs to the group. Tasks running on these
+	// CPUs that are not assigned to any other group use the allocations of
+	// this group. CPUs of a class are taken away from other classes and
+	// CPUs removed from a class are given back to the root class. CPUs of a
+	// monitoring group must be a subset of the CPUs of its class.
+	SetCpus(cpus CPUSet) error
+
 	// GetMonData retrieves the monitoring data of the group
 	GetMonData() MonData
 }
@@ -121,9 +221,29 @@ const (
 	MonResourceL3 MonResource = "l3"
 )
 
+// GroupMode is the mode of a resctrl group, controlling the sharing of its
+// cache allocations with other groups
+type GroupMode string
+
+const (
+	// GroupModeShareable allows cache allocations to overlap with other
+	// groups. This is the default.
+	GroupModeShareable GroupMode = "shareable"
+	// GroupModeExclusive guarantees that the cache allocations of the group
+	// are not shared with any other group
+	GroupModeExclusive GroupMode = "exclusive"
+	// GroupModePseudoLockSetup is the transient mode of a group whose cache
+	// allocation is about to be pseudo-locked
+	GroupModePseudoLockSetup GroupMode = "pseudo-locksetup"
+	// GroupModePseudoLocked is the mode of a group with a pseudo-locked
+	// region
+	GroupModePseudoLocked GroupMode = "pseudo-locked"
+)
+
 type ctrlGroup struct {
 	resctrlGroup
 
+	mutex     sync.RWMutex
 	monPrefix string
 	monGroups map[string]*monGroup
 }
@@ -135,6 +255,7 @@ type monGroup struct {
 }
 
 type resctrlGroup struct {
+	ctrl   *Control
 	prefix string
 	name   string
 	parent *ctrlGroup // parent for MON groups
@@ -143,38 +264,32 @@ type resctrlGroup struct {
 // SetLogger sets the logger instance to be used by the package. This function
 // may be called even before Initialize().
 func SetLogger(l Logger) {
-	log = l
-	if rdt != nil {
-		rdt.setLogger(l)
+	log.set(l)
+	if r := getRdt(); r != nil {
+		r.SetLogger(l)
 	}
 }
 
-// Initialize discovers RDT support and initializes the  rdtControl singleton interface
+// Initialize discovers RDT support and initializes the default Control
+// instance used by the package-level functions
 func Initialize(resctrlGroupPrefix string) error {
-	var err error
+	return InitializeWithOptions(ControlOptions{ResctrlGroupPrefix: resctrlGroupPrefix})
+}
+
+// InitializeWithOptions initializes the default Control instance used by the
+// package-level functions with the given options
+func InitializeWithOptions(opts ControlOptions) error {
+	rdtMutex.Lock()
+	defer rdtMutex.Unlock()
 
-	info = nil
 	rdt = nil
 
-	// Get info from the resctrl filesystem
-	info, err = getRdtInfo()
+	c, err := NewControl(opts)
 	if err != nil {
 		return err
 	}
 
-	r := &control{Logger: log, resctrlGroupPrefix: resctrlGroupPrefix}
-
-	// NOTE: we lose monitoring group annotations (i.e. prometheus metrics
-	// labels) on re-init
-	if r.classes, err = r.classesFromResctrlFs(); err != nil {
-		return rdtError("failed to initialize classes from resctrl fs", err)
-	}
-
-	if err := r.pruneMonGroups(); err != nil {
-		return err
-	}
-
-	rdt = r
+	rdt = c
 
 	return nil
 }
@@ -183,59 +298,159 @@ func Initialize(resctrlGroupPrefix string) error {
 // Makes it possible to discover gropus with another prefix than was set with
 // Initialize(). The original prefix is still used for monitoring groups.
 func DiscoverClasses(resctrlGroupPrefix string) error {
-	if rdt != nil {
-		return rdt.discoverFromResctrl(resctrlGroupPrefix)
+	if r := getRdt(); r != nil {
+		return r.DiscoverClasses(resctrlGroupPrefix)
 	}
-	return rdtError("rdt not initialized")
+	return rdtError("%w", ErrNotInitialized)
 }
 
 // SetConfig parses new configuration and reconfigures the resctrl filesystem
 // accordingly
 func SetConfig(c *Config, force bool) error {
-	if rdt != nil {
-		return rdt.setConfig(c, force)
+	if r := getRdt(); r != nil {
+		return r.SetConfig(c, force)
 	}
-	return rdtError("rdt not initialized")
+	return rdtError("%w", ErrNotInitialized)
 }
 
 // GetClass returns one RDT class
 func GetClass(name string) (CtrlGroup, bool) {
-	if rdt != nil {
-		return rdt.getClass(name)
+	if r := getRdt(); r != nil {
+		return r.GetClass(name)
 	}
 	return nil, false
 }
 
 // GetClasses returns all available RDT classes
 func GetClasses() []CtrlGroup {
-	if rdt != nil {
-		return rdt.getClasses()
+	if r := getRdt(); r != nil {
+		return r.GetClasses()
 	}
 	return []CtrlGroup{}
 }
 
 // MonSupported returns true if RDT monitoring features are available
 func MonSupported() bool {
-	if rdt != nil {
-		return rdt.monSupported()
+	if r := getRdt(); r != nil {
+		return r.MonSupported()
 	}
 	return false
 }
 
 // GetMonFeatures returns the available monitoring stats of each available monitoring technology
 func GetMonFeatures() map[MonResource][]string {
-	if rdt != nil {
-		return rdt.getMonFeatures()
+	if r := getRdt(); r != nil {
+		return r.GetMonFeatures()
 	}
 	return map[MonResource][]string{}
 }
 
-func (c *control) getClass(name string) (CtrlGroup, bool) {
+// GetInfo returns a description of the RDT resources of the system
+func GetInfo() (Info, error) {
+	if r := getRdt(); r != nil {
+		return r.GetInfo(), nil
+	}
+	return Info{}, rdtError("%w", ErrNotInitialized)
+}
+
+// GetBitUsage returns the current usage of the ways of one cache resource,
+// e.g. "L3", "L3CODE" or "L2", per cache id
+func GetBitUsage(resource string) (map[uint64]BitUsage, error) {
+	if r := getRdt(); r != nil {
+		return r.GetBitUsage(resource)
+	}
+	return nil, rdtError("%w", ErrNotInitialized)
+}
+
+// getRdt returns the default Control instance
+func getRdt() *Control {
+	rdtMutex.RLock()
+	defer rdtMutex.RUnlock()
+	return rdt
+}
+
+// NewControl discovers RDT support from the resctrl filesystem and creates a
+// new Control instance for managing it. Existing resctrl groups matching the
+// configured prefix are taken under the control of the new instance.
+func NewControl(opts ControlOptions) (*Control, error) {
+	var err error
+
+	c := &Control{log: opts.Logger, fs: opts.FileSystem, resctrlGroupPrefix: opts.ResctrlGroupPrefix}
+	if c.log == nil {
+		c.log = log.get()
+	}
+	if c.fs == nil {
+		c.fs = osFileSystem{}
+	}
+
+	mountInfoPath := opts.MountInfoPath
+	if mountInfoPath == "" {
+		mountInfoPath = defaultMountInfoPath
+	}
+
+	if opts.Mount != nil {
+		if err := mountIfNeeded(mountInfoPath, *opts.Mount); err != nil {
+			return nil, err
+		}
+	}
+
+	// Get info from the resctrl filesystem
+	c.info, err = getRdtInfo(mountInfoPath)
+	if err != nil {
+		return nil, err
+	}
+	c.logger().Info("detected resctrl filesystem at %q", c.info.resctrlPath)
+
+	c.lock = &fsLock{path: c.info.resctrlPath, timeout: opts.LockTimeout}
+	c.readOnly = opts.ReadOnly
+	c.fs = &lockingFileSystem{fs: c.fs, lock: c.lock, readOnly: opts.ReadOnly}
+
+	// Empty monitoring groups are pruned
+	unlock, err := c.lockResctrl(true)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	// Monitoring group annotations are restored from the state file when the
+	// existing groups are discovered
+	if opts.StateFile != "" {
+		if c.state, err = loadStateFile(opts.StateFile); err != nil {
+			c.logger().Warn("discarding monitoring group annotations: %v", err)
+		}
+	}
+
+	if c.classes, err = c.classesFromResctrlFs(); err != nil {
+		return nil, rdtError("failed to initialize classes from resctrl fs: %w", err)
+	}
+
+	if err := c.pruneMonGroups(); err != nil {
+		return nil, err
+	}
+
+	if !c.readOnly {
+		if err := c.state.retain(c.monGroupPaths()); err != nil {
+			c.logger().Warn("failed to update state file: %v", err)
+		}
+	}
+
+	return c, nil
+}
+
+// GetClass returns one RDT class
+func (c *Control) GetClass(name string) (CtrlGroup, bool) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
 	cls, ok := c.classes[name]
 	return cls, ok
 }
 
-func (c *control) getClasses() []CtrlGroup {
+// GetClasses returns all available RDT classes
+func (c *Control) GetClasses() []CtrlGroup {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
 	ret := make([]CtrlGroup, 0, len(c.classes))
 
 	for _, v := range c.classes {
@@ -246,46 +461,128 @@ func (c *control) getClasses() []CtrlGroup {
 	return ret
 }
 
-func (c *control) monSupported() bool {
-	return info.l3mon.Supported()
+// MonSupported returns true if RDT monitoring features are available
+func (c *Control) MonSupported() bool {
+	return c.info.l3mon.Supported()
 }
 
-func (c *control) getMonFeatures() map[MonResource][]string {
+// GetMonFeatures returns the available monitoring stats of each available monitoring technology
+func (c *Control) GetMonFeatures() map[MonResource][]string {
 	ret := make(map[MonResource][]string)
-	if info.l3mon.Supported() {
-		ret[MonResourceL3] = append([]string{}, info.l3mon.monFeatures...)
+	if c.info.l3mon.Supported() {
+		ret[MonResourceL3] = append([]string{}, c.info.l3mon.monFeatures...)
 	}
 
 	return ret
 }
 
-func (c *control) setLogger(l Logger) {
-	c.Logger = l
+// GetInfo returns a description of the RDT resources of the system
+func (c *Control) GetInfo() Info {
+	return c.info.export()
+}
+
+// GetBitUsage returns the current usage of the ways of one cache resource,
+// e.g. "L3", "L3CODE" or "L2", per cache id
+func (c *Control) GetBitUsage(resource string) (map[uint64]BitUsage, error) {
+	found := false
+	for lvl := range c.info.cat {
+		for _, typ := range c.info.catSchemaTypes(lvl) {
+			found = found || resource == string(lvl)+typ.ToResctrlStr()
+		}
+	}
+	if !found {
+		return nil, rdtError("cache resource %q %w by system", resource, ErrNotSupported)
+	}
+
+	data, err := c.readRdtFile(filepath.Join("info", resource, "bit_usage"))
+	if err != nil {
+		return nil, rdtError("failed to read %s bit usage: %w", resource, err)
+	}
+	usage, err := parseBitUsage(string(data))
+	if err != nil {
+		return nil, rdtError("failed to parse %s bit usage: %w", resource, err)
+	}
+	return usage, nil
+}
+
+// SetLogger sets the logger instance to be used by the Control
+func (c *Control) SetLogger(l Logger) {
+	c.logMutex.Lock()
+	defer c.logMutex.Unlock()
+
+	c.log = l
 }
 
-func (c *control) setConfig(newConfig *Config, force bool) error {
-	c.Info("configuration update")
+func (c *Control) logger() Logger {
+	c.logMutex.RLock()
+	defer c.logMutex.RUnlock()
+
+	return c.log
+}
+
+// SetConfig parses new configuration and reconfigures the resctrl filesystem
+// accordingly
+func (c *Control) SetConfig(newConfig *Config, force bool) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.logger().Info("configuration update")
 
-	conf, err := (*newConfig).resolve()
+	if c.readOnly {
+		return rdtError("cannot set configuration: %w", ErrReadOnly)
+	}
+	unlock, err := c.lockResctrl(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	locks, err := c.pseudoLocks()
 	if err != nil {
-		return rdtError("invalid configuration: %v", err)
+		return err
 	}
 
-	err = c.configureResctrl(conf, force)
+	conf, err := (*newConfig).resolve(c.info, locks)
 	if err != nil {
-		return rdtError("resctrl configuration failed: %v", err)
+		return &ConfigError{Err: err}
+	}
+
+	if err := c.checkIDBudget(conf); err != nil {
+		return err
+	}
+
+	snapshot := c.newResctrlSnapshot()
+	if err := c.configureResctrl(conf, force, snapshot); err != nil {
+		if rbErr := snapshot.rollback(); rbErr != nil {
+			return rdtError("resctrl configuration failed: %w (rollback failed: %v)", err, rbErr)
+		}
+		return rdtError("resctrl configuration failed: %w (rolled back: %s)", err, snapshot)
 	}
 
 	c.conf = conf
 	// TODO: we'd better create a deep copy
 	c.rawConf = *newConfig
-	c.Info("configuration finished")
+	c.logger().Info("configuration finished")
 
 	return nil
 }
 
-func (c *control) configureResctrl(conf config, force bool) error {
-	c.DebugBlock("", "applying resolved config: |\n%s", utils.DumpJSON(conf))
+// configureResctrl applies a resolved configuration on the resctrl filesystem.
+// All changes are recorded in snapshot so that they can be reverted if the
+// configuration fails.
+func (c *Control) configureResctrl(conf config, force bool, snapshot *resctrlSnapshot) error {
+	c.logger().DebugBlock("", "applying resolved config: |\n%s", utils.DumpJSON(conf))
+
+	// Writing the cpus of a class takes the CPUs away from other groups,
+	// managed or not, so the cpus of all groups are saved
+	for _, class := range conf.Classes {
+		if class.Cpus != nil {
+			if err := snapshot.saveAllCpus(); err != nil {
+				return err
+			}
+			break
+		}
+	}
 
 	// Remove stale resctrl groups
 	classesFromFs, err := c.classesFromResctrlFs()
@@ -298,16 +595,23 @@ func (c *control) configureResctrl(conf config, force bool) error {
 			if !force {
 				tasks, err := cls.GetPids()
 				if err != nil {
-					return rdtError("failed to get resctrl group tasks: %v", err)
+					return rdtError("failed to get resctrl group tasks: %w", err)
 				}
 				if len(tasks) > 0 {
-					return rdtError("refusing to remove non-empty resctrl group %q", cls.relPath(""))
+					return rdtError("refusing to remove non-empty resctrl group %q: %w", cls.relPath(""),
+						newGroupError("rmdir", cls.relPath(""), "", "", ErrGroupNotEmpty))
 				}
 			}
-			log.Debug("removing existing resctrl group %q", cls.relPath(""))
-			err = groupRemoveFunc(cls.path(""))
+			if err := snapshot.groupRemoved(name, cls); err != nil {
+				return err
+			}
+			c.logger().Debug("removing existing resctrl group %q", cls.relPath(""))
+			err = c.fs.Rmdir(cls.path(""))
 			if err != nil {
-				return rdtError("failed to remove resctrl group %q: %v", cls.relPath(""), err)
+				return rdtError("failed to remove resctrl group %q: %w", cls.relPath(""), newGroupError("rmdir", cls.relPath(""), "", "", err))
+			}
+			if err := c.state.remove(cls.relPath("")); err != nil {
+				c.logger().Warn("failed to drop annotations of resctrl group %q: %v", cls.relPath(""), err)
 			}
 
 			delete(c.classes, name)
@@ -317,32 +621,75 @@ func (c *control) configureResctrl(conf config, force bool) error {
 	for name, cls := range c.classes {
 		if _, ok := conf.Classes[cls.name]; !ok || cls.prefix != c.resctrlGroupPrefix {
 			if cls.name != RootClassName {
-				log.Debug("dropping stale class %q (%q)", name, cls.path(""))
+				c.logger().Debug("dropping stale class %q (%q)", name, cls.path(""))
 				delete(c.classes, name)
 			}
 		}
 	}
 
 	if _, ok := c.classes[RootClassName]; !ok {
-		log.Warn("root class missing from runtime data, re-adding...")
+		c.logger().Warn("root class missing from runtime data, re-adding...")
 		c.classes[RootClassName] = classesFromFs[RootClassName]
 	}
 
+	// Make existing exclusive groups shareable so that allocations can be
+	// moved freely. Exclusive modes are set after all schemata are written.
+	for name := range conf.Classes {
+		cg, ok := classesFromFs[name]
+		if !ok {
+			continue
+		}
+		mode, err := cg.GetMode()
+		if err != nil {
+			return err
+		}
+		if mode == GroupModeExclusive {
+			snapshot.modeChanged(cg, mode)
+			if err := cg.setMode(GroupModeShareable); err != nil {
+				return err
+			}
+		}
+	}
+
 	// Try to apply given configuration
 	for name, class := range conf.Classes {
+		if _, ok := conf.pseudoLocked[name]; ok {
+			c.logger().Debug("leaving pseudo-locked class %q untouched", name)
+			continue
+		}
 		if _, ok := c.classes[name]; !ok {
-			cg, err := newCtrlGroup(c.resctrlGroupPrefix, c.resctrlGroupPrefix, name)
+			cg, err := c.newCtrlGroup(c.resctrlGroupPrefix, c.resctrlGroupPrefix, name)
 			if err != nil {
 				return err
 			}
 			c.classes[name] = cg
 		}
+		if _, ok := classesFromFs[name]; ok {
+			if err := snapshot.groupModified(c.classes[name]); err != nil {
+				return err
+			}
+		} else {
+			snapshot.groupCreated(c.classes[name])
+		}
 		partition := conf.Partitions[class.Partition]
 		if err := c.classes[name].configure(name, class, partition, conf.Options); err != nil {
 			return err
 		}
 	}
 
+	for name, class := range conf.Classes {
+		if _, ok := conf.pseudoLocked[name]; ok || class.Mode != GroupModeExclusive {
+			continue
+		}
+		cg := c.classes[name]
+		if _, ok := classesFromFs[name]; ok {
+			snapshot.modeChanged(cg, GroupModeShareable)
+		}
+		if err := cg.setMode(GroupModeExclusive); err != nil {
+			return err
+		}
+	}
+
 	if err := c.pruneMonGroups(); err != nil {
 		return err
 	}
@@ -350,8 +697,274 @@ func (c *control) configureResctrl(conf config, force bool) error {
 	return nil
 }
 
-func (c *control) discoverFromResctrl(prefix string) error {
-	c.Debug("running class discovery from resctrl filesystem using prefix %q", prefix)
+// resctrlSnapshot records the original state of the resctrl groups touched
+// during a reconfiguration so that it can be restored if the reconfiguration
+// fails. Monitoring groups of removed resctrl groups are not restored.
+type resctrlSnapshot struct {
+	ctrl     *Control
+	classes  map[string]*ctrlGroup
+	modified []savedGroup
+	created  []*ctrlGroup
+	removed  []savedGroup
+	modes    []savedMode
+	cpus     map[string][]byte
+}
+
+// savedMode is the original mode of a group whose mode was changed
+type savedMode struct {
+	group *ctrlGroup
+	mode  GroupMode
+}
+
+// savedGroup is the original state of one resctrl group
+type savedGroup struct {
+	name     string
+	group    *ctrlGroup
+	schemata []byte
+	cpus     []byte
+	mode     GroupMode
+	tasks    []string
+}
+
+func (c *Control) newResctrlSnapshot() *resctrlSnapshot {
+	s := &resctrlSnapshot{ctrl: c, classes: make(map[string]*ctrlGroup, len(c.classes))}
+	for name, cls := range c.classes {
+		s.classes[name] = cls
+	}
+	return s
+}
+
+// groupModified records the original schemata of a group about to be
+// configured
+func (s *resctrlSnapshot) groupModified(cg *ctrlGroup) error {
+	g := savedGroup{name: cg.name, group: cg}
+
+	var err error
+	if g.schemata, err = s.ctrl.readRdtFile(cg.relPath("schemata")); err != nil {
+		return rdtError("failed to read schemata of %q: %v", cg.relPath(""), err)
+	}
+	s.modified = append(s.modified, g)
+	return nil
+}
+
+// saveAllCpus records the original cpus of all control groups, including the
+// root group and groups not managed by us, keyed by their path relative to
+// the resctrl root
+func (s *resctrlSnapshot) saveAllCpus() error {
+	groups, err := resctrlGroupsFromFs("", s.ctrl.info.resctrlPath)
+	if err != nil {
+		return rdtError("failed to list resctrl groups: %w", err)
+	}
+	s.cpus = make(map[string][]byte, len(groups)+1)
+	for _, g := range append(groups, "") {
+		cpus, err := s.ctrl.readRdtFile(filepath.Join(g, "cpus_list"))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return rdtError("failed to read cpus of %q: %v", g, err)
+		}
+		s.cpus[g] = cpus
+	}
+	return nil
+}
+
+// modeChanged records the original mode of an existing group whose mode is
+// about to be changed
+func (s *resctrlSnapshot) modeChanged(cg *ctrlGroup, mode GroupMode) {
+	s.modes = append(s.modes, savedMode{group: cg, mode: mode})
+}
+
+// groupCreated records a newly created group
+func (s *resctrlSnapshot) groupCreated(cg *ctrlGroup) {
+	s.created = append(s.created, cg)
+}
+
+// groupRemoved records the original state of a group about to be removed
+func (s *resctrlSnapshot) groupRemoved(name string, cg *ctrlGroup) error {
+	data, err := s.ctrl.readRdtFile(cg.relPath("schemata"))
+	if err != nil {
+		return rdtError("failed to read schemata of %q: %v", cg.relPath(""), err)
+	}
+	cpus, err := s.ctrl.readRdtFile(cg.relPath("cpus_list"))
+	if err != nil && !os.IsNotExist(err) {
+		return rdtError("failed to read cpus of %q: %v", cg.relPath(""), err)
+	}
+	mode, err := cg.GetMode()
+	if err != nil {
+		return err
+	}
+	tasks, err := cg.GetPids()
+	if err != nil {
+		return rdtError("failed to get resctrl group tasks: %w", err)
+	}
+	s.removed = append(s.removed, savedGroup{name: name, group: cg, schemata: data, cpus: cpus, mode: mode, tasks: tasks})
+	return nil
+}
+
+// rollback reverts the recorded changes in reverse order: created groups are
+// removed, modified schemata are restored and removed groups re-created.
+// Groups made exclusive are made shareable before restoring any schemata and
+// groups that originally were exclusive are made exclusive again after that.
+// Tasks of removed groups are moved back on a best-effort basis. Saved cpus
+// of all groups are restored after the groups have been re-created.
+func (s *resctrlSnapshot) rollback() error {
+	c := s.ctrl
+	errs := []string{}
+
+	c.logger().Warn("rolling back resctrl configuration")
+
+	for i := len(s.created) - 1; i >= 0; i-- {
+		cg := s.created[i]
+		c.logger().Debug("removing created resctrl group %q", cg.relPath(""))
+		if err := c.fs.Rmdir(cg.path("")); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, fmt.Sprintf("failed to remove resctrl group %q: %v", cg.relPath(""), err))
+		}
+	}
+
+	restoreModes := func(mode GroupMode) {
+		for i := len(s.modes) - 1; i >= 0; i-- {
+			m := s.modes[i]
+			if m.mode != mode {
+				continue
+			}
+			c.logger().Debug("restoring mode of %q", m.group.relPath(""))
+			if err := m.group.setMode(m.mode); err != nil {
+				errs = append(errs, fmt.Sprintf("failed to restore mode of %q: %v", m.group.relPath(""), err))
+			}
+		}
+	}
+	restoreModes(GroupModeShareable)
+
+	for i := len(s.modified) - 1; i >= 0; i-- {
+		g := s.modified[i]
+		c.logger().Debug("restoring schemata of %q", g.group.relPath(""))
+		if err := c.writeRdtFile(g.group.relPath("schemata"), g.schemata); err != nil {
+			errs = append(errs, fmt.Sprintf("failed to restore schemata of %q: %v", g.group.relPath(""), err))
+		}
+	}
+
+	for i := len(s.removed) - 1; i >= 0; i-- {
+		g := s.removed[i]
+		c.logger().Debug("re-creating removed resctrl group %q", g.group.relPath(""))
+		cg, err := c.newCtrlGroup(g.group.prefix, g.group.monPrefix, g.group.name)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("failed to re-create resctrl group %q: %v", g.group.relPath(""), err))
+			continue
+		}
+		if err := c.writeRdtFile(cg.relPath("schemata"), g.schemata); err != nil {
+			errs = append(errs, fmt.Sprintf("failed to restore schemata of %q: %v", cg.relPath(""), err))
+		}
+		if g.mode == GroupModeExclusive {
+			if err := cg.setMode(g.mode); err != nil {
+				errs = append(errs, fmt.Sprintf("failed to restore mode of %q: %v", cg.relPath(""), err))
+			}
+		}
+		if len(strings.TrimSpace(string(g.cpus))) > 0 {
+			if err := c.writeRdtFile(cg.relPath("cpus_list"), g.cpus); err != nil {
+				c.logger().Warn("failed to move cpus back to %q: %v", cg.relPath(""), err)
+			}
+		}
+		if len(g.tasks) > 0 {
+			if err := cg.AddPids(g.tasks...); err != nil {
+				c.logger().Warn("failed to move tasks back to %q: %v", cg.relPath(""), err)
+			}
+		}
+		s.classes[g.name] = cg
+	}
+
+	errs = append(errs, s.restoreCpus()...)
+
+	restoreModes(GroupModeExclusive)
+
+	c.classes = s.classes
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// restoreCpus writes back the saved cpus of all groups whose cpus have
+// changed. CPUs dropped from a group are given to the root group and the
+// kernel does not allow dropping CPUs from the root group, so the root group
+// is restored last.
+func (s *resctrlSnapshot) restoreCpus() []string {
+	c := s.ctrl
+	errs := []string{}
+
+	groups := make([]string, 0, len(s.cpus))
+	for g := range s.cpus {
+		if g != "" {
+			groups = append(groups, g)
+		}
+	}
+	sort.Strings(groups)
+	if _, ok := s.cpus[""]; ok {
+		groups = append(groups, "")
+	}
+
+	for _, g := range groups {
+		path := filepath.Join(g, "cpus_list")
+		cur, err := c.readRdtFile(path)
+		if err == nil && bytes.Equal(bytes.TrimSpace(cur), bytes.TrimSpace(s.cpus[g])) {
+			continue
+		}
+		c.logger().Debug("restoring cpus of %q", g)
+		if err := c.writeRdtFile(path, s.cpus[g]); err != nil {
+			errs = append(errs, fmt.Sprintf("failed to restore cpus of %q: %v", g, err))
+		}
+	}
+	return errs
+}
+
+// String returns a human-readable summary of the recorded changes
+func (s *resctrlSnapshot) String() string {
+	names := func(groups []savedGroup) []string {
+		ret := make([]string, len(groups))
+		for i, g := range groups {
+			ret[i] = strconv.Quote(g.name)
+		}
+		return ret
+	}
+
+	parts := []string{}
+	if len(s.created) > 0 {
+		created := make([]string, len(s.created))
+		for i, cg := range s.created {
+			created[i] = strconv.Quote(cg.name)
+		}
+		parts = append(parts, "removed created classes "+strings.Join(created, ", "))
+	}
+	if len(s.modified) > 0 {
+		parts = append(parts, "restored schemata of classes "+strings.Join(names(s.modified), ", "))
+	}
+	if len(s.removed) > 0 {
+		parts = append(parts, "re-created removed classes "+strings.Join(names(s.removed), ", "))
+	}
+	if len(s.cpus) > 0 {
+		parts = append(parts, "restored cpus of all groups")
+	}
+	if len(parts) == 0 {
+		return "no changes"
+	}
+	return strings.Join(parts, "; ")
+}
+
+// DiscoverClasses discovers existing classes from the resctrl filesystem.
+// Makes it possible to discover gropus with another prefix than was set with
+// NewControl(). The original prefix is still used for monitoring groups.
+func (c *Control) DiscoverClasses(prefix string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.logger().Debug("running class discovery from resctrl filesystem using prefix %q", prefix)
+
+	// Empty monitoring groups are pruned
+	unlock, err := c.lockResctrl(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
 
 	classesFromFs, err := c.classesFromResctrlFsPrefix(prefix)
 	if err != nil {
@@ -362,7 +975,7 @@ func (c *control) discoverFromResctrl(prefix string) error {
 	for name, cls := range c.classes {
 		if _, ok := classesFromFs[cls.name]; !ok || cls.prefix != prefix {
 			if cls.name != RootClassName {
-				log.Debug("dropping stale class %q (%q)", name, cls.path(""))
+				c.logger().Debug("dropping stale class %q (%q)", name, cls.path(""))
 				delete(c.classes, name)
 			}
 		}
@@ -371,7 +984,7 @@ func (c *control) discoverFromResctrl(prefix string) error {
 	for name, cls := range classesFromFs {
 		if _, ok := c.classes[name]; !ok {
 			c.classes[name] = cls
-			log.Debug("adding discovered class %q (%q)", name, cls.path(""))
+			c.logger().Debug("adding discovered class %q (%q)", name, cls.path(""))
 		}
 	}
 
@@ -382,13 +995,13 @@ func (c *control) discoverFromResctrl(prefix string) error {
 	return nil
 }
 
-func (c *control) classesFromResctrlFs() (map[string]*ctrlGroup, error) {
+func (c *Control) classesFromResctrlFs() (map[string]*ctrlGroup, error) {
 	return c.classesFromResctrlFsPrefix(c.resctrlGroupPrefix)
 }
 
-func (c *control) classesFromResctrlFsPrefix(prefix string) (map[string]*ctrlGroup, error) {
+func (c *Control) classesFromResctrlFsPrefix(prefix string) (map[string]*ctrlGroup, error) {
 	names := []string{RootClassName}
-	if g, err := resctrlGroupsFromFs(prefix, info.resctrlPath); err != nil {
+	if g, err := resctrlGroupsFromFs(prefix, c.info.resctrlPath); err != nil {
 		return nil, err
 	} else {
 		for _, n := range g {
@@ -404,7 +1017,7 @@ func (c *control) classesFromResctrlFsPrefix(prefix string) (map[string]*ctrlGro
 
 	classes := make(map[string]*ctrlGroup, len(names)+1)
 	for _, name := range names {
-		g, err := newCtrlGroup(prefix, c.resctrlGroupPrefix, name)
+		g, err := c.newCtrlGroup(prefix, c.resctrlGroupPrefix, name)
 		if err != nil {
 			return nil, err
 		}
@@ -414,93 +1027,161 @@ func (c *control) classesFromResctrlFsPrefix(prefix string) (map[string]*ctrlGro
 	return classes, nil
 }
 
-func (c *control) pruneMonGroups() error {
+func (c *Control) pruneMonGroups() error {
+	if c.readOnly {
+		return nil
+	}
 	for name, cls := range c.classes {
 		if err := cls.pruneMonGroups(); err != nil {
-			return rdtError("failed to prune stale monitoring groups of %q: %v", name, err)
+			return rdtError("failed to prune stale monitoring groups of %q: %w", name, err)
 		}
 	}
 	return nil
 }
 
-func (c *control) readRdtFile(rdtPath string) ([]byte, error) {
-	return ioutil.ReadFile(filepath.Join(info.resctrlPath, rdtPath))
+// monGroupPaths returns the paths of all monitoring groups of all classes
+func (c *Control) monGroupPaths() map[string]struct{} {
+	paths := map[string]struct{}{}
+	for _, cls := range c.classes {
+		cls.mutex.RLock()
+		for _, mg := range cls.monGroups {
+			paths[mg.relPath("")] = struct{}{}
+		}
+		cls.mutex.RUnlock()
+	}
+	return paths
 }
 
-func (c *control) writeRdtFile(rdtPath string, data []byte) error {
-	if err := ioutil.WriteFile(filepath.Join(info.resctrlPath, rdtPath), data, 0644); err != nil {
-		return c.cmdError(err)
+func (c *Control) readRdtFile(rdtPath string) ([]byte, error) {
+	return ioutil.ReadFile(filepath.Join(c.info.resctrlPath, rdtPath))
+}
+
+func (c *Control) writeRdtFile(rdtPath string, data []byte) error {
+	f, err := c.fs.OpenFile(filepath.Join(c.info.resctrlPath, rdtPath))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := f.Write(data); err != nil {
+		group := filepath.Dir(rdtPath)
+		if group == "." {
+			group = ""
+		}
+		return c.cmdError("write", group, filepath.Base(rdtPath), err)
 	}
 	return nil
 }
 
-func (c *control) cmdError(origErr error) error {
-	errData, readErr := c.readRdtFile(filepath.Join("info", "last_cmd_status"))
-	if readErr != nil {
-		return origErr
-	}
-	cmdStatus := strings.TrimSpace(string(errData))
-	if len(cmdStatus) > 0 && cmdStatus != "ok" {
-		return fmt.Errorf("%s", cmdStatus)
+// cmdError converts the error of a failed operation on a resctrl group into
+// a GroupError, adding the status reported by the kernel
+func (c *Control) cmdError(op, group, file string, origErr error) *GroupError {
+	cmdStatus := ""
+	// The kernel has not seen operations refused in read-only mode
+	if errData, err := c.readRdtFile(filepath.Join("info", "last_cmd_status")); err == nil && !errors.Is(origErr, ErrReadOnly) {
+		cmdStatus = strings.TrimSpace(string(errData))
+		if cmdStatus == "ok" {
+			cmdStatus = ""
+		}
 	}
-	return origErr
+	return newGroupError(op, group, file, cmdStatus, origErr)
 }
 
-func newCtrlGroup(prefix, monPrefix, name string) (*ctrlGroup, error) {
+func (c *Control) newCtrlGroup(prefix, monPrefix, name string) (*ctrlGroup, error) {
 	cg := &ctrlGroup{
-		resctrlGroup: resctrlGroup{prefix: prefix, name: name},
+		resctrlGroup: resctrlGroup{ctrl: c, prefix: prefix, name: name},
 		monPrefix:    monPrefix,
 	}
 
-	if err := os.Mkdir(cg.path(""), 0755); err != nil && !os.IsExist(err) {
-		return nil, err
+	if err := c.fs.Mkdir(cg.path("")); err != nil && !os.IsExist(err) {
+		return nil, c.cmdError("mkdir", cg.relPath(""), "", err)
 	}
 
 	var err error
 	cg.monGroups, err = cg.monGroupsFromResctrlFs()
 	if err != nil {
-		return nil, fmt.Errorf("error when retrieving existing monitor groups: %v", err)
+		return nil, fmt.Errorf("error when retrieving existing monitor groups: %w", err)
 	}
 
 	return cg, nil
 }
 
 func (c *ctrlGroup) CreateMonGroup(name string, annotations map[string]string) (MonGroup, error) {
+	unlock, err := c.ctrl.lockResctrl(true)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
 	if mg, ok := c.monGroups[name]; ok {
 		return mg, nil
 	}
 
-	log.Debug("creating monitoring group %s/%s", c.name, name)
+	c.ctrl.logger().Debug("creating monitoring group %s/%s", c.name, name)
 	mg, err := newMonGroup(c.monPrefix, name, c, annotations)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create new monitoring group %q: %v", name, err)
+		return nil, fmt.Errorf("failed to create new monitoring group %q: %w", name, err)
 	}
 
 	c.monGroups[name] = mg
 
+	if err := c.ctrl.state.setAnnotations(mg.relPath(""), mg.annotations); err != nil {
+		c.ctrl.logger().Warn("failed to store annotations of monitoring group %q: %v", mg.relPath(""), err)
+	}
+
 	return mg, err
 }
 
 func (c *ctrlGroup) DeleteMonGroup(name string) error {
+	unlock, err := c.ctrl.lockResctrl(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.deleteMonGroup(name)
+}
+
+// deleteMonGroup deletes a monitoring group, caller must hold c.mutex
+func (c *ctrlGroup) deleteMonGroup(name string) error {
 	mg, ok := c.monGroups[name]
 	if !ok {
-		log.Warn("trying to delete non-existent mon group %s/%s", c.name, name)
+		c.ctrl.logger().Warn("trying to delete non-existent mon group %s/%s", c.name, name)
 		return nil
 	}
 
-	log.Debug("deleting monitoring group %s/%s", c.name, name)
-	if err := groupRemoveFunc(mg.path("")); err != nil {
-		return rdtError("failed to remove monitoring group %q: %v", mg.relPath(""), err)
+	c.ctrl.logger().Debug("deleting monitoring group %s/%s", c.name, name)
+	if err := c.ctrl.fs.Rmdir(mg.path("")); err != nil {
+		return rdtError("failed to remove monitoring group %q: %w", mg.relPath(""), newGroupError("rmdir", mg.relPath(""), "", "", err))
 	}
 
 	delete(c.monGroups, name)
 
+	if err := c.ctrl.state.remove(mg.relPath("")); err != nil {
+		c.ctrl.logger().Warn("failed to drop annotations of monitoring group %q: %v", mg.relPath(""), err)
+	}
+
 	return nil
 }
 
 func (c *ctrlGroup) DeleteMonGroups() error {
+	unlock, err := c.ctrl.lockResctrl(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
 	for name := range c.monGroups {
-		if err := c.DeleteMonGroup(name); err != nil {
+		if err := c.deleteMonGroup(name); err != nil {
 			return err
 		}
 	}
@@ -508,11 +1189,17 @@ func (c *ctrlGroup) DeleteMonGroups() error {
 }
 
 func (c *ctrlGroup) GetMonGroup(name string) (MonGroup, bool) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
 	mg, ok := c.monGroups[name]
 	return mg, ok
 }
 
 func (c *ctrlGroup) GetMonGroups() []MonGroup {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
 	ret := make([]MonGroup, 0, len(c.monGroups))
 
 	for _, v := range c.monGroups {
@@ -525,53 +1212,162 @@ func (c *ctrlGroup) GetMonGroups() []MonGroup {
 
 func (c *ctrlGroup) configure(name string, class classConfig,
 	partition partitionConfig, options Options) error {
-	schemata := ""
+	schemata, warnings, err := classSchemata(c.ctrl.info, name, class, partition, options)
+	if err != nil {
+		return err
+	}
+	for _, w := range warnings {
+		c.ctrl.logger().Debug("%s", w)
+	}
 
-	// Handle L3 cache allocation
-	switch {
-	case info.l3.Supported():
-		schema, err := class.L3Schema.ToStr(l3SchemaTypeUnified, partition.L3)
-		if err != nil {
-			return err
-		}
-		schemata += schema
-	case info.l3data.Supported() || info.l3code.Supported():
-		schema, err := class.L3Schema.ToStr(l3SchemaTypeCode, partition.L3)
-		if err != nil {
+	if len(schemata) > 0 {
+		c.ctrl.logger().Debug("writing schemata %q to %q", schemata, c.relPath(""))
+		if err := c.ctrl.writeRdtFile(c.relPath("schemata"), []byte(schemata)); err != nil {
 			return err
 		}
-		schemata += schema
+	} else {
+		c.ctrl.logger().Debug("empty schemata")
+	}
 
-		schema, err = class.L3Schema.ToStr(l3SchemaTypeData, partition.L3)
-		if err != nil {
+	if class.Cpus != nil {
+		c.ctrl.logger().Debug("assigning cpus %q to %q", class.Cpus, c.relPath(""))
+		if err := c.SetCpus(class.Cpus); err != nil {
 			return err
 		}
-		schemata += schema
-	default:
-		if class.L3Schema != nil && !options.L3.Optional {
-			return rdtError("L3 cache allocation for %q specified in configuration but not supported by system", name)
+	}
+
+	return nil
+}
+
+// classSchemata composes the schemata of a class. Returns warnings about
+// optional allocations that are ignored because they are not supported by the
+// system.
+func classSchemata(info *resctrlInfo, name string, class classConfig,
+	partition partitionConfig, options Options) (string, []string, error) {
+	schemata := ""
+	warnings := []string{}
+
+	// Handle L3 and L2 cache allocation
+	for _, lvl := range []cacheLevel{cacheLevelL3, cacheLevelL2} {
+		switch {
+		case info.cat[lvl].unified.Supported():
+			schema, err := class.CATSchema[lvl].ToStr(info, lvl, catSchemaTypeUnified, partition.CAT[lvl])
+			if err != nil {
+				return "", nil, err
+			}
+			schemata += schema
+		case info.cat[lvl].data.Supported() || info.cat[lvl].code.Supported():
+			schema, err := class.CATSchema[lvl].ToStr(info, lvl, catSchemaTypeCode, partition.CAT[lvl])
+			if err != nil {
+				return "", nil, err
+			}
+			schemata += schema
+
+			schema, err = class.CATSchema[lvl].ToStr(info, lvl, catSchemaTypeData, partition.CAT[lvl])
+			if err != nil {
+				return "", nil, err
+			}
+			schemata += schema
+		default:
+			if class.CATSchema[lvl] != nil {
+				if !options.cat(lvl).Optional {
+					return "", nil, rdtError("%s cache allocation for %q specified in configuration but %w by system", lvl, name, ErrNotSupported)
+				}
+				warnings = append(warnings, fmt.Sprintf("ignoring %s cache allocation of %q, not supported by system", lvl, name))
+			}
 		}
 	}
 
 	// Handle memory bandwidth allocation
 	switch {
 	case info.mb.Supported():
-		schemata += class.MBSchema.ToStr(partition.MB)
+		schemata += class.MBSchema.ToStr(info, partition.MB)
 	default:
-		if class.MBSchema != nil && !options.MB.Optional {
-			return rdtError("memory bandwidth allocation for %q specified in configuration but not supported by system", name)
+		if class.MBSchema != nil {
+			if !options.MB.Optional {
+				return "", nil, rdtError("memory bandwidth allocation for %q specified in configuration but %w by system", name, ErrNotSupported)
+			}
+			warnings = append(warnings, fmt.Sprintf("ignoring memory bandwidth allocation of %q, not supported by system", name))
 		}
 	}
 
-	if len(schemata) > 0 {
-		log.Debug("writing schemata %q to %q", schemata, c.relPath(""))
-		if err := rdt.writeRdtFile(c.relPath("schemata"), []byte(schemata)); err != nil {
-			return err
+	return schemata, warnings, nil
+}
+
+func (c *ctrlGroup) GetSchemata() (string, error) {
+	data, err := c.ctrl.readRdtFile(c.relPath("schemata"))
+	if err != nil {
+		return "", rdtError("failed to read schemata of %q: %w", c.name, err)
+	}
+	return string(data), nil
+}
+
+// parseSchemata parses a schemata or size file. Returns the values per
+// resource and cache id.
+func parseSchemata(data string, base int) map[string]map[uint64]uint64 {
+	ret := map[string]map[uint64]uint64{}
+	for _, line := range strings.Split(data, "\n") {
+		split := strings.SplitN(line, ":", 2)
+		if len(split) != 2 {
+			continue
 		}
-	} else {
-		log.Debug("empty schemata")
+		name := strings.TrimSpace(split[0])
+		for _, d := range strings.Split(split[1], ";") {
+			kv := strings.SplitN(d, "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			id, err := strconv.ParseUint(strings.TrimSpace(kv[0]), 10, 64)
+			if err != nil {
+				continue
+			}
+			value, err := strconv.ParseUint(strings.TrimSpace(kv[1]), base, 64)
+			if err != nil {
+				continue
+			}
+			if ret[name] == nil {
+				ret[name] = map[uint64]uint64{}
+			}
+			ret[name][id] = value
+		}
+	}
+	return ret
+}
+
+func (c *ctrlGroup) GetMode() (GroupMode, error) {
+	data, err := c.ctrl.readRdtFile(c.relPath("mode"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			// Kernels without support for group modes
+			return GroupModeShareable, nil
+		}
+		return "", rdtError("failed to read mode of %q: %w", c.name, err)
 	}
+	return GroupMode(strings.TrimSpace(string(data))), nil
+}
 
+func (c *ctrlGroup) Size() (map[string]map[uint64]uint64, error) {
+	data, err := c.ctrl.readRdtFile(c.relPath("size"))
+	if err != nil {
+		return nil, rdtError("failed to read size of %q: %w", c.name, err)
+	}
+	sizes := parseSchemata(string(data), 10)
+	// MB lines of the size file contain bandwidth values, not sizes
+	for name := range sizes {
+		if !strings.HasPrefix(name, "L2") && !strings.HasPrefix(name, "L3") {
+			delete(sizes, name)
+		}
+	}
+	return sizes, nil
+}
+
+// setMode changes the mode of the group. The kernel refuses to make a group
+// exclusive if its cache allocations overlap with any other group.
+func (c *ctrlGroup) setMode(mode GroupMode) error {
+	c.ctrl.logger().Debug("setting mode of %q to %s", c.relPath(""), mode)
+	if err := c.ctrl.writeRdtFile(c.relPath("mode"), []byte(string(mode)+"\n")); err != nil {
+		return rdtError("failed to set mode of %q to %s: %w", c.name, mode, err)
+	}
 	return nil
 }
 
@@ -584,24 +1380,24 @@ func (c *ctrlGroup) monGroupsFromResctrlFs() (map[string]*monGroup, error) {
 	grps := make(map[string]*monGroup, len(names))
 	for _, name := range names {
 		name = name[len(c.monPrefix):]
-		mg, err := newMonGroup(c.monPrefix, name, c, nil)
-		if err != nil {
-			return nil, err
-		}
-		grps[name] = mg
+		annotations := c.ctrl.state.annotations(c.relPath("mon_groups", c.monPrefix+name))
+		grps[name] = existingMonGroup(c.monPrefix, name, c, annotations)
 	}
 	return grps, nil
 }
 
 // Remove empty monitoring groups
 func (c *ctrlGroup) pruneMonGroups() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
 	for name, mg := range c.monGroups {
 		pids, err := mg.GetPids()
 		if err != nil {
 			return fmt.Errorf("failed to get pids for monitoring group %q: %v", mg.relPath(""), err)
 		}
 		if len(pids) == 0 {
-			if err := c.DeleteMonGroup(name); err != nil {
+			if err := c.deleteMonGroup(name); err != nil {
 				return fmt.Errorf("failed to remove monitoring group %q: %v", mg.relPath(""), err)
 			}
 		}
@@ -614,7 +1410,7 @@ func (r *resctrlGroup) Name() string {
 }
 
 func (r *resctrlGroup) GetPids() ([]string, error) {
-	data, err := rdt.readRdtFile(r.relPath("tasks"))
+	data, err := r.ctrl.readRdtFile(r.relPath("tasks"))
 	if err != nil {
 		return []string{}, err
 	}
@@ -626,31 +1422,46 @@ func (r *resctrlGroup) GetPids() ([]string, error) {
 }
 
 func (r *resctrlGroup) AddPids(pids ...string) error {
-	f, err := os.OpenFile(r.path("tasks"), os.O_WRONLY, 0644)
+	f, err := r.ctrl.fs.OpenFile(r.path("tasks"))
 	if err != nil {
 		return err
 	}
 	defer f.Close()
 
 	for _, pid := range pids {
-		if _, err := f.WriteString(pid + "\n"); err != nil {
+		if _, err := f.Write([]byte(pid + "\n")); err != nil {
 			if errors.Is(err, syscall.ESRCH) {
-				log.Debug("no task %s", pid)
+				r.ctrl.logger().Debug("no task %s", pid)
 			} else {
-				return rdtError("failed to assign processes %v to class %q: %v", pids, r.name, rdt.cmdError(err))
+				return rdtError("failed to assign processes %v to class %q: %w", pids, r.name, r.ctrl.cmdError("write", r.relPath(""), "tasks", err))
 			}
 		}
 	}
 	return nil
 }
 
+func (r *resctrlGroup) GetCpus() (CPUSet, error) {
+	data, err := r.ctrl.readRdtFile(r.relPath("cpus_list"))
+	if err != nil {
+		return nil, rdtError("failed to read cpus of %q: %w", r.name, err)
+	}
+	return ParseCPUSet(string(data))
+}
+
+func (r *resctrlGroup) SetCpus(cpus CPUSet) error {
+	if err := r.ctrl.writeRdtFile(r.relPath("cpus_list"), []byte(cpus.String()+"\n")); err != nil {
+		return rdtError("failed to assign cpus %q to %q: %w", cpus, r.name, err)
+	}
+	return nil
+}
+
 func (r *resctrlGroup) GetMonData() MonData {
 	m := MonData{}
 
-	if info.l3mon.Supported() {
+	if r.ctrl.info.l3mon.Supported() {
 		l3, err := r.getMonL3Data()
 		if err != nil {
-			log.Warn("failed to retrieve L3 monitoring data: %v", err)
+			r.ctrl.logger().Warn("failed to retrieve L3 monitoring data: %v", err)
 		} else {
 			m.L3 = l3
 		}
@@ -673,13 +1484,13 @@ func (r *resctrlGroup) getMonL3Data() (MonL3Data, error) {
 			id, err := strconv.ParseUint(strings.TrimPrefix(name, "mon_L3_"), 10, 32)
 			if err != nil {
 				// Just print a warning, we try to retrieve as much info as possible
-				log.Warn("error parsing L3 monitor data directory name %q: %v", name, err)
+				r.ctrl.logger().Warn("error parsing L3 monitor data directory name %q: %v", name, err)
 				continue
 			}
 
 			data, err := r.getMonLeafData(filepath.Join("mon_data", name))
 			if err != nil {
-				log.Warn("failed to read monitor data: %v", err)
+				r.ctrl.logger().Warn("failed to read monitor data: %v", err)
 				continue
 			}
 
@@ -705,7 +1516,7 @@ func (r *resctrlGroup) getMonLeafData(path string) (MonLeafData, error) {
 		val, err := readFileUint64(r.path(path, name))
 		if err != nil {
 			// Just print a warning, we want to retrieve as much info as possible
-			log.Warn("error reading data file: %v", err)
+			r.ctrl.logger().Warn("error reading data file: %v", err)
 			continue
 		}
 
@@ -727,16 +1538,14 @@ func (r *resctrlGroup) relPath(elem ...string) string {
 }
 
 func (r *resctrlGroup) path(elem ...string) string {
-	return filepath.Join(info.resctrlPath, r.relPath(elem...))
+	return filepath.Join(r.ctrl.info.resctrlPath, r.relPath(elem...))
 }
 
 func newMonGroup(prefix string, name string, parent *ctrlGroup, annotations map[string]string) (*monGroup, error) {
-	mg := &monGroup{
-		resctrlGroup: resctrlGroup{prefix: prefix, name: name, parent: parent},
-		annotations:  make(map[string]string, len(annotations))}
+	mg := existingMonGroup(prefix, name, parent, nil)
 
-	if err := os.Mkdir(mg.path(""), 0755); err != nil && !os.IsExist(err) {
-		return nil, err
+	if err := parent.ctrl.fs.Mkdir(mg.path("")); err != nil && !os.IsExist(err) {
+		return nil, parent.ctrl.cmdError("mkdir", mg.relPath(""), "", err)
 	}
 	for k, v := range annotations {
 		mg.annotations[k] = v
@@ -745,6 +1554,18 @@ func newMonGroup(prefix string, name string, parent *ctrlGroup, annotations map[
 	return mg, nil
 }
 
+// existingMonGroup returns a monitoring group for an existing resctrl group,
+// without touching the filesystem
+func existingMonGroup(prefix string, name string, parent *ctrlGroup, annotations map[string]string) *monGroup {
+	mg := &monGroup{
+		resctrlGroup: resctrlGroup{ctrl: parent.ctrl, prefix: prefix, name: name, parent: parent},
+		annotations:  make(map[string]string, len(annotations))}
+	for k, v := range annotations {
+		mg.annotations[k] = v
+	}
+	return mg
+}
+
 func (m *monGroup) Parent() CtrlGroup {
 	return m.parent
 }
@@ -766,10 +1587,8 @@ func resctrlGroupsFromFs(prefix string, path string) ([]string, error) {
 	grps := make([]string, 0, len(files))
 	for _, file := range files {
 		filename := file.Name()
-		if strings.HasPrefix(filename, prefix) {
-			if s, err := os.Stat(filepath.Join(path, filename, "tasks")); err == nil && !s.IsDir() {
-				grps = append(grps, filename)
-			}
+		if strings.HasPrefix(filename, prefix) && isResctrlGroup(filepath.Join(path, filename)) {
+			grps = append(grps, filename)
 		}
 	}
 	return grps, nil
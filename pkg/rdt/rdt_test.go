@@ -17,6 +17,9 @@ limitations under the License.
 package rdt
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	stdlog "log"
 	"os"
@@ -25,10 +28,17 @@ import (
 	"regexp"
 	"sigs.k8s.io/yaml"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 
 	"github.com/intel/goresctrl/pkg/utils"
 	testdata "github.com/intel/goresctrl/test/data"
@@ -39,8 +49,9 @@ const mockGroupPrefix string = "goresctrl."
 type mockResctrlFs struct {
 	t *testing.T
 
-	origDir string
-	baseDir string
+	origDir       string
+	baseDir       string
+	mountInfoPath string
 }
 
 func newMockResctrlFs(t *testing.T, name, mountOpts string) (*mockResctrlFs, error) {
@@ -57,13 +68,18 @@ func newMockResctrlFs(t *testing.T, name, mountOpts string) (*mockResctrlFs, err
 	m.copyFromOrig("", "")
 
 	// Create mountinfo mock
-	mountInfoPath = filepath.Join(m.baseDir, "mounts")
+	m.mountInfoPath = filepath.Join(m.baseDir, "mountinfo")
 	resctrlPath := filepath.Join(m.baseDir, "resctrl")
-	data := "resctrl " + resctrlPath + " resctrl " + mountOpts + " 0 0\n"
-	if err := ioutil.WriteFile(mountInfoPath, []byte(data), 0644); err != nil {
+	superOpts := "rw"
+	if mountOpts != "" {
+		superOpts += "," + mountOpts
+	}
+	data := "40 22 0:37 / " + resctrlPath + " rw,relatime shared:20 - resctrl resctrl " + superOpts + "\n"
+	if err := ioutil.WriteFile(m.mountInfoPath, []byte(data), 0644); err != nil {
 		m.delete()
 		return nil, err
 	}
+	defaultMountInfoPath = m.mountInfoPath
 	return m, nil
 }
 
@@ -96,6 +112,12 @@ func (m *mockResctrlFs) verifyTextFile(relPath, content string) {
 	verifyTextFile(m.t, filepath.Join(m.baseDir, "resctrl", relPath), content)
 }
 
+func (m *mockResctrlFs) writeTextFile(relPath, content string) {
+	if err := ioutil.WriteFile(filepath.Join(m.baseDir, "resctrl", relPath), []byte(content), 0644); err != nil {
+		m.t.Fatalf("failed to write %q: %v", relPath, err)
+	}
+}
+
 func verifyTextFile(t *testing.T, path, content string) {
 	data, err := ioutil.ReadFile(path)
 	if err != nil {
@@ -234,7 +256,7 @@ partitions:
 
 	// Check that SetLogger() takes effect in the control interface, too
 	SetLogger(NewLoggerWrapper(stdlog.New(os.Stderr, "[ rdt-test-2 ] ", 0)))
-	if p := rdt.Logger.(*logger).Prefix(); p != "[ rdt-test-2 ] " {
+	if p := rdt.log.(*logger).Prefix(); p != "[ rdt-test-2 ] " {
 		t.Errorf("unexpected logger prefix %q", p)
 	}
 
@@ -428,176 +450,1984 @@ partitions:
 	verifyGroupNames(classes, []string{"SYSTEM_DEFAULT"})
 }
 
-// TestConfig tests configuration parsing and resolving
-func TestConfig(t *testing.T) {
-	type Schemata struct {
-		l3     string
-		l3code string
-		l3data string
-		mb     string
+// TestControl tests that multiple Control instances can be used side by side
+func TestControl(t *testing.T) {
+	const controlTestConfig string = `
+partitions:
+  part-1:
+    l3Allocation: 100%
+    classes:
+      class-1:
+        l3schema: 50%
+`
+	// Set group remove function so that mock groups can be removed
+	groupRemoveFunc = os.RemoveAll
+
+	mockFs1, err := newMockResctrlFs(t, "resctrl.nomb", "")
+	if err != nil {
+		t.Fatalf("failed to set up mock resctrl fs: %v", err)
 	}
+	defer mockFs1.delete()
 
-	type TC struct {
-		name        string
-		fs          string
-		fsMountOpts string
-		config      string
-		configErrRe string
-		schemata    map[string]Schemata
+	mockFs2, err := newMockResctrlFs(t, "resctrl.nomb.cdp", "")
+	if err != nil {
+		t.Fatalf("failed to set up mock resctrl fs: %v", err)
 	}
+	defer mockFs2.delete()
 
-	tcs := []TC{
-		// Testcase
-		TC{
-			name: "Complex config",
-			fs:   "resctrl.full",
-			config: `
+	c1, err := NewControl(ControlOptions{ResctrlGroupPrefix: mockGroupPrefix, MountInfoPath: mockFs1.mountInfoPath})
+	if err != nil {
+		t.Fatalf("NewControl() failed: %v", err)
+	}
+	c2, err := NewControl(ControlOptions{
+		ResctrlGroupPrefix: "foo.",
+		MountInfoPath:      mockFs2.mountInfoPath,
+		Logger:             NewLoggerWrapper(stdlog.New(os.Stderr, "[ rdt-test-control ] ", 0)),
+	})
+	if err != nil {
+		t.Fatalf("NewControl() failed: %v", err)
+	}
+
+	if p := c2.log.(*logger).Prefix(); p != "[ rdt-test-control ] " {
+		t.Errorf("unexpected logger prefix %q", p)
+	}
+	if _, err := NewControl(ControlOptions{MountInfoPath: filepath.Join(mockFs1.baseDir, "non-existent")}); err == nil {
+		t.Errorf("NewControl() succeeded unexpectedly with invalid mount info path")
+	}
+
+	if err := c1.SetConfig(parseTestConfig(t, controlTestConfig), true); err != nil {
+		t.Fatalf("SetConfig() failed: %v", err)
+	}
+	if err := c2.SetConfig(parseTestConfig(t, controlTestConfig), true); err != nil {
+		t.Fatalf("SetConfig() failed: %v", err)
+	}
+
+	if n := len(c1.GetClasses()); n != 2 {
+		t.Errorf("unexpected number of classes %d, expected 2", n)
+	}
+	if _, ok := c2.GetClass("class-1"); !ok {
+		t.Errorf("class-1 not found")
+	}
+	if !c1.MonSupported() || !c2.MonSupported() {
+		t.Errorf("MonSupported() returned false, expected true")
+	}
+	if f := c2.GetMonFeatures(); len(f[MonResourceL3]) != 3 {
+		t.Errorf("unexpected monitoring features %v", f)
+	}
+
+	mockFs1.verifyTextFile(filepath.Join(mockGroupPrefix+"class-1", "schemata"), "L3:0=3ff;1=3ff;2=3ff;3=3ff\n")
+	if cls, _ := c1.GetClass("class-1"); cls == nil {
+		t.Errorf("class-1 not found")
+	} else if s, err := cls.GetSchemata(); err != nil {
+		t.Errorf("GetSchemata() failed: %v", err)
+	} else if s != "L3:0=3ff;1=3ff;2=3ff;3=3ff\n" {
+		t.Errorf("unexpected schemata %q", s)
+	}
+	mockFs2.verifyTextFile(filepath.Join("foo.class-1", "schemata"),
+		"L3CODE:0=3ff;1=3ff;2=3ff;3=3ff\nL3DATA:0=3ff;1=3ff;2=3ff;3=3ff\n")
+
+	// CPU assignment
+	if cls, ok := c1.GetClass(RootClassName); !ok {
+		t.Errorf("root class not found")
+	} else if cpus, err := cls.GetCpus(); err != nil {
+		t.Errorf("GetCpus() failed: %v", err)
+	} else if cpus.Size() != 192 {
+		t.Errorf("unexpected cpus of the root class %q", cpus)
+	}
+	cpuConfig := controlTestConfig + "        cpus: 0-3,8\n"
+	if err := c1.SetConfig(parseTestConfig(t, cpuConfig), true); err != nil {
+		t.Fatalf("SetConfig() failed: %v", err)
+	}
+	mockFs1.verifyTextFile(filepath.Join(mockGroupPrefix+"class-1", "cpus_list"), "0-3,8\n")
+	if cls, _ := c1.GetClass("class-1"); cls == nil {
+		t.Errorf("class-1 not found")
+	} else {
+		if err := cls.SetCpus(NewCPUSet(4, 5)); err != nil {
+			t.Errorf("SetCpus() failed: %v", err)
+		}
+		if cpus, err := cls.GetCpus(); err != nil {
+			t.Errorf("GetCpus() failed: %v", err)
+		} else if !cpus.Equals(NewCPUSet(4, 5)) {
+			t.Errorf("unexpected cpus %q", cpus)
+		}
+	}
+	// Group modes
+	exclusiveConfig := strings.Replace(controlTestConfig, "50%", "50%\n        mode: exclusive", 1)
+	if err := c1.SetConfig(parseTestConfig(t, exclusiveConfig), true); err != nil {
+		t.Fatalf("SetConfig() failed: %v", err)
+	}
+	mockFs1.verifyTextFile(filepath.Join(mockGroupPrefix+"class-1", "mode"), "exclusive\n")
+	// Groups created in the mock fs are only discovered if they have tasks
+	mockFs1.writeTextFile(filepath.Join(mockGroupPrefix+"class-1", "tasks"), "")
+	if err := c1.SetConfig(parseTestConfig(t, controlTestConfig), true); err != nil {
+		t.Fatalf("SetConfig() failed: %v", err)
+	}
+	mockFs1.verifyTextFile(filepath.Join(mockGroupPrefix+"class-1", "mode"), "shareable\n")
+	if cls, _ := c1.GetClass("class-1"); cls == nil {
+		t.Errorf("class-1 not found")
+	} else if mode, err := cls.GetMode(); err != nil || mode != GroupModeShareable {
+		t.Errorf("unexpected mode %q (%v)", mode, err)
+	}
+
+	overlapConfig := cpuConfig + "      class-2:\n        l3schema: 50%\n        cpus: 8-9\n"
+	if err := c1.SetConfig(parseTestConfig(t, overlapConfig), true); err == nil {
+		t.Errorf("SetConfig() succeeded unexpectedly with overlapping cpus")
+	}
+
+	// The instances must not leak groups to each other
+	if _, err := os.Stat(filepath.Join(mockFs2.baseDir, "resctrl", mockGroupPrefix+"class-1")); !os.IsNotExist(err) {
+		t.Errorf("unexpected resctrl group found in the second mock fs: %v", err)
+	}
+}
+
+// TestMonGroupState verifies that monitoring group annotations are restored
+// when a Control is re-created
+func TestMonGroupState(t *testing.T) {
+	const stateTestConfig string = `
 partitions:
   part-1:
-    l3Allocation:
-      all: 60%
-      1: "0xff000"
-      2: "9-15"
-    mbAllocation:
-      all: [100%]
+    l3Allocation: 100%
     classes:
       class-1:
-        l3schema: 100%
-      class-2:
-        l3schema:
-          all: 100%
-          0-1: 10%
-          2: "0x70"
-        mbschema:
-          all: [40%]
-          3: [10%]
-  part-2:
-    l3Allocation:
-      all: 39%
-      1: "0-10"
-      2: "0-6"
-    mbAllocation:
-      all: [50%]
-      1: [80%]
-      2: [100%]
-    classes:
-      class-3:
-        l3schema: 100%
-        mbschema:
-          all: [40%]
-          0: [80%]
-      class-4:
         l3schema: 50%
-        mbschema: [100%]
-      SYSTEM_DEFAULT:
-        l3schema: 60%
-        mbschema: [60%]
-  part-3:
-    l3Allocation:
-      all: 1%
-      1: "0x800"
-      2: "7,8"
-    mbAllocation: [20%]
-    classes:
-      class-5:
-        l3schema: 100%
-        mbschema:
-          all: [100%]
-          0: [1%]
-`,
-			schemata: map[string]Schemata{
-				"class-1": Schemata{
-					l3: "0=fff;1=ff000;2=fe00;3=fff",
-					mb: "0=100;1=100;2=100;3=100",
-				},
-				"class-2": Schemata{
-					l3: "0=3;1=1000;2=e000;3=fff",
-					mb: "0=40;1=40;2=40;3=10",
-				},
-				"class-3": Schemata{
-					l3: "0=7f000;1=7ff;2=7f;3=7f000",
-					mb: "0=40;1=32;2=40;3=20",
-				},
-				"class-4": Schemata{
-					l3: "0=f000;1=3f;2=f;3=f000",
-					mb: "0=50;1=80;2=100;3=50",
-				},
-				"SYSTEM_DEFAULT": Schemata{
-					l3: "0=1f000;1=7f;2=1f;3=1f000",
-					mb: "0=30;1=48;2=60;3=30",
-				},
-				"class-5": Schemata{
-					l3: "0=80000;1=800;2=180;3=80000",
-					mb: "0=10;1=20;2=20;3=20",
-				},
-			},
-		},
-		// Testcase
-		TC{
-			name: "L3 CDP disabled",
-			fs:   "resctrl.nomb",
-			config: `
+`
+	groupRemoveFunc = os.RemoveAll
+
+	mockFs, err := newMockResctrlFs(t, "resctrl.full", "")
+	if err != nil {
+		t.Fatalf("failed to set up mock resctrl fs: %v", err)
+	}
+	defer mockFs.delete()
+
+	opts := ControlOptions{
+		ResctrlGroupPrefix: mockGroupPrefix,
+		MountInfoPath:      mockFs.mountInfoPath,
+		StateFile:          filepath.Join(mockFs.baseDir, "state", "goresctrl.json"),
+	}
+	c1, err := NewControl(opts)
+	if err != nil {
+		t.Fatalf("NewControl() failed: %v", err)
+	}
+	if err := c1.SetConfig(parseTestConfig(t, stateTestConfig), true); err != nil {
+		t.Fatalf("SetConfig() failed: %v", err)
+	}
+	mockFs.writeTextFile(filepath.Join(mockGroupPrefix+"class-1", "tasks"), "1\n")
+	if err := os.Mkdir(filepath.Join(mockFs.baseDir, "resctrl", mockGroupPrefix+"class-1", "mon_groups"), 0755); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// Groups created in the mock fs are only discovered if they have tasks
+	cls, _ := c1.GetClass("class-1")
+	for _, name := range []string{"mg-1", "mg-2"} {
+		mockFs.initMockMonGroup("class-1", name)
+		if _, err := cls.CreateMonGroup(name, map[string]string{"name": name}); err != nil {
+			t.Fatalf("CreateMonGroup() failed: %v", err)
+		}
+	}
+	if err := cls.DeleteMonGroup("mg-2"); err != nil {
+		t.Fatalf("DeleteMonGroup() failed: %v", err)
+	}
+	root, _ := c1.GetClass(RootClassName)
+	mockFs.copyFromOrig(filepath.Join("mon_groups", "example"), filepath.Join("mon_groups", mockGroupPrefix+"mg-3"))
+	if _, err := root.CreateMonGroup("mg-3", map[string]string{"name": "mg-3"}); err != nil {
+		t.Fatalf("CreateMonGroup() failed: %v", err)
+	}
+
+	verifyAnnotations := func(c *Control, class, name string, expected map[string]string) {
+		cls, ok := c.GetClass(class)
+		if !ok {
+			t.Fatalf("class %q not found", class)
+		}
+		mg, ok := cls.GetMonGroup(name)
+		if !ok {
+			t.Fatalf("monitoring group %s/%s not found", class, name)
+		}
+		if a := mg.GetAnnotations(); !cmp.Equal(a, expected) {
+			t.Errorf("unexpected annotations of %s/%s: expected %v, got %v", class, name, expected, a)
+		}
+	}
+
+	// Annotations are restored after a restart
+	c2, err := NewControl(opts)
+	if err != nil {
+		t.Fatalf("NewControl() failed: %v", err)
+	}
+	verifyAnnotations(c2, "class-1", "mg-1", map[string]string{"name": "mg-1"})
+	verifyAnnotations(c2, RootClassName, "mg-3", map[string]string{"name": "mg-3"})
+	verifyTextFile(t, opts.StateFile, `{"monGroups":{"goresctrl.class-1/mon_groups/goresctrl.mg-1":{"name":"mg-1"},"mon_groups/goresctrl.mg-3":{"name":"mg-3"}}}`)
+
+	// Stale entries are dropped and removed classes lose their annotations
+	if err := os.RemoveAll(filepath.Join(mockFs.baseDir, "resctrl", "mon_groups", mockGroupPrefix+"mg-3")); err != nil {
+		t.Fatalf("%v", err)
+	}
+	c3, err := NewControl(opts)
+	if err != nil {
+		t.Fatalf("NewControl() failed: %v", err)
+	}
+	mockFs.writeTextFile(filepath.Join(mockGroupPrefix+"class-1", "tasks"), "")
+	if err := c3.SetConfig(&Config{}, true); err != nil {
+		t.Fatalf("SetConfig() failed: %v", err)
+	}
+	verifyTextFile(t, opts.StateFile, `{"monGroups":{}}`)
+
+	// A corrupted state file is discarded
+	mockFs.copyFromOrig(filepath.Join("mon_groups", "example"), filepath.Join("mon_groups", mockGroupPrefix+"mg-4"))
+	if err := ioutil.WriteFile(opts.StateFile, []byte("{"), 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+	c4, err := NewControl(opts)
+	if err != nil {
+		t.Fatalf("NewControl() failed: %v", err)
+	}
+	verifyAnnotations(c4, RootClassName, "mg-4", map[string]string{})
+	verifyTextFile(t, opts.StateFile, `{"monGroups":{}}`)
+}
+
+// TestReconciler verifies detection and repair of changes made to the resctrl
+// groups behind the back of the Control
+func TestReconciler(t *testing.T) {
+	const reconcilerTestConfig string = `
 partitions:
   part-1:
-    l3Allocation:
-      0,1:
-        unified: 60%
-        code: 70%
-        data: 50%
-      2,3: 40%
+    l3Allocation: 100%
     classes:
       class-1:
-  part-2:
-    l3Allocation:
-      0,1:
-        unified: 40%
-        code: 30%
-        data: 50%
-      2,3: 60%
-    classes:
-      class-2:
-      SYSTEM_DEFAULT:
-        l3Schema:
-          all: 100%
-          3:
-            unified: 80%
-            code: 60%
-            data: 90%
+        l3schema: 50%
+        cpus: 0-3
+        mode: exclusive
+`
+	groupRemoveFunc = os.RemoveAll
 
-`,
-			schemata: map[string]Schemata{
-				"class-1": Schemata{
-					l3: "0=fff;1=fff;2=ff;3=ff",
-				},
-				"class-2": Schemata{
-					l3: "0=ff000;1=ff000;2=fff00;3=fff00",
-				},
-				"SYSTEM_DEFAULT": Schemata{
-					l3: "0=ff000;1=ff000;2=fff00;3=3ff00",
-				},
-			},
-		},
-		// Testcase
-		TC{
-			name: "L3 CDP enabled",
-			fs:   "resctrl.nomb.cdp",
-			config: `
+	mockFs, err := newMockResctrlFs(t, "resctrl.nomb", "")
+	if err != nil {
+		t.Fatalf("failed to set up mock resctrl fs: %v", err)
+	}
+	defer mockFs.delete()
+
+	c, err := NewControl(ControlOptions{ResctrlGroupPrefix: mockGroupPrefix, MountInfoPath: mockFs.mountInfoPath})
+	if err != nil {
+		t.Fatalf("NewControl() failed: %v", err)
+	}
+	if err := c.SetConfig(parseTestConfig(t, reconcilerTestConfig), true); err != nil {
+		t.Fatalf("SetConfig() failed: %v", err)
+	}
+
+	group := mockGroupPrefix + "class-1"
+	schemata := "L3:0=3ff;1=3ff;2=3ff;3=3ff\n"
+	drift := func() {
+		mockFs.writeTextFile(filepath.Join(group, "schemata"), "L3:0=0003ff;1=fffff;2=3ff;3=3ff\n")
+		mockFs.writeTextFile(filepath.Join(group, "cpus_list"), "0-1\n")
+		mockFs.writeTextFile(filepath.Join(group, "mode"), "shareable\n")
+	}
+	expectedEvents := []DriftEvent{
+		{Class: "class-1", Kind: DriftSchemata, Expected: schemata, Actual: "L3:0=0003ff;1=fffff;2=3ff;3=3ff"},
+		{Class: "class-1", Kind: DriftCpus, Expected: "0-3", Actual: "0-1"},
+		{Class: "class-1", Kind: DriftMode, Expected: "exclusive", Actual: "shareable"},
+	}
+
+	// No drift, the kernel format of the values does not matter
+	mockFs.writeTextFile(filepath.Join(group, "schemata"), "L3:0=003ff;1=003ff;2=003ff;3=003ff\n")
+	r := c.NewReconciler(ReconcilerOptions{})
+	if events, err := r.Reconcile(); err != nil {
+		t.Errorf("Reconcile() failed: %v", err)
+	} else if len(events) != 0 {
+		t.Errorf("unexpected drift detected: %v", events)
+	}
+
+	// Drift is only reported without repair
+	drift()
+	if events, err := r.Reconcile(); err != nil {
+		t.Errorf("Reconcile() failed: %v", err)
+	} else if !cmp.Equal(events, expectedEvents) {
+		t.Errorf("unexpected drift events\nexpected: %v\nfound:    %v", expectedEvents, events)
+	}
+	mockFs.verifyTextFile(filepath.Join(group, "cpus_list"), "0-1\n")
+
+	// Drift is repaired
+	r = c.NewReconciler(ReconcilerOptions{Repair: true})
+	for i := range expectedEvents {
+		expectedEvents[i].Repaired = true
+	}
+	if events, err := r.Reconcile(); err != nil {
+		t.Errorf("Reconcile() failed: %v", err)
+	} else if !cmp.Equal(events, expectedEvents) {
+		t.Errorf("unexpected drift events\nexpected: %v\nfound:    %v", expectedEvents, events)
+	}
+	mockFs.verifyTextFile(filepath.Join(group, "schemata"), schemata)
+	mockFs.verifyTextFile(filepath.Join(group, "cpus_list"), "0-3\n")
+	mockFs.verifyTextFile(filepath.Join(group, "mode"), "exclusive\n")
+
+	// Removed groups are re-created
+	if err := os.RemoveAll(filepath.Join(mockFs.baseDir, "resctrl", group)); err != nil {
+		t.Fatalf("%v", err)
+	}
+	expected := []DriftEvent{{Class: "class-1", Kind: DriftGroupMissing, Expected: group, Repaired: true}}
+	if events, err := r.Reconcile(); err != nil {
+		t.Errorf("Reconcile() failed: %v", err)
+	} else if !cmp.Equal(events, expected) {
+		t.Errorf("unexpected drift events\nexpected: %v\nfound:    %v", expected, events)
+	}
+	mockFs.verifyTextFile(filepath.Join(group, "schemata"), schemata)
+	mockFs.verifyTextFile(filepath.Join(group, "mode"), "exclusive\n")
+
+	// Classes dropped by a Watcher are restored
+	if err := os.RemoveAll(filepath.Join(mockFs.baseDir, "resctrl", group)); err != nil {
+		t.Fatalf("%v", err)
+	}
+	delete(c.classes, "class-1")
+	if events, err := r.Reconcile(); err != nil {
+		t.Errorf("Reconcile() failed: %v", err)
+	} else if !cmp.Equal(events, expected) {
+		t.Errorf("unexpected drift events\nexpected: %v\nfound:    %v", expected, events)
+	}
+	if _, ok := c.GetClass("class-1"); !ok {
+		t.Errorf("class-1 not restored")
+	}
+
+	// Periodic checks
+	ch := make(chan DriftEvent, 10)
+	r = c.NewReconciler(ReconcilerOptions{Interval: 10 * time.Millisecond, Repair: true, OnDrift: func(e DriftEvent) { ch <- e }})
+	r.Start()
+	defer r.Stop()
+	mockFs.writeTextFile(filepath.Join(group, "cpus_list"), "0-1\n")
+	select {
+	case e := <-ch:
+		if e.Kind != DriftCpus || !e.Repaired {
+			t.Errorf("unexpected drift event %v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("timeout waiting for drift event")
+	}
+	r.Stop()
+	mockFs.verifyTextFile(filepath.Join(group, "cpus_list"), "0-3\n")
+
+	if _, err := newReconciler(ReconcilerOptions{}, func() *Control { return nil }).Reconcile(); !errors.Is(err, ErrNotInitialized) {
+		t.Errorf("expected ErrNotInitialized, got %v", err)
+	}
+}
+
+// TestReconcilerMBGranularity verifies that memory bandwidth values rounded
+// by the kernel are not reported as drift
+func TestReconcilerMBGranularity(t *testing.T) {
+	const reconcilerTestConfig string = `
 partitions:
   part-1:
-    l3Allocation:
-      0,1:
-        unified: 60%
-        code: 70%
-        data: 50%
-      2,3: 40%
+    l3Allocation: 100%
+    mbAllocation: [100%]
     classes:
       class-1:
-  part-2:
-    l3Allocation:
-      0,1:
-        unified: 40%
-        code: 30%
-        data: 50%
+        mbschema: [25%]
+`
+	groupRemoveFunc = os.RemoveAll
+
+	// The bandwidth granularity of the mock is 10
+	mockFs, err := newMockResctrlFs(t, "resctrl.full", "")
+	if err != nil {
+		t.Fatalf("failed to set up mock resctrl fs: %v", err)
+	}
+	defer mockFs.delete()
+
+	c, err := NewControl(ControlOptions{ResctrlGroupPrefix: mockGroupPrefix, MountInfoPath: mockFs.mountInfoPath})
+	if err != nil {
+		t.Fatalf("NewControl() failed: %v", err)
+	}
+	if err := c.SetConfig(parseTestConfig(t, reconcilerTestConfig), true); err != nil {
+		t.Fatalf("SetConfig() failed: %v", err)
+	}
+	schemataPath := filepath.Join(mockGroupPrefix+"class-1", "schemata")
+	mockFs.verifyTextFile(schemataPath, "L3:0=fffff;1=fffff;2=fffff;3=fffff\nMB:0=25;1=25;2=25;3=25\n")
+
+	// The kernel rounds 25 up to 30
+	mockFs.writeTextFile(schemataPath, "L3:0=fffff;1=fffff;2=fffff;3=fffff\nMB:0=30;1=30;2=30;3=30\n")
+	r := c.NewReconciler(ReconcilerOptions{Repair: true})
+	if events, err := r.Reconcile(); err != nil {
+		t.Errorf("Reconcile() failed: %v", err)
+	} else if len(events) != 0 {
+		t.Errorf("unexpected drift detected: %v", events)
+	}
+	mockFs.verifyTextFile(schemataPath, "L3:0=fffff;1=fffff;2=fffff;3=fffff\nMB:0=30;1=30;2=30;3=30\n")
+
+	// Other values are still drift
+	mockFs.writeTextFile(schemataPath, "L3:0=fffff;1=fffff;2=fffff;3=fffff\nMB:0=30;1=40;2=30;3=30\n")
+	if events, err := r.Reconcile(); err != nil {
+		t.Errorf("Reconcile() failed: %v", err)
+	} else if len(events) != 1 || events[0].Kind != DriftSchemata || !events[0].Repaired {
+		t.Errorf("unexpected drift events %v", events)
+	}
+}
+
+// mkdirRecorderFs records the resctrl groups created
+type mkdirRecorderFs struct {
+	FileSystem
+	mutex  sync.Mutex
+	mkdirs []string
+}
+
+func (f *mkdirRecorderFs) Mkdir(path string) error {
+	f.mutex.Lock()
+	f.mkdirs = append(f.mkdirs, path)
+	f.mutex.Unlock()
+	return f.FileSystem.Mkdir(path)
+}
+
+// TestWatcher verifies that resctrl filesystem changes are reported and
+// reflected in the classes and monitoring groups
+func TestWatcher(t *testing.T) {
+	groupRemoveFunc = os.RemoveAll
+
+	mockFs, err := newMockResctrlFs(t, "resctrl.full", "")
+	if err != nil {
+		t.Fatalf("failed to set up mock resctrl fs: %v", err)
+	}
+	defer mockFs.delete()
+
+	recorder := &mkdirRecorderFs{FileSystem: osFileSystem{}}
+	c, err := NewControl(ControlOptions{ResctrlGroupPrefix: mockGroupPrefix, MountInfoPath: mockFs.mountInfoPath, FileSystem: recorder})
+	if err != nil {
+		t.Fatalf("NewControl() failed: %v", err)
+	}
+	recorder.mkdirs = nil
+
+	// Mock groups are staged and moved in place so that they are complete
+	// when the events arrive, like the groups created by the kernel
+	staging := filepath.Join(mockFs.baseDir, "staging")
+	if err := os.Mkdir(staging, 0755); err != nil {
+		t.Fatalf("%v", err)
+	}
+	stage := func(src, dst string) {
+		if err := exec.Command("cp", "-r", filepath.Join(mockFs.origDir, src), filepath.Join(staging, "group")).Run(); err != nil {
+			t.Fatalf("failed to copy mock data: %v", err)
+		}
+		if err := os.Rename(filepath.Join(staging, "group"), filepath.Join(mockFs.baseDir, "resctrl", dst)); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+	remove := func(path string) {
+		if err := os.RemoveAll(filepath.Join(mockFs.baseDir, "resctrl", path)); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+
+	w := c.NewWatcher()
+	if err := w.Start(); err != nil {
+		t.Fatalf("Watcher.Start() failed: %v", err)
+	}
+	defer w.Stop()
+	events, cancel := w.Subscribe(100)
+	defer cancel()
+
+	expectEvent := func(expected WatchEvent, skip ...WatchEventType) {
+		select {
+		case e := <-events:
+			for len(skip) > 0 && e.Type == skip[0] {
+				e = <-events
+			}
+			if !cmp.Equal(e, expected) {
+				t.Fatalf("unexpected watch event\nexpected: %+v\nfound:    %+v", expected, e)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout waiting for watch event %+v", expected)
+		}
+	}
+
+	mockFs.writeTextFile("schemata", "L3:0=ff\n")
+	expectEvent(WatchEvent{Type: WatchSchemataChanged, Group: "", Class: RootClassName})
+
+	// Managed groups are synced
+	stage("goresctrl.Stale", "goresctrl.New")
+	expectEvent(WatchEvent{Type: WatchGroupCreated, Group: "goresctrl.New", Class: "New"})
+	cls, ok := c.GetClass("New")
+	if !ok {
+		t.Fatalf("class created externally not found")
+	}
+
+	stage(filepath.Join("mon_groups", "example"), filepath.Join("goresctrl.New", "mon_groups", "goresctrl.mg"))
+	expectEvent(WatchEvent{Type: WatchMonGroupCreated, Group: "goresctrl.New/mon_groups/goresctrl.mg", Class: "New", MonGroup: "mg"})
+	if _, ok := cls.GetMonGroup("mg"); !ok {
+		t.Errorf("monitoring group created externally not found")
+	}
+
+	stage(filepath.Join("mon_groups", "example"), filepath.Join("mon_groups", "other"))
+	expectEvent(WatchEvent{Type: WatchMonGroupCreated, Group: "mon_groups/other", Class: RootClassName})
+
+	mockFs.writeTextFile(filepath.Join("goresctrl.New", "schemata"), "L3:0=ff\n")
+	expectEvent(WatchEvent{Type: WatchSchemataChanged, Group: "goresctrl.New", Class: "New"})
+
+	remove(filepath.Join("goresctrl.New", "mon_groups", "goresctrl.mg"))
+	expectEvent(WatchEvent{Type: WatchMonGroupRemoved, Group: "goresctrl.New/mon_groups/goresctrl.mg", Class: "New", MonGroup: "mg"})
+	if _, ok := cls.GetMonGroup("mg"); ok {
+		t.Errorf("monitoring group removed externally still found")
+	}
+
+	// Unlike the kernel, the mock fs removes the monitoring groups first
+	remove("goresctrl.New")
+	expectEvent(WatchEvent{Type: WatchGroupRemoved, Group: "goresctrl.New", Class: "New"}, WatchMonGroupRemoved)
+	if _, ok := c.GetClass("New"); ok {
+		t.Errorf("class removed externally still found")
+	}
+
+	// Unmanaged groups are only reported
+	stage("goresctrl.Stale", "other")
+	expectEvent(WatchEvent{Type: WatchGroupCreated, Group: "other"})
+	if n := len(c.GetClasses()); n != 3 {
+		t.Errorf("unexpected number of classes %d, expected 3", n)
+	}
+
+	// Changes lost in an inotify queue overflow are picked up by a re-scan.
+	// The queue is flooded while event handling is blocked, alternating the
+	// file names so that the kernel does not merge the events.
+	data, err := ioutil.ReadFile("/proc/sys/fs/inotify/max_queued_events")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	maxEvents, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	w.mutex.Lock()
+	for i := 0; i < maxEvents+8192; i++ {
+		mockFs.writeTextFile(fmt.Sprintf("flood-%d", i%2), "")
+	}
+	stage("goresctrl.Stale", "goresctrl.Lost")
+	remove("goresctrl.Stale")
+	stage(filepath.Join("mon_groups", "example"), filepath.Join("goresctrl.Guaranteed", "mon_groups", "goresctrl.lost"))
+	w.mutex.Unlock()
+
+	expected := map[WatchEvent]bool{
+		{Type: WatchGroupCreated, Group: "goresctrl.Lost", Class: "Lost"}:                                                            false,
+		{Type: WatchGroupRemoved, Group: "goresctrl.Stale", Class: "Stale"}:                                                          false,
+		{Type: WatchMonGroupCreated, Group: "goresctrl.Guaranteed/mon_groups/goresctrl.lost", Class: "Guaranteed", MonGroup: "lost"}: false,
+	}
+	for n := 0; n < len(expected); {
+		select {
+		case e := <-events:
+			if seen, ok := expected[e]; !ok || seen {
+				t.Fatalf("unexpected watch event after overflow: %+v", e)
+			}
+			expected[e] = true
+			n++
+		case <-time.After(10 * time.Second):
+			t.Fatalf("timeout waiting for watch events after overflow, received: %v", expected)
+		}
+	}
+	if _, ok := c.GetClass("Stale"); ok {
+		t.Errorf("class removed during overflow still found")
+	}
+	if cls, ok := c.GetClass("Guaranteed"); !ok {
+		t.Errorf("class Guaranteed not found")
+	} else if _, ok := cls.GetMonGroup("lost"); !ok {
+		t.Errorf("monitoring group created during overflow not found")
+	}
+	if _, ok := c.GetClass("Lost"); !ok {
+		t.Errorf("class created during overflow not found")
+	}
+	// New groups are watched after the re-scan
+	stage(filepath.Join("mon_groups", "example"), filepath.Join("goresctrl.Lost", "mon_groups", "goresctrl.mg"))
+	expectEvent(WatchEvent{Type: WatchMonGroupCreated, Group: "goresctrl.Lost/mon_groups/goresctrl.mg", Class: "Lost", MonGroup: "mg"})
+
+	// Groups are only observed, never created
+	e := WatchEvent{Type: WatchGroupCreated, Group: "goresctrl.Gone"}
+	c.syncWatchEvent(&e)
+	if _, ok := c.GetClass("Gone"); ok {
+		t.Errorf("class added for a non-existent group")
+	}
+	recorder.mutex.Lock()
+	if len(recorder.mkdirs) != 0 {
+		t.Errorf("resctrl groups created by the watcher: %v", recorder.mkdirs)
+	}
+	recorder.mutex.Unlock()
+
+	// Subscriber channels are closed when stopped
+	w.Stop()
+	remove("other")
+	select {
+	case e, ok := <-events:
+		if ok {
+			t.Errorf("unexpected event after stop: %+v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("subscriber channel not closed on stop")
+	}
+}
+
+// TestLock verifies the locking of the resctrl filesystem and the read-only
+// mode
+func TestLock(t *testing.T) {
+	const lockTestConfig string = `
+partitions:
+  part-1:
+    l3Allocation: 100%
+    classes:
+      class-1:
+        l3schema: 50%
+`
+	groupRemoveFunc = os.RemoveAll
+
+	mockFs, err := newMockResctrlFs(t, "resctrl.nomb", "")
+	if err != nil {
+		t.Fatalf("failed to set up mock resctrl fs: %v", err)
+	}
+	defer mockFs.delete()
+
+	opts := ControlOptions{ResctrlGroupPrefix: mockGroupPrefix, MountInfoPath: mockFs.mountInfoPath, LockTimeout: 50 * time.Millisecond}
+	c, err := NewControl(opts)
+	if err != nil {
+		t.Fatalf("NewControl() failed: %v", err)
+	}
+	root, _ := c.GetClass(RootClassName)
+
+	// Lock held by another process
+	f, err := os.Open(filepath.Join(mockFs.baseDir, "resctrl"))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer f.Close()
+	flock := func(how int) {
+		if err := syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB); err != nil {
+			t.Fatalf("flock failed: %v", err)
+		}
+	}
+
+	flock(syscall.LOCK_EX)
+	if _, err := NewControl(opts); !errors.Is(err, ErrLockTimeout) {
+		t.Errorf("expected ErrLockTimeout from NewControl(), got %v", err)
+	}
+	if err := c.SetConfig(parseTestConfig(t, lockTestConfig), true); !errors.Is(err, ErrLockTimeout) {
+		t.Errorf("expected ErrLockTimeout from SetConfig(), got %v", err)
+	}
+	if _, err := root.CreateMonGroup("mg", nil); !errors.Is(err, ErrLockTimeout) {
+		t.Errorf("expected ErrLockTimeout from CreateMonGroup(), got %v", err)
+	}
+
+	// Readers share the lock
+	flock(syscall.LOCK_SH)
+	ro, err := NewControl(ControlOptions{ResctrlGroupPrefix: mockGroupPrefix, MountInfoPath: mockFs.mountInfoPath, ReadOnly: true})
+	if err != nil {
+		t.Fatalf("NewControl() failed: %v", err)
+	}
+	if _, err := ro.GetIDBudget(); err != nil {
+		t.Errorf("GetIDBudget() failed: %v", err)
+	}
+	if _, err := ro.PlanConfig(parseTestConfig(t, lockTestConfig)); err != nil {
+		t.Errorf("PlanConfig() failed: %v", err)
+	}
+	if err := c.SetConfig(parseTestConfig(t, lockTestConfig), true); !errors.Is(err, ErrLockTimeout) {
+		t.Errorf("expected ErrLockTimeout from SetConfig(), got %v", err)
+	}
+
+	// Modifications are refused in read-only mode
+	roRoot, _ := ro.GetClass(RootClassName)
+	if err := ro.SetConfig(parseTestConfig(t, lockTestConfig), true); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("expected ErrReadOnly from SetConfig(), got %v", err)
+	}
+	if _, err := roRoot.CreateMonGroup("mg", nil); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("expected ErrReadOnly from CreateMonGroup(), got %v", err)
+	}
+	if err := roRoot.SetCpus(NewCPUSet(0)); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("expected ErrReadOnly from SetCpus(), got %v", err)
+	}
+	mockFs.verifyTextFile("cpus_list", "0-191\n")
+
+	// The lock is released after every operation
+	flock(syscall.LOCK_UN)
+	if err := c.SetConfig(parseTestConfig(t, lockTestConfig), true); err != nil {
+		t.Fatalf("SetConfig() failed: %v", err)
+	}
+	if cpus, err := root.GetCpus(); err != nil {
+		t.Errorf("GetCpus() failed: %v", err)
+	} else if err := root.SetCpus(cpus); err != nil {
+		t.Errorf("SetCpus() failed: %v", err)
+	}
+	flock(syscall.LOCK_EX)
+	flock(syscall.LOCK_UN)
+
+	// A shared lock is not converted into an exclusive one, not even without
+	// a timeout
+	c, err = NewControl(ControlOptions{ResctrlGroupPrefix: mockGroupPrefix, MountInfoPath: mockFs.mountInfoPath})
+	if err != nil {
+		t.Fatalf("NewControl() failed: %v", err)
+	}
+	root, _ = c.GetClass(RootClassName)
+	if err := c.lock.lock(false); err != nil {
+		t.Fatalf("failed to take shared lock: %v", err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		// Locked and unlocked by the same goroutine
+		if err := c.lock.lock(false); err != nil {
+			done <- err
+			return
+		}
+		defer c.lock.unlock()
+		done <- root.SetCpus(NewCPUSet(0, 1))
+	}()
+	select {
+	case err := <-done:
+		if err == nil || !strings.Contains(err.Error(), "while holding a shared lock") {
+			t.Errorf("expected an error from SetCpus() while holding a shared lock, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("SetCpus() blocked while holding a shared lock")
+	}
+
+	// Writers wait for the shared lock of other goroutines to be released,
+	// new readers wait for the writers
+	writerDone := make(chan error, 1)
+	go func() {
+		writerDone <- root.SetCpus(NewCPUSet(0, 1))
+	}()
+	waitingWriters := func() int {
+		c.lock.mutex.Lock()
+		defer c.lock.mutex.Unlock()
+		return c.lock.waitingWriters
+	}
+	for i := 0; waitingWriters() == 0; i++ {
+		if i > 500 {
+			t.Fatalf("writer not waiting for the lock")
+		}
+		time.Sleep(lockPollInterval)
+	}
+	readerDone := make(chan struct{})
+	go func() {
+		if err := c.lock.lock(false); err != nil {
+			t.Errorf("failed to take shared lock: %v", err)
+		} else {
+			c.lock.unlock()
+		}
+		close(readerDone)
+	}()
+	select {
+	case <-readerDone:
+		t.Errorf("reader took the lock before a waiting writer")
+	case err := <-writerDone:
+		t.Errorf("writer took the lock before it was released: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	c.lock.unlock()
+	if err := <-writerDone; err != nil {
+		t.Errorf("SetCpus() failed: %v", err)
+	}
+	<-readerDone
+	mockFs.verifyTextFile("cpus_list", "0-1\n")
+	flock(syscall.LOCK_EX)
+	flock(syscall.LOCK_UN)
+}
+
+// TestMount verifies kernel support detection and mount management
+func TestMount(t *testing.T) {
+	mockFs, err := newMockResctrlFs(t, "resctrl.full", "rw,relatime")
+	if err != nil {
+		t.Fatalf("failed to set up mock resctrl fs: %v", err)
+	}
+	defer mockFs.delete()
+
+	writeFile := func(name, data string) string {
+		path := filepath.Join(mockFs.baseDir, name)
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatalf("%v", err)
+		}
+		return path
+	}
+
+	origPaths := []string{procFilesystemsPath, cpuInfoPath}
+	origMount, origUnmount := mountFunc, unmountFunc
+	defer func() {
+		procFilesystemsPath, cpuInfoPath = origPaths[0], origPaths[1]
+		mountFunc, unmountFunc = origMount, origUnmount
+	}()
+	procFilesystemsPath = writeFile("filesystems", "nodev\tsysfs\nnodev\tresctrl\n\text4\n")
+	cpuInfoPath = writeFile("cpuinfo", "processor\t: 0\nflags\t\t: fpu cat_l3 cdp_l3 mba cqm_occup_llc cqm_mbm_total cqm_mbm_local\n\n"+
+		"processor\t: 1\nflags\t\t: fpu cat_l2\n")
+
+	calls := []string{}
+	mountFunc = func(source, target, fstype string, flags uintptr, data string) error {
+		calls = append(calls, "mount "+target+" "+data)
+		writeFile("mountinfo", "40 22 0:37 / "+target+" rw,relatime shared:20 - resctrl resctrl rw,"+data+"\n")
+		return nil
+	}
+	busy := false
+	unmountFunc = func(target string, flags int) error {
+		// The lock must not keep resctrl busy while unmounting
+		if f, err := os.Open(target); err != nil {
+			t.Errorf("%v", err)
+		} else {
+			if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+				t.Errorf("resctrl locked while unmounting: %v", err)
+			}
+			f.Close()
+		}
+		if flags == syscall.MNT_DETACH {
+			calls = append(calls, "detach "+target)
+		} else if flags != 0 {
+			t.Errorf("unexpected unmount flags %#x", flags)
+		} else if busy {
+			calls = append(calls, "busy "+target)
+			return syscall.EBUSY
+		} else {
+			calls = append(calls, "unmount "+target)
+		}
+		writeFile("mountinfo", "")
+		return nil
+	}
+	verifyCalls := func(expected ...string) {
+		if !cmp.Equal(calls, expected) && !(len(calls) == 0 && len(expected) == 0) {
+			t.Errorf("unexpected mount calls\nexpected: %q\nfound:    %q", expected, calls)
+		}
+		calls = []string{}
+	}
+	verifyMount := func(expected *MountInfo) {
+		if m, err := GetMount(); err != nil {
+			t.Errorf("GetMount() failed: %v", err)
+		} else if !cmp.Equal(m, expected) {
+			t.Errorf("unexpected mount\nexpected: %+v\nfound:    %+v", expected, m)
+		}
+	}
+
+	// Kernel support
+	expectedSupport := KernelSupport{Filesystem: true, CATL3: true, CDPL3: true, MBA: true, CMT: true, MBMTotal: true, MBMLocal: true}
+	if k, err := GetKernelSupport(); err != nil {
+		t.Errorf("GetKernelSupport() failed: %v", err)
+	} else if !cmp.Equal(k, expectedSupport) || !k.Supported() {
+		t.Errorf("unexpected kernel support\nexpected: %+v\nfound:    %+v", expectedSupport, k)
+	}
+
+	// Mounted already
+	resctrlPath := filepath.Join(mockFs.baseDir, "resctrl")
+	verifyMount(&MountInfo{Path: resctrlPath})
+	if err := Mount("", MountOptions{}); err != nil {
+		t.Errorf("Mount() failed: %v", err)
+	}
+	if err := Mount("", MountOptions{CDP: true}); err == nil {
+		t.Errorf("Mount() succeeded unexpectedly with different options")
+	}
+	verifyCalls()
+
+	// Remount is refused if groups exist
+	if err := Remount(MountOptions{CDP: true}, 0); !errors.Is(err, ErrGroupsExist) {
+		t.Errorf("expected ErrGroupsExist from Remount(), got %v", err)
+	}
+	if err := Unmount(false, 0); !errors.Is(err, ErrGroupsExist) {
+		t.Errorf("expected ErrGroupsExist from Unmount(), got %v", err)
+	}
+	verifyCalls()
+
+	// Other processes holding the lock block unmounting
+	resctrlDir, err := os.Open(filepath.Join(mockFs.baseDir, "resctrl"))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer resctrlDir.Close()
+	if err := syscall.Flock(int(resctrlDir.Fd()), syscall.LOCK_SH); err != nil {
+		t.Fatalf("flock failed: %v", err)
+	}
+	if err := Remount(MountOptions{CDP: true}, 50*time.Millisecond); !errors.Is(err, ErrLockTimeout) {
+		t.Errorf("expected ErrLockTimeout from Remount(), got %v", err)
+	}
+	if err := Unmount(true, 50*time.Millisecond); !errors.Is(err, ErrLockTimeout) {
+		t.Errorf("expected ErrLockTimeout from Unmount(), got %v", err)
+	}
+	verifyCalls()
+	if err := syscall.Flock(int(resctrlDir.Fd()), syscall.LOCK_UN); err != nil {
+		t.Fatalf("flock failed: %v", err)
+	}
+
+	for _, g := range []string{"Guaranteed", "goresctrl.Guaranteed", "goresctrl.Stale", "non_goresctrl.Group", "mon_groups/example", "mon_groups/non_goresctrl.group"} {
+		if err := os.RemoveAll(filepath.Join(resctrlPath, g)); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+
+	// Busy resctrl is only detached when forced
+	busy = true
+	if err := Remount(MountOptions{CDP: true}, 0); !errors.Is(err, syscall.EBUSY) {
+		t.Errorf("expected EBUSY from Remount(), got %v", err)
+	}
+	verifyCalls("busy " + resctrlPath)
+	if err := Unmount(false, 0); !errors.Is(err, syscall.EBUSY) {
+		t.Errorf("expected EBUSY from Unmount(), got %v", err)
+	}
+	verifyCalls("busy " + resctrlPath)
+	verifyMount(&MountInfo{Path: resctrlPath})
+	if err := Unmount(true, 0); err != nil {
+		t.Errorf("Unmount() failed: %v", err)
+	}
+	verifyCalls("busy "+resctrlPath, "detach "+resctrlPath)
+	verifyMount(nil)
+	busy = false
+	writeFile("mountinfo", "40 22 0:37 / "+resctrlPath+" rw,relatime shared:20 - resctrl resctrl rw\n")
+
+	// Remount
+	if err := Remount(MountOptions{CDPL2: true}, 0); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("expected ErrNotSupported from Remount(), got %v", err)
+	}
+	if err := Remount(MountOptions{CDP: true, MBps: true}, 0); err != nil {
+		t.Errorf("Remount() failed: %v", err)
+	}
+	verifyCalls("unmount "+resctrlPath, "mount "+resctrlPath+" cdp,mba_MBps")
+	verifyMount(&MountInfo{Path: resctrlPath, Options: MountOptions{CDP: true, MBps: true}})
+	if err := Remount(MountOptions{CDP: true, MBps: true}, 0); err != nil {
+		t.Errorf("Remount() failed: %v", err)
+	}
+	verifyCalls()
+
+	// Unmount and mount
+	if err := Unmount(false, 0); err != nil {
+		t.Errorf("Unmount() failed: %v", err)
+	}
+	verifyCalls("unmount " + resctrlPath)
+	verifyMount(nil)
+	if err := Remount(MountOptions{}, 0); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("expected ErrNotSupported from Remount(), got %v", err)
+	}
+	mountPoint := filepath.Join(mockFs.baseDir, "mnt")
+	if err := Mount(mountPoint, MountOptions{Debug: true}); err != nil {
+		t.Errorf("Mount() failed: %v", err)
+	}
+	verifyCalls("mount " + mountPoint + " debug")
+	if _, err := os.Stat(mountPoint); err != nil {
+		t.Errorf("mount point not created: %v", err)
+	}
+
+	// No kernel support
+	writeFile("mountinfo", "")
+	procFilesystemsPath = writeFile("filesystems", "nodev\tsysfs\n")
+	if err := Mount(mountPoint, MountOptions{}); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("expected ErrNotSupported from Mount(), got %v", err)
+	}
+	verifyCalls()
+}
+
+// TestParseMountInfo tests detecting the resctrl mount from the mount table
+func TestParseMountInfo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goresctrl.test.")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	const (
+		sysfs   = "17 22 0:17 / /sys rw,nosuid,nodev,noexec,relatime shared:6 - sysfs sysfs rw\n"
+		resctrl = "40 17 0:37 / /sys/fs/resctrl rw,relatime shared:20 - resctrl resctrl rw,mba_MBps\n"
+	)
+
+	tcs := []struct {
+		name          string
+		data          string
+		expectedPath  string
+		expectedOpts  MountOptions
+		expectedError error
+	}{
+		{
+			name:         "mountinfo",
+			data:         sysfs + resctrl,
+			expectedPath: "/sys/fs/resctrl",
+			expectedOpts: MountOptions{MBps: true},
+		},
+		{
+			name:         "no optional fields",
+			data:         "40 17 0:37 / /sys/fs/resctrl rw,relatime - resctrl resctrl rw,cdp,cdpl2\n",
+			expectedPath: "/sys/fs/resctrl",
+			expectedOpts: MountOptions{CDP: true, CDPL2: true},
+		},
+		{
+			name:         "multiple optional fields",
+			data:         "40 17 0:37 / /sys/fs/resctrl rw,relatime shared:20 master:1 - resctrl resctrl rw,debug\n",
+			expectedPath: "/sys/fs/resctrl",
+			expectedOpts: MountOptions{Debug: true},
+		},
+		{
+			name:         "octal escapes",
+			data:         sysfs + "40 17 0:37 / /mnt/res\\040ctrl\\134x rw,relatime - resctrl resctrl rw\n",
+			expectedPath: "/mnt/res ctrl\\x",
+		},
+		{
+			name:         "multiple mounts",
+			data:         sysfs + resctrl + "41 22 0:37 / /mnt/resctrl rw,relatime shared:20 - resctrl resctrl rw,mba_MBps\n",
+			expectedPath: "/sys/fs/resctrl",
+			expectedOpts: MountOptions{MBps: true},
+		},
+		{
+			name:         "bind mount of a group",
+			data:         sysfs + "41 22 0:37 /goresctrl.c1 /mnt/c1 rw,relatime - resctrl resctrl rw\n" + resctrl,
+			expectedPath: "/sys/fs/resctrl",
+			expectedOpts: MountOptions{MBps: true},
+		},
+		{
+			name:          "only bind mount of a group",
+			data:          sysfs + "41 22 0:37 /goresctrl.c1 /mnt/c1 rw,relatime - resctrl resctrl rw\n",
+			expectedError: ErrNotSupported,
+		},
+		{
+			name:          "not mounted",
+			data:          sysfs,
+			expectedError: ErrNotSupported,
+		},
+		{
+			name:         "proc mounts",
+			data:         "sysfs /sys sysfs rw,nosuid 0 0\nresctrl /sys/fs/resctrl resctrl rw,relatime,cdp 0 0\n",
+			expectedPath: "/sys/fs/resctrl",
+			expectedOpts: MountOptions{CDP: true},
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(dir, "mountinfo")
+			if err := ioutil.WriteFile(path, []byte(tc.data), 0644); err != nil {
+				t.Fatalf("%v", err)
+			}
+
+			m, err := findResctrlMount(path)
+			if tc.expectedError != nil {
+				if !errors.Is(err, tc.expectedError) {
+					t.Errorf("expected error %v, got %v", tc.expectedError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if m.mountPoint != tc.expectedPath {
+				t.Errorf("expected mount point %q, got %q", tc.expectedPath, m.mountPoint)
+			}
+			if opts := mountOptionsFromSet(m.options); opts != tc.expectedOpts {
+				t.Errorf("expected mount options %+v, got %+v", tc.expectedOpts, opts)
+			}
+		})
+	}
+
+	if _, err := findResctrlMount(filepath.Join(dir, "non-existent")); err == nil {
+		t.Errorf("expected an error for a non-existent mount table")
+	}
+}
+
+// noSpaceFs fails the creation of resctrl groups like the kernel does when
+// it runs out of CLOSIDs or RMIDs
+type noSpaceFs struct {
+	FileSystem
+}
+
+func (noSpaceFs) Mkdir(path string) error {
+	if _, err := os.Stat(path); err == nil {
+		return &os.PathError{Op: "mkdir", Path: path, Err: syscall.EEXIST}
+	}
+	return &os.PathError{Op: "mkdir", Path: path, Err: syscall.ENOSPC}
+}
+
+// TestIDBudget tests the accounting and enforcement of CLOSIDs and RMIDs
+func TestIDBudget(t *testing.T) {
+	mockFs, err := newMockResctrlFs(t, "resctrl.full", "")
+	if err != nil {
+		t.Fatalf("failed to set up mock resctrl fs: %v", err)
+	}
+	defer mockFs.delete()
+
+	groupRemoveFunc = os.RemoveAll
+	c, err := NewControl(ControlOptions{ResctrlGroupPrefix: mockGroupPrefix, MountInfoPath: mockFs.mountInfoPath})
+	if err != nil {
+		t.Fatalf("NewControl() failed: %v", err)
+	}
+
+	budget, err := c.GetIDBudget()
+	if err != nil {
+		t.Fatalf("GetIDBudget() failed: %v", err)
+	}
+	if budget.Closids.Total != 8 || budget.Rmids.Total != 192 {
+		t.Errorf("unexpected id totals %+v", budget)
+	}
+	if budget.Closids.Used == 0 || budget.Rmids.Used < budget.Closids.Used {
+		t.Errorf("unexpected id usage %+v", budget)
+	}
+
+	// More classes than CLOSIDs
+	conf := "partitions:\n  part:\n    l3Allocation: 100%\n    classes:\n"
+	for i := uint64(0); i < budget.Closids.Total; i++ {
+		conf += fmt.Sprintf("      class-%d:\n", i)
+	}
+	err = c.SetConfig(parseTestConfig(t, conf), false)
+	if !errors.Is(err, ErrClosidsExhausted) || !errors.Is(err, ErrResourcesExhausted) {
+		t.Errorf("expected ErrClosidsExhausted from SetConfig(), got %v", err)
+	} else if errors.Is(err, ErrRmidsExhausted) {
+		t.Errorf("unexpected ErrRmidsExhausted from SetConfig(): %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(mockFs.baseDir, "resctrl", mockGroupPrefix+"class-0")); !os.IsNotExist(err) {
+		t.Errorf("resctrl group created despite exhausted CLOSIDs: %v", err)
+	}
+	if _, ok := c.GetClass("class-0"); ok {
+		t.Errorf("class created despite exhausted CLOSIDs")
+	}
+
+	// The kernel refuses to create a monitoring group when out of RMIDs
+	c, err = NewControl(ControlOptions{ResctrlGroupPrefix: mockGroupPrefix, MountInfoPath: mockFs.mountInfoPath,
+		FileSystem: noSpaceFs{osFileSystem{}}})
+	if err != nil {
+		t.Fatalf("NewControl() failed: %v", err)
+	}
+	cls, _ := c.GetClass("Guaranteed")
+	_, err = cls.CreateMonGroup("mg", nil)
+	if !errors.Is(err, ErrRmidsExhausted) || !errors.Is(err, ErrResourcesExhausted) || !errors.Is(err, syscall.ENOSPC) {
+		t.Errorf("expected ErrRmidsExhausted from CreateMonGroup(), got %v", err)
+	} else if errors.Is(err, ErrClosidsExhausted) {
+		t.Errorf("unexpected ErrClosidsExhausted from CreateMonGroup(): %v", err)
+	}
+	if _, ok := cls.GetMonGroup("mg"); ok {
+		t.Errorf("monitoring group created despite exhausted RMIDs")
+	}
+
+	// ...or a control group when out of CLOSIDs
+	conf = "partitions:\n  part:\n    l3Allocation: 100%\n    classes:\n      Guaranteed:\n      Stale:\n      New:\n"
+	err = c.SetConfig(parseTestConfig(t, conf), false)
+	if !errors.Is(err, ErrClosidsExhausted) || !errors.Is(err, syscall.ENOSPC) {
+		t.Errorf("expected ErrClosidsExhausted from SetConfig(), got %v", err)
+	} else if errors.Is(err, ErrRmidsExhausted) {
+		t.Errorf("unexpected ErrRmidsExhausted from SetConfig(): %v", err)
+	}
+}
+
+// TestSetConfigRollback verifies that a failed reconfiguration is reverted
+func TestSetConfigRollback(t *testing.T) {
+	const rollbackTestConfig string = `
+partitions:
+  default:
+    l3Allocation: 100%
+    mbAllocation: [100%]
+    classes:
+      Guaranteed:
+        l3schema: 50%
+      Burstable:
+        l3schema: 50%
+        mbschema: [50%]
+      Broken:
+        l3schema: 50%
+`
+	groupRemoveFunc = os.RemoveAll
+
+	mockFs, err := newMockResctrlFs(t, "resctrl.full", "")
+	if err != nil {
+		t.Fatalf("failed to set up mock resctrl fs: %v", err)
+	}
+	defer mockFs.delete()
+
+	// Mock a group whose schemata cannot be accessed
+	if err := os.MkdirAll(filepath.Join(mockFs.baseDir, "resctrl", mockGroupPrefix+"Broken", "schemata"), 0755); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	if err := Initialize(mockGroupPrefix); err != nil {
+		t.Fatalf("rdt initialization failed: %v", err)
+	}
+	classNames := func() []string {
+		names := []string{}
+		for _, cls := range GetClasses() {
+			names = append(names, cls.Name())
+		}
+		sort.Strings(names)
+		return names
+	}
+	origClasses := classNames()
+
+	err = SetConfig(parseTestConfig(t, rollbackTestConfig), true)
+	if err == nil {
+		t.Fatalf("SetConfig() succeeded unexpectedly")
+	}
+	if !strings.Contains(err.Error(), `re-created removed classes "Stale"`) {
+		t.Errorf("unexpected error message: %v", err)
+	}
+
+	origSchemata := "L3:0=fffff;1=fffff;2=fffff;3=fffff\nMB:0=100;1=100;2=100;3=100\n"
+	mockFs.verifyTextFile("schemata", origSchemata)
+	mockFs.verifyTextFile(filepath.Join(mockGroupPrefix+"Guaranteed", "schemata"), origSchemata)
+	mockFs.verifyTextFile(filepath.Join(mockGroupPrefix+"Stale", "schemata"), origSchemata)
+	if _, err := os.Stat(filepath.Join(mockFs.baseDir, "resctrl", mockGroupPrefix+"Burstable")); !os.IsNotExist(err) {
+		t.Errorf("created resctrl group not removed in rollback: %v", err)
+	}
+	if names := classNames(); !cmp.Equal(names, origClasses) {
+		t.Errorf("unexpected classes after rollback: expected %v, got %v", origClasses, names)
+	}
+}
+
+// TestPlanConfig tests the dry-run mode of configuration
+func TestPlanConfig(t *testing.T) {
+	const planTestConfig string = `
+partitions:
+  default:
+    l3Allocation: 100%
+    mbAllocation: [5%]
+    classes:
+      Guaranteed:
+        l3schema: 100%
+      Burstable:
+        l3schema: 50%
+        cpus: 0-3
+`
+	mockFs, err := newMockResctrlFs(t, "resctrl.full", "")
+	if err != nil {
+		t.Fatalf("failed to set up mock resctrl fs: %v", err)
+	}
+	defer mockFs.delete()
+
+	if err := Initialize(mockGroupPrefix); err != nil {
+		t.Fatalf("rdt initialization failed: %v", err)
+	}
+	staleTasks := filepath.Join(mockFs.baseDir, "resctrl", mockGroupPrefix+"Stale", "tasks")
+	if err := ioutil.WriteFile(staleTasks, []byte("42\n"), 0644); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	plan, err := PlanConfig(parseTestConfig(t, planTestConfig))
+	if err != nil {
+		t.Fatalf("PlanConfig() failed: %v", err)
+	}
+
+	expected := &Plan{
+		Create:   []string{"Burstable"},
+		Delete:   []string{"Stale"},
+		Blocking: []string{"Stale"},
+		Schemata: map[string]string{
+			"Guaranteed": "L3:0=fffff;1=fffff;2=fffff;3=fffff\nMB:0=10;1=10;2=10;3=10\n",
+			"Burstable":  "L3:0=3ff;1=3ff;2=3ff;3=3ff\nMB:0=10;1=10;2=10;3=10\n",
+		},
+		Cpus: map[string]string{"Burstable": "0-3"},
+		Warnings: []string{
+			`L3 allocation 0xfffff of partition "default" for cache id 0 overlaps with ways 0xc0000 used by hardware`,
+			`L3 allocation 0xfffff of partition "default" for cache id 1 overlaps with ways 0xc0000 used by hardware`,
+			`L3 allocation 0xfffff of partition "default" for cache id 2 overlaps with ways 0xc0000 used by hardware`,
+			`L3 allocation 0xfffff of partition "default" for cache id 3 overlaps with ways 0xc0000 used by hardware`,
+			`MB allocation of partition "default" for cache id 0 raised from 5% to the minimum of 10%`,
+			`MB allocation of partition "default" for cache id 1 raised from 5% to the minimum of 10%`,
+			`MB allocation of partition "default" for cache id 2 raised from 5% to the minimum of 10%`,
+			`MB allocation of partition "default" for cache id 3 raised from 5% to the minimum of 10%`,
+		},
+	}
+	if !cmp.Equal(plan, expected) {
+		t.Errorf("unexpected plan:\n%s", cmp.Diff(expected, plan))
+	}
+
+	// Planning must not touch the filesystem
+	if _, err := os.Stat(filepath.Join(mockFs.baseDir, "resctrl", mockGroupPrefix+"Burstable")); !os.IsNotExist(err) {
+		t.Errorf("resctrl group created by PlanConfig(): %v", err)
+	}
+	mockFs.verifyTextFile(filepath.Join(mockGroupPrefix+"Guaranteed", "schemata"), "L3:0=fffff;1=fffff;2=fffff;3=fffff\nMB:0=100;1=100;2=100;3=100\n")
+	mockFs.verifyTextFile(filepath.Join(mockGroupPrefix+"Stale", "tasks"), "42\n")
+
+	if _, err := PlanConfig(parseTestConfig(t, "partitions: {default: {l3Allocation: 200%}}")); err == nil {
+		t.Errorf("PlanConfig() succeeded unexpectedly with invalid configuration")
+	}
+}
+
+// TestHardwareProfile tests capturing hardware profiles and validating
+// configurations against them
+func TestHardwareProfile(t *testing.T) {
+	const (
+		l3Config = `
+partitions:
+  default:
+    l3Allocation: 100%
+    classes:
+      Guaranteed:
+        l3schema: 50%
+`
+		l2Config = `
+partitions:
+  default:
+    l2Allocation: 100%
+    classes:
+      Guaranteed:
+        l2schema: 50%
+`
+		l2Profile = `
+numClosids: 2
+l2:
+  cacheIds: [0, 1]
+  cbmMask: "0xff"
+  minCbmBits: 2
+  cdp: true
+`
+	)
+
+	for _, fs := range []string{"resctrl.full", "resctrl.nomb.cdp", "resctrl.l2.cdp"} {
+		mockFs, err := newMockResctrlFs(t, fs, "")
+		if err != nil {
+			t.Fatalf("failed to set up mock resctrl fs: %v", err)
+		}
+
+		hw, err := DiscoverHardwareProfile()
+		if err != nil {
+			t.Errorf("DiscoverHardwareProfile() failed on %s: %v", fs, err)
+		}
+		info, err := getRdtInfo(defaultMountInfoPath)
+		if err != nil {
+			t.Errorf("getRdtInfo() failed on %s: %v", fs, err)
+		}
+		mockFs.delete()
+
+		// Serialization round-trip must not lose anything
+		data, err := yaml.Marshal(hw)
+		if err != nil {
+			t.Fatalf("failed to marshal hardware profile: %v", err)
+		}
+		hw2 := HardwareProfile{}
+		if err := yaml.Unmarshal(data, &hw2); err != nil {
+			t.Fatalf("failed to unmarshal hardware profile: %v", err)
+		}
+		if !cmp.Equal(hw, hw2) {
+			t.Errorf("hardware profile of %s changed in serialization:\n%s", fs, cmp.Diff(hw, hw2))
+		}
+
+		// Conversion back to resctrlInfo must not lose anything relevant
+		info.resctrlPath = ""
+		info.mountOpts = MountOptions{}
+		opt := cmp.AllowUnexported(resctrlInfo{}, catInfoAll{}, catInfo{}, l3MonInfo{}, mbInfo{})
+		if info2 := hw2.resctrlInfo(); !cmp.Equal(info, info2, opt) {
+			t.Errorf("hardware profile of %s did not convert back to original info:\n%s", fs, cmp.Diff(info, info2, opt))
+		}
+
+		if err := ValidateConfig(parseTestConfig(t, l3Config), hw2); err != nil {
+			t.Errorf("valid configuration failed validation on %s: %v", fs, err)
+		}
+		err = ValidateConfig(parseTestConfig(t, l2Config), hw2)
+		if hw2.L2 != nil && err != nil {
+			t.Errorf("valid configuration failed validation on %s: %v", fs, err)
+		} else if hw2.L2 == nil && err == nil {
+			t.Errorf("L2 configuration passed validation on %s without L2 support", fs)
+		}
+	}
+
+	// With CDP the ways used by hardware on the data side must not be lost
+	mockFs, err := newMockResctrlFs(t, "resctrl.nomb.cdp", "")
+	if err != nil {
+		t.Fatalf("failed to set up mock resctrl fs: %v", err)
+	}
+	usage := "0=00000000000SSSSSSSSS;1=00000000000SSSSSSSSS;2=00000000000SSSSSSSSS;3=00000000000SSSSSSSSS\n"
+	if err := ioutil.WriteFile(filepath.Join(mockFs.baseDir, "resctrl", "info", "L3CODE", "bit_usage"), []byte(usage), 0644); err != nil {
+		t.Fatalf("failed to write bit usage: %v", err)
+	}
+	cdpHw, err := DiscoverHardwareProfile()
+	if err != nil {
+		t.Errorf("DiscoverHardwareProfile() failed: %v", err)
+	}
+	mockFs.delete()
+	expectedBits := map[uint64]Bitmask{0: 0xc0000, 1: 0xc0000, 2: 0xc0000, 3: 0xc0000}
+	if !cmp.Equal(cdpHw.L3.HardwareBits, expectedBits) {
+		t.Errorf("unexpected hardware bits with CDP:\n%s", cmp.Diff(expectedBits, cdpHw.L3.HardwareBits))
+	}
+	exclusiveConfig := `
+partitions:
+  default:
+    l3Allocation: "0xc0000"
+    classes:
+      Guaranteed:
+        mode: exclusive
+`
+	if err := ValidateConfig(parseTestConfig(t, exclusiveConfig), cdpHw); err == nil {
+		t.Errorf("exclusive allocation of ways used by hardware passed validation with CDP")
+	} else if !strings.Contains(err.Error(), "shared with hardware") {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// Validation against a hand-written profile
+	hw := HardwareProfile{}
+	if err := yaml.Unmarshal([]byte(l2Profile), &hw); err != nil {
+		t.Fatalf("failed to unmarshal hardware profile: %v", err)
+	}
+	if err := ValidateConfig(parseTestConfig(t, l2Config), hw); err != nil {
+		t.Errorf("valid configuration failed validation: %v", err)
+	}
+	if err := ValidateConfig(parseTestConfig(t, l3Config), hw); err == nil {
+		t.Errorf("L3 configuration passed validation without L3 support")
+	}
+	tooManyClasses := l2Config + `      Burstable:
+        l2schema: 50%
+`
+	if err := ValidateConfig(parseTestConfig(t, tooManyClasses), hw); err == nil {
+		t.Errorf("configuration passed validation with too few CLOSIDs")
+	}
+}
+
+// TestBitUsage tests parsing and querying the usage of cache ways
+func TestBitUsage(t *testing.T) {
+	testSet := map[string]map[uint64]BitUsage{
+		"":                  {},
+		"0=SSSS":            {0: {Software: 0xf}},
+		"0=XXSS00;1=HEEPP0": {0: {Hardware: 0x30, Software: 0x3c}, 1: {Hardware: 0x20, Exclusive: 0x18, PseudoLocked: 0x6}},
+	}
+	for data, expected := range testSet {
+		usage, err := parseBitUsage(data)
+		if err != nil {
+			t.Errorf("unexpected error when parsing %q: %v", data, err)
+		} else if !cmp.Equal(usage, expected) {
+			t.Errorf("from %q expected %v, got %v", data, expected, usage)
+		}
+	}
+	for _, data := range []string{"0", "a=SS", "0=SSY", "0=SS;"} {
+		if usage, err := parseBitUsage(data); err == nil {
+			t.Errorf("expected err but got %v when parsing %q", usage, data)
+		}
+	}
+
+	mockFs, err := newMockResctrlFs(t, "resctrl.nomb.cdp", "")
+	if err != nil {
+		t.Fatalf("failed to set up mock resctrl fs: %v", err)
+	}
+	defer mockFs.delete()
+
+	if err := Initialize(mockGroupPrefix); err != nil {
+		t.Fatalf("rdt initialization failed: %v", err)
+	}
+	usage, err := GetBitUsage("L3CODE")
+	if err != nil {
+		t.Fatalf("GetBitUsage() failed: %v", err)
+	}
+	for id := uint64(0); id < 4; id++ {
+		if u := usage[id]; u != (BitUsage{Hardware: 0xc0000, Software: 0x1ff}) || u.Used() != 0xc01ff {
+			t.Errorf("unexpected bit usage of cache id %d: %+v", id, u)
+		}
+	}
+	if _, err := GetBitUsage("L3"); err == nil {
+		t.Errorf("GetBitUsage() succeeded unexpectedly for a resource not enabled")
+	}
+
+	// Exclusive allocations must not overlap with ways used by hardware
+	conf := `
+partitions:
+  default:
+    l3Allocation: "0x60000"
+    classes:
+      Guaranteed:
+        mode: exclusive
+`
+	if err := SetConfig(parseTestConfig(t, conf), false); err == nil {
+		t.Errorf("SetConfig() succeeded unexpectedly")
+	} else if !strings.Contains(err.Error(), "overlaps with bits 0x40000 shared with hardware") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+// TestGetInfo tests the system capability description
+func TestGetInfo(t *testing.T) {
+	mockFs, err := newMockResctrlFs(t, "resctrl.full", "")
+	if err != nil {
+		t.Fatalf("failed to set up mock resctrl fs: %v", err)
+	}
+
+	if err := Initialize(mockGroupPrefix); err != nil {
+		t.Fatalf("rdt initialization failed: %v", err)
+	}
+	info, err := GetInfo()
+	if err != nil {
+		t.Fatalf("GetInfo() failed: %v", err)
+	}
+
+	cacheSize := uint64(57671680)
+	expected := Info{
+		ResctrlPath: filepath.Join(mockFs.baseDir, "resctrl"),
+		NumClosids:  8,
+		L3: &CacheInfo{
+			CacheIds:   []uint64{0, 1, 2, 3},
+			CacheSizes: map[uint64]uint64{0: cacheSize, 1: cacheSize, 2: cacheSize, 3: cacheSize},
+			Resources: []CacheResourceInfo{{
+				Name:          "L3",
+				NumClosids:    16,
+				CbmMask:       0xfffff,
+				NumCbmBits:    20,
+				MinCbmBits:    1,
+				ShareableBits: 0xc0000,
+				HardwareBits:  map[uint64]Bitmask{0: 0xc0000, 1: 0xc0000, 2: 0xc0000, 3: 0xc0000},
+			}},
+		},
+		MB: &MBAInfo{
+			NumClosids:    8,
+			CacheIds:      []uint64{0, 1, 2, 3},
+			BandwidthGran: 10,
+			DelayLinear:   true,
+			MinBandwidth:  10,
+		},
+		L3Mon: &L3MonitoringInfo{
+			NumRmids:    192,
+			MonFeatures: []string{"llc_occupancy", "mbm_local_bytes", "mbm_total_bytes"},
+		},
+	}
+	if !cmp.Equal(info, expected) {
+		t.Errorf("unexpected info:\n%s", cmp.Diff(expected, info))
+	}
+
+	// Modifying the returned copy must not affect the Control
+	info.L3.Resources[0].CbmMask = 0xf
+	info.L3Mon.MonFeatures[0] = "foo"
+	info, _ = GetInfo()
+	if !cmp.Equal(info, expected) {
+		t.Errorf("info changed by modifying a copy:\n%s", cmp.Diff(expected, info))
+	}
+
+	data, err := json.Marshal(info)
+	if err != nil {
+		t.Fatalf("failed to marshal info: %v", err)
+	}
+	if !strings.Contains(string(data), `"cbmMask":"0xfffff","numCbmBits":20`) {
+		t.Errorf("unexpected JSON encoding of info: %s", data)
+	}
+
+	// CDP is visible per resource
+	mockFs.delete()
+	mockFs, err = newMockResctrlFs(t, "resctrl.l2.cdp", "")
+	if err != nil {
+		t.Fatalf("failed to set up mock resctrl fs: %v", err)
+	}
+	defer mockFs.delete()
+	if err := Initialize(mockGroupPrefix); err != nil {
+		t.Fatalf("rdt initialization failed: %v", err)
+	}
+	info, _ = GetInfo()
+	if !info.L2.CDP || len(info.L2.Resources) != 2 || info.L2.Resources[0].Name != "L2CODE" || info.L2.Resources[1].NumClosids != 4 {
+		t.Errorf("unexpected L2 info: %+v", info.L2)
+	}
+	if info.L3.CDP || info.MB != nil {
+		t.Errorf("unexpected info: %+v", info)
+	}
+}
+
+// TestMBSampler tests memory bandwidth rate sampling
+func TestMBSampler(t *testing.T) {
+	mockFs, err := newMockResctrlFs(t, "resctrl.full", "")
+	if err != nil {
+		t.Fatalf("failed to set up mock resctrl fs: %v", err)
+	}
+	defer mockFs.delete()
+
+	groupRemoveFunc = os.RemoveAll
+	if err := Initialize(mockGroupPrefix); err != nil {
+		t.Fatalf("rdt initialization failed: %v", err)
+	}
+	mockFs.initMockMonGroup("Guaranteed", "mg")
+	cls, _ := GetClass("Guaranteed")
+	if _, err := cls.CreateMonGroup("mg", map[string]string{"a": "b"}); err != nil {
+		t.Fatalf("CreateMonGroup() failed: %v", err)
+	}
+
+	setCounters := func(group string, total, local uint64) {
+		for id := 0; id < 4; id++ {
+			dir := filepath.Join(group, "mon_data", fmt.Sprintf("mon_L3_%02d", id))
+			mockFs.writeTextFile(filepath.Join(dir, "mbm_total_bytes"), fmt.Sprintf("%d\n", total+uint64(id)))
+			mockFs.writeTextFile(filepath.Join(dir, "mbm_local_bytes"), fmt.Sprintf("%d\n", local))
+		}
+	}
+	mgPath := filepath.Join(mockGroupPrefix+"Guaranteed", "mon_groups", mockGroupPrefix+"mg")
+
+	s := NewMBSampler(MBSamplerOptions{CounterWidth: 24})
+	t0 := time.Now()
+
+	setCounters(mgPath, 1000, 500)
+	s.sample(t0)
+	if r := s.GetRates(); len(r) != 0 {
+		t.Errorf("expected no rates after the first sample, got %v", r)
+	}
+
+	// Normal increase
+	setCounters(mgPath, 5000, 2500)
+	s.sample(t0.Add(2 * time.Second))
+	if r, ok := s.GetGroupRates("Guaranteed", "mg"); !ok {
+		t.Errorf("no rates for monitoring group")
+	} else if r[0] != (MBRate{Total: 2000, Local: 1000}) {
+		t.Errorf("unexpected rates %v", r[0])
+	}
+	if r, ok := s.GetGroupRates("Guaranteed", ""); !ok {
+		t.Errorf("no rates for class")
+	} else if r[0] != (MBRate{}) {
+		t.Errorf("unexpected rates %v", r[0])
+	}
+
+	// Counter wraparound
+	setCounters(mgPath, 1<<24-1000, 2500)
+	s.sample(t0.Add(3 * time.Second))
+	setCounters(mgPath, 1000, 2500)
+	s.sample(t0.Add(4 * time.Second))
+	if r, _ := s.GetGroupRates("Guaranteed", "mg"); r[3] != (MBRate{Total: 2000, Local: 0}) {
+		t.Errorf("unexpected rates after wraparound %v", r[3])
+	}
+
+	// With 64-bit counters a decrease is a counter reset
+	s64 := NewMBSampler(MBSamplerOptions{})
+	setCounters(mgPath, 5000, 2500)
+	s64.sample(t0)
+	setCounters(mgPath, 1000, 3500)
+	s64.sample(t0.Add(time.Second))
+	if r, _ := s64.GetGroupRates("Guaranteed", "mg"); r[0] != (MBRate{Total: 0, Local: 1000}) {
+		t.Errorf("unexpected rates after counter reset %v", r[0])
+	}
+
+	// Prometheus gauges
+	RegisterCustomPrometheusLabels("a")
+	numMetrics := 0
+	for _, r := range s.GetRates() {
+		numMetrics += 2 * len(r.Rates)
+	}
+	if n := testutil.CollectAndCount(NewMBRateCollector(s)); n == 0 || n != numMetrics {
+		t.Errorf("unexpected number of metrics %d, expected %d", n, numMetrics)
+	}
+
+	// Labels registered after the first collection
+	RegisterCustomPrometheusLabels("c")
+	if n := testutil.CollectAndCount(NewMBRateCollector(s)); n != numMetrics {
+		t.Errorf("unexpected number of metrics %d after adding labels, expected %d", n, numMetrics)
+	}
+
+	// Features not supported by the system are not exported
+	totalOnly := newMBSampler(MBSamplerOptions{}, GetClasses, func() map[MonResource][]string {
+		return map[MonResource][]string{MonResourceL3: {"llc_occupancy", mbmTotalBytes}}
+	})
+	totalOnly.sample(t0)
+	totalOnly.sample(t0.Add(time.Second))
+	if n, expected := testutil.CollectAndCount(NewMBRateCollector(totalOnly)), numMetrics/2; n != expected {
+		t.Errorf("unexpected number of metrics %d with local bandwidth unsupported, expected %d", n, expected)
+	}
+
+	// Background sampling
+	s.Start()
+	s.Start()
+	s.Stop()
+	s.Stop()
+
+	// Removed groups are forgotten
+	if err := cls.DeleteMonGroup("mg"); err != nil {
+		t.Fatalf("DeleteMonGroup() failed: %v", err)
+	}
+	s.sample(t0.Add(5 * time.Second))
+	if _, ok := s.GetGroupRates("Guaranteed", "mg"); ok {
+		t.Errorf("rates of a deleted monitoring group still available")
+	}
+}
+
+// TestConcurrency exercises the locking model of the package. It is most
+// useful when run with the race detector enabled.
+func TestConcurrency(t *testing.T) {
+	const (
+		confA = `
+partitions:
+  default:
+    l3Allocation: 100%
+    mbAllocation: [100%]
+    classes:
+      Guaranteed:
+        l3schema: 100%
+      BestEffort:
+        l3schema: 50%
+`
+		confB = `
+partitions:
+  default:
+    l3Allocation: 100%
+    mbAllocation: [100%]
+    classes:
+      Guaranteed:
+        l3schema: 50%
+`
+		iterations = 50
+	)
+
+	mockFs, err := newMockResctrlFs(t, "resctrl.full", "")
+	if err != nil {
+		t.Fatalf("failed to set up mock resctrl fs: %v", err)
+	}
+	defer mockFs.delete()
+
+	// Remove groups atomically so that a concurrent reconfiguration never
+	// sees a half-removed mock group
+	trashDir := filepath.Join(mockFs.baseDir, "trash")
+	if err := os.Mkdir(trashDir, 0755); err != nil {
+		t.Fatalf("%v", err)
+	}
+	var trashCnt uint64
+	groupRemoveFunc = func(path string) error {
+		dst := filepath.Join(trashDir, strconv.FormatUint(atomic.AddUint64(&trashCnt, 1), 10))
+		if err := os.Rename(path, dst); err != nil {
+			return err
+		}
+		return os.RemoveAll(dst)
+	}
+	defer func() { groupRemoveFunc = os.RemoveAll }()
+
+	if err := Initialize(mockGroupPrefix); err != nil {
+		t.Fatalf("rdt initialization failed: %v", err)
+	}
+	if err := SetConfig(parseTestConfig(t, confA), true); err != nil {
+		t.Fatalf("SetConfig() failed: %v", err)
+	}
+
+	// Mock monitoring groups are staged in advance and moved in place
+	// atomically, for the same reason as above
+	if err := os.Mkdir(filepath.Join(mockFs.baseDir, "resctrl", "staging"), 0755); err != nil {
+		t.Fatalf("%v", err)
+	}
+	for i := 0; i < iterations; i++ {
+		mockFs.copyFromOrig(filepath.Join("mon_groups", "example"), filepath.Join("staging", strconv.Itoa(i)))
+	}
+	mockFs.initMockMonGroup("Guaranteed", "persistent")
+	cls, _ := GetClass("Guaranteed")
+	if _, err := cls.CreateMonGroup("persistent", map[string]string{"a": "b"}); err != nil {
+		t.Fatalf("CreateMonGroup() failed: %v", err)
+	}
+
+	RegisterCustomPrometheusLabels("a")
+	collector, err := NewCollector()
+	if err != nil {
+		t.Fatalf("NewCollector() failed: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	run := func(f func(i int)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				f(i)
+			}
+		}()
+	}
+
+	// Metrics scrapes
+	run(func(int) {
+		ch := make(chan prometheus.Metric)
+		done := make(chan struct{})
+		go func() {
+			for range ch {
+			}
+			close(done)
+		}()
+		collector.Collect(ch)
+		close(ch)
+		<-done
+	})
+
+	// Reconfiguration
+	run(func(i int) {
+		conf := confA
+		if i%2 == 1 {
+			conf = confB
+		}
+		c := &Config{}
+		if err := yaml.Unmarshal([]byte(conf), c); err != nil {
+			t.Errorf("failed to parse rdt config: %v", err)
+		} else if err := SetConfig(c, true); err != nil {
+			t.Errorf("SetConfig() failed: %v", err)
+		}
+	})
+
+	// Monitoring group churn
+	run(func(i int) {
+		cls, ok := GetClass("Guaranteed")
+		if !ok {
+			t.Errorf("class Guaranteed not found")
+			return
+		}
+		name := "churn-" + strconv.Itoa(i)
+		src := filepath.Join(mockFs.baseDir, "resctrl", "staging", strconv.Itoa(i))
+		dst := filepath.Join(mockFs.baseDir, "resctrl", mockGroupPrefix+"Guaranteed", "mon_groups", mockGroupPrefix+name)
+		if err := os.Rename(src, dst); err != nil {
+			t.Errorf("failed to move mock mon group in place: %v", err)
+			return
+		}
+		if _, err := cls.CreateMonGroup(name, map[string]string{"a": name}); err != nil {
+			t.Errorf("CreateMonGroup() failed: %v", err)
+		}
+		if _, ok := cls.GetMonGroup(name); !ok {
+			t.Errorf("mon group %q not found", name)
+		}
+		_ = cls.GetMonGroups()
+		if err := cls.DeleteMonGroup(name); err != nil {
+			t.Errorf("DeleteMonGroup() failed: %v", err)
+		}
+	})
+
+	// Queries and logger updates
+	run(func(int) {
+		for _, cls := range GetClasses() {
+			_ = cls.GetMonGroups()
+		}
+		_ = GetMonFeatures()
+		SetLogger(log)
+	})
+
+	wg.Wait()
+
+	cls, _ = GetClass("Guaranteed")
+	if _, ok := cls.GetMonGroup("persistent"); !ok {
+		t.Errorf("persistent mon group lost during concurrent operation")
+	}
+}
+
+// TestConfig tests configuration parsing and resolving
+func TestConfig(t *testing.T) {
+	type Schemata struct {
+		l3     string
+		l3code string
+		l3data string
+		l2     string
+		l2code string
+		l2data string
+		mb     string
+	}
+
+	type TC struct {
+		name        string
+		fs          string
+		fsMountOpts string
+		config      string
+		configErrRe string
+		schemata    map[string]Schemata
+	}
+
+	tcs := []TC{
+		// Testcase
+		TC{
+			name: "Complex config",
+			fs:   "resctrl.full",
+			config: `
+partitions:
+  part-1:
+    l3Allocation:
+      all: 60%
+      1: "0xff000"
+      2: "9-15"
+    mbAllocation:
+      all: [100%]
+    classes:
+      class-1:
+        l3schema: 100%
+      class-2:
+        l3schema:
+          all: 100%
+          0-1: 10%
+          2: "0x70"
+        mbschema:
+          all: [40%]
+          3: [10%]
+  part-2:
+    l3Allocation:
+      all: 39%
+      1: "0-10"
+      2: "0-6"
+    mbAllocation:
+      all: [50%]
+      1: [80%]
+      2: [100%]
+    classes:
+      class-3:
+        l3schema: 100%
+        mbschema:
+          all: [40%]
+          0: [80%]
+      class-4:
+        l3schema: 50%
+        mbschema: [100%]
+      SYSTEM_DEFAULT:
+        l3schema: 60%
+        mbschema: [60%]
+  part-3:
+    l3Allocation:
+      all: 1%
+      1: "0x800"
+      2: "7,8"
+    mbAllocation: [20%]
+    classes:
+      class-5:
+        l3schema: 100%
+        mbschema:
+          all: [100%]
+          0: [1%]
+`,
+			schemata: map[string]Schemata{
+				"class-1": Schemata{
+					l3: "0=fff;1=ff000;2=fe00;3=fff",
+					mb: "0=100;1=100;2=100;3=100",
+				},
+				"class-2": Schemata{
+					l3: "0=3;1=1000;2=e000;3=fff",
+					mb: "0=40;1=40;2=40;3=10",
+				},
+				"class-3": Schemata{
+					l3: "0=7f000;1=7ff;2=7f;3=7f000",
+					mb: "0=40;1=32;2=40;3=20",
+				},
+				"class-4": Schemata{
+					l3: "0=f000;1=3f;2=f;3=f000",
+					mb: "0=50;1=80;2=100;3=50",
+				},
+				"SYSTEM_DEFAULT": Schemata{
+					l3: "0=1f000;1=7f;2=1f;3=1f000",
+					mb: "0=30;1=48;2=60;3=30",
+				},
+				"class-5": Schemata{
+					l3: "0=80000;1=800;2=180;3=80000",
+					mb: "0=10;1=20;2=20;3=20",
+				},
+			},
+		},
+		// Testcase
+		TC{
+			name: "L3 CDP disabled",
+			fs:   "resctrl.nomb",
+			config: `
+partitions:
+  part-1:
+    l3Allocation:
+      0,1:
+        unified: 60%
+        code: 70%
+        data: 50%
+      2,3: 40%
+    classes:
+      class-1:
+  part-2:
+    l3Allocation:
+      0,1:
+        unified: 40%
+        code: 30%
+        data: 50%
+      2,3: 60%
+    classes:
+      class-2:
+      SYSTEM_DEFAULT:
+        l3Schema:
+          all: 100%
+          3:
+            unified: 80%
+            code: 60%
+            data: 90%
+
+`,
+			schemata: map[string]Schemata{
+				"class-1": Schemata{
+					l3: "0=fff;1=fff;2=ff;3=ff",
+				},
+				"class-2": Schemata{
+					l3: "0=ff000;1=ff000;2=fff00;3=fff00",
+				},
+				"SYSTEM_DEFAULT": Schemata{
+					l3: "0=ff000;1=ff000;2=fff00;3=3ff00",
+				},
+			},
+		},
+		// Testcase
+		TC{
+			name: "L3 CDP enabled",
+			fs:   "resctrl.nomb.cdp",
+			config: `
+partitions:
+  part-1:
+    l3Allocation:
+      0,1:
+        unified: 60%
+        code: 70%
+        data: 50%
+      2,3: 40%
+    classes:
+      class-1:
+  part-2:
+    l3Allocation:
+      0,1:
+        unified: 40%
+        code: 30%
+        data: 50%
       2,3: 60%
     classes:
       class-2:
@@ -612,46 +2442,250 @@ partitions:
 `,
 			schemata: map[string]Schemata{
 				"class-1": Schemata{
-					l3code: "0=3fff;1=3fff;2=ff;3=ff",
-					l3data: "0=3ff;1=3ff;2=ff;3=ff",
+					l3code: "0=3fff;1=3fff;2=ff;3=ff",
+					l3data: "0=3ff;1=3ff;2=ff;3=ff",
+				},
+				"class-2": Schemata{
+					l3code: "0=fc000;1=fc000;2=fff00;3=fff00",
+					l3data: "0=ffc00;1=ffc00;2=fff00;3=fff00",
+				},
+				"SYSTEM_DEFAULT": Schemata{
+					l3code: "0=fc000;1=fc000;2=fff00;3=ff00",
+					l3data: "0=ffc00;1=ffc00;2=fff00;3=7ff00",
+				},
+			},
+		},
+		// Testcase
+		TC{
+			name: "L3 optional",
+			fs:   "resctrl.nol3",
+			config: `
+options:
+  l3:
+    optional: true
+partitions:
+  part-1:
+    l3Allocation: 100%
+    mbAllocation: [100%]
+    classes:
+      class-1:
+        l3schema: 20%
+        mbschema: [50%]
+`,
+			schemata: map[string]Schemata{
+				"class-1": Schemata{
+					mb: "0=50;1=50;2=50;3=50",
+				},
+				"SYSTEM_DEFAULT": Schemata{
+					mb: "0=100;1=100;2=100;3=100",
+				},
+			},
+		},
+		// Testcase
+		TC{
+			name: "L2 and L3",
+			fs:   "resctrl.l2",
+			config: `
+partitions:
+  part-1:
+    l2Allocation:
+      all: 50%
+      3: 25%
+    l3Allocation: 75%
+    classes:
+      class-1:
+        l2Schema: 50%
+  part-2:
+    l2Allocation:
+      all: 50%
+      3: 75%
+    l3Allocation: 25%
+    classes:
+      class-2:
+        l2Schema:
+          all: 100%
+          1: "0x3"
+        l3Schema: 50%
+`,
+			schemata: map[string]Schemata{
+				"class-1": Schemata{
+					l3: "0=1ff",
+					l2: "0=3;1=3;2=3;3=1",
+				},
+				"class-2": Schemata{
+					l3: "0=600",
+					l2: "0=f0;1=30;2=f0;3=fc",
+				},
+				"SYSTEM_DEFAULT": Schemata{
+					l3: "0=fff",
+					l2: "0=ff;1=ff;2=ff;3=ff",
+				},
+			},
+		},
+		// Testcase
+		TC{
+			name: "L2 CDP disabled",
+			fs:   "resctrl.l2",
+			config: `
+partitions:
+  part-1:
+    l2Allocation:
+      0,1:
+        unified: 50%
+        code: 75%
+        data: 25%
+      2,3: 50%
+    classes:
+      class-1:
+        l2Schema:
+          all: 100%
+          3:
+            unified: 50%
+            code: 100%
+            data: 50%
+  part-2:
+    l2Allocation:
+      0,1:
+        unified: 50%
+        code: 25%
+        data: 75%
+      2,3: 50%
+    classes:
+      class-2:
+      SYSTEM_DEFAULT:
+        l2Schema: 50%
+`,
+			schemata: map[string]Schemata{
+				"class-1": Schemata{
+					l2: "0=f;1=f;2=f;3=3",
+				},
+				"class-2": Schemata{
+					l2: "0=f0;1=f0;2=f0;3=f0",
+				},
+				"SYSTEM_DEFAULT": Schemata{
+					l2: "0=30;1=30;2=30;3=30",
+				},
+			},
+		},
+		// Testcase
+		TC{
+			name: "L2 CDP enabled",
+			fs:   "resctrl.l2.cdp",
+			config: `
+partitions:
+  part-1:
+    l2Allocation:
+      0,1:
+        unified: 50%
+        code: 75%
+        data: 25%
+      2,3: 50%
+    classes:
+      class-1:
+        l2Schema:
+          all: 100%
+          3:
+            unified: 50%
+            code: 100%
+            data: 50%
+  part-2:
+    l2Allocation:
+      0,1:
+        unified: 50%
+        code: 25%
+        data: 75%
+      2,3: 50%
+    classes:
+      class-2:
+      SYSTEM_DEFAULT:
+        l2Schema: 50%
+`,
+			schemata: map[string]Schemata{
+				"class-1": Schemata{
+					l2code: "0=3f;1=3f;2=f;3=f",
+					l2data: "0=3;1=3;2=f;3=3",
 				},
 				"class-2": Schemata{
-					l3code: "0=fc000;1=fc000;2=fff00;3=fff00",
-					l3data: "0=ffc00;1=ffc00;2=fff00;3=fff00",
+					l2code: "0=c0;1=c0;2=f0;3=f0",
+					l2data: "0=fc;1=fc;2=f0;3=f0",
 				},
 				"SYSTEM_DEFAULT": Schemata{
-					l3code: "0=fc000;1=fc000;2=fff00;3=ff00",
-					l3data: "0=ffc00;1=ffc00;2=fff00;3=7ff00",
+					l2code: "0=40;1=40;2=30;3=30",
+					l2data: "0=1c;1=1c;2=30;3=30",
 				},
 			},
 		},
 		// Testcase
 		TC{
-			name: "L3 optional",
-			fs:   "resctrl.nol3",
+			name:        "L2 missing cdp (fail)",
+			fs:          "resctrl.l2.cdp",
+			configErrRe: `some partition\(s\) missing l2 "code" allocation request for cache id [0-3]`,
+			config: `
+partitions:
+  part-1:
+    l2Allocation:
+      all:
+        unified: "50%"
+        code: "40%"
+        data: "60%"
+  part-2:
+    l2Allocation: "50%"
+`,
+		},
+		// Testcase
+		TC{
+			name: "L2 optional",
+			fs:   "resctrl.nomb",
 			config: `
 options:
-  l3:
+  l2:
     optional: true
 partitions:
   part-1:
+    l2Allocation: 100%
     l3Allocation: 100%
-    mbAllocation: [100%]
     classes:
       class-1:
-        l3schema: 20%
-        mbschema: [50%]
+        l2schema: 20%
+        l3schema: 50%
 `,
 			schemata: map[string]Schemata{
 				"class-1": Schemata{
-					mb: "0=50;1=50;2=50;3=50",
+					l3: "0=3ff;1=3ff;2=3ff;3=3ff",
 				},
 				"SYSTEM_DEFAULT": Schemata{
-					mb: "0=100;1=100;2=100;3=100",
+					l3: "0=fffff;1=fffff;2=fffff;3=fffff",
 				},
 			},
 		},
 		// Testcase
+		TC{
+			name:        "L2 required (fail)",
+			fs:          "resctrl.nomb",
+			configErrRe: `L2 cache allocation for "class-1" specified in configuration but not supported by system`,
+			config: `
+partitions:
+  part-1:
+    l2Allocation: 100%
+    classes:
+      class-1:
+        l2schema: 20%
+`,
+		},
+		// Testcase
+		TC{
+			name:        "L2 missing from partition (fail)",
+			fs:          "resctrl.l2",
+			configErrRe: `L2 allocation missing from partition "part-1"`,
+			config: `
+partitions:
+  part-1:
+    classes:
+      class-1:
+        l2schema: "100%"
+`,
+		},
+		// Testcase
 		TC{
 			name:        "duplicate class names (fail)",
 			fs:          "resctrl.nomb",
@@ -1004,221 +3038,449 @@ partitions:
 		},
 		// Testcase
 		TC{
-			name:        "L3 class allocation does not fit partition (fail)",
-			fs:          "resctrl.nomb",
-			configErrRe: `bitmask 0x1ff00 \(0x1ff << 8\) does not fit basemask 0xff00`,
+			name:        "L3 class allocation does not fit partition (fail)",
+			fs:          "resctrl.nomb",
+			configErrRe: `bitmask 0x1ff00 \(0x1ff << 8\) does not fit basemask 0xff00`,
+			config: `
+partitions:
+  part-1:
+    l3Allocation: "0xff00"
+    classes:
+      class-1:
+        l3schema: "0x1ff"
+`,
+		},
+		// Testcase
+		TC{
+			name: "L3 min cbm bits is respected",
+			fs:   "resctrl.nomb",
+			config: `
+partitions:
+  part-1:
+    l3Allocation: "100%"
+    classes:
+      class-1:
+        l3schema:
+          all: "1%"
+          1-2: "99-100%"
+`,
+			schemata: map[string]Schemata{
+				"class-1": Schemata{
+					l3: "0=3;1=c0000;2=c0000;3=3",
+				},
+				"SYSTEM_DEFAULT": Schemata{
+					l3: "0=fffff;1=fffff;2=fffff;3=fffff",
+				},
+			},
+		},
+		// Testcase
+		TC{
+			name:        "L3 too few bits (fail)",
+			fs:          "resctrl.nomb",
+			configErrRe: `bitmask 0x1ff00 \(0x1ff << 8\) does not fit basemask 0xff00`,
+			config: `
+partitions:
+  part-1:
+    l3Allocation: "0xff00"
+    classes:
+      class-1:
+        l3schema: "0x1ff"
+`,
+		},
+		// Testcase
+		TC{
+			name:        "L3 invalid percentage range in class (fail)",
+			fs:          "resctrl.nomb",
+			configErrRe: `invalid configuration: failed to resolve L3 allocation for class "class-1": invalid percentage range`,
+			config: `
+partitions:
+  part-1:
+    l3Allocation: "100%"
+    classes:
+      class-1:
+        l3schema: "0-101%"
+`,
+		},
+		// Testcase
+		TC{
+			name:        "L3 missing from partition (fail)",
+			fs:          "resctrl.nomb",
+			configErrRe: `L3 allocation missing from partition "part-1"`,
+			config: `
+partitions:
+  part-1:
+    classes:
+      class-1:
+        l3schema: "100%"
+`,
+		},
+		// Testcase
+		TC{
+			name: "MB allocation under minimum",
+			fs:   "resctrl.nol3",
+			config: `
+partitions:
+  part-1:
+    mbAllocation: ["1%"]
+    classes:
+      class-1:
+        mbSchema: ["100%"]
+`,
+			schemata: map[string]Schemata{
+				"class-1": Schemata{
+					mb: "0=10;1=10;2=10;3=10",
+				},
+				"SYSTEM_DEFAULT": Schemata{
+					mb: "0=100;1=100;2=100;3=100",
+				},
+			},
+		},
+		// Testcase
+		TC{
+			name:        "MB nan percentage value in partition (fail)",
+			fs:          "resctrl.nol3",
+			configErrRe: `failed to resolve MB allocation for partition "part-1": strconv.ParseUint: parsing "xyz"`,
+			config: `
+partitions:
+  part-1:
+    mbAllocation: ["xyz%"]
+`,
+		},
+		// Testcase
+		TC{
+			name:        "MB invalid percentage value in class (fail)",
+			fs:          "resctrl.nol3",
+			configErrRe: `failed to resolve MB allocation for class "class-1":.*invalid syntax`,
+			config: `
+partitions:
+  part-1:
+    mbAllocation: ["100%"]
+    classes:
+      class-1:
+        mbschema: ["1a%"]
+`,
+		},
+		// Testcase
+		TC{
+			name:        "MB class allocation not a list (fail)",
+			fs:          "resctrl.nol3",
+			configErrRe: `failed to resolve MB allocation for class "class-1": not a list value`,
+			config: `
+partitions:
+  part-1:
+    mbAllocation: ["100%"]
+    classes:
+      class-1:
+        mbschema: "100%"
+`,
+		},
+		// Testcase
+		TC{
+			name:        "MB missing percentage value (fail)",
+			fs:          "resctrl.nol3",
+			configErrRe: `missing '%' value from mbSchema`,
+			config: `
+partitions:
+  part-1:
+    mbAllocation: ["100MBps"]
+`,
+		},
+		// Testcase
+		TC{
+			name:        "MB missing from partition (fail)",
+			fs:          "resctrl.nol3",
+			configErrRe: `MB allocation missing from partition "part-1"`,
+			config: `
+partitions:
+  part-1:
+    classes:
+      class-1:
+        mbschema: ["100%"]
+`,
+		},
+		// Testcase
+		TC{
+			name:        "MB MBps",
+			fs:          "resctrl.nol3.mbps",
+			fsMountOpts: "mba_MBps",
+			config: `
+partitions:
+  part-1:
+    mbAllocation: ["50%", "1000MBps"]
+    classes:
+      class-1:
+        mbschema: ["100%", "1500MBps"]
+  part-2:
+    mbAllocation:
+      all: ["1000MBps"]
+      # Unsupported values should just be ignored
+      0,1: [50, "1GBps", "500MBps"]
+    classes:
+      class-2:
+        mbschema: ["750MBps"]
+`,
+			schemata: map[string]Schemata{
+				"class-1": Schemata{
+					mb: "0=1000;1=1000;2=1000;3=1000",
+				},
+				"class-2": Schemata{
+					mb: "0=500;1=500;2=750;3=750",
+				},
+				"SYSTEM_DEFAULT": Schemata{
+					mb: "0=4294967295;1=4294967295;2=4294967295;3=4294967295",
+				},
+			},
+		},
+		// Testcase
+		TC{
+			name:        "MB nan MBps value (fail)",
+			fs:          "resctrl.nol3.mbps",
+			fsMountOpts: "mba_MBps",
+			configErrRe: `failed to resolve MB allocation for partition "part-1":.* invalid syntax`,
+			config: `
+partitions:
+  part-1:
+    mbAllocation: ["0xffMBps"]
+`,
+		},
+		// Testcase
+		TC{
+			name:        "MB missing MBps value (fail)",
+			fs:          "resctrl.nol3.mbps",
+			fsMountOpts: "mba_MBps",
+			configErrRe: `missing 'MBps' value from mbSchema`,
 			config: `
 partitions:
   part-1:
-    l3Allocation: "0xff00"
-    classes:
-      class-1:
-        l3schema: "0x1ff"
+    mbAllocation: ["100%"]
 `,
 		},
 		// Testcase
 		TC{
-			name: "L3 min cbm bits is respected",
+			name: "L3 exclusive class",
 			fs:   "resctrl.nomb",
 			config: `
 partitions:
   part-1:
-    l3Allocation: "100%"
+    l3Allocation: 40%
     classes:
       class-1:
-        l3schema:
-          all: "1%"
-          1-2: "99-100%"
+        mode: exclusive
+  part-2:
+    l3Allocation: 60%
+    classes:
+      class-2:
+        mode: shareable
+      SYSTEM_DEFAULT:
+        l3schema: 50%
 `,
 			schemata: map[string]Schemata{
 				"class-1": Schemata{
-					l3: "0=3;1=c0000;2=c0000;3=3",
+					l3: "0=ff;1=ff;2=ff;3=ff",
+				},
+				"class-2": Schemata{
+					l3: "0=fff00;1=fff00;2=fff00;3=fff00",
 				},
 				"SYSTEM_DEFAULT": Schemata{
-					l3: "0=fffff;1=fffff;2=fffff;3=fffff",
+					l3: "0=3f00;1=3f00;2=3f00;3=3f00",
 				},
 			},
 		},
 		// Testcase
 		TC{
-			name:        "L3 too few bits (fail)",
+			name:        "L3 exclusive class overlaps other class (fail)",
 			fs:          "resctrl.nomb",
-			configErrRe: `bitmask 0x1ff00 \(0x1ff << 8\) does not fit basemask 0xff00`,
+			configErrRe: `L3 allocation 0xff of exclusive class "class-1" for cache id 0 overlaps with allocation 0xf of class "class-2"`,
 			config: `
 partitions:
   part-1:
-    l3Allocation: "0xff00"
+    l3Allocation: 40%
     classes:
       class-1:
-        l3schema: "0x1ff"
+        mode: exclusive
+      class-2:
+        l3schema: 50%
 `,
 		},
 		// Testcase
 		TC{
-			name:        "L3 invalid percentage range in class (fail)",
+			name:        "L3 exclusive class overlaps shareable bits (fail)",
 			fs:          "resctrl.nomb",
-			configErrRe: `invalid configuration: failed to resolve L3 allocation for class "class-1": invalid percentage range`,
+			configErrRe: `L3 allocation 0xfff00 of exclusive class "class-2" for cache id 0 overlaps with bits 0xc0000 shared with hardware`,
 			config: `
 partitions:
   part-1:
-    l3Allocation: "100%"
+    l3Allocation: 40%
     classes:
       class-1:
-        l3schema: "0-101%"
+  part-2:
+    l3Allocation: 60%
+    classes:
+      class-2:
+        mode: exclusive
 `,
 		},
 		// Testcase
 		TC{
-			name:        "L3 missing from partition (fail)",
+			name:        "invalid mode (fail)",
 			fs:          "resctrl.nomb",
-			configErrRe: `L3 allocation missing from partition "part-1"`,
+			configErrRe: `invalid mode "pseudo-locked" of class "class-1"`,
 			config: `
 partitions:
   part-1:
+    l3Allocation: 100%
     classes:
       class-1:
-        l3schema: "100%"
+        mode: pseudo-locked
 `,
 		},
 		// Testcase
 		TC{
-			name: "MB allocation under minimum",
-			fs:   "resctrl.nol3",
+			name: "L3 shareable bits avoided",
+			fs:   "resctrl.nomb",
 			config: `
+options:
+  l3:
+    shareableBits: avoid
 partitions:
   part-1:
-    mbAllocation: ["1%"]
+    l3Allocation: 50%
     classes:
       class-1:
-        mbSchema: ["100%"]
+  part-2:
+    l3Allocation: 50%
+    classes:
+      class-2:
+      SYSTEM_DEFAULT:
 `,
 			schemata: map[string]Schemata{
 				"class-1": Schemata{
-					mb: "0=10;1=10;2=10;3=10",
+					l3: "0=1ff;1=1ff;2=1ff;3=1ff",
+				},
+				"class-2": Schemata{
+					l3: "0=3fe00;1=3fe00;2=3fe00;3=3fe00",
 				},
 				"SYSTEM_DEFAULT": Schemata{
-					mb: "0=100;1=100;2=100;3=100",
+					l3: "0=3fe00;1=3fe00;2=3fe00;3=3fe00",
 				},
 			},
 		},
 		// Testcase
 		TC{
-			name:        "MB nan percentage value in partition (fail)",
-			fs:          "resctrl.nol3",
-			configErrRe: `failed to resolve MB allocation for partition "part-1": strconv.ParseUint: parsing "xyz"`,
-			config: `
-partitions:
-  part-1:
-    mbAllocation: ["xyz%"]
-`,
-		},
-		// Testcase
-		TC{
-			name:        "MB invalid percentage value in class (fail)",
-			fs:          "resctrl.nol3",
-			configErrRe: `failed to resolve MB allocation for class "class-1":.*invalid syntax`,
+			name: "L3 shareable bits preferred",
+			fs:   "resctrl.nomb",
 			config: `
+options:
+  l3:
+    shareableBits: prefer
 partitions:
   part-1:
-    mbAllocation: ["100%"]
+    l3Allocation: 40%
     classes:
       class-1:
-        mbschema: ["1a%"]
-`,
-		},
-		// Testcase
-		TC{
-			name:        "MB class allocation not a list (fail)",
-			fs:          "resctrl.nol3",
-			configErrRe: `failed to resolve MB allocation for class "class-1": not a list value`,
-			config: `
-partitions:
-  part-1:
-    mbAllocation: ["100%"]
+  part-2:
+    l3Allocation: 40%
     classes:
-      class-1:
-        mbschema: "100%"
-`,
-		},
-		// Testcase
-		TC{
-			name:        "MB missing percentage value (fail)",
-			fs:          "resctrl.nol3",
-			configErrRe: `missing '%' value from mbSchema`,
-			config: `
-partitions:
-  part-1:
-    mbAllocation: ["100MBps"]
+      class-2:
+      SYSTEM_DEFAULT:
 `,
+			schemata: map[string]Schemata{
+				"class-1": Schemata{
+					l3: "0=ff000;1=ff000;2=ff000;3=ff000",
+				},
+				"class-2": Schemata{
+					l3: "0=ff0;1=ff0;2=ff0;3=ff0",
+				},
+				"SYSTEM_DEFAULT": Schemata{
+					l3: "0=ff0;1=ff0;2=ff0;3=ff0",
+				},
+			},
 		},
 		// Testcase
 		TC{
-			name:        "MB missing from partition (fail)",
-			fs:          "resctrl.nol3",
-			configErrRe: `MB allocation missing from partition "part-1"`,
+			name:        "L3 shareable bits avoided, absolute allocation (fail)",
+			fs:          "resctrl.nomb",
+			configErrRe: `L3 allocation of partition "part-1" for cache id 0 overlaps with ways 0xc0000 shared with hardware`,
 			config: `
+options:
+  l3:
+    shareableBits: avoid
 partitions:
   part-1:
+    l3Allocation: "0xf0000"
     classes:
       class-1:
-        mbschema: ["100%"]
 `,
 		},
 		// Testcase
 		TC{
-			name:        "MB MBps",
-			fs:          "resctrl.nol3.mbps",
-			fsMountOpts: "mba_MBps",
+			name: "L3 size-based partition allocation",
+			fs:   "resctrl.nomb",
 			config: `
 partitions:
   part-1:
-    mbAllocation: ["50%", "1000MBps"]
+    l3Allocation: 11MiB
     classes:
       class-1:
-        mbschema: ["100%", "1500MBps"]
   part-2:
-    mbAllocation:
-      all: ["1000MBps"]
-      # Unsupported values should just be ignored
-      0,1: [50, "1GBps", "500MBps"]
+    l3Allocation: 50%
     classes:
       class-2:
-        mbschema: ["750MBps"]
+      SYSTEM_DEFAULT:
 `,
 			schemata: map[string]Schemata{
 				"class-1": Schemata{
-					mb: "0=1000;1=1000;2=1000;3=1000",
+					l3: "0=f;1=f;2=f;3=f",
 				},
 				"class-2": Schemata{
-					mb: "0=500;1=500;2=750;3=750",
+					l3: "0=3ff0;1=3ff0;2=3ff0;3=3ff0",
 				},
 				"SYSTEM_DEFAULT": Schemata{
-					mb: "0=4294967295;1=4294967295;2=4294967295;3=4294967295",
+					l3: "0=3ff0;1=3ff0;2=3ff0;3=3ff0",
 				},
 			},
 		},
 		// Testcase
 		TC{
-			name:        "MB nan MBps value (fail)",
-			fs:          "resctrl.nol3.mbps",
-			fsMountOpts: "mba_MBps",
-			configErrRe: `failed to resolve MB allocation for partition "part-1":.* invalid syntax`,
+			name:        "L3 size-based partition allocation too big (fail)",
+			fs:          "resctrl.nomb",
+			configErrRe: `L3 allocation of partition "part-1" for cache id 0, 64MiB exceeds the available cache size of 55MiB`,
 			config: `
 partitions:
   part-1:
-    mbAllocation: ["0xffMBps"]
+    l3Allocation: 64MiB
+    classes:
+      class-1:
 `,
 		},
 		// Testcase
 		TC{
-			name:        "MB missing MBps value (fail)",
-			fs:          "resctrl.nol3.mbps",
-			fsMountOpts: "mba_MBps",
-			configErrRe: `missing 'MBps' value from mbSchema`,
+			name:        "L3 size-based class allocation (fail)",
+			fs:          "resctrl.nomb",
+			configErrRe: `invalid L3 schema of class "class-1": size-based allocation 2MiB only supported in partitions`,
 			config: `
 partitions:
   part-1:
-    mbAllocation: ["100%"]
+    l3Allocation: 100%
+    classes:
+      class-1:
+        l3Schema: 2MiB
+`,
+		},
+		// Testcase
+		TC{
+			name:        "invalid shareable bits policy (fail)",
+			fs:          "resctrl.nomb",
+			configErrRe: `invalid L3 shareable bits policy "never"`,
+			config: `
+options:
+  l3:
+    shareableBits: never
+partitions:
+  part-1:
+    l3Allocation: 100%
+    classes:
+      class-1:
 `,
 		},
 	}
@@ -1235,6 +3497,15 @@ partitions:
 			if s.l3data != "" {
 				expected += "L3DATA:" + s.l3data + "\n"
 			}
+			if s.l2 != "" {
+				expected += "L2:" + s.l2 + "\n"
+			}
+			if s.l2code != "" {
+				expected += "L2CODE:" + s.l2code + "\n"
+			}
+			if s.l2data != "" {
+				expected += "L2DATA:" + s.l2data + "\n"
+			}
 			if s.mb != "" {
 				expected += "MB:" + s.mb + "\n"
 			}
@@ -1307,6 +3578,123 @@ partitions:
 	}
 }
 
+func TestErrors(t *testing.T) {
+	// Kernel errors
+	err := rdtError("failed to create %q: %w", "grp", newGroupError("mkdir", "grp", "", "No space on L3:1", syscall.ENOSPC))
+	ge := &GroupError{}
+	if !errors.As(err, &ge) {
+		t.Fatalf("GroupError not found in %v", err)
+	}
+	if ge.Group != "grp" || ge.Op != "mkdir" || ge.Resource != "L3" || !ge.HasCacheID || ge.CacheID != 1 {
+		t.Errorf("unexpected GroupError %+v", ge)
+	}
+	if err.Error() != `rdt: failed to create "grp": No space on L3:1` {
+		t.Errorf("unexpected message %q", err)
+	}
+	for _, target := range []error{ErrKernelRejected, ErrResourcesExhausted, syscall.ENOSPC} {
+		if !errors.Is(err, target) {
+			t.Errorf("%v does not match %v", err, target)
+		}
+	}
+	for _, target := range []error{ErrGroupNotEmpty, ErrInvalidConfig, ErrNotSupported} {
+		if errors.Is(err, target) {
+			t.Errorf("%v unexpectedly matches %v", err, target)
+		}
+	}
+
+	ge = newGroupError("write", "", "schemata", "Unknown or unsupported resource name 'L2'", syscall.EINVAL)
+	if ge.Resource != "L2" || ge.HasCacheID || !errors.Is(ge, ErrKernelRejected) {
+		t.Errorf("unexpected GroupError %+v", ge)
+	}
+	ge = newGroupError("rmdir", "grp", "", "", ErrGroupNotEmpty)
+	if !errors.Is(ge, ErrGroupNotEmpty) || errors.Is(ge, ErrKernelRejected) {
+		t.Errorf("unexpected GroupError %+v", ge)
+	}
+	ge = newGroupError("rmdir", "grp", "", "", syscall.EBUSY)
+	if !errors.Is(ge, ErrGroupNotEmpty) || errors.Is(ge, ErrKernelRejected) {
+		t.Errorf("unexpected GroupError %+v", ge)
+	}
+	ge = newGroupError("write", "grp", "schemata", "", &os.PathError{Op: "write", Path: "schemata", Err: syscall.EINVAL})
+	if !errors.Is(ge, ErrKernelRejected) {
+		t.Errorf("EINVAL without kernel status does not match ErrKernelRejected: %+v", ge)
+	}
+	for _, errno := range []syscall.Errno{syscall.EACCES, syscall.EPERM, syscall.ENOENT} {
+		ge = newGroupError("write", "grp", "schemata", "", &os.PathError{Op: "write", Path: "schemata", Err: errno})
+		if errors.Is(ge, ErrKernelRejected) {
+			t.Errorf("%v unexpectedly matches ErrKernelRejected", errno)
+		}
+	}
+
+	// Exhausted resources
+	for _, err := range []error{ErrClosidsExhausted, ErrRmidsExhausted} {
+		if !errors.Is(rdtError("foo: %w", err), ErrResourcesExhausted) {
+			t.Errorf("%v does not match ErrResourcesExhausted", err)
+		}
+	}
+	if errors.Is(ErrClosidsExhausted, ErrRmidsExhausted) {
+		t.Errorf("ErrClosidsExhausted matches ErrRmidsExhausted")
+	}
+	for _, tc := range []struct {
+		group, status string
+		expected      error
+	}{
+		{"grp", "", ErrClosidsExhausted},
+		{"grp", "Out of RMIDs", ErrRmidsExhausted},
+		{"grp/mon_groups/mg", "", ErrRmidsExhausted},
+		{"mon_groups/mg", "", ErrRmidsExhausted},
+	} {
+		ge = newGroupError("mkdir", tc.group, "", tc.status, &os.PathError{Op: "mkdir", Path: tc.group, Err: syscall.ENOSPC})
+		unexpected := ErrRmidsExhausted
+		if tc.expected == ErrRmidsExhausted {
+			unexpected = ErrClosidsExhausted
+		}
+		if !errors.Is(ge, tc.expected) || !errors.Is(ge, syscall.ENOSPC) || !errors.Is(ge, ErrResourcesExhausted) {
+			t.Errorf("mkdir of %q with status %q does not match %v and ENOSPC", tc.group, tc.status, tc.expected)
+		} else if errors.Is(ge, unexpected) {
+			t.Errorf("mkdir of %q with status %q unexpectedly matches %v", tc.group, tc.status, unexpected)
+		}
+	}
+	ge = newGroupError("write", "grp", "schemata", "", syscall.ENOSPC)
+	if errors.Is(ge, ErrClosidsExhausted) || errors.Is(ge, ErrRmidsExhausted) {
+		t.Errorf("write failure unexpectedly matches exhausted ids: %+v", ge)
+	}
+
+	// Configuration errors
+	mockFs, err := newMockResctrlFs(t, "resctrl.nomb", "")
+	if err != nil {
+		t.Fatalf("failed to set up mock resctrl fs: %v", err)
+	}
+	defer mockFs.delete()
+
+	if err := Initialize(mockGroupPrefix); err != nil {
+		t.Fatalf("rdt initialization failed: %v", err)
+	}
+	conf := `
+partitions:
+  default:
+    l3Allocation: 101%
+`
+	err = SetConfig(parseTestConfig(t, conf), false)
+	ce := &ConfigError{}
+	if !errors.As(err, &ce) || !errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("unexpected error %v", err)
+	}
+	conf = `
+options:
+  mb:
+    optional: false
+partitions:
+  default:
+    mbAllocation: [100%]
+    classes:
+      Guaranteed:
+        mbSchema: [50%]
+`
+	if err := SetConfig(parseTestConfig(t, conf), false); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
 func TestBitMap(t *testing.T) {
 	// Test ListStr()
 	testSet := map[Bitmask]string{
@@ -1365,6 +3753,98 @@ func TestBitMap(t *testing.T) {
 	} else if string(s) != `"0xa"` {
 		t.Errorf(`expected "0xa" but returned %s`, s)
 	}
+
+	// Test UnmarshalJSON
+	for s, expected := range map[string]Bitmask{`"0xa"`: 10, `10`: 10, `"0"`: 0} {
+		var b Bitmask
+		if err := b.UnmarshalJSON([]byte(s)); err != nil {
+			t.Errorf("failed to unmarshal %s: %v", s, err)
+		} else if b != expected {
+			t.Errorf("expected %#x but got %#x when unmarshaling %s", expected, b, s)
+		}
+	}
+	var b Bitmask
+	if err := b.UnmarshalJSON([]byte(`"0xg"`)); err == nil {
+		t.Errorf("unmarshaling invalid bitmask succeeded unexpectedly")
+	}
+
+	// Test largestRange()
+	for i, expected := range map[Bitmask]Bitmask{
+		0x0:    0x0,
+		0xf:    0xf,
+		0xff8:  0xff8,
+		0x1d1a: 0x1c00,
+		0x33:   0x3,
+		0xf0f:  0xf,
+	} {
+		if r := i.largestRange(); r != expected {
+			t.Errorf("expected largest range %#x of %#x, got %#x", expected, i, r)
+		}
+	}
+}
+
+func TestCPUSet(t *testing.T) {
+	testSet := map[string][]int{
+		"":             {},
+		"0":            {0},
+		"0-3":          {0, 1, 2, 3},
+		"1,3-4,8":      {1, 3, 4, 8},
+		"62-65,191":    {62, 63, 64, 65, 191},
+		"0,2,4,6,8,10": {0, 2, 4, 6, 8, 10},
+	}
+	for str, cpus := range testSet {
+		s, err := ParseCPUSet(str)
+		if err != nil {
+			t.Errorf("unexpected err when parsing %q: %v", str, err)
+			continue
+		}
+		if !s.Equals(NewCPUSet(cpus...)) {
+			t.Errorf("from %q expected %v, got %v", str, cpus, s.List())
+		}
+		if s.String() != str {
+			t.Errorf("from %v expected %q, got %q", cpus, str, s.String())
+		}
+	}
+
+	// Whitespace, e.g. a trailing newline, is ignored
+	if s, err := ParseCPUSet("0-1\n"); err != nil || !s.Equals(NewCPUSet(0, 1)) {
+		t.Errorf("failed to parse cpu list with trailing newline: %v %v", s, err)
+	}
+
+	// Ranges are limited before expanding them
+	if s, err := ParseCPUSet("0-8191"); err != nil || s.Size() != 8192 {
+		t.Errorf("failed to parse the maximum cpu range: %v", err)
+	}
+
+	for _, str := range []string{",", "-", "1,", "-4", "0-", "13-13", "14-13", "a-2", "1,2,,3", "8192", "0-8192", "0-2000000000"} {
+		if s, err := ParseCPUSet(str); err == nil {
+			t.Errorf("expected err but got %v when parsing %q", s, str)
+		}
+	}
+
+	// Set operations
+	a, b := NewCPUSet(1, 2, 3), NewCPUSet(3, 4)
+	if i := a.Intersection(b); !i.Equals(NewCPUSet(3)) {
+		t.Errorf("unexpected intersection %v", i)
+	}
+	if !a.Has(1) || a.Has(4) || a.Size() != 3 {
+		t.Errorf("unexpected set %v", a)
+	}
+
+	// JSON
+	if data, err := json.Marshal(a); err != nil {
+		t.Errorf("failed to marshal cpu set: %v", err)
+	} else if string(data) != `"1-3"` {
+		t.Errorf("unexpected json %s", data)
+	}
+	for data, expected := range map[string]CPUSet{`"1-3"`: a, `7`: NewCPUSet(7), `""`: NewCPUSet()} {
+		var s CPUSet
+		if err := json.Unmarshal([]byte(data), &s); err != nil {
+			t.Errorf("failed to unmarshal %s: %v", data, err)
+		} else if !s.Equals(expected) {
+			t.Errorf("expected %v but got %v when unmarshaling %s", expected, s, data)
+		}
+	}
 }
 
 func TestListStrToArray(t *testing.T) {
@@ -1430,125 +3910,145 @@ func TestCacheAllocation(t *testing.T) {
 	}
 
 	// Test absolute allocation
-	abs := l3AbsoluteAllocation(0x7)
-	if res, err := abs.Overlay(0xf00); err != nil {
-		t.Errorf("unexpected error when overlaying l3AbsoluteAllocation: %v", err)
+	minBits := uint64(2)
+	abs := catAbsoluteAllocation(0x7)
+	if res, err := abs.Overlay(0xf00, minBits); err != nil {
+		t.Errorf("unexpected error when overlaying catAbsoluteAllocation: %v", err)
 	} else if res != 0x700 {
-		t.Errorf("expected 0x700 but got %#x when overlaying l3AbsoluteAllocation", res)
+		t.Errorf("expected 0x700 but got %#x when overlaying catAbsoluteAllocation", res)
 	}
 
-	if _, err := abs.Overlay(0); err == nil {
-		t.Errorf("unexpected success when overlaying l3AbsoluteAllocation with empty basemask")
+	if _, err := abs.Overlay(0, minBits); err == nil {
+		t.Errorf("unexpected success when overlaying catAbsoluteAllocation with empty basemask")
 	}
 
-	if _, err := abs.Overlay(0x30); err == nil {
-		t.Errorf("unexpected success when overlaying too wide l3AbsoluteAllocation")
+	if _, err := abs.Overlay(0x30, minBits); err == nil {
+		t.Errorf("unexpected success when overlaying too wide catAbsoluteAllocation")
 	}
 
-	if _, err := abs.Overlay(0xf0f); err == nil {
-		t.Errorf("unexpected success when overlaying l3AbsoluteAllocation with non-contiguous basemask")
+	if _, err := abs.Overlay(0xf0f, minBits); err == nil {
+		t.Errorf("unexpected success when overlaying catAbsoluteAllocation with non-contiguous basemask")
 	}
 
-	if _, err := l3AbsoluteAllocation(0x1).Overlay(0x10); err == nil {
-		t.Errorf("unexpected success when overlaying l3AbsoluteAllocation with too small basemask")
+	if _, err := catAbsoluteAllocation(0x1).Overlay(0x10, minBits); err == nil {
+		t.Errorf("unexpected success when overlaying catAbsoluteAllocation with too small basemask")
 	}
 
 	// Test percentage allocation
-	info.l3.minCbmBits = 4
-	if res, err := (l3PctRangeAllocation{lowPct: 0, highPct: 100}).Overlay(0xff00); err != nil {
-		t.Errorf("unexpected error when overlaying l3PctRangeAllocation: %v", err)
+	minBits = 4
+	if res, err := (catPctRangeAllocation{lowPct: 0, highPct: 100}).Overlay(0xff00, minBits); err != nil {
+		t.Errorf("unexpected error when overlaying catPctRangeAllocation: %v", err)
 	} else if res != 0xff00 {
-		t.Errorf("expected 0xff00 but got %#x when overlaying l3PctRangeAllocation", res)
+		t.Errorf("expected 0xff00 but got %#x when overlaying catPctRangeAllocation", res)
 	}
-	if res, err := (l3PctRangeAllocation{lowPct: 99, highPct: 100}).Overlay(0xff00); err != nil {
-		t.Errorf("unexpected error when overlaying l3PctRangeAllocation: %v", err)
+	if res, err := (catPctRangeAllocation{lowPct: 99, highPct: 100}).Overlay(0xff00, minBits); err != nil {
+		t.Errorf("unexpected error when overlaying catPctRangeAllocation: %v", err)
 	} else if res != 0xf000 {
-		t.Errorf("expected 0xf000 but got %#x when overlaying l3PctRangeAllocation", res)
+		t.Errorf("expected 0xf000 but got %#x when overlaying catPctRangeAllocation", res)
 	}
-	if res, err := (l3PctRangeAllocation{lowPct: 0, highPct: 1}).Overlay(0xff00); err != nil {
-		t.Errorf("unexpected error when overlaying l3PctRangeAllocation: %v", err)
+	if res, err := (catPctRangeAllocation{lowPct: 0, highPct: 1}).Overlay(0xff00, minBits); err != nil {
+		t.Errorf("unexpected error when overlaying catPctRangeAllocation: %v", err)
 	} else if res != 0xf00 {
-		t.Errorf("expected 0xf00 but got %#x when overlaying l3PctRangeAllocation", res)
+		t.Errorf("expected 0xf00 but got %#x when overlaying catPctRangeAllocation", res)
 	}
-	if res, err := (l3PctRangeAllocation{lowPct: 20, highPct: 30}).Overlay(0x3ff00); err != nil {
-		t.Errorf("unexpected error when overlaying l3PctRangeAllocation: %v", err)
+	if res, err := (catPctRangeAllocation{lowPct: 20, highPct: 30}).Overlay(0x3ff00, minBits); err != nil {
+		t.Errorf("unexpected error when overlaying catPctRangeAllocation: %v", err)
 	} else if res != 0xf00 {
-		t.Errorf("expected 0xf00 but got %#x when overlaying l3PctRangeAllocation", res)
+		t.Errorf("expected 0xf00 but got %#x when overlaying catPctRangeAllocation", res)
 	}
-	if res, err := (l3PctRangeAllocation{lowPct: 30, highPct: 60}).Overlay(0xf00); err != nil {
-		t.Errorf("unexpected error when overlaying l3PctRangeAllocation: %v", err)
+	if res, err := (catPctRangeAllocation{lowPct: 30, highPct: 60}).Overlay(0xf00, minBits); err != nil {
+		t.Errorf("unexpected error when overlaying catPctRangeAllocation: %v", err)
 	} else if res != 0xf00 {
-		t.Errorf("expected 0xf00 but got %#x when overlaying l3PctRangeAllocation", res)
+		t.Errorf("expected 0xf00 but got %#x when overlaying catPctRangeAllocation", res)
 	}
-	if _, err := (l3PctRangeAllocation{lowPct: 20, highPct: 10}).Overlay(0xff00); err == nil {
-		t.Errorf("unexpected success when overlaying l3PctRangeAllocation of invalid percentage range")
+	if _, err := (catPctRangeAllocation{lowPct: 20, highPct: 10}).Overlay(0xff00, minBits); err == nil {
+		t.Errorf("unexpected success when overlaying catPctRangeAllocation of invalid percentage range")
 	}
-	if _, err := (l3PctRangeAllocation{lowPct: 0, highPct: 100}).Overlay(0); err == nil {
-		t.Errorf("unexpected success when overlaying l3PctRangeAllocation of invalid percentage range")
+	if _, err := (catPctRangeAllocation{lowPct: 0, highPct: 100}).Overlay(0, minBits); err == nil {
+		t.Errorf("unexpected success when overlaying catPctRangeAllocation of invalid percentage range")
 	}
 }
 
 func TestParseCacheAllocation(t *testing.T) {
 	// Test percentage
-	if a, err := parseCacheAllocation("10%"); err != nil {
+	if a, err := parseCacheAllocation("10%", 2); err != nil {
 		t.Errorf("unexpected error when parsing cache allocation: %v", err)
-	} else if a != l3PctAllocation(10) {
+	} else if a != catPctAllocation(10) {
 		t.Errorf("expected 10%% but got %d%%", a)
 	}
-	if _, err := parseCacheAllocation("1a%"); err == nil {
+	if _, err := parseCacheAllocation("1a%", 2); err == nil {
 		t.Errorf("unexpected success when parsing percentage cache allocation")
 	}
-	if _, err := parseCacheAllocation("101%"); err == nil {
+	if _, err := parseCacheAllocation("101%", 2); err == nil {
 		t.Errorf("unexpected success when parsing percentage cache allocation")
 	}
 
 	// Test percentage ranges
-	if a, err := parseCacheAllocation("10-20%"); err != nil {
+	if a, err := parseCacheAllocation("10-20%", 2); err != nil {
 		t.Errorf("unexpected error when parsing cache allocation: %v", err)
-	} else if a != (l3PctRangeAllocation{lowPct: 10, highPct: 20}) {
+	} else if a != (catPctRangeAllocation{lowPct: 10, highPct: 20}) {
 		t.Errorf("expected {10 20} but got %v", a)
 	}
-	if _, err := parseCacheAllocation("a-100%"); err == nil {
+	if _, err := parseCacheAllocation("a-100%", 2); err == nil {
 		t.Errorf("unexpected success when parsing percentage range cache allocation")
 	}
-	if _, err := parseCacheAllocation("0-1f%"); err == nil {
+	if _, err := parseCacheAllocation("0-1f%", 2); err == nil {
 		t.Errorf("unexpected success when parsing percentage range cache allocation")
 	}
-	if _, err := parseCacheAllocation("20-10%"); err == nil {
+	if _, err := parseCacheAllocation("20-10%", 2); err == nil {
 		t.Errorf("unexpected success when parsing percentage range cache allocation")
 	}
-	if _, err := parseCacheAllocation("20-101%"); err == nil {
+	if _, err := parseCacheAllocation("20-101%", 2); err == nil {
 		t.Errorf("unexpected success when parsing percentage range cache allocation")
 	}
 
 	// Test bitmask
-	info = &resctrlInfo{}
-	info.l3.minCbmBits = 2
-	if a, err := parseCacheAllocation("0xf0"); err != nil {
+	if a, err := parseCacheAllocation("0xf0", 2); err != nil {
 		t.Errorf("unexpected error when parsing cache allocation: %v", err)
-	} else if a != l3AbsoluteAllocation(0xf0) {
+	} else if a != catAbsoluteAllocation(0xf0) {
 		t.Errorf("expected 0xf0 but got %#x", a)
 	}
-	if _, err := parseCacheAllocation("0x11"); err == nil {
+	if _, err := parseCacheAllocation("0x11", 2); err == nil {
 		t.Errorf("unexpected success when parsing bitmask cache allocation")
 	}
-	if _, err := parseCacheAllocation("0xg"); err == nil {
+	if _, err := parseCacheAllocation("0xg", 2); err == nil {
 		t.Errorf("unexpected success when parsing bitmask cache allocation")
 	}
 
+	// Test sizes
+	if a, err := parseCacheAllocation("12MiB", 2); err != nil {
+		t.Errorf("unexpected error when parsing cache allocation: %v", err)
+	} else if a != catBytesAllocation(12<<20) {
+		t.Errorf("expected 12MiB but got %v", a)
+	}
+	if a, err := parseCacheAllocation("1.5KiB", 2); err != nil {
+		t.Errorf("unexpected error when parsing cache allocation: %v", err)
+	} else if a != catBytesAllocation(1536) {
+		t.Errorf("expected 1536B but got %v", a)
+	}
+	if _, err := parseCacheAllocation("0MiB", 2); err == nil {
+		t.Errorf("unexpected success when parsing size cache allocation")
+	}
+	if _, err := parseCacheAllocation("12MB", 2); err == nil {
+		t.Errorf("unexpected success when parsing size cache allocation")
+	}
+	if _, err := parseCacheAllocation("-1GiB", 2); err == nil {
+		t.Errorf("unexpected success when parsing size cache allocation")
+	}
+
 	// Test bit numbers
-	if a, err := parseCacheAllocation("3,4,5-7,8"); err != nil {
+	if a, err := parseCacheAllocation("3,4,5-7,8", 2); err != nil {
 		t.Errorf("unexpected error when parsing cache allocation: %v", err)
-	} else if a != l3AbsoluteAllocation(0x1f8) {
+	} else if a != catAbsoluteAllocation(0x1f8) {
 		t.Errorf("expected 0x1f8 but got %#x", a)
 	}
-	if _, err := parseCacheAllocation("3,5"); err == nil {
+	if _, err := parseCacheAllocation("3,5", 2); err == nil {
 		t.Errorf("unexpected success when parsing bitmask cache allocation")
 	}
-	if _, err := parseCacheAllocation("1"); err == nil {
+	if _, err := parseCacheAllocation("1", 2); err == nil {
 		t.Errorf("unexpected success when parsing bitmask cache allocation")
 	}
-	if _, err := parseCacheAllocation("3-x"); err == nil {
+	if _, err := parseCacheAllocation("3-x", 2); err == nil {
 		t.Errorf("unexpected success when parsing bitmask cache allocation")
 	}
 }
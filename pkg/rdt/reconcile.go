@@ -0,0 +1,379 @@
+/*
+Copyright 2021 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rdt
+
+import (
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultReconcileInterval is the default interval of Reconciler
+const DefaultReconcileInterval = 30 * time.Second
+
+// DriftKind is the type of a difference between the active configuration
+// and the resctrl filesystem
+type DriftKind string
+
+const (
+	// DriftGroupMissing means that the resctrl group of a class has been
+	// removed
+	DriftGroupMissing DriftKind = "group-missing"
+	// DriftSchemata means that the schemata of a class has been modified
+	DriftSchemata DriftKind = "schemata"
+	// DriftMode means that the mode of a class has been changed
+	DriftMode DriftKind = "mode"
+	// DriftCpus means that the cpus of a class have been changed
+	DriftCpus DriftKind = "cpus"
+)
+
+// DriftEvent describes one difference between the active configuration and
+// the resctrl filesystem
+type DriftEvent struct {
+	// Class is the name of the class
+	Class string `json:"class"`
+	// Kind is the type of the difference
+	Kind DriftKind `json:"kind"`
+	// Expected is the configured state, e.g. the schemata of the class. The
+	// path of the group if the group is missing.
+	Expected string `json:"expected"`
+	// Actual is the state found on the resctrl filesystem, empty if the group
+	// is missing
+	Actual string `json:"actual"`
+	// Repaired is true if the configured state was successfully re-applied
+	Repaired bool `json:"repaired"`
+}
+
+// ReconcilerOptions contains the settings of a Reconciler
+type ReconcilerOptions struct {
+	// Interval is the interval of periodic checks. Defaults to
+	// DefaultReconcileInterval.
+	Interval time.Duration
+
+	// Repair enables re-applying the configured state when drift is
+	// detected. Drift is only reported if not set.
+	Repair bool
+
+	// OnDrift is called for every difference detected by periodic checks
+	OnDrift func(DriftEvent)
+}
+
+// Reconciler detects changes made to the resctrl groups of the managed
+// classes behind the back of the Control, comparing the schemata, mode and
+// cpus of each class against the active configuration. Optionally, the
+// configured state is re-applied. Pseudo-locked classes are not checked.
+type Reconciler struct {
+	mutex sync.Mutex
+
+	interval time.Duration
+	repair   bool
+	onDrift  func(DriftEvent)
+	ctrl     func() *Control
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// NewReconciler creates a new Reconciler for the default Control instance
+func NewReconciler(opts ReconcilerOptions) *Reconciler {
+	return newReconciler(opts, getRdt)
+}
+
+// NewReconciler creates a new Reconciler for the Control
+func (c *Control) NewReconciler(opts ReconcilerOptions) *Reconciler {
+	return newReconciler(opts, func() *Control { return c })
+}
+
+func newReconciler(opts ReconcilerOptions, ctrl func() *Control) *Reconciler {
+	r := &Reconciler{
+		interval: opts.Interval,
+		repair:   opts.Repair,
+		onDrift:  opts.OnDrift,
+		ctrl:     ctrl,
+	}
+	if r.interval <= 0 {
+		r.interval = DefaultReconcileInterval
+	}
+	return r
+}
+
+// Start starts periodic checks in the background
+func (r *Reconciler) Start() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.stop != nil {
+		return
+	}
+	r.stop = make(chan struct{})
+	r.done = make(chan struct{})
+
+	go func(stop, done chan struct{}) {
+		defer close(done)
+
+		ticker := time.NewTicker(r.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				r.run()
+			}
+		}
+	}(r.stop, r.done)
+}
+
+// Stop stops periodic checks
+func (r *Reconciler) Stop() {
+	r.mutex.Lock()
+	stop, done := r.stop, r.done
+	r.stop, r.done = nil, nil
+	r.mutex.Unlock()
+
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+}
+
+// Reconcile checks all managed classes once and returns the detected
+// differences, repairing them if enabled. Returns the first error
+// encountered while repairing, the remaining classes are still checked.
+func (r *Reconciler) Reconcile() ([]DriftEvent, error) {
+	c := r.ctrl()
+	if c == nil {
+		return nil, rdtError("%w", ErrNotInitialized)
+	}
+	return c.reconcile(r.repair)
+}
+
+// run does one periodic check
+func (r *Reconciler) run() {
+	c := r.ctrl()
+	if c == nil {
+		return
+	}
+	events, err := c.reconcile(r.repair)
+	if err != nil {
+		c.logger().Error("reconciliation failed: %v", err)
+	}
+	if r.onDrift != nil {
+		for _, e := range events {
+			r.onDrift(e)
+		}
+	}
+}
+
+// reconcile compares the managed classes against the active configuration
+func (c *Control) reconcile(repair bool) ([]DriftEvent, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	unlock, err := c.lockResctrl(repair)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	names := make([]string, 0, len(c.conf.Classes))
+	for name := range c.conf.Classes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	events := []DriftEvent{}
+	var firstErr error
+	for _, name := range names {
+		if _, ok := c.conf.pseudoLocked[name]; ok {
+			continue
+		}
+		cg, ok := c.classes[name]
+		if !ok {
+			// Dropped by a Watcher after the group was removed
+			cg = &ctrlGroup{
+				resctrlGroup: resctrlGroup{ctrl: c, prefix: c.resctrlGroupPrefix, name: name},
+				monPrefix:    c.resctrlGroupPrefix,
+				monGroups:    make(map[string]*monGroup),
+			}
+		}
+		classEvents, err := cg.reconcile(c.conf.Classes[name], repair)
+		if !ok && err == nil && repair {
+			c.classes[name] = cg
+		}
+		for _, e := range classEvents {
+			c.logger().Warn("drift detected in %s of class %q: expected %q, found %q (repaired: %v)",
+				e.Kind, e.Class, e.Expected, e.Actual, e.Repaired)
+		}
+		events = append(events, classEvents...)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = rdtError("failed to repair class %q: %w", name, err)
+			} else {
+				c.logger().Error("failed to repair class %q: %v", name, err)
+			}
+		}
+	}
+	return events, firstErr
+}
+
+// reconcile compares one class against its configuration, caller must hold
+// the mutex of the Control
+func (c *ctrlGroup) reconcile(class classConfig, repair bool) ([]DriftEvent, error) {
+	conf := c.ctrl.conf
+	events := []DriftEvent{}
+
+	schemata, _, err := classSchemata(c.ctrl.info, c.name, class, conf.Partitions[class.Partition], conf.Options)
+	if err != nil {
+		return events, err
+	}
+
+	// A removed group is re-created from scratch, its monitoring groups
+	// are lost
+	if _, err := os.Stat(c.path("")); os.IsNotExist(err) {
+		e := DriftEvent{Class: c.name, Kind: DriftGroupMissing, Expected: c.relPath("")}
+		if !repair {
+			return append(events, e), nil
+		}
+		err := c.recreate(class, conf)
+		e.Repaired = err == nil
+		return append(events, e), err
+	} else if err != nil {
+		return events, rdtError("failed to access resctrl group %q: %w", c.relPath(""), err)
+	}
+
+	mode, err := c.GetMode()
+	if err != nil {
+		return events, err
+	}
+	switch mode {
+	case GroupModePseudoLockSetup, GroupModePseudoLocked:
+		// Pseudo-locked after the configuration was set
+		return events, nil
+	}
+	origMode := mode
+
+	var firstErr error
+	check := func(kind DriftKind, expected, actual string, fix func() error) {
+		e := DriftEvent{Class: c.name, Kind: kind, Expected: expected, Actual: actual}
+		if repair {
+			err := fix()
+			e.Repaired = err == nil
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		events = append(events, e)
+	}
+
+	live, err := c.GetSchemata()
+	if err != nil {
+		return events, err
+	}
+	if !schemataMatches(c.ctrl.info, schemata, live) {
+		// Exclusive groups must be made shareable for changing the schemata
+		check(DriftSchemata, schemata, strings.TrimSpace(live), func() error {
+			if mode == GroupModeExclusive {
+				if err := c.setMode(GroupModeShareable); err != nil {
+					return err
+				}
+				mode = GroupModeShareable
+			}
+			return c.ctrl.writeRdtFile(c.relPath("schemata"), []byte(schemata))
+		})
+	}
+
+	if class.Cpus != nil {
+		cpus, err := c.GetCpus()
+		if err != nil {
+			return events, err
+		}
+		if !cpus.Equals(class.Cpus) {
+			check(DriftCpus, class.Cpus.String(), cpus.String(), func() error {
+				return c.SetCpus(class.Cpus)
+			})
+		}
+	}
+
+	if origMode != class.Mode {
+		check(DriftMode, string(class.Mode), string(origMode), func() error {
+			return c.setMode(class.Mode)
+		})
+	} else if mode != class.Mode {
+		// Restore the exclusive mode dropped for repairing the schemata
+		if err := c.setMode(class.Mode); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return events, firstErr
+}
+
+// recreate re-creates a removed resctrl group and configures it
+func (c *ctrlGroup) recreate(class classConfig, conf config) error {
+	c.ctrl.logger().Debug("re-creating resctrl group %q", c.relPath(""))
+	if err := c.ctrl.fs.Mkdir(c.path("")); err != nil && !os.IsExist(err) {
+		return c.ctrl.cmdError("mkdir", c.relPath(""), "", err)
+	}
+
+	c.mutex.Lock()
+	for name, mg := range c.monGroups {
+		if err := c.ctrl.state.remove(mg.relPath("")); err != nil {
+			c.ctrl.logger().Warn("failed to drop annotations of monitoring group %q: %v", mg.relPath(""), err)
+		}
+		delete(c.monGroups, name)
+	}
+	c.mutex.Unlock()
+
+	if err := c.configure(c.name, class, conf.Partitions[class.Partition], conf.Options); err != nil {
+		return err
+	}
+	if class.Mode == GroupModeExclusive {
+		return c.setMode(class.Mode)
+	}
+	return nil
+}
+
+// schemataMatches returns true if the live schemata of a group contains the
+// values of the expected schemata. The kernel reports the values in its own
+// format, rounds memory bandwidth percentages up to the bandwidth
+// granularity and includes resources not managed by the configuration.
+func schemataMatches(info *resctrlInfo, expected, live string) bool {
+	// Memory bandwidth values are decimal, cache bitmasks hexadecimal
+	parse := func(data string) map[string]map[uint64]uint64 {
+		ret := parseSchemata(data, 16)
+		if mb, ok := parseSchemata(data, 10)["MB"]; ok {
+			ret["MB"] = mb
+		}
+		return ret
+	}
+
+	l := parse(live)
+	for name, domains := range parse(expected) {
+		for id, value := range domains {
+			if name == "MB" {
+				value = info.mb.roundBandwidth(value)
+			}
+			if v, ok := l[name][id]; !ok || v != value {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,1348 @@
+/*
+Copyright 2021 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package resctrltest provides a fake resctrl filesystem for unit testing
+// code that uses goresctrl.
+//
+// The fake is a directory tree in a temporary directory, built from an
+// rdt.HardwareProfile. Reads are served directly from the tree. Writes, and
+// creation and removal of groups, go through the Fs which emulates the kernel
+// semantics where practical: schemata are validated and merged, exclusive
+// groups are protected from overlapping allocations, cache allocations can be
+// pseudo-locked, the usage of cache ways is reported in bit_usage, tasks and
+// CPUs are moved between groups, CLOSIDs and RMIDs are accounted and
+// info/last_cmd_status is updated. The fake system has NumCpus CPUs, all of
+// them initially owned by the root group. The size of one cache way is
+// derived from the CacheSizes of the profile, defaulting to WaySize bytes.
+//
+// Typical usage:
+//
+//	fs, err := resctrltest.New(hw)
+//	...
+//	defer fs.Close()
+//	ctrl, err := rdt.NewControl(fs.ControlOptions("test."))
+package resctrltest
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/intel/goresctrl/pkg/rdt"
+)
+
+const (
+	// NumCpus is the number of CPUs of the fake system
+	NumCpus = 8
+	// WaySize is the size of one cache way of the fake system, in bytes, if
+	// the hardware profile does not specify cache sizes
+	WaySize = 1 << 20
+)
+
+// Fs is a fake resctrl filesystem
+type Fs struct {
+	mutex sync.Mutex
+
+	hw            rdt.HardwareProfile
+	baseDir       string
+	root          string
+	mountInfoPath string
+	resources     []resource
+}
+
+// resource is one allocation resource, i.e. one line in the schemata
+type resource struct {
+	name          string
+	ids           []uint64
+	cbmMask       rdt.Bitmask
+	minCbmBits    uint64
+	shareableBits rdt.Bitmask
+	numClosids    uint64
+	hardwareBits  map[uint64]rdt.Bitmask
+	cacheSizes    map[uint64]uint64
+	mb            *rdt.MBProfile
+}
+
+// New creates a new fake resctrl filesystem in a temporary directory
+func New(hw rdt.HardwareProfile) (*Fs, error) {
+	baseDir, err := ioutil.TempDir("", "resctrltest.")
+	if err != nil {
+		return nil, err
+	}
+
+	f := &Fs{
+		hw:            hw,
+		baseDir:       baseDir,
+		root:          filepath.Join(baseDir, "resctrl"),
+		mountInfoPath: filepath.Join(baseDir, "mountinfo"),
+	}
+
+	if err := f.init(); err != nil {
+		if rmErr := os.RemoveAll(baseDir); rmErr != nil {
+			return nil, fmt.Errorf("%v (cleanup failed: %v)", err, rmErr)
+		}
+		return nil, err
+	}
+	return f, nil
+}
+
+// Close removes the fake filesystem
+func (f *Fs) Close() error {
+	return os.RemoveAll(f.baseDir)
+}
+
+// Path returns the mount point of the fake resctrl filesystem
+func (f *Fs) Path() string {
+	return f.root
+}
+
+// MountInfoPath returns the path of a mount table with the fake resctrl
+// filesystem mounted
+func (f *Fs) MountInfoPath() string {
+	return f.mountInfoPath
+}
+
+// ControlOptions returns options for creating an rdt.Control operating on
+// the fake filesystem
+func (f *Fs) ControlOptions(resctrlGroupPrefix string) rdt.ControlOptions {
+	return rdt.ControlOptions{
+		ResctrlGroupPrefix: resctrlGroupPrefix,
+		MountInfoPath:      f.mountInfoPath,
+		FileSystem:         f,
+	}
+}
+
+// ReadFile reads a file of the fake filesystem. The path is relative to the
+// resctrl mount point.
+func (f *Fs) ReadFile(relPath string) (string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(f.root, relPath))
+	return string(data), err
+}
+
+// SetMonData sets the value of a monitoring counter of a group. The group is
+// given as a path relative to the resctrl mount point.
+func (f *Fs) SetMonData(group string, cacheID uint64, feature string, value uint64) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	path := filepath.Join(f.root, group, "mon_data", fmt.Sprintf("mon_L3_%02d", cacheID), feature)
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+	return writeFile(path, strconv.FormatUint(value, 10)+"\n")
+}
+
+// OpenFile implements the rdt.FileSystem interface
+func (f *Fs) OpenFile(path string) (io.WriteCloser, error) {
+	rel, err := f.relPath(path)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	if s, err := os.Stat(path); err != nil {
+		return nil, err
+	} else if s.IsDir() {
+		return nil, &os.PathError{Op: "open", Path: path, Err: syscall.EISDIR}
+	}
+	return &file{fs: f, path: path, rel: rel}, nil
+}
+
+// Mkdir implements the rdt.FileSystem interface
+func (f *Fs) Mkdir(path string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	rel, err := f.relPath(path)
+	if err != nil {
+		return &os.PathError{Op: "mkdir", Path: path, Err: err}
+	}
+	if _, err := os.Stat(path); err == nil {
+		return &os.PathError{Op: "mkdir", Path: path, Err: syscall.EEXIST}
+	}
+
+	f.setCmdStatus("ok")
+
+	switch {
+	case filepath.Dir(rel) == "." && !isReserved(rel):
+		if f.usedClosids() >= f.numClosids() {
+			f.setCmdStatus("Out of CLOSIDs")
+			return &os.PathError{Op: "mkdir", Path: path, Err: syscall.ENOSPC}
+		}
+		if err := f.checkRmids(); err != nil {
+			return &os.PathError{Op: "mkdir", Path: path, Err: err}
+		}
+		if err := f.createCtrlGroup(rel); err != nil {
+			return err
+		}
+		return f.updateBitUsage()
+	case filepath.Base(filepath.Dir(rel)) == "mon_groups" && f.isCtrlGroup(filepath.Dir(filepath.Dir(rel))):
+		if f.isPseudoLocking(filepath.Dir(filepath.Dir(rel))) {
+			f.setCmdStatus("Pseudo-locking in progress")
+			return &os.PathError{Op: "mkdir", Path: path, Err: syscall.EINVAL}
+		}
+		if err := f.checkRmids(); err != nil {
+			return &os.PathError{Op: "mkdir", Path: path, Err: err}
+		}
+		return f.createMonGroup(rel)
+	}
+	return &os.PathError{Op: "mkdir", Path: path, Err: syscall.EPERM}
+}
+
+// Rmdir implements the rdt.FileSystem interface. Tasks of a removed control
+// group are moved to the root group.
+func (f *Fs) Rmdir(path string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	rel, err := f.relPath(path)
+	if err != nil {
+		return &os.PathError{Op: "rmdir", Path: path, Err: err}
+	}
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+
+	switch {
+	case rel != "." && f.isCtrlGroup(rel):
+		tasks, err := f.readTasks(rel)
+		if err != nil {
+			return err
+		}
+		if err := f.addTasks(".", tasks); err != nil {
+			return err
+		}
+		cpus, err := f.readCpus(rel)
+		if err != nil {
+			return err
+		}
+		root, err := f.readCpus(".")
+		if err != nil {
+			return err
+		}
+		if err := f.writeCpus(".", union(root, cpus)); err != nil {
+			return err
+		}
+	case f.isMonGroup(rel):
+		// Tasks stay in the parent control group
+	default:
+		return &os.PathError{Op: "rmdir", Path: path, Err: syscall.EPERM}
+	}
+	if err := os.RemoveAll(path); err != nil {
+		return err
+	}
+	return f.updateBitUsage()
+}
+
+// file is a resctrl file opened for writing
+type file struct {
+	fs   *Fs
+	path string
+	rel  string
+}
+
+// Write emulates one write(2) on a resctrl file
+func (w *file) Write(data []byte) (int, error) {
+	w.fs.mutex.Lock()
+	defer w.fs.mutex.Unlock()
+
+	w.fs.setCmdStatus("ok")
+
+	var err error
+	dir, name := filepath.Split(w.rel)
+	dir = filepath.Clean(dir)
+	switch {
+	case strings.HasPrefix(w.rel, "info"+string(filepath.Separator)) || strings.Contains(w.rel, "mon_data"):
+		err = syscall.EACCES
+	case name == "schemata" && w.fs.isCtrlGroup(dir):
+		err = w.fs.writeSchemata(dir, string(data))
+	case name == "mode" && w.fs.isCtrlGroup(dir):
+		err = w.fs.writeMode(dir, string(data))
+	case (name == "tasks" || name == "cpus" || name == "cpus_list") && w.fs.isCtrlGroup(dir) && w.fs.isPseudoLocking(dir):
+		w.fs.setCmdStatus("Pseudo-locking in progress")
+		err = syscall.EINVAL
+	case name == "tasks" && w.fs.isCtrlGroup(dir):
+		err = w.fs.moveTasks(dir, "", string(data))
+	case name == "tasks" && w.fs.isMonGroup(dir):
+		err = w.fs.moveTasks(filepath.Dir(filepath.Dir(dir)), dir, string(data))
+	case (name == "cpus" || name == "cpus_list") && w.fs.isCtrlGroup(dir):
+		err = w.fs.moveCpus(dir, "", string(data), name == "cpus_list")
+	case (name == "cpus" || name == "cpus_list") && w.fs.isMonGroup(dir):
+		err = w.fs.moveCpus(filepath.Dir(filepath.Dir(dir)), dir, string(data), name == "cpus_list")
+	default:
+		err = writeFile(w.path, string(data))
+	}
+	if err == nil {
+		err = w.fs.updateBitUsage()
+	}
+	if err != nil {
+		return 0, &os.PathError{Op: "write", Path: w.path, Err: err}
+	}
+	return len(data), nil
+}
+
+// Close implements io.Closer
+func (w *file) Close() error {
+	return nil
+}
+
+func (f *Fs) init() error {
+	// Allocation resources in the order the kernel lists them
+	for _, c := range []struct {
+		name string
+		p    *rdt.CacheProfile
+	}{{"L3", f.hw.L3}, {"L2", f.hw.L2}} {
+		if c.p == nil {
+			continue
+		}
+		names := []string{c.name}
+		if c.p.CDP {
+			names = []string{c.name + "DATA", c.name + "CODE"}
+		}
+		for _, name := range names {
+			f.resources = append(f.resources, resource{name: name, numClosids: resourceClosids(f.hw, c.p.NumClosids), ids: c.p.CacheIds, cbmMask: c.p.CbmMask, minCbmBits: c.p.MinCbmBits, shareableBits: c.p.ShareableBits, hardwareBits: c.p.HardwareBits, cacheSizes: c.p.CacheSizes})
+
+			infoDir := filepath.Join(f.root, "info", name)
+			if err := writeFiles(infoDir, map[string]string{
+				"cbm_mask":       fmt.Sprintf("%x\n", uint64(c.p.CbmMask)),
+				"min_cbm_bits":   fmt.Sprintf("%d\n", c.p.MinCbmBits),
+				"num_closids":    fmt.Sprintf("%d\n", f.resources[len(f.resources)-1].numClosids),
+				"shareable_bits": fmt.Sprintf("%x\n", uint64(c.p.ShareableBits)),
+			}); err != nil {
+				return err
+			}
+		}
+	}
+	if mb := f.hw.MB; mb != nil {
+		f.resources = append(f.resources, resource{name: "MB", numClosids: resourceClosids(f.hw, mb.NumClosids), ids: mb.CacheIds, mb: mb})
+		if err := writeFiles(filepath.Join(f.root, "info", "MB"), map[string]string{
+			"bandwidth_gran": fmt.Sprintf("%d\n", mb.BandwidthGran),
+			"delay_linear":   fmt.Sprintf("%d\n", mb.DelayLinear),
+			"min_bandwidth":  fmt.Sprintf("%d\n", mb.MinBandwidth),
+			"num_closids":    fmt.Sprintf("%d\n", f.resources[len(f.resources)-1].numClosids),
+		}); err != nil {
+			return err
+		}
+	}
+	if mon := f.hw.L3Mon; mon != nil {
+		if err := writeFiles(filepath.Join(f.root, "info", "L3_MON"), map[string]string{
+			"num_rmids":               fmt.Sprintf("%d\n", mon.NumRmids),
+			"mon_features":            strings.Join(mon.MonFeatures, "\n") + "\n",
+			"max_threshold_occupancy": "0\n",
+		}); err != nil {
+			return err
+		}
+	}
+	if err := writeFiles(filepath.Join(f.root, "info"), map[string]string{"last_cmd_status": "ok\n"}); err != nil {
+		return err
+	}
+
+	if err := f.createCtrlGroup("."); err != nil {
+		return err
+	}
+	all := rdt.CPUSet{}
+	for cpu := 0; cpu < NumCpus; cpu++ {
+		all[cpu] = struct{}{}
+	}
+	if err := f.writeCpus(".", all); err != nil {
+		return err
+	}
+	if err := f.updateBitUsage(); err != nil {
+		return err
+	}
+
+	// Mount options, in /proc/self/mountinfo format
+	opts := []string{"rw"}
+	if f.hw.L3 != nil && f.hw.L3.CDP {
+		opts = append(opts, "cdp")
+	}
+	if f.hw.L2 != nil && f.hw.L2.CDP {
+		opts = append(opts, "cdpl2")
+	}
+	if f.hw.MB != nil && f.hw.MB.MBpsEnabled {
+		opts = append(opts, "mba_MBps")
+	}
+	mounts := fmt.Sprintf("40 22 0:37 / %s rw,relatime shared:20 - resctrl resctrl %s\n",
+		escapeMountField(f.root), strings.Join(opts, ","))
+	return writeFile(f.mountInfoPath, mounts)
+}
+
+func (f *Fs) relPath(path string) (string, error) {
+	rel, err := filepath.Rel(f.root, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", syscall.ENOENT
+	}
+	return rel, nil
+}
+
+func (f *Fs) setCmdStatus(status string) {
+	_ = writeFile(filepath.Join(f.root, "info", "last_cmd_status"), status+"\n")
+}
+
+// updateBitUsage updates the bit_usage files of the cache resources the way
+// the kernel reports the usage of the ways
+func (f *Fs) updateBitUsage() error {
+	groups := f.ctrlGroups()
+	for _, r := range f.resources {
+		if r.mb != nil {
+			continue
+		}
+
+		sw, excl, locked := map[uint64]uint64{}, map[uint64]uint64{}, map[uint64]uint64{}
+		for _, g := range groups {
+			s, err := f.readSchemata(g)
+			if err != nil {
+				return err
+			}
+			for id, mask := range s[r.name] {
+				switch f.readMode(g) {
+				case "shareable":
+					sw[id] |= mask
+				case "exclusive":
+					excl[id] |= mask
+				case "pseudo-locked":
+					locked[id] |= mask
+				}
+			}
+		}
+
+		ids := append([]uint64{}, r.ids...)
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+		width := bits.Len64(uint64(r.cbmMask))
+		domains := make([]string, len(ids))
+		for i, id := range ids {
+			hw := uint64(r.shareableBits | r.hardwareBits[id])
+			usage := make([]byte, width)
+			for n := range usage {
+				bit := uint64(1) << uint(width-1-n)
+				switch {
+				case hw&bit != 0 && sw[id]&bit != 0:
+					usage[n] = 'X'
+				case hw&bit != 0 && excl[id]&bit != 0:
+					usage[n] = 'E'
+				case hw&bit != 0:
+					usage[n] = 'H'
+				case sw[id]&bit != 0:
+					usage[n] = 'S'
+				case excl[id]&bit != 0:
+					usage[n] = 'E'
+				case locked[id]&bit != 0:
+					usage[n] = 'P'
+				default:
+					usage[n] = '0'
+				}
+			}
+			domains[i] = fmt.Sprintf("%d=%s", id, usage)
+		}
+		if err := writeFile(filepath.Join(f.root, "info", r.name, "bit_usage"), strings.Join(domains, ";")+"\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isCtrlGroup returns true if the relative path is a control group
+func (f *Fs) isCtrlGroup(rel string) bool {
+	if rel == "." {
+		return true
+	}
+	if filepath.Dir(rel) != "." || isReserved(rel) {
+		return false
+	}
+	s, err := os.Stat(filepath.Join(f.root, rel))
+	return err == nil && s.IsDir()
+}
+
+// isReserved returns true if the name is reserved in the root directory
+func isReserved(name string) bool {
+	return name == "info" || name == "mon_groups" || name == "mon_data"
+}
+
+// isMonGroup returns true if the relative path is a monitoring group
+func (f *Fs) isMonGroup(rel string) bool {
+	parent := filepath.Dir(rel)
+	if filepath.Base(parent) != "mon_groups" || !f.isCtrlGroup(filepath.Dir(parent)) {
+		return false
+	}
+	s, err := os.Stat(filepath.Join(f.root, rel))
+	return err == nil && s.IsDir()
+}
+
+// ctrlGroups returns all control groups, including the root group
+func (f *Fs) ctrlGroups() []string {
+	groups := []string{"."}
+	files, _ := ioutil.ReadDir(f.root)
+	for _, file := range files {
+		if file.IsDir() && f.isCtrlGroup(file.Name()) {
+			groups = append(groups, file.Name())
+		}
+	}
+	return groups
+}
+
+// monGroups returns the monitoring groups of a control group
+func (f *Fs) monGroups(ctrlGroup string) []string {
+	groups := []string{}
+	files, _ := ioutil.ReadDir(filepath.Join(f.root, ctrlGroup, "mon_groups"))
+	for _, file := range files {
+		if file.IsDir() {
+			groups = append(groups, filepath.Join(ctrlGroup, "mon_groups", file.Name()))
+		}
+	}
+	return groups
+}
+
+// usedClosids returns the number of CLOSIDs in use. Pseudo-locked groups
+// release their CLOSID.
+func (f *Fs) usedClosids() uint64 {
+	used := uint64(0)
+	for _, g := range f.ctrlGroups() {
+		if f.readMode(g) != "pseudo-locked" {
+			used++
+		}
+	}
+	return used
+}
+
+// numClosids returns the number of CLOSIDs available for groups which, like
+// in the kernel, is the smallest number supported by any resource
+func (f *Fs) numClosids() uint64 {
+	n := f.hw.NumClosids
+	for _, r := range f.resources {
+		if num := r.numClosids; n == 0 || num < n {
+			n = num
+		}
+	}
+	return n
+}
+
+// resourceClosids returns the number of CLOSIDs of one resource, defaulting
+// to the NumClosids of the hardware profile
+func resourceClosids(hw rdt.HardwareProfile, n uint64) uint64 {
+	if n == 0 {
+		return hw.NumClosids
+	}
+	return n
+}
+
+// checkRmids checks that a free RMID is available for a new group. Groups
+// release their RMID when entering pseudo-lock setup.
+func (f *Fs) checkRmids() error {
+	if f.hw.L3Mon == nil {
+		return nil
+	}
+	used := uint64(0)
+	for _, g := range f.ctrlGroups() {
+		if !f.isPseudoLocking(g) {
+			used += 1 + uint64(len(f.monGroups(g)))
+		}
+	}
+	if used >= f.hw.L3Mon.NumRmids {
+		f.setCmdStatus("Out of RMIDs")
+		return syscall.ENOSPC
+	}
+	return nil
+}
+
+// createCtrlGroup creates a new control group. Like in the kernel, the cache
+// allocations of a new group exclude the bits used by exclusive groups and
+// pseudo-locked regions.
+func (f *Fs) createCtrlGroup(rel string) error {
+	s := f.defaultSchemata()
+	for _, cg := range f.ctrlGroups() {
+		if mode := f.readMode(cg); cg == rel || (mode != "exclusive" && mode != "pseudo-locked") {
+			continue
+		}
+		o, err := f.readSchemata(cg)
+		if err != nil {
+			return err
+		}
+		for _, r := range f.resources {
+			if r.mb != nil {
+				continue
+			}
+			for _, id := range r.ids {
+				s[r.name][id] &^= o[r.name][id]
+				if s[r.name][id] == 0 {
+					f.setCmdStatus(fmt.Sprintf("No space on %s:%d", r.name, id))
+					return syscall.ENOSPC
+				}
+			}
+		}
+	}
+
+	dir := filepath.Join(f.root, rel)
+	if err := writeFiles(dir, map[string]string{
+		"cpus":      "0\n",
+		"cpus_list": "\n",
+		"mode":      "shareable\n",
+		"schemata":  f.formatSchemata(s),
+		"size":      f.formatSize(s),
+		"tasks":     "",
+	}); err != nil {
+		return err
+	}
+	if f.hw.L3Mon != nil {
+		if err := os.MkdirAll(filepath.Join(dir, "mon_groups"), 0755); err != nil {
+			return err
+		}
+	}
+	return f.createMonData(dir)
+}
+
+func (f *Fs) createMonGroup(rel string) error {
+	dir := filepath.Join(f.root, rel)
+	if err := writeFiles(dir, map[string]string{
+		"cpus":      "0\n",
+		"cpus_list": "\n",
+		"tasks":     "",
+	}); err != nil {
+		return err
+	}
+	return f.createMonData(dir)
+}
+
+func (f *Fs) createMonData(dir string) error {
+	if f.hw.L3Mon == nil || f.hw.L3 == nil {
+		return nil
+	}
+	for _, id := range f.hw.L3.CacheIds {
+		data := map[string]string{}
+		for _, feature := range f.hw.L3Mon.MonFeatures {
+			data[feature] = "0\n"
+		}
+		if err := writeFiles(filepath.Join(dir, "mon_data", fmt.Sprintf("mon_L3_%02d", id)), data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// schemata contains the allocations of a group, per resource and domain id
+type schemata map[string]map[uint64]uint64
+
+func (f *Fs) defaultSchemata() schemata {
+	s := make(schemata, len(f.resources))
+	for _, r := range f.resources {
+		s[r.name] = make(map[uint64]uint64, len(r.ids))
+		for _, id := range r.ids {
+			switch {
+			case r.mb == nil:
+				s[r.name][id] = uint64(r.cbmMask)
+			case r.mb.MBpsEnabled:
+				s[r.name][id] = 1<<32 - 1
+			default:
+				s[r.name][id] = 100
+			}
+		}
+	}
+	return s
+}
+
+// formatSchemata formats schemata the way the kernel does
+func (f *Fs) formatSchemata(s schemata) string {
+	return f.format(s, "%x")
+}
+
+// format formats values per resource and domain id, using cacheFmt for the
+// values of cache resources
+func (f *Fs) format(s schemata, cacheFmt string) string {
+	width := 0
+	for _, r := range f.resources {
+		if len(r.name) > width {
+			width = len(r.name)
+		}
+	}
+
+	out := ""
+	for _, r := range f.resources {
+		ids := append([]uint64{}, r.ids...)
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+		domains := make([]string, len(ids))
+		for i, id := range ids {
+			if r.mb != nil {
+				domains[i] = fmt.Sprintf("%d=%d", id, s[r.name][id])
+			} else {
+				domains[i] = fmt.Sprintf("%d="+cacheFmt, id, s[r.name][id])
+			}
+		}
+		out += fmt.Sprintf("%*s:%s\n", width, r.name, strings.Join(domains, ";"))
+	}
+	return out
+}
+
+// formatSize formats the size file of a group with the given schemata: the
+// sizes of cache allocations in bytes and the memory bandwidth allocations as
+// such
+func (f *Fs) formatSize(s schemata) string {
+	sizes := make(schemata, len(s))
+	for _, r := range f.resources {
+		sizes[r.name] = make(map[uint64]uint64, len(s[r.name]))
+		for id, value := range s[r.name] {
+			if r.mb == nil {
+				value = uint64(bits.OnesCount64(value)) * r.waySize(id)
+			}
+			sizes[r.name][id] = value
+		}
+	}
+	return f.format(sizes, "%d")
+}
+
+// parseSchemata parses schemata as read from a schemata file
+func (f *Fs) parseSchemata(data string) schemata {
+	return f.parseSchemataInto(f.defaultSchemata(), data)
+}
+
+// parseSchemataInto parses schemata and merges the allocations into s
+func (f *Fs) parseSchemataInto(s schemata, data string) schemata {
+	for _, line := range strings.Split(data, "\n") {
+		split := strings.SplitN(line, ":", 2)
+		if len(split) != 2 {
+			continue
+		}
+		name := strings.TrimSpace(split[0])
+		for _, d := range strings.Split(split[1], ";") {
+			kv := strings.SplitN(d, "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			id, _ := strconv.ParseUint(strings.TrimSpace(kv[0]), 10, 64)
+			base := 16
+			if name == "MB" {
+				base = 10
+			}
+			value, _ := strconv.ParseUint(strings.TrimSpace(kv[1]), base, 64)
+			if f.resource(name) == nil {
+				continue
+			}
+			if _, ok := s[name]; !ok {
+				s[name] = map[uint64]uint64{}
+			}
+			s[name][id] = value
+		}
+	}
+	return s
+}
+
+// writeSchemata emulates a write to the schemata file of a control group:
+// the new allocations are validated and merged into the existing schemata. In
+// pseudo-locksetup mode the first cache allocation written is pseudo-locked.
+func (f *Fs) writeSchemata(group, data string) error {
+	mode := f.readMode(group)
+	if mode == "pseudo-locked" {
+		f.setCmdStatus("Resource group is pseudo-locked")
+		return syscall.EINVAL
+	}
+
+	path := filepath.Join(f.root, group, "schemata")
+	old, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	s := f.parseSchemata(string(old))
+	var region schemata
+
+	for _, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		split := strings.SplitN(line, ":", 2)
+		if len(split) != 2 {
+			f.setCmdStatus("Missing ':'")
+			return syscall.EINVAL
+		}
+		name := strings.TrimSpace(split[0])
+		r := f.resource(name)
+		if r == nil {
+			f.setCmdStatus(fmt.Sprintf("Unknown or unsupported resource name '%s'", name))
+			return syscall.EINVAL
+		}
+		if mode == "pseudo-locksetup" && r.mb != nil {
+			f.setCmdStatus("Cannot pseudo-lock MBA resource")
+			return syscall.EINVAL
+		}
+		if strings.TrimSpace(split[1]) == "" {
+			// Like the kernel, accept an empty list of domains
+			continue
+		}
+		for _, d := range strings.Split(split[1], ";") {
+			kv := strings.SplitN(d, "=", 2)
+			if len(kv) != 2 {
+				f.setCmdStatus("Missing '=' or non-numeric domain id")
+				return syscall.EINVAL
+			}
+			id, err := strconv.ParseUint(strings.TrimSpace(kv[0]), 10, 64)
+			if err != nil || !r.hasID(id) {
+				f.setCmdStatus("Missing '=' or non-numeric domain id")
+				return syscall.EINVAL
+			}
+			value, status := r.parseValue(strings.TrimSpace(kv[1]))
+			if status != "" {
+				f.setCmdStatus(status)
+				return syscall.EINVAL
+			}
+			if r.mb == nil && f.overlapsPseudoLocked(group, schemata{name: {id: value}}) {
+				f.setCmdStatus("CBM overlaps with pseudo-locked region")
+				return syscall.EINVAL
+			}
+			s[name][id] = value
+			if mode == "pseudo-locksetup" && region == nil {
+				region = schemata{name: {id: value}}
+			}
+		}
+	}
+
+	if mode == "pseudo-locksetup" {
+		if region == nil {
+			return f.writeSchemataFiles(group, s)
+		}
+		return f.pseudoLock(group, region)
+	}
+
+	if mode == "exclusive" {
+		if f.overlaps(group, s, true) {
+			f.setCmdStatus("Overlaps with other group")
+			return syscall.EINVAL
+		}
+	} else if f.overlaps(group, s, false) {
+		f.setCmdStatus("Overlaps with exclusive group")
+		return syscall.EINVAL
+	}
+
+	return f.writeSchemataFiles(group, s)
+}
+
+// writeSchemataFiles updates the schemata and size files of a group
+func (f *Fs) writeSchemataFiles(group string, s schemata) error {
+	return writeFiles(filepath.Join(f.root, group), map[string]string{
+		"schemata": f.formatSchemata(s),
+		"size":     f.formatSize(s),
+	})
+}
+
+// writeMode emulates a write to the mode file of a control group. A group
+// can only be made exclusive if its cache allocations do not overlap with any
+// other group or the bits shared with hardware. The mode of a pseudo-locked
+// group cannot be changed.
+func (f *Fs) writeMode(group, data string) error {
+	if f.readMode(group) == "pseudo-locked" {
+		f.setCmdStatus("Cannot change pseudo-locked group")
+		return syscall.EINVAL
+	}
+
+	mode := strings.TrimSpace(data)
+	switch mode {
+	case "shareable":
+	case "pseudo-locksetup":
+		if status := f.checkLockSetup(group); status != "" {
+			f.setCmdStatus(status)
+			return syscall.EINVAL
+		}
+	case "exclusive":
+		hasCache := false
+		for _, r := range f.resources {
+			hasCache = hasCache || r.mb == nil
+		}
+		if !hasCache {
+			f.setCmdStatus("Cannot be exclusive without CAT/CDP")
+			return syscall.EINVAL
+		}
+		s, err := f.readSchemata(group)
+		if err != nil {
+			return err
+		}
+		if f.overlaps(group, s, true) {
+			f.setCmdStatus("Schemata overlaps")
+			return syscall.EINVAL
+		}
+	default:
+		f.setCmdStatus("Unknown or unsupported mode")
+		return syscall.EINVAL
+	}
+	return writeFile(filepath.Join(f.root, group, "mode"), mode+"\n")
+}
+
+// checkLockSetup checks if a group can enter pseudo-locksetup mode. Returns
+// the error status reported by the kernel on failure.
+func (f *Fs) checkLockSetup(group string) string {
+	if group == "." {
+		return "Cannot pseudo-lock default group"
+	}
+	for _, r := range f.resources {
+		if strings.HasSuffix(r.name, "CODE") || strings.HasSuffix(r.name, "DATA") {
+			return "CDP enabled"
+		}
+	}
+	if len(f.monGroups(group)) > 0 {
+		return "Monitoring in progress"
+	}
+	if tasks, _ := f.readTasks(group); len(tasks) > 0 {
+		return "Tasks assigned to resource group"
+	}
+	if cpus, _ := f.readCpus(group); cpus.Size() > 0 {
+		return "CPUs assigned to resource group"
+	}
+	return ""
+}
+
+// pseudoLock locks one cache allocation of a group in pseudo-locksetup mode.
+// The region must not overlap with any other group. Like in the kernel, the
+// group then only shows the locked region in its schemata and size files and
+// releases its CLOSID.
+func (f *Fs) pseudoLock(group string, region schemata) error {
+	if f.overlaps(group, region, true) {
+		f.setCmdStatus("Overlaps with other group")
+		return syscall.EINVAL
+	}
+
+	dir := filepath.Join(f.root, group)
+	for name, domains := range region {
+		for id, mask := range domains {
+			return writeFiles(dir, map[string]string{
+				"schemata": fmt.Sprintf("%s:%d=%x\n", name, id, mask),
+				"size":     fmt.Sprintf("%s:%d=%d\n", name, id, uint64(bits.OnesCount64(mask))*f.resource(name).waySize(id)),
+				"mode":     "pseudo-locked\n",
+			})
+		}
+	}
+	return nil
+}
+
+// isPseudoLocking returns true if a group is in pseudo-locksetup or
+// pseudo-locked mode
+func (f *Fs) isPseudoLocking(group string) bool {
+	mode := f.readMode(group)
+	return mode == "pseudo-locksetup" || mode == "pseudo-locked"
+}
+
+func (f *Fs) readMode(group string) string {
+	data, _ := ioutil.ReadFile(filepath.Join(f.root, group, "mode"))
+	return strings.TrimSpace(string(data))
+}
+
+// readSchemata reads the allocations of a group. The schemata of a
+// pseudo-locked group only contain the locked region.
+func (f *Fs) readSchemata(group string) (schemata, error) {
+	data, err := ioutil.ReadFile(filepath.Join(f.root, group, "schemata"))
+	if err != nil {
+		return nil, err
+	}
+	if f.readMode(group) == "pseudo-locked" {
+		return f.parseSchemataInto(schemata{}, string(data)), nil
+	}
+	return f.parseSchemata(string(data)), nil
+}
+
+// overlaps checks if the cache allocations of a group overlap with other
+// groups. If all is false only exclusive groups are taken into account,
+// otherwise all groups and the bits shared with hardware.
+func (f *Fs) overlaps(group string, s schemata, all bool) bool {
+	for _, other := range f.ctrlGroups() {
+		if other == group || (!all && f.readMode(other) != "exclusive") {
+			continue
+		}
+		o, err := f.readSchemata(other)
+		if err != nil {
+			continue
+		}
+		for _, r := range f.resources {
+			if r.mb != nil {
+				continue
+			}
+			for _, id := range r.ids {
+				if s[r.name][id]&o[r.name][id] != 0 {
+					return true
+				}
+			}
+		}
+	}
+	if all {
+		for _, r := range f.resources {
+			for _, id := range r.ids {
+				if r.mb == nil && s[r.name][id]&uint64(r.shareableBits) != 0 {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// overlapsPseudoLocked checks if cache allocations overlap with the
+// pseudo-locked regions of other groups
+func (f *Fs) overlapsPseudoLocked(group string, s schemata) bool {
+	for _, other := range f.ctrlGroups() {
+		if other == group || f.readMode(other) != "pseudo-locked" {
+			continue
+		}
+		o, err := f.readSchemata(other)
+		if err != nil {
+			continue
+		}
+		for name, domains := range s {
+			for id, mask := range domains {
+				if mask&o[name][id] != 0 {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func (f *Fs) resource(name string) *resource {
+	for i := range f.resources {
+		if f.resources[i].name == name {
+			return &f.resources[i]
+		}
+	}
+	return nil
+}
+
+// waySize returns the size of one cache way of a cache resource in bytes
+func (r *resource) waySize(id uint64) uint64 {
+	if size, ok := r.cacheSizes[id]; ok {
+		return size / uint64(bits.OnesCount64(uint64(r.cbmMask)))
+	}
+	return WaySize
+}
+
+func (r *resource) hasID(id uint64) bool {
+	for _, i := range r.ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
+
+// parseValue validates one allocation value the way the kernel does.
+// Returns the value and, on failure, the error status reported by the kernel.
+func (r *resource) parseValue(str string) (uint64, string) {
+	if r.mb != nil {
+		value, err := strconv.ParseUint(str, 10, 32)
+		if err != nil {
+			return 0, fmt.Sprintf("Non-decimal digit in MB value %s", str)
+		}
+		if r.mb.MBpsEnabled {
+			return value, ""
+		}
+		if value < r.mb.MinBandwidth || value > 100 {
+			return 0, fmt.Sprintf("MB value %d out of range [%d,%d]", value, r.mb.MinBandwidth, 100)
+		}
+		// Round up to the bandwidth granularity
+		if gran := r.mb.BandwidthGran; gran > 1 {
+			value = (value + gran - 1) / gran * gran
+		}
+		return value, ""
+	}
+
+	value, err := strconv.ParseUint(str, 16, 64)
+	if err != nil {
+		return 0, fmt.Sprintf("Non-hex character in the mask %s", str)
+	}
+	if value & ^uint64(r.cbmMask) != 0 {
+		return 0, "Mask out of range"
+	}
+	if value != 0 {
+		// Check that the bits are consecutive
+		v := value
+		for v&1 == 0 {
+			v >>= 1
+		}
+		if v&(v+1) != 0 {
+			return 0, fmt.Sprintf("The mask %x has non-consecutive 1-bits", value)
+		}
+	}
+	if n := uint64(bits.OnesCount64(value)); n < r.minCbmBits {
+		return 0, fmt.Sprintf("Need at least %d bits in the mask", r.minCbmBits)
+	}
+	return value, ""
+}
+
+// moveTasks emulates a write to a tasks file. A task belongs to exactly one
+// control group and to at most one of its monitoring groups. Tasks can only
+// be moved to monitoring groups of their current control group.
+func (f *Fs) moveTasks(ctrlGroup, monGroup, data string) error {
+	pids := []string{}
+	for _, str := range strings.Fields(data) {
+		if _, err := strconv.ParseUint(str, 10, 32); err != nil {
+			f.setCmdStatus(fmt.Sprintf("Invalid pid %q", str))
+			return syscall.EINVAL
+		}
+		pids = append(pids, str)
+	}
+
+	if monGroup != "" {
+		tasks, err := f.readTasks(ctrlGroup)
+		if err != nil {
+			return err
+		}
+		for _, pid := range pids {
+			if !contains(tasks, pid) {
+				f.setCmdStatus("Can't move task to different control group")
+				return syscall.EINVAL
+			}
+		}
+		for _, mg := range f.monGroups(ctrlGroup) {
+			if err := f.removeTasks(mg, pids); err != nil {
+				return err
+			}
+		}
+		return f.addTasks(monGroup, pids)
+	}
+
+	for _, cg := range f.ctrlGroups() {
+		if err := f.removeTasks(cg, pids); err != nil {
+			return err
+		}
+		for _, mg := range f.monGroups(cg) {
+			if err := f.removeTasks(mg, pids); err != nil {
+				return err
+			}
+		}
+	}
+	return f.addTasks(ctrlGroup, pids)
+}
+
+// moveCpus emulates a write to a cpus or cpus_list file. A CPU belongs to
+// exactly one control group and to at most one of its monitoring groups. CPUs
+// dropped from a control group are given back to the root group, which
+// cannot drop CPUs itself. CPUs of a monitoring group must belong to its
+// control group.
+func (f *Fs) moveCpus(ctrlGroup, monGroup, data string, list bool) error {
+	cpus, err := parseCpus(data, list)
+	if err != nil {
+		f.setCmdStatus("Bad CPU list/mask")
+		return syscall.EINVAL
+	}
+	for cpu := range cpus {
+		if cpu >= NumCpus {
+			f.setCmdStatus("Can only assign online CPUs")
+			return syscall.EINVAL
+		}
+	}
+
+	cur, err := f.readCpus(ctrlGroup)
+	if err != nil {
+		return err
+	}
+
+	if monGroup != "" {
+		if difference(cpus, cur).Size() > 0 {
+			f.setCmdStatus("Can only add CPUs to mongroup that belong to parent")
+			return syscall.EINVAL
+		}
+		for _, mg := range f.monGroups(ctrlGroup) {
+			if err := f.removeCpus(mg, cpus); err != nil {
+				return err
+			}
+		}
+		return f.writeCpus(monGroup, cpus)
+	}
+
+	dropped := difference(cur, cpus)
+	if ctrlGroup == "." && dropped.Size() > 0 {
+		f.setCmdStatus("Can't drop CPUs from default group")
+		return syscall.EINVAL
+	}
+
+	for _, cg := range f.ctrlGroups() {
+		if cg == ctrlGroup {
+			continue
+		}
+		if err := f.removeCpus(cg, cpus); err != nil {
+			return err
+		}
+		for _, mg := range f.monGroups(cg) {
+			if err := f.removeCpus(mg, cpus); err != nil {
+				return err
+			}
+		}
+	}
+	for _, mg := range f.monGroups(ctrlGroup) {
+		if err := f.removeCpus(mg, dropped); err != nil {
+			return err
+		}
+	}
+	if dropped.Size() > 0 {
+		root, err := f.readCpus(".")
+		if err != nil {
+			return err
+		}
+		if err := f.writeCpus(".", union(root, dropped)); err != nil {
+			return err
+		}
+	}
+	return f.writeCpus(ctrlGroup, cpus)
+}
+
+func parseCpus(data string, list bool) (rdt.CPUSet, error) {
+	if list {
+		return rdt.ParseCPUSet(data)
+	}
+	mask, err := strconv.ParseUint(strings.Replace(strings.TrimSpace(data), ",", "", -1), 16, 64)
+	if err != nil {
+		return nil, err
+	}
+	cpus := rdt.CPUSet{}
+	for cpu := 0; cpu < 64; cpu++ {
+		if mask&(1<<uint(cpu)) != 0 {
+			cpus[cpu] = struct{}{}
+		}
+	}
+	return cpus, nil
+}
+
+func (f *Fs) readCpus(group string) (rdt.CPUSet, error) {
+	data, err := ioutil.ReadFile(filepath.Join(f.root, group, "cpus_list"))
+	if err != nil {
+		return nil, err
+	}
+	return rdt.ParseCPUSet(string(data))
+}
+
+// writeCpus updates both the cpus and the cpus_list file of a group
+func (f *Fs) writeCpus(group string, cpus rdt.CPUSet) error {
+	mask := uint64(0)
+	for cpu := range cpus {
+		mask |= 1 << uint(cpu)
+	}
+	return writeFiles(filepath.Join(f.root, group), map[string]string{
+		"cpus":      fmt.Sprintf("%x\n", mask),
+		"cpus_list": cpus.String() + "\n",
+	})
+}
+
+func (f *Fs) removeCpus(group string, cpus rdt.CPUSet) error {
+	cur, err := f.readCpus(group)
+	if err != nil {
+		return err
+	}
+	if cur.Intersection(cpus).Size() == 0 {
+		return nil
+	}
+	return f.writeCpus(group, difference(cur, cpus))
+}
+
+func union(a, b rdt.CPUSet) rdt.CPUSet {
+	ret := rdt.NewCPUSet(a.List()...)
+	for cpu := range b {
+		ret[cpu] = struct{}{}
+	}
+	return ret
+}
+
+func difference(a, b rdt.CPUSet) rdt.CPUSet {
+	ret := rdt.CPUSet{}
+	for cpu := range a {
+		if !b.Has(cpu) {
+			ret[cpu] = struct{}{}
+		}
+	}
+	return ret
+}
+
+func (f *Fs) readTasks(group string) ([]string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(f.root, group, "tasks"))
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(string(data)), nil
+}
+
+func (f *Fs) writeTasks(group string, tasks []string) error {
+	sort.Slice(tasks, func(i, j int) bool {
+		a, _ := strconv.Atoi(tasks[i])
+		b, _ := strconv.Atoi(tasks[j])
+		return a < b
+	})
+	data := ""
+	for _, t := range tasks {
+		data += t + "\n"
+	}
+	return writeFile(filepath.Join(f.root, group, "tasks"), data)
+}
+
+func (f *Fs) addTasks(group string, pids []string) error {
+	tasks, err := f.readTasks(group)
+	if err != nil {
+		return err
+	}
+	for _, pid := range pids {
+		if !contains(tasks, pid) {
+			tasks = append(tasks, pid)
+		}
+	}
+	return f.writeTasks(group, tasks)
+}
+
+func (f *Fs) removeTasks(group string, pids []string) error {
+	tasks, err := f.readTasks(group)
+	if err != nil {
+		return err
+	}
+	kept := make([]string, 0, len(tasks))
+	for _, t := range tasks {
+		if !contains(pids, t) {
+			kept = append(kept, t)
+		}
+	}
+	if len(kept) == len(tasks) {
+		return nil
+	}
+	return f.writeTasks(group, kept)
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+// escapeMountField escapes a path like the kernel does in the mount table
+func escapeMountField(s string) string {
+	return strings.NewReplacer(`\`, `\134`, " ", `\040`, "\t", `\011`, "\n", `\012`).Replace(s)
+}
+
+func writeFile(path, data string) error {
+	return ioutil.WriteFile(path, []byte(data), 0644)
+}
+
+// writeFiles creates a directory with the given files in it
+func writeFiles(dir string, files map[string]string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for name, data := range files {
+		if err := writeFile(filepath.Join(dir, name), data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
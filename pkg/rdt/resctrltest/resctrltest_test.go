@@ -0,0 +1,598 @@
+/*
+Copyright 2021 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resctrltest
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"sigs.k8s.io/yaml"
+
+	"github.com/intel/goresctrl/pkg/rdt"
+)
+
+const testProfile = `
+numClosids: 3
+l3:
+  cacheIds: [0, 1]
+  cbmMask: "0xfff"
+  minCbmBits: 2
+mb:
+  cacheIds: [0, 1]
+  bandwidthGran: 10
+  minBandwidth: 10
+l3Mon:
+  numRmids: 4
+  monFeatures: [llc_occupancy, mbm_local_bytes, mbm_total_bytes]
+`
+
+const testConfig = `
+partitions:
+  default:
+    l3Allocation: 100%
+    mbAllocation: [100%]
+    classes:
+      Guaranteed:
+        l3schema: 50%
+      BestEffort:
+        l3schema: 25%
+        mbschema: [45%]
+`
+
+func newTestFs(t *testing.T, profile string) *Fs {
+	hw := rdt.HardwareProfile{}
+	if err := yaml.Unmarshal([]byte(profile), &hw); err != nil {
+		t.Fatalf("failed to parse hardware profile: %v", err)
+	}
+	fs, err := New(hw)
+	if err != nil {
+		t.Fatalf("failed to create fake resctrl fs: %v", err)
+	}
+	return fs
+}
+
+func parseConfig(t *testing.T, data string) *rdt.Config {
+	c := &rdt.Config{}
+	if err := yaml.Unmarshal([]byte(data), c); err != nil {
+		t.Fatalf("failed to parse rdt config: %v", err)
+	}
+	return c
+}
+
+func verifyFile(t *testing.T, fs *Fs, relPath, expected string) {
+	data, err := fs.ReadFile(relPath)
+	if err != nil {
+		t.Fatalf("failed to read %q: %v", relPath, err)
+	}
+	if data != expected {
+		t.Errorf("unexpected content in %q\nexpected:\n  %q\nfound:\n  %q", relPath, expected, data)
+	}
+}
+
+func TestFs(t *testing.T) {
+	fs := newTestFs(t, testProfile)
+	defer fs.Close()
+
+	ctrl, err := rdt.NewControl(fs.ControlOptions("test."))
+	if err != nil {
+		t.Fatalf("NewControl() failed: %v", err)
+	}
+
+	// The profile must be discoverable from the fake
+	if !ctrl.MonSupported() {
+		t.Errorf("monitoring not supported by fake resctrl fs")
+	}
+
+	// Configuration
+	if err := ctrl.SetConfig(parseConfig(t, testConfig), false); err != nil {
+		t.Fatalf("SetConfig() failed: %v", err)
+	}
+	verifyFile(t, fs, "schemata", "L3:0=fff;1=fff\nMB:0=100;1=100\n")
+	verifyFile(t, fs, "test.Guaranteed/schemata", "L3:0=3f;1=3f\nMB:0=100;1=100\n")
+	// MB is rounded up to the bandwidth granularity
+	verifyFile(t, fs, "test.BestEffort/schemata", "L3:0=7;1=7\nMB:0=50;1=50\n")
+
+	// Schemata validation
+	for data, status := range map[string]string{
+		"L3:0=f0f\n":     "The mask f0f has non-consecutive 1-bits\n",
+		"L3:0=1\n":       "Need at least 2 bits in the mask\n",
+		"L3:0=1000\n":    "Mask out of range\n",
+		"L3:2=ff\n":      "Missing '=' or non-numeric domain id\n",
+		"L2:0=ff\n":      "Unknown or unsupported resource name 'L2'\n",
+		"MB:0=5\n":       "MB value 5 out of range [10,100]\n",
+		"L3:0=ff;1=fg\n": "Non-hex character in the mask fg\n",
+	} {
+		f, err := fs.OpenFile(filepath.Join(fs.Path(), "test.Guaranteed", "schemata"))
+		if err != nil {
+			t.Fatalf("OpenFile() failed: %v", err)
+		}
+		if _, err := f.Write([]byte(data)); err == nil {
+			t.Errorf("writing invalid schemata %q succeeded unexpectedly", data)
+		}
+		f.Close()
+		verifyFile(t, fs, "info/last_cmd_status", status)
+	}
+	verifyFile(t, fs, "test.Guaranteed/schemata", "L3:0=3f;1=3f\nMB:0=100;1=100\n")
+
+	// Partial update only touches the given domains
+	f, _ := fs.OpenFile(filepath.Join(fs.Path(), "test.Guaranteed", "schemata"))
+	if _, err := f.Write([]byte("L3:1=ff0\n")); err != nil {
+		t.Errorf("failed to write schemata: %v", err)
+	}
+	f.Close()
+	verifyFile(t, fs, "test.Guaranteed/schemata", "L3:0=3f;1=ff0\nMB:0=100;1=100\n")
+	verifyFile(t, fs, "info/last_cmd_status", "ok\n")
+
+	// Tasks move between groups
+	gua, _ := ctrl.GetClass("Guaranteed")
+	be, _ := ctrl.GetClass("BestEffort")
+	if err := gua.AddPids("10", "11", "12"); err != nil {
+		t.Fatalf("AddPids() failed: %v", err)
+	}
+	if err := be.AddPids("11"); err != nil {
+		t.Fatalf("AddPids() failed: %v", err)
+	}
+	verifyFile(t, fs, "test.Guaranteed/tasks", "10\n12\n")
+	verifyFile(t, fs, "test.BestEffort/tasks", "11\n")
+
+	mg, err := gua.CreateMonGroup("mg", nil)
+	if err != nil {
+		t.Fatalf("CreateMonGroup() failed: %v", err)
+	}
+	if err := mg.AddPids("12"); err != nil {
+		t.Errorf("AddPids() failed: %v", err)
+	}
+	verifyFile(t, fs, "test.Guaranteed/mon_groups/test.mg/tasks", "12\n")
+	verifyFile(t, fs, "test.Guaranteed/tasks", "10\n12\n")
+	if err := mg.AddPids("11"); err == nil {
+		t.Errorf("moving a task to the monitoring group of another class succeeded unexpectedly")
+	}
+
+	// CPUs move between groups, dropped CPUs go back to the root group
+	verifyFile(t, fs, "cpus_list", "0-7\n")
+	if err := gua.SetCpus(rdt.NewCPUSet(0, 1, 2)); err != nil {
+		t.Fatalf("SetCpus() failed: %v", err)
+	}
+	if err := mg.SetCpus(rdt.NewCPUSet(2)); err != nil {
+		t.Errorf("SetCpus() failed: %v", err)
+	}
+	if err := mg.SetCpus(rdt.NewCPUSet(3)); err == nil {
+		t.Errorf("assigning cpus of another class to a monitoring group succeeded unexpectedly")
+	}
+	if err := be.SetCpus(rdt.NewCPUSet(2, 3)); err != nil {
+		t.Fatalf("SetCpus() failed: %v", err)
+	}
+	verifyFile(t, fs, "test.Guaranteed/cpus_list", "0-1\n")
+	verifyFile(t, fs, "test.Guaranteed/cpus", "3\n")
+	verifyFile(t, fs, "test.Guaranteed/mon_groups/test.mg/cpus_list", "\n")
+	verifyFile(t, fs, "test.BestEffort/cpus_list", "2-3\n")
+	verifyFile(t, fs, "cpus_list", "4-7\n")
+	if err := gua.SetCpus(rdt.NewCPUSet()); err != nil {
+		t.Fatalf("SetCpus() failed: %v", err)
+	}
+	root, _ := ctrl.GetClass(rdt.RootClassName)
+	if cpus, err := root.GetCpus(); err != nil {
+		t.Errorf("GetCpus() failed: %v", err)
+	} else if cpus.String() != "0-1,4-7" {
+		t.Errorf("unexpected cpus of the root class %q", cpus)
+	}
+	if err := root.SetCpus(rdt.NewCPUSet(0)); err == nil {
+		t.Errorf("dropping cpus from the root class succeeded unexpectedly")
+	}
+	verifyFile(t, fs, "info/last_cmd_status", "Can't drop CPUs from default group\n")
+	if err := be.SetCpus(rdt.NewCPUSet(8)); err == nil {
+		t.Errorf("assigning an offline cpu succeeded unexpectedly")
+	}
+
+	// Monitoring data
+	if err := fs.SetMonData("test.Guaranteed/mon_groups/test.mg", 1, "mbm_total_bytes", 1234); err != nil {
+		t.Fatalf("SetMonData() failed: %v", err)
+	}
+	if v := mg.GetMonData().L3[1]["mbm_total_bytes"]; v != 1234 {
+		t.Errorf("unexpected monitoring data %d", v)
+	}
+
+	// RMIDs: root, two classes and one monitoring group use all four
+	budget, err := ctrl.GetIDBudget()
+	if err != nil {
+		t.Errorf("GetIDBudget() failed: %v", err)
+	} else if expected := (rdt.IDBudget{Closids: rdt.IDUsage{Used: 3, Total: 3}, Rmids: rdt.IDUsage{Used: 4, Total: 4}}); budget != expected {
+		t.Errorf("unexpected id budget, expected %+v, got %+v", expected, budget)
+	}
+	if _, err := be.CreateMonGroup("mg2", nil); err == nil {
+		t.Errorf("creating a monitoring group succeeded unexpectedly with RMIDs exhausted")
+	} else if ge := (&rdt.GroupError{}); !errors.Is(err, rdt.ErrRmidsExhausted) || !errors.As(err, &ge) {
+		t.Errorf("unexpected error: %v", err)
+	} else if ge.Group != "test.BestEffort/mon_groups/test.mg2" || ge.Op != "mkdir" || ge.CmdStatus != "Out of RMIDs" {
+		t.Errorf("unexpected GroupError: %+v", ge)
+	}
+	verifyFile(t, fs, "info/last_cmd_status", "Out of RMIDs\n")
+
+	// CLOSIDs are checked before touching the filesystem
+	tooMany := testConfig + "      Burstable:\n        l3schema: 25%\n"
+	if err := ctrl.SetConfig(parseConfig(t, tooMany), false); err == nil {
+		t.Errorf("SetConfig() succeeded unexpectedly with CLOSIDs exhausted")
+	} else if !strings.Contains(err.Error(), "configuration requires 4 CLOSIDs but only 3 are available") || !errors.Is(err, rdt.ErrClosidsExhausted) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(fs.Path(), "test.Burstable")); !os.IsNotExist(err) {
+		t.Errorf("group created with CLOSIDs exhausted: %v", err)
+	}
+
+	// Tasks of a removed group are moved to the root group
+	if err := ctrl.SetConfig(parseConfig(t, strings.Replace(testConfig, "BestEffort", "Burstable", 1)), true); err != nil {
+		t.Fatalf("SetConfig() failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(fs.Path(), "test.BestEffort")); !os.IsNotExist(err) {
+		t.Errorf("removed group still exists: %v", err)
+	}
+	verifyFile(t, fs, "tasks", "11\n")
+	verifyFile(t, fs, "cpus_list", "0-7\n")
+}
+
+func TestFsCpusRollback(t *testing.T) {
+	fs := newTestFs(t, testProfile)
+	defer fs.Close()
+
+	ctrl, err := rdt.NewControl(fs.ControlOptions("test."))
+	if err != nil {
+		t.Fatalf("NewControl() failed: %v", err)
+	}
+
+	// CPUs of a group not managed by us
+	if err := fs.Mkdir(filepath.Join(fs.Path(), "other")); err != nil {
+		t.Fatalf("Mkdir() failed: %v", err)
+	}
+	f, _ := fs.OpenFile(filepath.Join(fs.Path(), "other", "cpus_list"))
+	if _, err := f.Write([]byte("2-3\n")); err != nil {
+		t.Fatalf("failed to assign cpus: %v", err)
+	}
+	f.Close()
+
+	// Making the class exclusive fails after its cpus have been taken from
+	// the other group, the cpus must be given back to it
+	conf := `
+partitions:
+  default:
+    l3Allocation: 100%
+    classes:
+      Guaranteed:
+        l3schema: 50%
+        cpus: 0-3
+        mode: exclusive
+`
+	if err := ctrl.SetConfig(parseConfig(t, conf), false); err == nil {
+		t.Fatalf("SetConfig() succeeded unexpectedly with overlapping root class")
+	} else if !strings.Contains(err.Error(), "restored cpus of all groups") {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(fs.Path(), "test.Guaranteed")); !os.IsNotExist(err) {
+		t.Errorf("created group not removed in rollback: %v", err)
+	}
+	verifyFile(t, fs, "other/cpus_list", "2-3\n")
+	verifyFile(t, fs, "cpus_list", "0-1,4-7\n")
+}
+
+func TestFsCDP(t *testing.T) {
+	fs := newTestFs(t, `
+numClosids: 4
+l3:
+  cacheIds: [0]
+  cbmMask: "0xff"
+  minCbmBits: 1
+  cdp: true
+mb:
+  cacheIds: [0]
+  bandwidthGran: 1
+  minBandwidth: 1
+  mbaMBps: true
+`)
+	defer fs.Close()
+
+	verifyFile(t, fs, "schemata", "L3DATA:0=ff\nL3CODE:0=ff\n    MB:0=4294967295\n")
+
+	ctrl, err := rdt.NewControl(fs.ControlOptions(""))
+	if err != nil {
+		t.Fatalf("NewControl() failed: %v", err)
+	}
+	conf := `
+partitions:
+  default:
+    l3Allocation: 100%
+    mbAllocation: [1000MBps]
+    classes:
+      Guaranteed:
+        l3schema:
+          all:
+            unified: 100%
+            code: 50%
+            data: 100%
+`
+	if err := ctrl.SetConfig(parseConfig(t, conf), false); err != nil {
+		t.Fatalf("SetConfig() failed: %v", err)
+	}
+	verifyFile(t, fs, "Guaranteed/schemata", "L3DATA:0=ff\nL3CODE:0=f\n    MB:0=1000\n")
+}
+
+func TestFsSize(t *testing.T) {
+	fs := newTestFs(t, `
+numClosids: 3
+l3:
+  cacheIds: [0, 1]
+  cacheSizes: {0: 25165824, 1: 25165824}
+  cbmMask: "0xfff"
+  minCbmBits: 1
+mb:
+  cacheIds: [0, 1]
+  bandwidthGran: 10
+  minBandwidth: 10
+`)
+	defer fs.Close()
+
+	verifyFile(t, fs, "size", "L3:0=25165824;1=25165824\nMB:0=100;1=100\n")
+
+	ctrl, err := rdt.NewControl(fs.ControlOptions(""))
+	if err != nil {
+		t.Fatalf("NewControl() failed: %v", err)
+	}
+	conf := `
+partitions:
+  fixed:
+    l3Allocation: 5MiB
+    mbAllocation: [50%]
+    classes:
+      Guaranteed:
+  rest:
+    l3Allocation: 50%
+    mbAllocation: [50%]
+    classes:
+      SYSTEM_DEFAULT:
+`
+	if err := ctrl.SetConfig(parseConfig(t, conf), false); err != nil {
+		t.Fatalf("SetConfig() failed: %v", err)
+	}
+	// 5MiB is rounded to three 2MiB ways
+	verifyFile(t, fs, "Guaranteed/schemata", "L3:0=7;1=7\nMB:0=50;1=50\n")
+	verifyFile(t, fs, "Guaranteed/size", "L3:0=6291456;1=6291456\nMB:0=50;1=50\n")
+
+	cls, _ := ctrl.GetClass("Guaranteed")
+	expected := map[string]map[uint64]uint64{"L3": {0: 6 << 20, 1: 6 << 20}}
+	if sizes, err := cls.Size(); err != nil {
+		t.Errorf("Size() failed: %v", err)
+	} else if !reflect.DeepEqual(sizes, expected) {
+		t.Errorf("unexpected sizes, expected %v, got %v", expected, sizes)
+	}
+}
+
+func TestFsModes(t *testing.T) {
+	fs := newTestFs(t, testProfile)
+	defer fs.Close()
+
+	ctrl, err := rdt.NewControl(fs.ControlOptions(""))
+	if err != nil {
+		t.Fatalf("NewControl() failed: %v", err)
+	}
+
+	// The kernel refuses to make a class exclusive while the root class
+	// overlaps with it
+	conf := `
+partitions:
+  default:
+    l3Allocation: 100%
+    classes:
+      Guaranteed:
+        l3schema: 50%
+        mode: exclusive
+`
+	if err := ctrl.SetConfig(parseConfig(t, conf), false); err == nil {
+		t.Errorf("SetConfig() succeeded unexpectedly with overlapping root class")
+	} else if !strings.Contains(err.Error(), "Schemata overlaps") || !errors.Is(err, rdt.ErrKernelRejected) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(fs.Path(), "Guaranteed")); !os.IsNotExist(err) {
+		t.Errorf("created group not removed in rollback: %v", err)
+	}
+
+	conf = `
+partitions:
+  exclusive:
+    l3Allocation: 50%
+    classes:
+      Guaranteed:
+        mode: exclusive
+  shared:
+    l3Allocation: 50%
+    classes:
+      SYSTEM_DEFAULT:
+      BestEffort:
+`
+	if err := ctrl.SetConfig(parseConfig(t, conf), false); err != nil {
+		t.Fatalf("SetConfig() failed: %v", err)
+	}
+	verifyFile(t, fs, "Guaranteed/mode", "exclusive\n")
+	verifyFile(t, fs, "Guaranteed/schemata", "L3:0=3f;1=3f\nMB:0=100;1=100\n")
+	verifyFile(t, fs, "schemata", "L3:0=fc0;1=fc0\nMB:0=100;1=100\n")
+	verifyFile(t, fs, "info/L3/bit_usage", "0=SSSSSSEEEEEE;1=SSSSSSEEEEEE\n")
+
+	// Other groups cannot overlap with the exclusive group
+	f, _ := fs.OpenFile(filepath.Join(fs.Path(), "BestEffort", "schemata"))
+	if _, err := f.Write([]byte("L3:0=ff\n")); err == nil {
+		t.Errorf("overlapping an exclusive group succeeded unexpectedly")
+	}
+	f.Close()
+	verifyFile(t, fs, "info/last_cmd_status", "Overlaps with exclusive group\n")
+
+	// Swapping the allocations requires dropping exclusivity first
+	conf = strings.Replace(strings.Replace(conf, "Guaranteed", "tmp", 1), "BestEffort", "Guaranteed", 1)
+	conf = strings.Replace(conf, "tmp", "BestEffort", 1)
+	if err := ctrl.SetConfig(parseConfig(t, conf), false); err != nil {
+		t.Fatalf("SetConfig() failed: %v", err)
+	}
+	verifyFile(t, fs, "Guaranteed/mode", "shareable\n")
+	verifyFile(t, fs, "BestEffort/mode", "exclusive\n")
+	verifyFile(t, fs, "BestEffort/schemata", "L3:0=3f;1=3f\nMB:0=100;1=100\n")
+}
+
+func TestFsPseudoLock(t *testing.T) {
+	fs := newTestFs(t, testProfile)
+	defer fs.Close()
+
+	ctrl, err := rdt.NewControl(fs.ControlOptions(""))
+	if err != nil {
+		t.Fatalf("NewControl() failed: %v", err)
+	}
+
+	conf := `
+partitions:
+  locked:
+    l3Allocation: 25%
+    classes:
+      RT:
+  shared:
+    l3Allocation: 75%
+    classes:
+      SYSTEM_DEFAULT:
+      BestEffort:
+`
+	if err := ctrl.SetConfig(parseConfig(t, conf), false); err != nil {
+		t.Fatalf("SetConfig() failed: %v", err)
+	}
+
+	root, _ := ctrl.GetClass(rdt.RootClassName)
+	if _, err := ctrl.PseudoLock(rdt.RootClassName, "L3", 0); err == nil {
+		t.Errorf("pseudo-locking the root class succeeded unexpectedly")
+	}
+	if _, err := ctrl.PseudoLock("Missing", "L3", 0); err == nil {
+		t.Errorf("pseudo-locking a non-existent class succeeded unexpectedly")
+	}
+
+	// The kernel refuses to lock an allocation shared with other groups
+	if _, err := ctrl.PseudoLock("BestEffort", "L3", 0); err == nil {
+		t.Errorf("pseudo-locking an overlapping allocation succeeded unexpectedly")
+	} else if !strings.Contains(err.Error(), "Overlaps with other group") {
+		t.Errorf("unexpected error: %v", err)
+	}
+	verifyFile(t, fs, "BestEffort/mode", "shareable\n")
+
+	// The class must be empty
+	rt, _ := ctrl.GetClass("RT")
+	verifyNotEmpty := func(condition string) {
+		t.Helper()
+		_, err := ctrl.PseudoLock("RT", "L3", 0)
+		var groupErr *rdt.GroupError
+		if !errors.As(err, &groupErr) || !errors.Is(err, rdt.ErrGroupNotEmpty) {
+			t.Errorf("expected a GroupError matching ErrGroupNotEmpty, got %v", err)
+		} else if !strings.Contains(err.Error(), condition) {
+			t.Errorf("expected error about %s, got %v", condition, err)
+		}
+		verifyFile(t, fs, "RT/mode", "shareable\n")
+	}
+	if err := rt.AddPids("42"); err != nil {
+		t.Fatalf("AddPids() failed: %v", err)
+	}
+	verifyNotEmpty("tasks")
+	if err := root.AddPids("42"); err != nil {
+		t.Fatalf("AddPids() failed: %v", err)
+	}
+	if err := rt.SetCpus(rdt.NewCPUSet(1)); err != nil {
+		t.Fatalf("SetCpus() failed: %v", err)
+	}
+	verifyNotEmpty("cpus")
+	if err := rt.SetCpus(rdt.NewCPUSet()); err != nil {
+		t.Fatalf("SetCpus() failed: %v", err)
+	}
+	if _, err := rt.CreateMonGroup("mg", nil); err != nil {
+		t.Fatalf("CreateMonGroup() failed: %v", err)
+	}
+	verifyNotEmpty("monitoring groups")
+	if err := rt.DeleteMonGroup("mg"); err != nil {
+		t.Fatalf("DeleteMonGroup() failed: %v", err)
+	}
+
+	r, err := ctrl.PseudoLock("RT", "L3", 0)
+	if err != nil {
+		t.Fatalf("PseudoLock() failed: %v", err)
+	}
+	expected := &rdt.PseudoLockedRegion{
+		Cache:      "L3",
+		CacheID:    0,
+		Bitmask:    0x7,
+		Size:       3 * WaySize,
+		DevicePath: "/dev/pseudo_lock/RT",
+	}
+	if !reflect.DeepEqual(r, expected) {
+		t.Errorf("expected region %+v, got %+v", expected, r)
+	}
+	verifyFile(t, fs, "RT/mode", "pseudo-locked\n")
+	verifyFile(t, fs, "RT/schemata", "L3:0=7\n")
+	usage, err := ctrl.GetBitUsage("L3")
+	if err != nil {
+		t.Fatalf("GetBitUsage() failed: %v", err)
+	}
+	if u := usage[0]; u.PseudoLocked != 0x7 || u.Software != 0xff8 {
+		t.Errorf("unexpected bit usage: %+v", u)
+	}
+	// The pseudo-locked class releases its CLOSID and RMID
+	if budget, err := ctrl.GetIDBudget(); err != nil {
+		t.Errorf("GetIDBudget() failed: %v", err)
+	} else if budget.Closids.Used != 2 || budget.Rmids.Used != 2 {
+		t.Errorf("unexpected id budget: %+v", budget)
+	}
+
+	if err := rt.AddPids("1"); err == nil {
+		t.Errorf("adding tasks to a pseudo-locked class succeeded unexpectedly")
+	}
+
+	// The locked ways are reserved when the configuration is re-applied
+	if err := ctrl.SetConfig(parseConfig(t, conf), false); err != nil {
+		t.Fatalf("SetConfig() failed: %v", err)
+	}
+	if r, err := rt.GetPseudoLockedRegion(); err != nil || !reflect.DeepEqual(r, expected) {
+		t.Errorf("pseudo-locked region changed by SetConfig(): %+v %v", r, err)
+	}
+	verifyFile(t, fs, "schemata", "L3:0=7e0;1=ff8\nMB:0=100;1=100\n")
+
+	// The plan must not claim to write the schemata of the pseudo-locked class
+	plan, err := ctrl.PlanConfig(parseConfig(t, conf))
+	if err != nil {
+		t.Fatalf("PlanConfig() failed: %v", err)
+	}
+	if !reflect.DeepEqual(plan.PseudoLocked, []string{"RT"}) {
+		t.Errorf("expected pseudo-locked classes [RT], got %v", plan.PseudoLocked)
+	}
+	if s, ok := plan.Schemata["RT"]; ok {
+		t.Errorf("schemata %q planned for a pseudo-locked class", s)
+	}
+	if _, ok := plan.Schemata["BestEffort"]; !ok {
+		t.Errorf("no schemata planned for class BestEffort")
+	}
+
+	if err := ctrl.RemovePseudoLock("RT"); err != nil {
+		t.Fatalf("RemovePseudoLock() failed: %v", err)
+	}
+	if r, err := rt.GetPseudoLockedRegion(); err != nil || r != nil {
+		t.Errorf("pseudo-locked region not removed: %+v %v", r, err)
+	}
+	verifyFile(t, fs, "RT/mode", "shareable\n")
+	if err := ctrl.RemovePseudoLock("RT"); err == nil {
+		t.Errorf("removing a non-existent pseudo-locked region succeeded unexpectedly")
+	}
+}
@@ -0,0 +1,155 @@
+/*
+Copyright 2021 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rdt
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// stateData is the on-disk format of the state file
+type stateData struct {
+	// MonGroups contains the annotations of monitoring groups, keyed by the
+	// path of the group relative to the resctrl root
+	MonGroups map[string]map[string]string `json:"monGroups"`
+}
+
+// stateFile stores the annotations of monitoring groups so that they survive
+// restarts of the process. A nil stateFile disables persistence.
+type stateFile struct {
+	mutex sync.Mutex
+	path  string
+	data  stateData
+}
+
+// loadStateFile reads a state file. A missing file is not an error.
+func loadStateFile(path string) (*stateFile, error) {
+	s := &stateFile{path: path, data: stateData{MonGroups: map[string]map[string]string{}}}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return s, rdtError("failed to read state file: %w", err)
+	}
+	if err := json.Unmarshal(data, &s.data); err != nil {
+		return s, rdtError("failed to parse state file %q: %w", path, err)
+	}
+	if s.data.MonGroups == nil {
+		s.data.MonGroups = map[string]map[string]string{}
+	}
+	return s, nil
+}
+
+// annotations returns the stored annotations of a monitoring group
+func (s *stateFile) annotations(group string) map[string]string {
+	if s == nil {
+		return nil
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.data.MonGroups[group]
+}
+
+// setAnnotations stores the annotations of a monitoring group
+func (s *stateFile) setAnnotations(group string, annotations map[string]string) error {
+	if s == nil {
+		return nil
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	a := make(map[string]string, len(annotations))
+	for k, v := range annotations {
+		a[k] = v
+	}
+	s.data.MonGroups[group] = a
+
+	return s.save()
+}
+
+// remove drops a resctrl group and all groups below it from the state
+func (s *stateFile) remove(group string) error {
+	if s == nil {
+		return nil
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	changed := false
+	for g := range s.data.MonGroups {
+		if g == group || strings.HasPrefix(g, group+"/") {
+			delete(s.data.MonGroups, g)
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return s.save()
+}
+
+// retain drops all monitoring groups not in groups from the state
+func (s *stateFile) retain(groups map[string]struct{}) error {
+	if s == nil {
+		return nil
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for g := range s.data.MonGroups {
+		if _, ok := groups[g]; !ok {
+			delete(s.data.MonGroups, g)
+		}
+	}
+	return s.save()
+}
+
+// save writes the state file atomically, caller must hold s.mutex
+func (s *stateFile) save() error {
+	data, err := json.Marshal(s.data)
+	if err != nil {
+		return rdtError("failed to marshal state: %w", err)
+	}
+
+	dir := filepath.Dir(s.path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return rdtError("failed to create state directory: %w", err)
+	}
+	tmp, err := ioutil.TempFile(dir, filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return rdtError("failed to write state file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return rdtError("failed to write state file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return rdtError("failed to write state file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return rdtError("failed to write state file: %w", err)
+	}
+	return nil
+}
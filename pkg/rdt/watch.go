@@ -0,0 +1,545 @@
+/*
+Copyright 2021 Intel Corporation
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rdt
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// WatchEventType is the type of a resctrl filesystem change
+type WatchEventType string
+
+const (
+	// WatchGroupCreated is emitted when a control group is created
+	WatchGroupCreated WatchEventType = "group-created"
+	// WatchGroupRemoved is emitted when a control group is removed
+	WatchGroupRemoved WatchEventType = "group-removed"
+	// WatchMonGroupCreated is emitted when a monitoring group is created
+	WatchMonGroupCreated WatchEventType = "mon-group-created"
+	// WatchMonGroupRemoved is emitted when a monitoring group is removed
+	WatchMonGroupRemoved WatchEventType = "mon-group-removed"
+	// WatchSchemataChanged is emitted when the schemata of a control group
+	// is written
+	WatchSchemataChanged WatchEventType = "schemata-changed"
+)
+
+// WatchEvent describes one change of the resctrl filesystem
+type WatchEvent struct {
+	// Type is the type of the change
+	Type WatchEventType `json:"type"`
+	// Group is the path of the changed group relative to the resctrl root,
+	// e.g. "goresctrl.Guaranteed/mon_groups/goresctrl.mg". Empty for the
+	// root group.
+	Group string `json:"group"`
+	// Class is the name of the class of the group, empty if the control
+	// group is not managed by the Control
+	Class string `json:"class,omitempty"`
+	// MonGroup is the name of the monitoring group, empty for control
+	// groups and for monitoring groups not managed by the Control
+	MonGroup string `json:"monGroup,omitempty"`
+}
+
+// watchKind tells which directory an inotify watch is for
+type watchKind int
+
+const (
+	watchGroupDir watchKind = iota
+	watchMonGroupsDir
+)
+
+// watch is one inotify watch, group is the path of the control group
+// relative to the resctrl root
+type watch struct {
+	kind  watchKind
+	group string
+}
+
+const (
+	watchDirMask   = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MOVED_TO | syscall.IN_MOVED_FROM | syscall.IN_ONLYDIR
+	watchGroupMask = watchDirMask | syscall.IN_CLOSE_WRITE
+)
+
+// Watcher follows changes of the resctrl filesystem with inotify and emits
+// events to subscribers. The control groups, their schemata files and
+// mon_groups directories are watched, monitoring groups themselves are not.
+// The classes and monitoring groups of the Control are kept in sync with the
+// filesystem while the Watcher is running. If the inotify event queue
+// overflows, the filesystem is re-scanned.
+type Watcher struct {
+	mutex sync.Mutex
+
+	ctrl        *Control
+	file        *os.File
+	fd          int
+	watches     map[int32]watch
+	subscribers map[int]chan WatchEvent
+	nextID      int
+	done        chan struct{}
+}
+
+// NewWatcher creates a new Watcher for the default Control instance
+func NewWatcher() (*Watcher, error) {
+	if r := getRdt(); r != nil {
+		return r.NewWatcher(), nil
+	}
+	return nil, rdtError("%w", ErrNotInitialized)
+}
+
+// NewWatcher creates a new Watcher for the Control
+func (c *Control) NewWatcher() *Watcher {
+	return &Watcher{ctrl: c, subscribers: make(map[int]chan WatchEvent)}
+}
+
+// Start starts watching the resctrl filesystem in the background
+func (w *Watcher) Start() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.file != nil {
+		return nil
+	}
+
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return rdtError("failed to initialize inotify: %w", err)
+	}
+	// A non-blocking file is handled by the runtime poller so that closing
+	// it interrupts a pending read
+	w.file = os.NewFile(uintptr(fd), "inotify")
+	w.fd = fd
+	w.watches = make(map[int32]watch)
+
+	groups, err := resctrlGroupsFromFs("", w.ctrl.info.resctrlPath)
+	if err == nil {
+		for _, g := range append([]string{""}, groups...) {
+			if err = w.addGroupWatches(g); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		w.file.Close()
+		w.file = nil
+		return rdtError("failed to watch resctrl filesystem: %w", err)
+	}
+
+	w.done = make(chan struct{})
+	go w.run(w.file, w.done)
+
+	return nil
+}
+
+// Stop stops watching and closes the channels of all subscribers
+func (w *Watcher) Stop() {
+	w.mutex.Lock()
+	file, done := w.file, w.done
+	w.file, w.done = nil, nil
+	w.mutex.Unlock()
+
+	if file != nil {
+		file.Close()
+		<-done
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	for id, ch := range w.subscribers {
+		delete(w.subscribers, id)
+		close(ch)
+	}
+}
+
+// Subscribe returns a channel receiving the events of the Watcher and a
+// function for cancelling the subscription. Events are dropped if the
+// buffer of the channel, of the given size, is full. The channel is closed
+// when the subscription is cancelled or the Watcher is stopped.
+func (w *Watcher) Subscribe(size int) (<-chan WatchEvent, func()) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	id := w.nextID
+	w.nextID++
+	ch := make(chan WatchEvent, size)
+	w.subscribers[id] = ch
+
+	cancel := func() {
+		w.mutex.Lock()
+		defer w.mutex.Unlock()
+		if _, ok := w.subscribers[id]; ok {
+			delete(w.subscribers, id)
+			close(ch)
+		}
+	}
+	return ch, cancel
+}
+
+// addGroupWatches watches a control group and its mon_groups directory,
+// caller must hold w.mutex
+func (w *Watcher) addGroupWatches(group string) error {
+	if err := w.addWatch(group, watchGroupDir, watchGroupMask); err != nil {
+		return err
+	}
+	if err := w.addWatch(group, watchMonGroupsDir, watchDirMask); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// addWatch adds one inotify watch, caller must hold w.mutex
+func (w *Watcher) addWatch(group string, kind watchKind, mask uint32) error {
+	if w.file == nil {
+		return nil
+	}
+	path := filepath.Join(w.ctrl.info.resctrlPath, group)
+	if kind == watchMonGroupsDir {
+		path = filepath.Join(path, "mon_groups")
+	}
+	wd, err := syscall.InotifyAddWatch(w.fd, path, mask)
+	if err != nil {
+		return &os.PathError{Op: "inotify_add_watch", Path: path, Err: err}
+	}
+	w.watches[int32(wd)] = watch{kind: kind, group: group}
+	return nil
+}
+
+// run reads inotify events until the file is closed
+func (w *Watcher) run(file *os.File, done chan struct{}) {
+	defer close(done)
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := file.Read(buf)
+		if err != nil {
+			if !errors.Is(err, os.ErrClosed) {
+				w.ctrl.logger().Error("failed to read inotify events: %v", err)
+			}
+			return
+		}
+		for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+			raw := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			off += syscall.SizeofInotifyEvent
+			name := strings.TrimRight(string(buf[off:off+int(raw.Len)]), "\x00")
+			off += int(raw.Len)
+
+			w.handle(raw.Wd, raw.Mask, name)
+		}
+	}
+}
+
+// handle processes one inotify event
+func (w *Watcher) handle(wd int32, mask uint32, name string) {
+	w.mutex.Lock()
+	wt, ok := w.watches[wd]
+	if mask&syscall.IN_IGNORED != 0 {
+		delete(w.watches, wd)
+	}
+	w.mutex.Unlock()
+
+	if mask&syscall.IN_Q_OVERFLOW != 0 {
+		w.ctrl.logger().Warn("inotify event queue overflow, re-scanning resctrl filesystem")
+		w.resync()
+		return
+	}
+	if !ok || name == "" {
+		return
+	}
+
+	created := mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0
+	removed := mask&(syscall.IN_DELETE|syscall.IN_MOVED_FROM) != 0
+	isDir := mask&syscall.IN_ISDIR != 0
+
+	var e WatchEvent
+	switch {
+	case wt.kind == watchGroupDir && name == "schemata" && mask&syscall.IN_CLOSE_WRITE != 0:
+		e = WatchEvent{Type: WatchSchemataChanged, Group: wt.group}
+	case wt.kind == watchGroupDir && name == "mon_groups" && isDir && created:
+		// The kernel creates mon_groups together with the group itself
+		w.mutex.Lock()
+		err := w.addWatch(wt.group, watchMonGroupsDir, watchDirMask)
+		w.mutex.Unlock()
+		if err != nil && !os.IsNotExist(err) {
+			w.ctrl.logger().Warn("%v", err)
+		}
+		return
+	case wt.kind == watchGroupDir && wt.group == "" && isDir && created:
+		if !isResctrlGroup(filepath.Join(w.ctrl.info.resctrlPath, name)) {
+			return
+		}
+		w.mutex.Lock()
+		err := w.addGroupWatches(name)
+		w.mutex.Unlock()
+		if err != nil && !os.IsNotExist(err) {
+			w.ctrl.logger().Warn("%v", err)
+		}
+		e = WatchEvent{Type: WatchGroupCreated, Group: name}
+	case wt.kind == watchGroupDir && wt.group == "" && isDir && removed:
+		switch name {
+		case "info", "mon_groups", "mon_data":
+			return
+		}
+		e = WatchEvent{Type: WatchGroupRemoved, Group: name}
+	case wt.kind == watchMonGroupsDir && isDir && created:
+		group := filepath.Join(wt.group, "mon_groups", name)
+		if !isResctrlGroup(filepath.Join(w.ctrl.info.resctrlPath, group)) {
+			return
+		}
+		e = WatchEvent{Type: WatchMonGroupCreated, Group: group}
+	case wt.kind == watchMonGroupsDir && isDir && removed:
+		e = WatchEvent{Type: WatchMonGroupRemoved, Group: filepath.Join(wt.group, "mon_groups", name)}
+	default:
+		return
+	}
+
+	w.ctrl.syncWatchEvent(&e)
+	w.publish(e)
+}
+
+// resync re-scans the resctrl filesystem after inotify events have been lost.
+// Watches are added for new control groups and events are emitted for the
+// control groups created or removed meanwhile. The classes and monitoring
+// groups of the Control are brought up to date, with events for the managed
+// monitoring groups that changed.
+func (w *Watcher) resync() {
+	groups, err := resctrlGroupsFromFs("", w.ctrl.info.resctrlPath)
+	if err != nil {
+		w.ctrl.logger().Error("failed to re-scan resctrl filesystem: %v", err)
+		return
+	}
+	onFs := make(map[string]struct{}, len(groups))
+	for _, g := range groups {
+		onFs[g] = struct{}{}
+	}
+
+	events := []WatchEvent{}
+	w.mutex.Lock()
+	watched := map[string]struct{}{}
+	for wd, wt := range w.watches {
+		if _, ok := onFs[wt.group]; ok || wt.group == "" {
+			watched[wt.group] = struct{}{}
+			continue
+		}
+		// The IN_IGNORED event of the watch may have been lost, too
+		delete(w.watches, wd)
+		if wt.kind == watchGroupDir {
+			events = append(events, WatchEvent{Type: WatchGroupRemoved, Group: wt.group})
+		}
+	}
+	for _, g := range append([]string{""}, groups...) {
+		// Adding an existing watch again only returns its descriptor
+		if err := w.addGroupWatches(g); err != nil && !os.IsNotExist(err) {
+			w.ctrl.logger().Warn("%v", err)
+		}
+		if _, ok := watched[g]; !ok {
+			events = append(events, WatchEvent{Type: WatchGroupCreated, Group: g})
+		}
+	}
+	w.mutex.Unlock()
+
+	for i := range events {
+		w.ctrl.syncWatchEvent(&events[i])
+	}
+	events = append(events, w.ctrl.resyncWatch()...)
+	for _, e := range events {
+		w.publish(e)
+	}
+}
+
+// publish delivers an event to all subscribers
+func (w *Watcher) publish(e WatchEvent) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	for _, ch := range w.subscribers {
+		select {
+		case ch <- e:
+		default:
+			w.ctrl.logger().Warn("dropping resctrl %s event of %q, subscriber not keeping up", e.Type, e.Group)
+		}
+	}
+}
+
+// syncWatchEvent updates the classes and monitoring groups of the Control
+// according to a filesystem change and fills in the class and monitoring
+// group names of the event
+func (c *Control) syncWatchEvent(e *WatchEvent) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	ctrlPath, monPath := e.Group, ""
+	if split := strings.SplitN(e.Group, "/mon_groups/", 2); len(split) == 2 {
+		ctrlPath, monPath = split[0], split[1]
+	} else if strings.HasPrefix(e.Group, "mon_groups/") {
+		ctrlPath, monPath = "", e.Group[len("mon_groups/"):]
+	}
+
+	switch {
+	case ctrlPath == "":
+		e.Class = RootClassName
+	case strings.HasPrefix(ctrlPath, c.resctrlGroupPrefix):
+		e.Class = ctrlPath[len(c.resctrlGroupPrefix):]
+	}
+	if e.Class == "" {
+		return
+	}
+
+	exists := isResctrlGroup(filepath.Join(c.info.resctrlPath, e.Group))
+	cls, ok := c.classes[e.Class]
+	if ok && cls.relPath("") != ctrlPath {
+		// Class discovered with another prefix
+		e.Class = ""
+		return
+	}
+
+	switch e.Type {
+	case WatchGroupCreated:
+		if ok || !exists {
+			return
+		}
+		c.addObservedClass(e.Class)
+	case WatchGroupRemoved:
+		if !ok || exists || e.Class == RootClassName {
+			return
+		}
+		c.dropObservedClass(e.Class, cls)
+	case WatchMonGroupCreated, WatchMonGroupRemoved:
+		if !ok || !strings.HasPrefix(monPath, cls.monPrefix) {
+			return
+		}
+		e.MonGroup = monPath[len(cls.monPrefix):]
+		cls.syncMonGroup(e.MonGroup, exists)
+	}
+}
+
+// addObservedClass adds a class for a control group created externally,
+// caller must hold c.mutex. Only observes, the group is not created if it
+// was removed already.
+func (c *Control) addObservedClass(name string) {
+	cg := &ctrlGroup{
+		resctrlGroup: resctrlGroup{ctrl: c, prefix: c.resctrlGroupPrefix, name: name},
+		monPrefix:    c.resctrlGroupPrefix,
+	}
+	monGroups, err := cg.monGroupsFromResctrlFs()
+	if err != nil {
+		c.logger().Warn("failed to add class %q: %v", name, err)
+		return
+	}
+	cg.monGroups = monGroups
+	c.logger().Debug("class %q created externally", name)
+	c.classes[name] = cg
+}
+
+// dropObservedClass drops the class of a control group removed externally,
+// caller must hold c.mutex
+func (c *Control) dropObservedClass(name string, cls *ctrlGroup) {
+	c.logger().Debug("class %q removed externally", name)
+	if err := c.state.remove(cls.relPath("")); err != nil {
+		c.logger().Warn("failed to drop annotations of resctrl group %q: %v", cls.relPath(""), err)
+	}
+	delete(c.classes, name)
+}
+
+// resyncWatch brings the classes and monitoring groups up to date with the
+// filesystem after watch events have been lost. Returns the events of the
+// managed monitoring groups that changed.
+func (c *Control) resyncWatch() []WatchEvent {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	groups, err := resctrlGroupsFromFs(c.resctrlGroupPrefix, c.info.resctrlPath)
+	if err != nil {
+		c.logger().Error("failed to re-scan resctrl groups: %v", err)
+		return nil
+	}
+	for _, g := range groups {
+		if _, ok := c.classes[g[len(c.resctrlGroupPrefix):]]; !ok {
+			c.addObservedClass(g[len(c.resctrlGroupPrefix):])
+		}
+	}
+
+	events := []WatchEvent{}
+	for name, cls := range c.classes {
+		if name != RootClassName && !isResctrlGroup(cls.path("")) {
+			c.dropObservedClass(name, cls)
+			continue
+		}
+		monGroups, err := resctrlGroupsFromFs(cls.monPrefix, cls.path("mon_groups"))
+		if err != nil && !os.IsNotExist(err) {
+			c.logger().Warn("failed to re-scan monitoring groups of %q: %v", name, err)
+			continue
+		}
+		exists := make(map[string]bool, len(monGroups))
+		for _, mg := range monGroups {
+			exists[mg[len(cls.monPrefix):]] = true
+		}
+		cls.mutex.RLock()
+		for mg := range cls.monGroups {
+			if _, ok := exists[mg]; !ok {
+				exists[mg] = false
+			}
+		}
+		cls.mutex.RUnlock()
+
+		for mg, ok := range exists {
+			if !cls.syncMonGroup(mg, ok) {
+				continue
+			}
+			e := WatchEvent{Type: WatchMonGroupCreated, Group: cls.relPath("mon_groups", cls.monPrefix+mg), Class: name, MonGroup: mg}
+			if !ok {
+				e.Type = WatchMonGroupRemoved
+			}
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+// syncMonGroup adds or drops a monitoring group changed externally, returns
+// true if the monitoring group was added or dropped
+func (c *ctrlGroup) syncMonGroup(name string, exists bool) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	_, ok := c.monGroups[name]
+	switch {
+	case exists && !ok:
+		path := c.relPath("mon_groups", c.monPrefix+name)
+		c.ctrl.logger().Debug("monitoring group %q created externally", path)
+		c.monGroups[name] = existingMonGroup(c.monPrefix, name, c, c.ctrl.state.annotations(path))
+	case !exists && ok:
+		path := c.relPath("mon_groups", c.monPrefix+name)
+		c.ctrl.logger().Debug("monitoring group %q removed externally", path)
+		if err := c.ctrl.state.remove(path); err != nil {
+			c.ctrl.logger().Warn("failed to drop annotations of monitoring group %q: %v", path, err)
+		}
+		delete(c.monGroups, name)
+	default:
+		return false
+	}
+	return true
+}
+
+// isResctrlGroup returns true if path is a resctrl group
+func isResctrlGroup(path string) bool {
+	s, err := os.Stat(filepath.Join(path, "tasks"))
+	return err == nil && !s.IsDir()
+}